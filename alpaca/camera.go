@@ -0,0 +1,685 @@
+package alpaca
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"github.com/indihub-space/agent/fits"
+	"github.com/indihub-space/agent/indiclient"
+)
+
+const (
+	cameraIdle     = 0
+	cameraExposing = 2
+	cameraDownload = 4
+	cameraError    = 5
+
+	sensorMonochrome = 0
+	sensorRGGB       = 2
+
+	imageInt32     = 2
+	imageBytesMIME = "application/imagebytes"
+)
+
+type cameraState struct {
+	initialized bool
+	maxX        int
+	maxY        int
+	binX        int
+	binY        int
+	startX      int
+	startY      int
+	numX        int
+	numY        int
+
+	exposing     bool
+	started      time.Time
+	duration     float64
+	lastStart    *time.Time
+	lastDuration *float64
+	targetTemp   *float64
+
+	image      *fits.Image
+	imageReady bool
+}
+
+var cameraMethods = methods{
+	get: map[string]method{
+		"bayeroffsetx":          getBayerOffset("CFA_OFFSET_X"),
+		"bayeroffsety":          getBayerOffset("CFA_OFFSET_Y"),
+		"binx":                  getCameraInt(func(cam *cameraState) int { return cam.binX }),
+		"biny":                  getCameraInt(func(cam *cameraState) int { return cam.binY }),
+		"camerastate":           getCameraState,
+		"cameraxsize":           getCameraInt(func(cam *cameraState) int { return cam.maxX }),
+		"cameraysize":           getCameraInt(func(cam *cameraState) int { return cam.maxY }),
+		"canabortexposure":      canProperty("CCD_ABORT_EXPOSURE"),
+		"canasymmetricbin":      constant(false),
+		"canfastreadout":        constant(false),
+		"cangetcoolerpower":     canProperty("CCD_COOLER_POWER"),
+		"canpulseguide":         constant(false),
+		"cansetccdtemperature":  canProperty("CCD_TEMPERATURE"),
+		"canstopexposure":       constant(false),
+		"ccdtemperature":        getNumber("CCD_TEMPERATURE", "CCD_TEMPERATURE_VALUE"),
+		"cooleron":              getCoolerOn,
+		"coolerpower":           getNumber("CCD_COOLER_POWER", "CCD_COOLER_VALUE"),
+		"electronsperadu":       notImplemented,
+		"exposuremax":           getLimit("CCD_EXPOSURE", "CCD_EXPOSURE_VALUE", true),
+		"exposuremin":           getLimit("CCD_EXPOSURE", "CCD_EXPOSURE_VALUE", false),
+		"exposureresolution":    constant(0.0),
+		"fastreadout":           notImplemented,
+		"fullwellcapacity":      notImplemented,
+		"gain":                  getControl(gainControl, ""),
+		"gainmax":               getControl(gainControl, "max"),
+		"gainmin":               getControl(gainControl, "min"),
+		"gains":                 notImplemented,
+		"hasshutter":            constant(false),
+		"heatsinktemperature":   notImplemented,
+		"imagearray":            getImageArray,
+		"imagearrayvariant":     notImplemented,
+		"imageready":            getImageReady,
+		"ispulseguiding":        constant(false),
+		"lastexposureduration":  getLastExposureDuration,
+		"lastexposurestarttime": getLastExposureStartTime,
+		"maxadu":                getMaxADU,
+		"maxbinx":               getMaxBin("HOR_BIN"),
+		"maxbiny":               getMaxBin("VER_BIN"),
+		"numx":                  getCameraInt(func(cam *cameraState) int { return cam.numX }),
+		"numy":                  getCameraInt(func(cam *cameraState) int { return cam.numY }),
+		"offset":                getControl(offsetControl, ""),
+		"offsetmax":             getControl(offsetControl, "max"),
+		"offsetmin":             getControl(offsetControl, "min"),
+		"offsets":               notImplemented,
+		"percentcompleted":      getPercentCompleted,
+		"pixelsizex":            getNumber("CCD_INFO", "CCD_PIXEL_SIZE_X"),
+		"pixelsizey":            getNumber("CCD_INFO", "CCD_PIXEL_SIZE_Y"),
+		"readoutmode":           constant(0),
+		"readoutmodes":          constant([]string{"Default"}),
+		"sensorname":            constant(""),
+		"sensortype":            getSensorType,
+		"setccdtemperature":     getTargetTemperature,
+		"startx":                getCameraInt(func(cam *cameraState) int { return cam.startX }),
+		"starty":                getCameraInt(func(cam *cameraState) int { return cam.startY }),
+		"subexposureduration":   notImplemented,
+	},
+	put: map[string]method{
+		"abortexposure":       abortExposure,
+		"binx":                setBin("BinX", func(cam *cameraState) *int { return &cam.binX }),
+		"biny":                setBin("BinY", func(cam *cameraState) *int { return &cam.binY }),
+		"cooleron":            setCoolerOn,
+		"fastreadout":         notImplemented,
+		"gain":                setControl(gainControl, "Gain"),
+		"numx":                setCameraInt("NumX", 1, func(cam *cameraState) *int { return &cam.numX }),
+		"numy":                setCameraInt("NumY", 1, func(cam *cameraState) *int { return &cam.numY }),
+		"offset":              setControl(offsetControl, "Offset"),
+		"pulseguide":          notImplemented,
+		"readoutmode":         setReadoutMode,
+		"setccdtemperature":   setTargetTemperature,
+		"startexposure":       startExposure,
+		"startx":              setCameraInt("StartX", 0, func(cam *cameraState) *int { return &cam.startX }),
+		"starty":              setCameraInt("StartY", 0, func(cam *cameraState) *int { return &cam.startY }),
+		"stopexposure":        notImplemented,
+		"subexposureduration": notImplemented,
+	},
+}
+
+// control is camera setting which drivers have as separate property or as element of CCD_CONTROLS
+type control struct {
+	prop    string
+	element string
+	control string
+}
+
+var (
+	gainControl   = control{prop: "CCD_GAIN", element: "GAIN", control: "Gain"}
+	offsetControl = control{prop: "CCD_OFFSET", element: "OFFSET", control: "Offset"}
+)
+
+func (ctl control) find(r *request) (string, string, error) {
+	if _, err := r.element(ctl.prop, ctl.element); err == nil {
+		return ctl.prop, ctl.element, nil
+	}
+	if _, err := r.element("CCD_CONTROLS", ctl.control); err == nil {
+		return "CCD_CONTROLS", ctl.control, nil
+	}
+	return "", "", newError(ErrNotImplemented, "%s has no %s control", r.dev.name, ctl.control)
+}
+
+func getControl(ctl control, limit string) method {
+	return func(r *request) (interface{}, error) {
+		prop, name, err := ctl.find(r)
+		if err != nil {
+			return nil, err
+		}
+		e, _ := r.element(prop, name)
+		switch limit {
+		case "min":
+			return int(parseNumber(e.Min)), nil
+		case "max":
+			return int(parseNumber(e.Max)), nil
+		}
+		return int(parseNumber(e.Value)), nil
+	}
+}
+
+func setControl(ctl control, param string) method {
+	return func(r *request) (interface{}, error) {
+		val, err := r.intParam(param)
+		if err != nil {
+			return nil, err
+		}
+		prop, name, err := ctl.find(r)
+		if err != nil {
+			return nil, err
+		}
+		e, _ := r.element(prop, name)
+		if float64(val) < parseNumber(e.Min) || float64(val) > parseNumber(e.Max) {
+			return nil, newError(ErrInvalidValue, "%s must be in range %s..%s", param, e.Min, e.Max)
+		}
+		return nil, r.setNumbers(prop, map[string]float64{name: float64(val)})
+	}
+}
+
+func getNumber(prop string, name string) method {
+	return func(r *request) (interface{}, error) {
+		return r.number(prop, name)
+	}
+}
+
+func getLimit(prop string, name string, max bool) method {
+	return func(r *request) (interface{}, error) {
+		e, err := r.element(prop, name)
+		if err != nil {
+			return nil, err
+		}
+		if max {
+			return parseNumber(e.Max), nil
+		}
+		return parseNumber(e.Min), nil
+	}
+}
+
+// camera calls fn with initialized camera state locked
+func (r *request) camera(fn func(cam *cameraState) (interface{}, error)) (interface{}, error) {
+	r.dev.mu.Lock()
+	defer r.dev.mu.Unlock()
+
+	cam := &r.dev.camera
+	if !cam.initialized {
+		maxX, err := r.number("CCD_INFO", "CCD_MAX_X")
+		if err != nil {
+			return nil, err
+		}
+		maxY, err := r.number("CCD_INFO", "CCD_MAX_Y")
+		if err != nil {
+			return nil, err
+		}
+		cam.maxX, cam.maxY = int(maxX), int(maxY)
+		cam.binX, cam.binY = 1, 1
+		cam.numX, cam.numY = cam.maxX, cam.maxY
+		cam.initialized = true
+	}
+	return fn(cam)
+}
+
+func getCameraInt(get func(cam *cameraState) int) method {
+	return func(r *request) (interface{}, error) {
+		return r.camera(func(cam *cameraState) (interface{}, error) {
+			return get(cam), nil
+		})
+	}
+}
+
+func setCameraInt(param string, min int, field func(cam *cameraState) *int) method {
+	return func(r *request) (interface{}, error) {
+		val, err := r.intParam(param)
+		if err != nil {
+			return nil, err
+		}
+		if val < min {
+			return nil, newError(ErrInvalidValue, "%s must not be less than %d", param, min)
+		}
+		return r.camera(func(cam *cameraState) (interface{}, error) {
+			*field(cam) = val
+			return nil, nil
+		})
+	}
+}
+
+func getMaxBin(name string) method {
+	return func(r *request) (interface{}, error) {
+		e, err := r.element("CCD_BINNING", name)
+		if err != nil {
+			return 1, nil
+		}
+		return int(parseNumber(e.Max)), nil
+	}
+}
+
+func setBin(param string, field func(cam *cameraState) *int) method {
+	return func(r *request) (interface{}, error) {
+		val, err := r.intParam(param)
+		if err != nil {
+			return nil, err
+		}
+		max := 1
+		if e, err := r.element("CCD_BINNING", "HOR_BIN"); err == nil {
+			max = int(parseNumber(e.Max))
+		}
+		if val < 1 || val > max {
+			return nil, newError(ErrInvalidValue, "%s must be in range 1..%d", param, max)
+		}
+		return r.camera(func(cam *cameraState) (interface{}, error) {
+			*field(cam) = val
+			return nil, nil
+		})
+	}
+}
+
+func getBayerOffset(name string) method {
+	return func(r *request) (interface{}, error) {
+		e, err := r.element("CCD_CFA", name)
+		if err != nil {
+			return nil, err
+		}
+		return int(parseNumber(e.Value)), nil
+	}
+}
+
+func getSensorType(r *request) (interface{}, error) {
+	if r.has("CCD_CFA") {
+		return sensorRGGB, nil
+	}
+	return sensorMonochrome, nil
+}
+
+func getMaxADU(r *request) (interface{}, error) {
+	bits, err := r.number("CCD_INFO", "CCD_BITSPERPIXEL")
+	if err != nil || bits <= 0 || bits > 31 {
+		return 65535, nil
+	}
+	return 1<<uint(bits) - 1, nil
+}
+
+func getCoolerOn(r *request) (interface{}, error) {
+	if _, err := r.property("CCD_COOLER"); err != nil {
+		return nil, err
+	}
+	return r.isOn("CCD_COOLER", "COOLER_ON"), nil
+}
+
+func setCoolerOn(r *request) (interface{}, error) {
+	on, err := r.boolParam("CoolerOn")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.property("CCD_COOLER"); err != nil {
+		return nil, err
+	}
+	if on {
+		return nil, r.setSwitch("CCD_COOLER", "COOLER_ON")
+	}
+	return nil, r.setSwitch("CCD_COOLER", "COOLER_OFF")
+}
+
+func getTargetTemperature(r *request) (interface{}, error) {
+	temp, err := r.number("CCD_TEMPERATURE", "CCD_TEMPERATURE_VALUE")
+	if err != nil {
+		return nil, err
+	}
+	r.dev.mu.Lock()
+	defer r.dev.mu.Unlock()
+	if r.dev.camera.targetTemp != nil {
+		return *r.dev.camera.targetTemp, nil
+	}
+	return temp, nil
+}
+
+func setTargetTemperature(r *request) (interface{}, error) {
+	temp, err := r.floatParam("SetCCDTemperature")
+	if err != nil {
+		return nil, err
+	}
+	if temp < -273.15 || temp > 100 {
+		return nil, newError(ErrInvalidValue, "SetCCDTemperature must be in range -273.15..100")
+	}
+	if err := r.setNumbers("CCD_TEMPERATURE", map[string]float64{"CCD_TEMPERATURE_VALUE": temp}); err != nil {
+		return nil, err
+	}
+	r.dev.mu.Lock()
+	r.dev.camera.targetTemp = &temp
+	r.dev.mu.Unlock()
+	return nil, nil
+}
+
+func setReadoutMode(r *request) (interface{}, error) {
+	mode, err := r.intParam("ReadoutMode")
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		return nil, newError(ErrInvalidValue, "only readout mode 0 is supported")
+	}
+	return nil, nil
+}
+
+func getCameraState(r *request) (interface{}, error) {
+	if r.state("CCD_EXPOSURE") == indiclient.StateAlert {
+		return cameraError, nil
+	}
+	return r.camera(func(cam *cameraState) (interface{}, error) {
+		switch {
+		case !cam.exposing:
+			return cameraIdle, nil
+		case r.state("CCD_EXPOSURE") == indiclient.StateBusy:
+			return cameraExposing, nil
+		}
+		return cameraDownload, nil
+	})
+}
+
+func getImageReady(r *request) (interface{}, error) {
+	return r.camera(func(cam *cameraState) (interface{}, error) {
+		return cam.imageReady, nil
+	})
+}
+
+func getPercentCompleted(r *request) (interface{}, error) {
+	return r.camera(func(cam *cameraState) (interface{}, error) {
+		switch {
+		case cam.imageReady:
+			return 100, nil
+		case !cam.exposing:
+			return nil, newError(ErrInvalidOperation, "no exposure in progress")
+		case cam.duration <= 0:
+			return 100, nil
+		}
+		percent := time.Since(cam.started).Seconds() / cam.duration * 100
+		return int(math.Min(percent, 100)), nil
+	})
+}
+
+func getLastExposureDuration(r *request) (interface{}, error) {
+	return r.camera(func(cam *cameraState) (interface{}, error) {
+		if cam.lastDuration == nil {
+			return nil, newError(ErrValueNotSet, "no exposure was made")
+		}
+		return *cam.lastDuration, nil
+	})
+}
+
+func getLastExposureStartTime(r *request) (interface{}, error) {
+	return r.camera(func(cam *cameraState) (interface{}, error) {
+		if cam.lastStart == nil {
+			return nil, newError(ErrValueNotSet, "no exposure was made")
+		}
+		return cam.lastStart.UTC().Format("2006-01-02T15:04:05"), nil
+	})
+}
+
+func startExposure(r *request) (interface{}, error) {
+	duration, err := r.floatParam("Duration")
+	if err != nil {
+		return nil, err
+	}
+	light, err := r.boolParam("Light")
+	if err != nil {
+		return nil, err
+	}
+	if e, err := r.element("CCD_EXPOSURE", "CCD_EXPOSURE_VALUE"); err != nil {
+		return nil, err
+	} else if duration < 0 || (e.Max != "" && duration > parseNumber(e.Max)) {
+		return nil, newError(ErrInvalidValue, "Duration must be in range 0..%s", e.Max)
+	}
+
+	return r.camera(func(cam *cameraState) (interface{}, error) {
+		if cam.exposing {
+			return nil, newError(ErrInvalidOperation, "exposure is in progress")
+		}
+		if cam.binX != cam.binY {
+			return nil, newError(ErrInvalidValue, "asymmetric binning is not supported")
+		}
+		if cam.numX < 1 || cam.numY < 1 || cam.startX < 0 || cam.startY < 0 ||
+			(cam.startX+cam.numX)*cam.binX > cam.maxX || (cam.startY+cam.numY)*cam.binY > cam.maxY {
+			return nil, newError(ErrInvalidValue, "subframe is out of sensor")
+		}
+
+		if r.has("CCD_BINNING") {
+			if err := r.setNumbers("CCD_BINNING", map[string]float64{
+				"HOR_BIN": float64(cam.binX),
+				"VER_BIN": float64(cam.binY),
+			}); err != nil {
+				return nil, err
+			}
+		}
+		if r.has("CCD_FRAME") {
+			if err := r.setNumbers("CCD_FRAME", map[string]float64{
+				"X":      float64(cam.startX * cam.binX),
+				"Y":      float64(cam.startY * cam.binY),
+				"WIDTH":  float64(cam.numX * cam.binX),
+				"HEIGHT": float64(cam.numY * cam.binY),
+			}); err != nil {
+				return nil, err
+			}
+		}
+		if r.has("CCD_FRAME_TYPE") {
+			frameType := "FRAME_DARK"
+			if light {
+				frameType = "FRAME_LIGHT"
+			}
+			if err := r.setSwitch("CCD_FRAME_TYPE", frameType); err != nil {
+				return nil, err
+			}
+		}
+		if err := indiError(r.client.EnableBLOB(r.dev.name, "", "Also")); err != nil {
+			return nil, err
+		}
+		if err := r.setNumbers("CCD_EXPOSURE", map[string]float64{"CCD_EXPOSURE_VALUE": duration}); err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		cam.exposing = true
+		cam.started = now
+		cam.duration = duration
+		cam.lastStart = &now
+		cam.lastDuration = &duration
+		cam.image = nil
+		cam.imageReady = false
+		return nil, nil
+	})
+}
+
+func abortExposure(r *request) (interface{}, error) {
+	return r.camera(func(cam *cameraState) (interface{}, error) {
+		if !cam.exposing {
+			return nil, nil
+		}
+		if err := r.setSwitch("CCD_ABORT_EXPOSURE", "ABORT"); err != nil {
+			return nil, err
+		}
+		cam.exposing = false
+		return nil, nil
+	})
+}
+
+// onBLOB decodes FITS image received from INDI-server if exposure was started via Alpaca
+func (d *device) onBLOB(v *indiclient.Vector) {
+	d.mu.Lock()
+	exposing := d.camera.exposing
+	d.mu.Unlock()
+	if !exposing {
+		return
+	}
+
+	for _, e := range v.Elements {
+		if e.Value == "" {
+			continue
+		}
+		if !strings.HasPrefix(e.Format, ".fits") || strings.HasSuffix(e.Format, ".fz") {
+			logger.Warnf("%s sent image in unsupported format '%s'", d.name, e.Format)
+			continue
+		}
+
+		// decode in background not to block reading from INDI-server
+		go func(value string) {
+			img, err := decodeImage(value)
+			if err != nil {
+				logger.Errorf("could not decode image from %s: %s", d.name, err)
+				return
+			}
+
+			d.mu.Lock()
+			d.camera.exposing = false
+			d.camera.image = img
+			d.camera.imageReady = true
+			d.mu.Unlock()
+
+			if client := d.server.currentClient(); client != nil {
+				client.EnableBLOB(d.name, "", "Never")
+			}
+		}(e.Value)
+		return
+	}
+}
+
+func decodeImage(value string) (*fits.Image, error) {
+	data, err := indiclient.DecodeBLOB(value)
+	if err != nil {
+		return nil, err
+	}
+	return fits.Decode(data)
+}
+
+// getImageArray writes image as JSON array or as ImageBytes if client accepts it
+func getImageArray(r *request) (interface{}, error) {
+	var img *fits.Image
+	if _, err := r.camera(func(cam *cameraState) (interface{}, error) {
+		if !cam.imageReady || cam.image == nil {
+			return nil, newError(ErrInvalidOperation, "there is no image")
+		}
+		img = cam.image
+		return nil, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	imageBytes := strings.Contains(r.c.Request().Header.Get(echo.HeaderAccept), imageBytesMIME)
+	return rawResponse(func(c echo.Context, clientTxID uint32, serverTxID uint32) error {
+		if imageBytes {
+			return writeImageBytes(c, img, clientTxID, serverTxID)
+		}
+		return writeImageJSON(c, img, clientTxID, serverTxID)
+	}), nil
+}
+
+// forEachPixel calls fn in Alpaca order: x is the slowest index, y goes from the top and plane is the fastest
+func forEachPixel(img *fits.Image, fn func(val float32)) {
+	topDown := img.TopDown()
+	for x := 0; x < img.Width; x++ {
+		for y := 0; y < img.Height; y++ {
+			row := y
+			if !topDown {
+				row = img.Height - 1 - y
+			}
+			for _, plane := range img.Channels {
+				fn(plane[row*img.Width+x])
+			}
+		}
+	}
+}
+
+func toInt32(val float32) int32 {
+	return int32(math.Max(math.MinInt32, math.Min(math.MaxInt32, math.Round(float64(val)))))
+}
+
+func writeImageJSON(c echo.Context, img *fits.Image, clientTxID uint32, serverTxID uint32) error {
+	rank := 2
+	if len(img.Channels) > 1 {
+		rank = 3
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	c.Response().WriteHeader(http.StatusOK)
+	w := bufio.NewWriterSize(c.Response(), 64*1024)
+
+	w.WriteString(`{"Type":` + strconv.Itoa(imageInt32) + `,"Rank":` + strconv.Itoa(rank) +
+		`,"ClientTransactionID":` + strconv.FormatUint(uint64(clientTxID), 10) +
+		`,"ServerTransactionID":` + strconv.FormatUint(uint64(serverTxID), 10) +
+		`,"ErrorNumber":0,"ErrorMessage":"","Value":[`)
+
+	num := make([]byte, 0, 16)
+	topDown := img.TopDown()
+	for x := 0; x < img.Width; x++ {
+		if x > 0 {
+			w.WriteByte(',')
+		}
+		w.WriteByte('[')
+		for y := 0; y < img.Height; y++ {
+			if y > 0 {
+				w.WriteByte(',')
+			}
+			row := y
+			if !topDown {
+				row = img.Height - 1 - y
+			}
+			if rank == 2 {
+				w.Write(strconv.AppendInt(num[:0], int64(toInt32(img.Channels[0][row*img.Width+x])), 10))
+				continue
+			}
+			w.WriteByte('[')
+			for p, plane := range img.Channels {
+				if p > 0 {
+					w.WriteByte(',')
+				}
+				w.Write(strconv.AppendInt(num[:0], int64(toInt32(plane[row*img.Width+x])), 10))
+			}
+			w.WriteByte(']')
+		}
+		w.WriteByte(']')
+	}
+	w.WriteString("]}")
+
+	return w.Flush()
+}
+
+// writeImageBytes writes image in Alpaca ImageBytes format with Int32 elements
+func writeImageBytes(c echo.Context, img *fits.Image, clientTxID uint32, serverTxID uint32) error {
+	rank, dim3 := 2, 0
+	if len(img.Channels) > 1 {
+		rank, dim3 = 3, len(img.Channels)
+	}
+
+	header := []int32{
+		1,                 // metadata version
+		0,                 // error number
+		int32(clientTxID), // client transaction ID
+		int32(serverTxID), // server transaction ID
+		44,                // data start
+		imageInt32,        // image element type
+		imageInt32,        // transmission element type
+		int32(rank),       // rank
+		int32(img.Width),  // dimension 1
+		int32(img.Height), // dimension 2
+		int32(dim3),       // dimension 3
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, imageBytesMIME)
+	c.Response().WriteHeader(http.StatusOK)
+	w := bufio.NewWriterSize(c.Response(), 64*1024)
+	binary.Write(w, binary.LittleEndian, header)
+
+	buf := make([]byte, 4)
+	forEachPixel(img, func(val float32) {
+		binary.LittleEndian.PutUint32(buf, uint32(toInt32(val)))
+		w.Write(buf)
+	})
+
+	return w.Flush()
+}
@@ -0,0 +1,280 @@
+package alpaca
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/indihub-space/agent/indiclient"
+	"github.com/indihub-space/agent/version"
+)
+
+const connectTimeout = 30 * time.Second
+
+// interfaceVersions are versions of Alpaca device interfaces
+var interfaceVersions = map[string]int{
+	TypeTelescope:   3,
+	TypeCamera:      3,
+	TypeFocuser:     3,
+	TypeFilterWheel: 2,
+	TypeDome:        2,
+}
+
+// disconnectedMethods can be called while device is not connected
+var disconnectedMethods = map[string]bool{
+	"connected":        true,
+	"description":      true,
+	"driverinfo":       true,
+	"driverversion":    true,
+	"interfaceversion": true,
+	"name":             true,
+	"supportedactions": true,
+}
+
+var commonGetMethods = map[string]method{
+	"connected": func(r *request) (interface{}, error) {
+		return r.dev.isConnected(r.client), nil
+	},
+	"description": func(r *request) (interface{}, error) {
+		if r.client == nil {
+			return r.dev.name, nil
+		}
+		if e, err := r.element("DRIVER_INFO", "DRIVER_NAME"); err == nil && e.Value != "" {
+			return e.Value, nil
+		}
+		return r.dev.name, nil
+	},
+	"driverinfo": func(r *request) (interface{}, error) {
+		return "INDIHUB agent bridge to INDI device " + r.dev.name, nil
+	},
+	"driverversion": func(r *request) (interface{}, error) {
+		return version.AgentVersion, nil
+	},
+	"interfaceversion": func(r *request) (interface{}, error) {
+		return interfaceVersions[r.dev.typ], nil
+	},
+	"name": func(r *request) (interface{}, error) {
+		return r.dev.name, nil
+	},
+	"supportedactions": func(r *request) (interface{}, error) {
+		return []string{}, nil
+	},
+}
+
+var commonPutMethods = map[string]method{
+	"connected": func(r *request) (interface{}, error) {
+		connect, err := r.boolParam("Connected")
+		if err != nil {
+			return nil, err
+		}
+		if r.client == nil {
+			return nil, newError(ErrNotConnected, "agent is not connected to INDI-server")
+		}
+		if connect == r.dev.isConnected(r.client) {
+			return nil, nil
+		}
+		element := "CONNECT"
+		if !connect {
+			element = "DISCONNECT"
+		}
+		state, err := r.client.SetSwitchAndWait(r.dev.name, "CONNECTION", element, connectTimeout)
+		if err != nil {
+			return nil, indiError(err)
+		}
+		if state == indiclient.StateAlert {
+			return nil, newError(ErrDriver, "could not change connection of %s", r.dev.name)
+		}
+		return nil, nil
+	},
+	"action": func(r *request) (interface{}, error) {
+		return nil, newError(ErrActionNotImplemented, "actions are not supported")
+	},
+	"commandblind":  notImplemented,
+	"commandbool":   notImplemented,
+	"commandstring": notImplemented,
+}
+
+// deviceMethods are methods of all device types including common ones
+var deviceMethods = map[string]methods{
+	TypeTelescope:   withCommon(telescopeMethods),
+	TypeCamera:      withCommon(cameraMethods),
+	TypeFocuser:     withCommon(focuserMethods),
+	TypeFilterWheel: withCommon(filterWheelMethods),
+	TypeDome:        withCommon(domeMethods),
+}
+
+func withCommon(ms methods) methods {
+	for name, fn := range commonGetMethods {
+		ms.get[name] = fn
+	}
+	for name, fn := range commonPutMethods {
+		ms.put[name] = fn
+	}
+	return ms
+}
+
+func notImplemented(r *request) (interface{}, error) {
+	return nil, newError(ErrNotImplemented, "%s is not implemented", r.c.Param("method"))
+}
+
+func constant(value interface{}) method {
+	return func(r *request) (interface{}, error) {
+		return value, nil
+	}
+}
+
+// device is INDI device exposed as Alpaca device of one type
+type device struct {
+	server   *Server
+	typ      string
+	number   int
+	name     string
+	uniqueID string
+
+	mu     sync.Mutex
+	scope  telescopeState
+	camera cameraState
+}
+
+func newDevice(s *Server, typ string, number int, name string) *device {
+	return &device{
+		server:   s,
+		typ:      typ,
+		number:   number,
+		name:     name,
+		uniqueID: uniqueID(typ, name),
+	}
+}
+
+func (d *device) isConnected(client *indiclient.Client) bool {
+	if client == nil {
+		return false
+	}
+	v, ok := client.Property(d.name, "CONNECTION")
+	if !ok {
+		// devices without connection property are always connected
+		return len(client.Properties(d.name)) > 0
+	}
+	e, ok := v.Element("CONNECT")
+	return ok && e.Value == indiclient.SwitchOn
+}
+
+// has checks if device has property
+func (r *request) has(prop string) bool {
+	return r.client.HasProperty(r.dev.name, prop)
+}
+
+func (r *request) property(prop string) (*indiclient.Vector, error) {
+	v, ok := r.client.Property(r.dev.name, prop)
+	if !ok {
+		return nil, newError(ErrNotImplemented, "%s has no %s property", r.dev.name, prop)
+	}
+	return v, nil
+}
+
+func (r *request) element(prop string, name string) (indiclient.Element, error) {
+	v, err := r.property(prop)
+	if err != nil {
+		return indiclient.Element{}, err
+	}
+	e, ok := v.Element(name)
+	if !ok {
+		return indiclient.Element{}, newError(ErrNotImplemented, "%s has no %s.%s element", r.dev.name, prop, name)
+	}
+	return e, nil
+}
+
+// number returns value of number element
+func (r *request) number(prop string, name string) (float64, error) {
+	e, err := r.element(prop, name)
+	if err != nil {
+		return 0, err
+	}
+	return parseNumber(e.Value), nil
+}
+
+// isOn checks if switch element is On, missing property is reported as false
+func (r *request) isOn(prop string, name string) bool {
+	e, err := r.element(prop, name)
+	return err == nil && e.Value == indiclient.SwitchOn
+}
+
+func (r *request) state(prop string) string {
+	v, ok := r.client.Property(r.dev.name, prop)
+	if !ok {
+		return ""
+	}
+	return v.State
+}
+
+func (r *request) isBusy(props ...string) bool {
+	for _, prop := range props {
+		if r.state(prop) == indiclient.StateBusy {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *request) setNumbers(prop string, values map[string]float64) error {
+	return indiError(r.client.SetNumbers(r.dev.name, prop, values))
+}
+
+func (r *request) setSwitch(prop string, element string) error {
+	return indiError(r.client.SetSwitch(r.dev.name, prop, element))
+}
+
+// setSwitchAndWait turns switch on and waits for property to become not busy
+func (r *request) setSwitchAndWait(prop string, element string, timeout time.Duration) error {
+	state, err := r.client.SetSwitchAndWait(r.dev.name, prop, element, timeout)
+	if err != nil {
+		return indiError(err)
+	}
+	if state == indiclient.StateAlert {
+		return newError(ErrDriver, "%s.%s failed", r.dev.name, prop)
+	}
+	return nil
+}
+
+// waitNotBusy waits for property to become not busy
+func (r *request) waitNotBusy(prop string, timeout time.Duration) error {
+	state, err := r.client.WaitState(r.dev.name, prop, timeout, func(state string) bool {
+		return state != indiclient.StateBusy
+	})
+	if err != nil {
+		return indiError(err)
+	}
+	if state == indiclient.StateAlert {
+		return newError(ErrDriver, "%s.%s failed", r.dev.name, prop)
+	}
+	return nil
+}
+
+// parseNumber parses INDI number, sexagesimal values are supported
+func parseNumber(s string) float64 {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+
+	val, div, sign := 0.0, 1.0, 1.0
+	part := ""
+	flush := func() {
+		if f, err := strconv.ParseFloat(part, 64); err == nil {
+			val += f / div
+		}
+		div *= 60
+		part = ""
+	}
+	for i, ch := range s {
+		switch {
+		case ch == '-' && i == 0:
+			sign = -1
+		case ch == ':' || ch == ' ' || ch == ';':
+			flush()
+		default:
+			part += string(ch)
+		}
+	}
+	flush()
+	return sign * val
+}
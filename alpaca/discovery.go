@@ -0,0 +1,56 @@
+package alpaca
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+const DiscoveryPort = 32227
+
+var discoveryRequest = []byte("alpacadiscovery1")
+
+// RunDiscovery answers Alpaca discovery requests on UDP port 32227 with Alpaca API port until Stop is called,
+// nothing is answered when API is listening on loopback address only
+func (s *Server) RunDiscovery() {
+	addr, ok := s.Addr().(*net.TCPAddr)
+	if !ok {
+		logger.Errorf("could not start Alpaca discovery responder: Alpaca API is not listening")
+		return
+	}
+	if addr.IP.IsLoopback() {
+		logger.Infof("Alpaca discovery is disabled: Alpaca API is listening on %s only", addr)
+		return
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: DiscoveryPort})
+	if err != nil {
+		logger.Errorf("could not start Alpaca discovery responder: %s", err)
+		return
+	}
+	go func() {
+		<-s.stopCh
+		conn.Close()
+	}()
+
+	logger.Infof("Alpaca discovery responder is listening on UDP port %d", DiscoveryPort)
+	response := []byte(fmt.Sprintf(`{"AlpacaPort":%d}`, addr.Port))
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.stopCh:
+			default:
+				logger.Errorf("Alpaca discovery responder error: %s", err)
+			}
+			return
+		}
+		if !bytes.HasPrefix(buf[:n], discoveryRequest) {
+			continue
+		}
+		if _, err := conn.WriteToUDP(response, addr); err != nil {
+			logger.Warnf("could not answer Alpaca discovery request from %s: %s", addr, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package alpaca
+
+import (
+	"github.com/indihub-space/agent/indiclient"
+)
+
+const (
+	shutterOpen    = 0
+	shutterClosed  = 1
+	shutterOpening = 2
+	shutterClosing = 3
+	shutterError   = 4
+)
+
+var domeMethods = methods{
+	get: map[string]method{
+		"altitude":       notImplemented,
+		"athome":         constant(false),
+		"atpark":         getDomeAtPark,
+		"azimuth":        getNumber("ABS_DOME_POSITION", "DOME_ABSOLUTE_POSITION"),
+		"canfindhome":    constant(false),
+		"canpark":        canProperty("DOME_PARK"),
+		"cansetaltitude": constant(false),
+		"cansetazimuth":  canProperty("ABS_DOME_POSITION"),
+		"cansetpark":     constant(false),
+		"cansetshutter":  canProperty("DOME_SHUTTER"),
+		"canslave":       constant(false),
+		"cansyncazimuth": constant(false),
+		"shutterstatus":  getShutterStatus,
+		"slaved":         constant(false),
+		"slewing":        getDomeSlewing,
+	},
+	put: map[string]method{
+		"abortslew":      abortDomeSlew,
+		"closeshutter":   setShutter("SHUTTER_CLOSE"),
+		"findhome":       notImplemented,
+		"openshutter":    setShutter("SHUTTER_OPEN"),
+		"park":           parkDome,
+		"setpark":        notImplemented,
+		"slaved":         setSlaved,
+		"slewtoaltitude": notImplemented,
+		"slewtoazimuth":  slewDome,
+		"synctoazimuth":  notImplemented,
+	},
+}
+
+func getDomeAtPark(r *request) (interface{}, error) {
+	return r.isOn("DOME_PARK", "PARK"), nil
+}
+
+func getShutterStatus(r *request) (interface{}, error) {
+	v, err := r.property("DOME_SHUTTER")
+	if err != nil {
+		return nil, err
+	}
+	opening := r.isOn("DOME_SHUTTER", "SHUTTER_OPEN")
+	switch {
+	case v.State == indiclient.StateAlert:
+		return shutterError, nil
+	case v.State == indiclient.StateBusy && opening:
+		return shutterOpening, nil
+	case v.State == indiclient.StateBusy:
+		return shutterClosing, nil
+	case opening:
+		return shutterOpen, nil
+	}
+	return shutterClosed, nil
+}
+
+func getDomeSlewing(r *request) (interface{}, error) {
+	return r.isBusy("ABS_DOME_POSITION", "DOME_MOTION", "DOME_PARK"), nil
+}
+
+func setShutter(element string) method {
+	return func(r *request) (interface{}, error) {
+		return nil, r.setSwitch("DOME_SHUTTER", element)
+	}
+}
+
+func parkDome(r *request) (interface{}, error) {
+	if r.isOn("DOME_PARK", "PARK") {
+		return nil, nil
+	}
+	return nil, r.setSwitch("DOME_PARK", "PARK")
+}
+
+func abortDomeSlew(r *request) (interface{}, error) {
+	if !r.has("DOME_ABORT_MOTION") {
+		return nil, nil
+	}
+	return nil, r.setSwitch("DOME_ABORT_MOTION", "ABORT")
+}
+
+func setSlaved(r *request) (interface{}, error) {
+	slaved, err := r.boolParam("Slaved")
+	if err != nil {
+		return nil, err
+	}
+	if slaved {
+		return nil, newError(ErrNotImplemented, "slaving is not supported")
+	}
+	return nil, nil
+}
+
+func slewDome(r *request) (interface{}, error) {
+	az, err := r.floatParam("Azimuth")
+	if err != nil {
+		return nil, err
+	}
+	if az < 0 || az >= 360 {
+		return nil, newError(ErrInvalidValue, "Azimuth must be in range 0..360")
+	}
+	if r.isOn("DOME_PARK", "PARK") {
+		return nil, newError(ErrInvalidWhileParked, "%s is parked", r.dev.name)
+	}
+	return nil, r.setNumbers("ABS_DOME_POSITION", map[string]float64{"DOME_ABSOLUTE_POSITION": az})
+}
@@ -0,0 +1,76 @@
+package alpaca
+
+import (
+	"fmt"
+)
+
+var filterWheelMethods = methods{
+	get: map[string]method{
+		"focusoffsets": getFocusOffsets,
+		"names":        getFilterNames,
+		"position":     getFilterPosition,
+	},
+	put: map[string]method{
+		"position": setFilterPosition,
+	},
+}
+
+// filterNames returns names from FILTER_NAME or generated ones for all slots
+func filterNames(r *request) ([]string, error) {
+	if v, err := r.property("FILTER_NAME"); err == nil && len(v.Elements) > 0 {
+		names := make([]string, 0, len(v.Elements))
+		for _, e := range v.Elements {
+			names = append(names, e.Value)
+		}
+		return names, nil
+	}
+
+	e, err := r.element("FILTER_SLOT", "FILTER_SLOT_VALUE")
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for i := 1; i <= int(parseNumber(e.Max)); i++ {
+		names = append(names, fmt.Sprintf("Filter %d", i))
+	}
+	return names, nil
+}
+
+func getFilterNames(r *request) (interface{}, error) {
+	return filterNames(r)
+}
+
+func getFocusOffsets(r *request) (interface{}, error) {
+	names, err := filterNames(r)
+	if err != nil {
+		return nil, err
+	}
+	return make([]int, len(names)), nil
+}
+
+// getFilterPosition returns zero-based slot or -1 while wheel is moving
+func getFilterPosition(r *request) (interface{}, error) {
+	slot, err := r.number("FILTER_SLOT", "FILTER_SLOT_VALUE")
+	if err != nil {
+		return nil, err
+	}
+	if r.isBusy("FILTER_SLOT") {
+		return -1, nil
+	}
+	return int(slot) - 1, nil
+}
+
+func setFilterPosition(r *request) (interface{}, error) {
+	pos, err := r.intParam("Position")
+	if err != nil {
+		return nil, err
+	}
+	names, err := filterNames(r)
+	if err != nil {
+		return nil, err
+	}
+	if pos < 0 || pos >= len(names) {
+		return nil, newError(ErrInvalidValue, "Position must be in range 0..%d", len(names)-1)
+	}
+	return nil, r.setNumbers("FILTER_SLOT", map[string]float64{"FILTER_SLOT_VALUE": float64(pos + 1)})
+}
@@ -0,0 +1,83 @@
+package alpaca
+
+import (
+	"math"
+)
+
+var focuserMethods = methods{
+	get: map[string]method{
+		"absolute":          canProperty("ABS_FOCUS_POSITION"),
+		"ismoving":          getFocuserMoving,
+		"maxincrement":      getFocuserMaxStep,
+		"maxstep":           getFocuserMaxStep,
+		"position":          getNumber("ABS_FOCUS_POSITION", "FOCUS_ABSOLUTE_POSITION"),
+		"stepsize":          notImplemented,
+		"tempcomp":          constant(false),
+		"tempcompavailable": constant(false),
+		"temperature":       getNumber("FOCUS_TEMPERATURE", "TEMPERATURE"),
+	},
+	put: map[string]method{
+		"halt":     haltFocuser,
+		"move":     moveFocuser,
+		"tempcomp": setTempComp,
+	},
+}
+
+func getFocuserMoving(r *request) (interface{}, error) {
+	return r.isBusy("ABS_FOCUS_POSITION", "REL_FOCUS_POSITION"), nil
+}
+
+func getFocuserMaxStep(r *request) (interface{}, error) {
+	if e, err := r.element("ABS_FOCUS_POSITION", "FOCUS_ABSOLUTE_POSITION"); err == nil {
+		return int(parseNumber(e.Max)), nil
+	}
+	e, err := r.element("REL_FOCUS_POSITION", "FOCUS_RELATIVE_POSITION")
+	if err != nil {
+		return nil, err
+	}
+	return int(parseNumber(e.Max)), nil
+}
+
+// moveFocuser moves to absolute position or by number of steps for relative focusers, position is clamped to limits
+func moveFocuser(r *request) (interface{}, error) {
+	pos, err := r.intParam("Position")
+	if err != nil {
+		return nil, err
+	}
+
+	if e, err := r.element("ABS_FOCUS_POSITION", "FOCUS_ABSOLUTE_POSITION"); err == nil {
+		target := math.Max(parseNumber(e.Min), math.Min(parseNumber(e.Max), float64(pos)))
+		return nil, r.setNumbers("ABS_FOCUS_POSITION", map[string]float64{"FOCUS_ABSOLUTE_POSITION": target})
+	}
+
+	e, err := r.element("REL_FOCUS_POSITION", "FOCUS_RELATIVE_POSITION")
+	if err != nil {
+		return nil, err
+	}
+	direction := "FOCUS_OUTWARD"
+	if pos < 0 {
+		direction = "FOCUS_INWARD"
+	}
+	if r.has("FOCUS_MOTION") {
+		if err := r.setSwitch("FOCUS_MOTION", direction); err != nil {
+			return nil, err
+		}
+	}
+	steps := math.Min(parseNumber(e.Max), math.Abs(float64(pos)))
+	return nil, r.setNumbers("REL_FOCUS_POSITION", map[string]float64{"FOCUS_RELATIVE_POSITION": steps})
+}
+
+func haltFocuser(r *request) (interface{}, error) {
+	return nil, r.setSwitch("FOCUS_ABORT_MOTION", "ABORT")
+}
+
+func setTempComp(r *request) (interface{}, error) {
+	on, err := r.boolParam("TempComp")
+	if err != nil {
+		return nil, err
+	}
+	if on {
+		return nil, newError(ErrNotImplemented, "temperature compensation is not available")
+	}
+	return nil, nil
+}
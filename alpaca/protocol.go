@@ -0,0 +1,233 @@
+package alpaca
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+
+	"github.com/indihub-space/agent/indiclient"
+)
+
+// Alpaca error numbers
+const (
+	ErrNotImplemented       = 0x400
+	ErrInvalidValue         = 0x401
+	ErrValueNotSet          = 0x402
+	ErrNotConnected         = 0x407
+	ErrInvalidWhileParked   = 0x408
+	ErrInvalidOperation     = 0x40B
+	ErrActionNotImplemented = 0x40C
+	ErrDriver               = 0x500
+)
+
+// Error is Alpaca error returned in response body with HTTP status 200
+type Error struct {
+	Number  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func newError(number int, format string, args ...interface{}) *Error {
+	return &Error{Number: number, Message: fmt.Sprintf(format, args...)}
+}
+
+// badRequest is returned with HTTP status 400 for requests which can't be processed at all
+type badRequest string
+
+func (e badRequest) Error() string {
+	return string(e)
+}
+
+// indiError converts INDI-client error to Alpaca error
+func indiError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch {
+	case errors.Is(err, indiclient.ErrBlocked):
+		return newError(ErrInvalidOperation, "command is blocked by safety supervisor: %s", err)
+	case errors.Is(err, indiclient.ErrUnknownProp):
+		return newError(ErrNotImplemented, "%s", err)
+	case errors.Is(err, indiclient.ErrClosed):
+		return newError(ErrNotConnected, "%s", err)
+	}
+	return newError(ErrDriver, "%s", err)
+}
+
+type method func(r *request) (interface{}, error)
+
+// methods of device type for GET and PUT requests
+type methods struct {
+	get map[string]method
+	put map[string]method
+}
+
+// request is Alpaca request to device
+type request struct {
+	c      echo.Context
+	dev    *device
+	client *indiclient.Client
+}
+
+// param returns request parameter, names are case insensitive in GET and case sensitive in PUT requests
+func (r *request) param(name string) (string, bool) {
+	if r.c.Request().Method != http.MethodPut {
+		for key, values := range r.c.QueryParams() {
+			if strings.EqualFold(key, name) && len(values) > 0 {
+				return values[0], true
+			}
+		}
+		return "", false
+	}
+
+	params, err := r.c.FormParams()
+	if err != nil {
+		return "", false
+	}
+	values, ok := params[name]
+	if !ok || len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+func (r *request) requiredParam(name string) (string, error) {
+	val, ok := r.param(name)
+	if !ok {
+		return "", badRequest(fmt.Sprintf("parameter '%s' is required", name))
+	}
+	return val, nil
+}
+
+func (r *request) floatParam(name string) (float64, error) {
+	val, err := r.requiredParam(name)
+	if err != nil {
+		return 0, err
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+	if err != nil {
+		return 0, badRequest(fmt.Sprintf("parameter '%s' is not a number: '%s'", name, val))
+	}
+	return f, nil
+}
+
+func (r *request) intParam(name string) (int, error) {
+	val, err := r.requiredParam(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(val))
+	if err != nil {
+		return 0, badRequest(fmt.Sprintf("parameter '%s' is not an integer: '%s'", name, val))
+	}
+	return n, nil
+}
+
+func (r *request) boolParam(name string) (bool, error) {
+	val, err := r.requiredParam(name)
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(val)) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, badRequest(fmt.Sprintf("parameter '%s' is not a boolean: '%s'", name, val))
+}
+
+// transactionID returns ClientTransactionID parameter, invalid values are treated as 0
+func transactionID(c echo.Context) uint32 {
+	values := c.QueryParams()
+	if c.Request().Method == http.MethodPut {
+		values, _ = c.FormParams()
+	}
+	for key, val := range values {
+		if strings.EqualFold(key, "ClientTransactionID") && len(val) > 0 {
+			if id, err := strconv.ParseUint(val[0], 10, 32); err == nil {
+				return uint32(id)
+			}
+		}
+	}
+	return 0
+}
+
+// respond writes Alpaca response, value is omitted for nil
+func (s *Server) respond(c echo.Context, value interface{}, err error) error {
+	if br, ok := err.(badRequest); ok {
+		return c.String(http.StatusBadRequest, string(br))
+	}
+
+	resp := map[string]interface{}{
+		"ClientTransactionID": transactionID(c),
+		"ServerTransactionID": s.nextServerTxID(),
+		"ErrorNumber":         0,
+		"ErrorMessage":        "",
+	}
+	if err != nil {
+		alpacaErr, ok := err.(*Error)
+		if !ok {
+			alpacaErr = newError(ErrDriver, "%s", err)
+		}
+		resp["ErrorNumber"] = alpacaErr.Number
+		resp["ErrorMessage"] = alpacaErr.Message
+	} else if value != nil {
+		resp["Value"] = value
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// handle dispatches device API request to method of device type
+func (s *Server) handle(c echo.Context) error {
+	typ := strings.ToLower(c.Param("device_type"))
+	ms, ok := deviceMethods[typ]
+	if !ok {
+		return c.String(http.StatusBadRequest, "unknown device type "+c.Param("device_type"))
+	}
+	number, err := strconv.Atoi(c.Param("device_number"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad device number "+c.Param("device_number"))
+	}
+
+	name := strings.ToLower(c.Param("method"))
+	fn, ok := ms.get[name]
+	if c.Request().Method == http.MethodPut {
+		fn, ok = ms.put[name]
+	}
+	if !ok {
+		return c.String(http.StatusBadRequest, "unknown method "+c.Param("method"))
+	}
+
+	s.refresh()
+	dev, ok := s.getDevice(typ, number)
+	if !ok {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("no %s device number %d", typ, number))
+	}
+
+	r := &request{
+		c:      c,
+		dev:    dev,
+		client: s.currentClient(),
+	}
+	if !disconnectedMethods[name] && !dev.isConnected(r.client) {
+		return s.respond(c, nil, newError(ErrNotConnected, "device %s is not connected", dev.name))
+	}
+
+	value, err := fn(r)
+	if raw, ok := value.(rawResponse); ok && err == nil {
+		return raw(c, transactionID(c), s.nextServerTxID())
+	}
+	return s.respond(c, value, err)
+}
+
+// rawResponse is returned by methods writing response on their own, i.e. image array
+type rawResponse func(c echo.Context, clientTxID uint32, serverTxID uint32) error
@@ -0,0 +1,337 @@
+package alpaca
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"github.com/indihub-space/agent/hostutils"
+	"github.com/indihub-space/agent/indiclient"
+	"github.com/indihub-space/agent/logutil"
+	"github.com/indihub-space/agent/version"
+)
+
+const (
+	TypeTelescope   = "telescope"
+	TypeCamera      = "camera"
+	TypeFocuser     = "focuser"
+	TypeFilterWheel = "filterwheel"
+	TypeDome        = "dome"
+
+	// DefaultAddr is Alpaca API address, Alpaca clients don't support authorization so only local clients are let in
+	DefaultAddr = "127.0.0.1:11111"
+
+	reconnectDelay = 10 * time.Second
+)
+
+// deviceTypeNames are device types as they are named in management API
+var deviceTypeNames = map[string]string{
+	TypeTelescope:   "Telescope",
+	TypeCamera:      "Camera",
+	TypeFocuser:     "Focuser",
+	TypeFilterWheel: "FilterWheel",
+	TypeDome:        "Dome",
+}
+
+// driverInterfaces are bits of INDI DRIVER_INFO.DRIVER_INTERFACE for device types
+var driverInterfaces = map[string]int{
+	TypeTelescope:   1 << 0,
+	TypeCamera:      1 << 1,
+	TypeFocuser:     1 << 3,
+	TypeFilterWheel: 1 << 4,
+	TypeDome:        1 << 5,
+}
+
+// typeProperties are used to detect device types when driver doesn't report its interfaces
+var typeProperties = map[string]string{
+	TypeTelescope:   "EQUATORIAL_EOD_COORD",
+	TypeCamera:      "CCD_EXPOSURE",
+	TypeFocuser:     "ABS_FOCUS_POSITION",
+	TypeFilterWheel: "FILTER_SLOT",
+	TypeDome:        "DOME_SHUTTER",
+}
+
+var logger = logutil.New("subsystem", "alpaca")
+
+// ConfiguredDevice is device description of management API
+type ConfiguredDevice struct {
+	DeviceName   string
+	DeviceType   string
+	DeviceNumber int
+	UniqueID     string
+}
+
+// Server is ASCOM Alpaca server bridging INDI devices,
+// devices are numbered per type in order they appear on INDI-server and keep their numbers
+type Server struct {
+	indiServerAddr string
+	filter         *hostutils.INDIFilter
+	sentHook       func(cmd []byte)
+	serverTxID     uint32
+
+	mu       sync.Mutex
+	client   *indiclient.Client
+	devices  map[string][]*device
+	listener net.Listener
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// NewServer creates Alpaca server, commands to INDI devices are checked with filter like guest commands
+func NewServer(indiServerAddr string, filter *hostutils.INDIFilter) *Server {
+	return &Server{
+		indiServerAddr: indiServerAddr,
+		filter:         filter,
+		devices:        map[string][]*device{},
+		stopCh:         make(chan struct{}),
+	}
+}
+
+// SetSentHook sets function called with every command sent to INDI-server, i.e. to write audit log
+func (s *Server) SetSentHook(fn func(cmd []byte)) {
+	s.sentHook = fn
+}
+
+// Run keeps connection to INDI-server until Stop is called
+func (s *Server) Run() {
+	for {
+		client, err := indiclient.Dial(s.indiServerAddr)
+		if err != nil {
+			logger.Errorf("could not connect to INDI-server: %s", err)
+		} else {
+			logger.Infof("Alpaca server is connected to INDI-server")
+			if s.filter != nil {
+				client.SetCommandFilter(s.filter.IsAllowed)
+			}
+			client.SetSentHook(s.sentHook)
+			unsubscribe := client.Subscribe(s.onMessage)
+			s.mu.Lock()
+			s.client = client
+			s.mu.Unlock()
+
+			select {
+			case <-s.stopCh:
+			case <-client.Done():
+				logger.Warnf("Alpaca server lost connection to INDI-server")
+			}
+
+			s.mu.Lock()
+			s.client = nil
+			s.mu.Unlock()
+			unsubscribe()
+			client.Close()
+		}
+
+		select {
+		case <-s.stopCh:
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// Listen starts Alpaca API on its own address, it is never served on API-server port
+// as Alpaca clients don't support authorization
+func (s *Server) Listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not start Alpaca API listener: %s", err)
+	}
+	logger.Infof("Alpaca API is listening on %s", l.Addr())
+
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+
+	e := echo.New()
+	e.HideBanner = true
+	s.register(e)
+	go func() {
+		if err := http.Serve(l, e); err != nil {
+			select {
+			case <-s.stopCh:
+			default:
+				logger.Errorf("Alpaca API error: %s", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops server
+func (s *Server) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.listener != nil {
+			s.listener.Close()
+		}
+	})
+}
+
+// Addr returns address Alpaca API is listening on, nil before Listen
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// register adds Alpaca device and management API routes
+func (s *Server) register(e *echo.Echo) {
+	e.GET("/management/apiversions", s.getAPIVersions)
+	e.GET("/management/v1/description", s.getDescription)
+	e.GET("/management/v1/configureddevices", s.getConfiguredDevices)
+
+	e.GET("/api/v1/:device_type/:device_number/:method", s.handle)
+	e.PUT("/api/v1/:device_type/:device_number/:method", s.handle)
+}
+
+// GetStatus returns Alpaca devices to be shown in agent status
+func (s *Server) GetStatus() map[string]interface{} {
+	s.mu.Lock()
+	connected := s.client != nil
+	s.mu.Unlock()
+
+	status := map[string]interface{}{
+		"indiConnected": connected,
+		"devices":       s.ConfiguredDevices(),
+	}
+	if addr := s.Addr(); addr != nil {
+		status["addr"] = addr.String()
+	}
+	return status
+}
+
+// ConfiguredDevices returns all devices known so far
+func (s *Server) ConfiguredDevices() []ConfiguredDevice {
+	s.refresh()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := []ConfiguredDevice{}
+	for _, typ := range []string{TypeTelescope, TypeCamera, TypeFocuser, TypeFilterWheel, TypeDome} {
+		for _, d := range s.devices[typ] {
+			list = append(list, ConfiguredDevice{
+				DeviceName:   d.name,
+				DeviceType:   deviceTypeNames[typ],
+				DeviceNumber: d.number,
+				UniqueID:     d.uniqueID,
+			})
+		}
+	}
+	return list
+}
+
+func (s *Server) currentClient() *indiclient.Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.client
+}
+
+func (s *Server) nextServerTxID() uint32 {
+	return atomic.AddUint32(&s.serverTxID, 1)
+}
+
+// refresh registers new INDI devices
+func (s *Server) refresh() {
+	client := s.currentClient()
+	if client == nil {
+		return
+	}
+
+	for _, name := range client.Devices() {
+		for typ := range deviceTypeNames {
+			if !isDeviceType(client, name, typ) {
+				continue
+			}
+			s.mu.Lock()
+			if s.findDevice(typ, name) == nil {
+				d := newDevice(s, typ, len(s.devices[typ]), name)
+				s.devices[typ] = append(s.devices[typ], d)
+				logger.Infof("INDI device '%s' is available as Alpaca %s %d", name, deviceTypeNames[typ], d.number)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Server) findDevice(typ string, name string) *device {
+	for _, d := range s.devices[typ] {
+		if d.name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+func (s *Server) getDevice(typ string, number int) (*device, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if number < 0 || number >= len(s.devices[typ]) {
+		return nil, false
+	}
+	return s.devices[typ][number], true
+}
+
+// onMessage passes images to cameras waiting for them
+func (s *Server) onMessage(msg *indiclient.Message) {
+	if msg.Tag != "setBLOBVector" || msg.Vector == nil {
+		return
+	}
+
+	s.mu.Lock()
+	cam := s.findDevice(TypeCamera, msg.Device)
+	s.mu.Unlock()
+	if cam != nil {
+		cam.onBLOB(msg.Vector)
+	}
+}
+
+func isDeviceType(client *indiclient.Client, name string, typ string) bool {
+	if v, ok := client.Property(name, "DRIVER_INFO"); ok {
+		if e, ok := v.Element("DRIVER_INTERFACE"); ok {
+			if bits, err := strconv.Atoi(e.Value); err == nil {
+				return bits&driverInterfaces[typ] != 0
+			}
+		}
+	}
+	return client.HasProperty(name, typeProperties[typ])
+}
+
+// uniqueID returns stable UUID-like ID of device
+func uniqueID(typ string, name string) string {
+	h := sha1.Sum([]byte("indihub-alpaca/" + typ + "/" + name))
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+func (s *Server) getAPIVersions(c echo.Context) error {
+	return s.respond(c, []int{1}, nil)
+}
+
+func (s *Server) getDescription(c echo.Context) error {
+	return s.respond(c, map[string]interface{}{
+		"ServerName":          "INDIHUB Agent",
+		"Manufacturer":        "INDIHUB",
+		"ManufacturerVersion": version.AgentVersion,
+		"Location":            "",
+	}, nil)
+}
+
+func (s *Server) getConfiguredDevices(c echo.Context) error {
+	return s.respond(c, s.ConfiguredDevices(), nil)
+}
@@ -0,0 +1,311 @@
+package alpaca
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/indihub-space/agent/hostutils"
+)
+
+const testDefs = `<defSwitchVector device="Mount" name="CONNECTION" state="Ok" perm="rw" rule="OneOfMany">
+<defSwitch name="CONNECT">On</defSwitch>
+<defSwitch name="DISCONNECT">Off</defSwitch>
+</defSwitchVector>
+<defNumberVector device="Mount" name="EQUATORIAL_EOD_COORD" state="Ok" perm="rw">
+<defNumber name="RA" format="%m" min="0" max="24" step="0">5.5</defNumber>
+<defNumber name="DEC" format="%m" min="-90" max="90" step="0">-10</defNumber>
+</defNumberVector>
+<defSwitchVector device="Mount" name="ON_COORD_SET" state="Ok" perm="rw" rule="OneOfMany">
+<defSwitch name="TRACK">On</defSwitch>
+<defSwitch name="SLEW">Off</defSwitch>
+<defSwitch name="SYNC">Off</defSwitch>
+</defSwitchVector>
+<defSwitchVector device="Mount" name="TELESCOPE_PARK" state="Ok" perm="rw" rule="OneOfMany">
+<defSwitch name="PARK">Off</defSwitch>
+<defSwitch name="UNPARK">On</defSwitch>
+</defSwitchVector>
+<defSwitchVector device="Mount" name="TELESCOPE_ABORT_MOTION" state="Idle" perm="rw" rule="AtMostOne">
+<defSwitch name="ABORT">Off</defSwitch>
+</defSwitchVector>
+<defNumberVector device="Focuser" name="ABS_FOCUS_POSITION" state="Ok" perm="rw">
+<defNumber name="FOCUS_ABSOLUTE_POSITION" format="%.0f" min="0" max="1000" step="1">300</defNumber>
+</defNumberVector>
+`
+
+// fakeINDIServer answers getProperties with defs and keeps everything it receives
+type fakeINDIServer struct {
+	l net.Listener
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	received strings.Builder
+}
+
+func newFakeINDIServer(t *testing.T) *fakeINDIServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeINDIServer{l: l}
+	go s.accept()
+	return s
+}
+
+func (s *fakeINDIServer) accept() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, c)
+		s.mu.Unlock()
+		go s.serve(c)
+	}
+}
+
+func (s *fakeINDIServer) serve(c net.Conn) {
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.received.WriteString(line)
+		s.mu.Unlock()
+
+		if strings.HasPrefix(line, "<getProperties") {
+			c.Write([]byte(testDefs))
+		}
+	}
+}
+
+func (s *fakeINDIServer) data() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received.String()
+}
+
+// waitData waits until INDI-server receives all parts
+func (s *fakeINDIServer) waitData(t *testing.T, parts ...string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		data := s.data()
+		received := true
+		for _, part := range parts {
+			received = received && strings.Contains(data, part)
+		}
+		if received {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("INDI-server didn't receive %q, got: %s", parts, data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *fakeINDIServer) close() {
+	s.l.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+type response struct {
+	ClientTransactionID uint32
+	ServerTransactionID uint32
+	ErrorNumber         int
+	ErrorMessage        string
+	Value               json.RawMessage
+}
+
+// startServer starts Alpaca server on random local port and waits until INDI devices are known
+func startServer(t *testing.T, filter *hostutils.INDIFilter) (*fakeINDIServer, string, func()) {
+	server := newFakeINDIServer(t)
+	s := NewServer(server.l.Addr().String(), filter)
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Run()
+		close(done)
+	}()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for len(s.ConfiguredDevices()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("INDI devices are not configured: %v", s.ConfiguredDevices())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return server, "http://" + s.Addr().String(), func() {
+		s.Stop()
+		<-done
+		server.close()
+	}
+}
+
+func call(t *testing.T, method string, u string, params url.Values) (int, response) {
+	t.Helper()
+	var req *http.Request
+	var err error
+	if method == http.MethodPut {
+		req, err = http.NewRequest(method, u, strings.NewReader(params.Encode()))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest(method, u+"?"+params.Encode(), nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	r := response{}
+	if resp.StatusCode == http.StatusOK {
+		if err := json.Unmarshal(body, &r); err != nil {
+			t.Fatalf("bad response %s: %s", body, err)
+		}
+	}
+	return resp.StatusCode, r
+}
+
+func TestConfiguredDevices(t *testing.T) {
+	_, base, stop := startServer(t, nil)
+	defer stop()
+
+	status, resp := call(t, http.MethodGet, base+"/management/v1/configureddevices", url.Values{"ClientTransactionID": {"7"}})
+	if status != http.StatusOK || resp.ClientTransactionID != 7 || resp.ServerTransactionID == 0 {
+		t.Fatalf("unexpected response %d: %+v", status, resp)
+	}
+	devices := []ConfiguredDevice{}
+	if err := json.Unmarshal(resp.Value, &devices); err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 ||
+		devices[0].DeviceName != "Mount" || devices[0].DeviceType != "Telescope" || devices[0].DeviceNumber != 0 ||
+		devices[1].DeviceName != "Focuser" || devices[1].DeviceType != "Focuser" {
+		t.Fatalf("unexpected devices: %+v", devices)
+	}
+}
+
+func TestTelescopeCalls(t *testing.T) {
+	server, base, stop := startServer(t, nil)
+	defer stop()
+	telescope := base + "/api/v1/telescope/0/"
+
+	// parameters of GET requests are case insensitive
+	_, resp := call(t, http.MethodGet, telescope+"rightascension", url.Values{"clienttransactionid": {"3"}})
+	if resp.ErrorNumber != 0 || string(resp.Value) != "5.5" || resp.ClientTransactionID != 3 {
+		t.Fatalf("unexpected right ascension response: %+v", resp)
+	}
+	_, resp = call(t, http.MethodGet, telescope+"connected", nil)
+	if string(resp.Value) != "true" {
+		t.Fatalf("telescope is not connected: %+v", resp)
+	}
+	_, resp = call(t, http.MethodGet, telescope+"canslewasync", nil)
+	if string(resp.Value) != "true" {
+		t.Fatalf("telescope can't slew: %+v", resp)
+	}
+
+	_, resp = call(t, http.MethodPut, telescope+"slewtocoordinatesasync", url.Values{"RightAscension": {"7.25"}, "Declination": {"20"}})
+	if resp.ErrorNumber != 0 {
+		t.Fatalf("slew failed: %+v", resp)
+	}
+	server.waitData(t,
+		`<newSwitchVector device="Mount" name="ON_COORD_SET"`,
+		`<newNumberVector device="Mount" name="EQUATORIAL_EOD_COORD"`,
+		`<oneNumber name="RA">7.25</oneNumber>`,
+		`<oneNumber name="DEC">20</oneNumber>`,
+	)
+	_, resp = call(t, http.MethodGet, telescope+"targetrightascension", nil)
+	if string(resp.Value) != "7.25" {
+		t.Fatalf("target is not set by slew: %+v", resp)
+	}
+
+	_, resp = call(t, http.MethodPut, telescope+"abortslew", nil)
+	if resp.ErrorNumber != 0 {
+		t.Fatalf("abort failed: %+v", resp)
+	}
+	server.waitData(t, `<newSwitchVector device="Mount" name="TELESCOPE_ABORT_MOTION"`)
+}
+
+func TestFocuserMoveIsClamped(t *testing.T) {
+	server, base, stop := startServer(t, nil)
+	defer stop()
+
+	_, resp := call(t, http.MethodGet, base+"/api/v1/focuser/0/position", nil)
+	if string(resp.Value) != "300" {
+		t.Fatalf("unexpected focuser position: %+v", resp)
+	}
+	_, resp = call(t, http.MethodPut, base+"/api/v1/focuser/0/move", url.Values{"Position": {"5000"}})
+	if resp.ErrorNumber != 0 {
+		t.Fatalf("move failed: %+v", resp)
+	}
+	server.waitData(t, `<oneNumber name="FOCUS_ABSOLUTE_POSITION">1000</oneNumber>`)
+}
+
+func TestBadRequests(t *testing.T) {
+	_, base, stop := startServer(t, nil)
+	defer stop()
+	telescope := base + "/api/v1/telescope/0/"
+
+	for _, c := range []struct {
+		method string
+		path   string
+		params url.Values
+		status int
+		errNum int
+	}{
+		{http.MethodGet, base + "/api/v1/telescope/1/rightascension", nil, http.StatusBadRequest, 0},
+		{http.MethodGet, base + "/api/v1/rotator/0/position", nil, http.StatusBadRequest, 0},
+		{http.MethodGet, telescope + "nosuchmethod", nil, http.StatusBadRequest, 0},
+		// parameters of PUT requests are case sensitive
+		{http.MethodPut, telescope + "slewtocoordinatesasync", url.Values{"rightascension": {"1"}, "declination": {"2"}}, http.StatusBadRequest, 0},
+		{http.MethodPut, telescope + "slewtocoordinatesasync", url.Values{"RightAscension": {"x"}, "Declination": {"2"}}, http.StatusBadRequest, 0},
+		{http.MethodPut, telescope + "slewtocoordinatesasync", url.Values{"RightAscension": {"25"}, "Declination": {"2"}}, http.StatusOK, ErrInvalidValue},
+		{http.MethodPut, telescope + "slewtotargetasync", nil, http.StatusOK, ErrValueNotSet},
+		{http.MethodPut, telescope + "moveaxis", nil, http.StatusOK, ErrNotImplemented},
+	} {
+		status, resp := call(t, c.method, c.path, c.params)
+		if status != c.status || resp.ErrorNumber != c.errNum {
+			t.Errorf("%s %s %v: expected %d with error %#x, got %d: %+v", c.method, c.path, c.params, c.status, c.errNum, status, resp)
+		}
+	}
+}
+
+func TestBlockedSlew(t *testing.T) {
+	filter := hostutils.NewINDIFilter(&hostutils.INDIFilterConfig{})
+	filter.Block(hostutils.BlockSafety, "roof is closed")
+	server, base, stop := startServer(t, filter)
+	defer stop()
+
+	_, resp := call(t, http.MethodPut, base+"/api/v1/telescope/0/slewtocoordinatesasync", url.Values{"RightAscension": {"7.25"}, "Declination": {"20"}})
+	if resp.ErrorNumber != ErrInvalidOperation {
+		t.Fatalf("blocked slew is not rejected: %+v", resp)
+	}
+	if data := server.data(); strings.Contains(data, "<newNumberVector") {
+		t.Fatalf("blocked slew is sent to INDI-server: %s", data)
+	}
+}
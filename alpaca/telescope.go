@@ -0,0 +1,448 @@
+package alpaca
+
+import (
+	"math"
+	"time"
+
+	"github.com/indihub-space/agent/astro"
+)
+
+const (
+	slewTimeout = 180 * time.Second
+	parkTimeout = 180 * time.Second
+
+	pierEast = 0
+	pierWest = 1
+
+	equTopocentric = 1
+	driveSidereal  = 0
+)
+
+type telescopeState struct {
+	targetRA   *float64
+	targetDec  *float64
+	settleTime float64
+}
+
+var telescopeMethods = methods{
+	get: map[string]method{
+		"alignmentmode":            notImplemented,
+		"altitude":                 getAltAz(0),
+		"aperturearea":             getAperture(true),
+		"aperturediameter":         getAperture(false),
+		"athome":                   constant(false),
+		"atpark":                   getAtPark,
+		"azimuth":                  getAltAz(1),
+		"axisrates":                constant([]interface{}{}),
+		"canfindhome":              constant(false),
+		"canmoveaxis":              constant(false),
+		"canpark":                  canProperty("TELESCOPE_PARK"),
+		"canpulseguide":            constant(false),
+		"cansetdeclinationrate":    constant(false),
+		"cansetguiderates":         constant(false),
+		"cansetpark":               constant(false),
+		"cansetpierside":           constant(false),
+		"cansetrightascensionrate": constant(false),
+		"cansettracking":           canProperty("TELESCOPE_TRACK_STATE"),
+		"canslew":                  canProperty("EQUATORIAL_EOD_COORD"),
+		"canslewaltaz":             constant(false),
+		"canslewaltazasync":        constant(false),
+		"canslewasync":             canProperty("EQUATORIAL_EOD_COORD"),
+		"cansync":                  canSync,
+		"cansyncaltaz":             constant(false),
+		"canunpark":                canProperty("TELESCOPE_PARK"),
+		"declination":              getCoord("DEC"),
+		"declinationrate":          constant(0.0),
+		"destinationsideofpier":    notImplemented,
+		"doesrefraction":           notImplemented,
+		"equatorialsystem":         constant(equTopocentric),
+		"focallength":              getFocalLength,
+		"guideratedeclination":     notImplemented,
+		"guideraterightascension":  notImplemented,
+		"ispulseguiding":           constant(false),
+		"rightascension":           getCoord("RA"),
+		"rightascensionrate":       constant(0.0),
+		"sideofpier":               getSideOfPier,
+		"siderealtime":             getSiderealTime,
+		"siteelevation":            getSite("ELEV"),
+		"sitelatitude":             getSite("LAT"),
+		"sitelongitude":            getSiteLongitude,
+		"slewing":                  getSlewing,
+		"slewsettletime":           getSettleTime,
+		"targetdeclination":        getTarget(false),
+		"targetrightascension":     getTarget(true),
+		"tracking":                 getTracking,
+		"trackingrate":             constant(driveSidereal),
+		"trackingrates":            constant([]int{driveSidereal}),
+		"utcdate":                  getUTCDate,
+	},
+	put: map[string]method{
+		"abortslew":               abortSlew,
+		"declinationrate":         notImplemented,
+		"doesrefraction":          notImplemented,
+		"findhome":                notImplemented,
+		"guideratedeclination":    notImplemented,
+		"guideraterightascension": notImplemented,
+		"moveaxis":                notImplemented,
+		"park":                    park,
+		"pulseguide":              notImplemented,
+		"rightascensionrate":      notImplemented,
+		"setpark":                 notImplemented,
+		"sideofpier":              notImplemented,
+		"siteelevation":           setSite("SiteElevation", "ELEV", -300, 10000),
+		"sitelatitude":            setSite("SiteLatitude", "LAT", -90, 90),
+		"sitelongitude":           setSite("SiteLongitude", "LONG", -180, 180),
+		"slewsettletime":          setSettleTime,
+		"slewtoaltaz":             notImplemented,
+		"slewtoaltazasync":        notImplemented,
+		"slewtocoordinates":       slewToCoordinates(false, true),
+		"slewtocoordinatesasync":  slewToCoordinates(false, false),
+		"slewtotarget":            slewToCoordinates(true, true),
+		"slewtotargetasync":       slewToCoordinates(true, false),
+		"synctoaltaz":             notImplemented,
+		"synctocoordinates":       syncToCoordinates(false),
+		"synctotarget":            syncToCoordinates(true),
+		"targetdeclination":       setTarget("TargetDeclination", false),
+		"targetrightascension":    setTarget("TargetRightAscension", true),
+		"tracking":                setTracking,
+		"trackingrate":            setTrackingRate,
+		"unpark":                  unpark,
+		"utcdate":                 notImplemented,
+	},
+}
+
+func canProperty(prop string) method {
+	return func(r *request) (interface{}, error) {
+		v, ok := r.client.Property(r.dev.name, prop)
+		return ok && v.Perm != "ro", nil
+	}
+}
+
+func canSync(r *request) (interface{}, error) {
+	_, err := r.element("ON_COORD_SET", "SYNC")
+	return err == nil, nil
+}
+
+func getCoord(name string) method {
+	return func(r *request) (interface{}, error) {
+		return r.number("EQUATORIAL_EOD_COORD", name)
+	}
+}
+
+func getAltAz(index int) method {
+	return func(r *request) (interface{}, error) {
+		if r.has("HORIZONTAL_COORD") {
+			name := []string{"ALT", "AZ"}[index]
+			return r.number("HORIZONTAL_COORD", name)
+		}
+
+		ra, err := r.number("EQUATORIAL_EOD_COORD", "RA")
+		if err != nil {
+			return nil, err
+		}
+		dec, err := r.number("EQUATORIAL_EOD_COORD", "DEC")
+		if err != nil {
+			return nil, err
+		}
+		lat, err := r.number("GEOGRAPHIC_COORD", "LAT")
+		if err != nil {
+			return nil, err
+		}
+		long, err := r.number("GEOGRAPHIC_COORD", "LONG")
+		if err != nil {
+			return nil, err
+		}
+		alt, az := astro.Horizontal(ra, dec, lat, astro.SiderealTime(time.Now(), long))
+		return []float64{alt, az}[index], nil
+	}
+}
+
+// getAperture returns aperture area in m² or diameter in m
+func getAperture(area bool) method {
+	return func(r *request) (interface{}, error) {
+		mm, err := r.number("TELESCOPE_INFO", "TELESCOPE_APERTURE")
+		if err != nil {
+			return nil, err
+		}
+		if area {
+			return math.Pi * math.Pow(mm/2000, 2), nil
+		}
+		return mm / 1000, nil
+	}
+}
+
+func getFocalLength(r *request) (interface{}, error) {
+	mm, err := r.number("TELESCOPE_INFO", "TELESCOPE_FOCAL_LENGTH")
+	if err != nil {
+		return nil, err
+	}
+	return mm / 1000, nil
+}
+
+func getAtPark(r *request) (interface{}, error) {
+	return r.isOn("TELESCOPE_PARK", "PARK"), nil
+}
+
+func getSideOfPier(r *request) (interface{}, error) {
+	if _, err := r.property("TELESCOPE_PIER_SIDE"); err != nil {
+		return nil, err
+	}
+	if r.isOn("TELESCOPE_PIER_SIDE", "PIER_WEST") {
+		return pierWest, nil
+	}
+	return pierEast, nil
+}
+
+func getSiderealTime(r *request) (interface{}, error) {
+	long, err := r.number("GEOGRAPHIC_COORD", "LONG")
+	if err != nil {
+		return nil, err
+	}
+	return astro.SiderealTime(time.Now(), long), nil
+}
+
+func getSite(name string) method {
+	return func(r *request) (interface{}, error) {
+		return r.number("GEOGRAPHIC_COORD", name)
+	}
+}
+
+// getSiteLongitude converts INDI longitude 0..360 to -180..180
+func getSiteLongitude(r *request) (interface{}, error) {
+	long, err := r.number("GEOGRAPHIC_COORD", "LONG")
+	if err != nil {
+		return nil, err
+	}
+	if long > 180 {
+		long -= 360
+	}
+	return long, nil
+}
+
+func setSite(param string, name string, min float64, max float64) method {
+	return func(r *request) (interface{}, error) {
+		val, err := r.floatParam(param)
+		if err != nil {
+			return nil, err
+		}
+		if val < min || val > max {
+			return nil, newError(ErrInvalidValue, "%s must be in range %g..%g", param, min, max)
+		}
+		if name == "LONG" && val < 0 {
+			val += 360
+		}
+		return nil, r.setNumbers("GEOGRAPHIC_COORD", map[string]float64{name: val})
+	}
+}
+
+func getSlewing(r *request) (interface{}, error) {
+	return r.isBusy("EQUATORIAL_EOD_COORD", "TELESCOPE_PARK", "TELESCOPE_MOTION_NS", "TELESCOPE_MOTION_WE"), nil
+}
+
+func getSettleTime(r *request) (interface{}, error) {
+	r.dev.mu.Lock()
+	defer r.dev.mu.Unlock()
+	return r.dev.scope.settleTime, nil
+}
+
+func setSettleTime(r *request) (interface{}, error) {
+	val, err := r.floatParam("SlewSettleTime")
+	if err != nil {
+		return nil, err
+	}
+	if val < 0 {
+		return nil, newError(ErrInvalidValue, "SlewSettleTime can't be negative")
+	}
+	r.dev.mu.Lock()
+	r.dev.scope.settleTime = val
+	r.dev.mu.Unlock()
+	return nil, nil
+}
+
+func getTarget(ra bool) method {
+	return func(r *request) (interface{}, error) {
+		r.dev.mu.Lock()
+		defer r.dev.mu.Unlock()
+
+		target := r.dev.scope.targetDec
+		if ra {
+			target = r.dev.scope.targetRA
+		}
+		if target == nil {
+			return nil, newError(ErrValueNotSet, "target is not set")
+		}
+		return *target, nil
+	}
+}
+
+func setTarget(param string, ra bool) method {
+	return func(r *request) (interface{}, error) {
+		val, err := r.floatParam(param)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkCoords(val, 0, ra, !ra); err != nil {
+			return nil, err
+		}
+
+		r.dev.mu.Lock()
+		defer r.dev.mu.Unlock()
+		if ra {
+			r.dev.scope.targetRA = &val
+		} else {
+			r.dev.scope.targetDec = &val
+		}
+		return nil, nil
+	}
+}
+
+func checkCoords(ra float64, dec float64, checkRA bool, checkDec bool) error {
+	if checkRA && (ra < 0 || ra > 24) {
+		return newError(ErrInvalidValue, "right ascension must be in range 0..24")
+	}
+	if checkDec && (dec < -90 || dec > 90) {
+		return newError(ErrInvalidValue, "declination must be in range -90..90")
+	}
+	return nil
+}
+
+// coordinates returns coordinates from request parameters or target
+func coordinates(r *request, fromTarget bool) (float64, float64, error) {
+	if fromTarget {
+		r.dev.mu.Lock()
+		defer r.dev.mu.Unlock()
+		if r.dev.scope.targetRA == nil || r.dev.scope.targetDec == nil {
+			return 0, 0, newError(ErrValueNotSet, "target is not set")
+		}
+		return *r.dev.scope.targetRA, *r.dev.scope.targetDec, nil
+	}
+
+	ra, err := r.floatParam("RightAscension")
+	if err != nil {
+		return 0, 0, err
+	}
+	dec, err := r.floatParam("Declination")
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := checkCoords(ra, dec, true, true); err != nil {
+		return 0, 0, err
+	}
+
+	r.dev.mu.Lock()
+	r.dev.scope.targetRA = &ra
+	r.dev.scope.targetDec = &dec
+	r.dev.mu.Unlock()
+	return ra, dec, nil
+}
+
+// gotoCoordinates sets action on coordinates set (TRACK, SLEW or SYNC) and sends coordinates
+func gotoCoordinates(r *request, action string, ra float64, dec float64) error {
+	if r.isOn("TELESCOPE_PARK", "PARK") {
+		return newError(ErrInvalidWhileParked, "%s is parked", r.dev.name)
+	}
+	if action == "TRACK" {
+		if _, err := r.element("ON_COORD_SET", "TRACK"); err != nil {
+			action = "SLEW"
+		}
+	}
+	if _, err := r.element("ON_COORD_SET", action); err == nil {
+		if err := r.setSwitch("ON_COORD_SET", action); err != nil {
+			return err
+		}
+	} else if action == "SYNC" {
+		return newError(ErrNotImplemented, "%s can't sync", r.dev.name)
+	}
+	return r.setNumbers("EQUATORIAL_EOD_COORD", map[string]float64{"RA": ra, "DEC": dec})
+}
+
+func slewToCoordinates(fromTarget bool, wait bool) method {
+	return func(r *request) (interface{}, error) {
+		ra, dec, err := coordinates(r, fromTarget)
+		if err != nil {
+			return nil, err
+		}
+		if err := gotoCoordinates(r, "TRACK", ra, dec); err != nil {
+			return nil, err
+		}
+		if !wait {
+			return nil, nil
+		}
+		if err := r.waitNotBusy("EQUATORIAL_EOD_COORD", slewTimeout); err != nil {
+			return nil, err
+		}
+
+		r.dev.mu.Lock()
+		settle := r.dev.scope.settleTime
+		r.dev.mu.Unlock()
+		time.Sleep(time.Duration(settle * float64(time.Second)))
+		return nil, nil
+	}
+}
+
+func syncToCoordinates(fromTarget bool) method {
+	return func(r *request) (interface{}, error) {
+		ra, dec, err := coordinates(r, fromTarget)
+		if err != nil {
+			return nil, err
+		}
+		if err := gotoCoordinates(r, "SYNC", ra, dec); err != nil {
+			return nil, err
+		}
+		return nil, r.waitNotBusy("EQUATORIAL_EOD_COORD", slewTimeout)
+	}
+}
+
+func abortSlew(r *request) (interface{}, error) {
+	if r.isOn("TELESCOPE_PARK", "PARK") {
+		return nil, newError(ErrInvalidWhileParked, "%s is parked", r.dev.name)
+	}
+	return nil, r.setSwitch("TELESCOPE_ABORT_MOTION", "ABORT")
+}
+
+func park(r *request) (interface{}, error) {
+	if r.isOn("TELESCOPE_PARK", "PARK") {
+		return nil, nil
+	}
+	return nil, r.setSwitchAndWait("TELESCOPE_PARK", "PARK", parkTimeout)
+}
+
+func unpark(r *request) (interface{}, error) {
+	if !r.isOn("TELESCOPE_PARK", "PARK") {
+		return nil, nil
+	}
+	return nil, r.setSwitchAndWait("TELESCOPE_PARK", "UNPARK", parkTimeout)
+}
+
+func getTracking(r *request) (interface{}, error) {
+	return r.isOn("TELESCOPE_TRACK_STATE", "TRACK_ON"), nil
+}
+
+func setTracking(r *request) (interface{}, error) {
+	on, err := r.boolParam("Tracking")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.property("TELESCOPE_TRACK_STATE"); err != nil {
+		return nil, err
+	}
+	if on {
+		return nil, r.setSwitch("TELESCOPE_TRACK_STATE", "TRACK_ON")
+	}
+	return nil, r.setSwitch("TELESCOPE_TRACK_STATE", "TRACK_OFF")
+}
+
+func setTrackingRate(r *request) (interface{}, error) {
+	rate, err := r.intParam("TrackingRate")
+	if err != nil {
+		return nil, err
+	}
+	if rate != driveSidereal {
+		return nil, newError(ErrInvalidValue, "only sidereal tracking rate is supported")
+	}
+	return nil, nil
+}
+
+func getUTCDate(r *request) (interface{}, error) {
+	return time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), nil
+}
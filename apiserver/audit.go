@@ -0,0 +1,137 @@
+package apiserver
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"github.com/indihub-space/agent/audit"
+	"github.com/indihub-space/agent/journal"
+)
+
+const defaultAuditLimit = 100
+
+// auditCommand records command sent to INDI-server by API client
+func (s *APIServer) auditCommand(source string, client string, el []byte) {
+	if s.audit == nil {
+		return
+	}
+	s.audit.Record(
+		audit.Entry{
+			Source:    source,
+			Client:    client,
+			Token:     audit.TokenID(s.token),
+			Mode:      s.CurrentMode(),
+			SessionID: s.currentSessionID(),
+			Decision:  audit.Allowed,
+		},
+		el,
+	)
+}
+
+// AuditHook returns function writing commands sent to INDI-server by other agent services to audit log
+func (s *APIServer) AuditHook(source string, client string) func(cmd []byte) {
+	return func(cmd []byte) {
+		if s.audit == nil {
+			return
+		}
+		s.audit.Record(
+			audit.Entry{
+				Source:    source,
+				Client:    client,
+				Mode:      s.CurrentMode(),
+				SessionID: s.currentSessionID(),
+				Decision:  audit.Allowed,
+			},
+			cmd,
+		)
+	}
+}
+
+// currentSessionID returns INDIHUB session ID of running mode if it is known from journal
+func (s *APIServer) currentSessionID() uint64 {
+	if s.journal == nil {
+		return 0
+	}
+	for _, rec := range s.journal.Records() {
+		if rec.Status == journal.StatusRunning {
+			return rec.SessionID
+		}
+	}
+	return 0
+}
+
+func (s *APIServer) getAudit(c echo.Context) error {
+	q := audit.Query{
+		Source:   c.QueryParam("source"),
+		Client:   c.QueryParam("client"),
+		Mode:     c.QueryParam("mode"),
+		Device:   c.QueryParam("device"),
+		Property: c.QueryParam("property"),
+		Decision: c.QueryParam("decision"),
+		Limit:    defaultAuditLimit,
+	}
+
+	var err error
+	badParam := func(name string) error {
+		c.JSON(
+			http.StatusBadRequest,
+			map[string]interface{}{
+				"message": "bad " + name + " value: " + err.Error(),
+			},
+		)
+		return nil
+	}
+	if val := c.QueryParam("from"); val != "" {
+		if q.From, err = time.Parse(time.RFC3339, val); err != nil {
+			return badParam("from")
+		}
+	}
+	if val := c.QueryParam("to"); val != "" {
+		if q.To, err = time.Parse(time.RFC3339, val); err != nil {
+			return badParam("to")
+		}
+	}
+	if val := c.QueryParam("session"); val != "" {
+		if q.SessionID, err = strconv.ParseUint(val, 10, 64); err != nil {
+			return badParam("session")
+		}
+	}
+	if val := c.QueryParam("limit"); val != "" {
+		if q.Limit, err = strconv.Atoi(val); err != nil {
+			return badParam("limit")
+		}
+	}
+
+	entries, err := s.audit.Query(q)
+	if err != nil {
+		c.JSON(
+			http.StatusInternalServerError,
+			map[string]interface{}{
+				"message": err.Error(),
+			},
+		)
+		return nil
+	}
+
+	c.JSONPretty(http.StatusOK, entries, "    ")
+
+	return nil
+}
+
+func (s *APIServer) verifyAudit(c echo.Context) error {
+	count, err := s.audit.Verify()
+	res := map[string]interface{}{
+		"ok":      err == nil,
+		"entries": count,
+	}
+	if err != nil {
+		res["message"] = err.Error()
+	}
+
+	c.JSONPretty(http.StatusOK, res, "    ")
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package apiserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/indihub-space/agent/lib"
+)
+
+// BLOBs are sent as binary WS-frames when "blobs=binary" query parameter is set
+const blobsBinary = "binary"
+
+var (
+	oneBLOBStart = []byte("<oneBLOB")
+	oneBLOBEnd   = []byte("</oneBLOB>")
+)
+
+// BLOBHeader is sent as JSON-frame {"blob": {...}} before binary frame with BLOB data
+type BLOBHeader struct {
+	Device    string `json:"device"`
+	Property  string `json:"property"`
+	Element   string `json:"element"`
+	Format    string `json:"format"`
+	Size      int    `json:"size"` // length of data in the following binary frame
+	State     string `json:"state,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"`
+}
+
+// writeBLOBFrames writes every BLOB of setBLOBVector, base64 data is decoded while it is written to WS
+func writeBLOBFrames(ws *websocket.Conn, el []byte) error {
+	header := BLOBHeader{
+		Device:    lib.ElementAttr(el, "device"),
+		Property:  lib.ElementAttr(el, "name"),
+		State:     lib.ElementAttr(el, "state"),
+		Timestamp: lib.ElementAttr(el, "timestamp"),
+	}
+
+	rest := el
+	for {
+		n := bytes.Index(rest, oneBLOBStart)
+		if n == -1 {
+			return nil
+		}
+		rest = rest[n:]
+		tagEnd := bytes.IndexByte(rest, '>')
+		if tagEnd == -1 {
+			return nil
+		}
+
+		var data []byte
+		startTag := rest[:tagEnd+1]
+		if rest[tagEnd-1] == '/' {
+			// empty BLOB
+			rest = rest[tagEnd+1:]
+		} else {
+			end := bytes.Index(rest, oneBLOBEnd)
+			if end == -1 {
+				return nil
+			}
+			data = rest[tagEnd+1 : end]
+			rest = rest[end+len(oneBLOBEnd):]
+		}
+
+		header.Element = lib.ElementAttr(startTag, "name")
+		header.Format = lib.ElementAttr(startTag, "format")
+		header.Size = decodedLen(data)
+		headerJSON, err := json.Marshal(map[string]interface{}{"blob": header})
+		if err != nil {
+			return err
+		}
+		if err := ws.WriteMessage(websocket.TextMessage, headerJSON); err != nil {
+			return err
+		}
+
+		w, err := ws.NextWriter(websocket.BinaryMessage)
+		if err != nil {
+			return err
+		}
+		written, err := io.Copy(w, base64.NewDecoder(base64.StdEncoding, bytes.NewReader(data)))
+		if err != nil {
+			// frame is still closed, so client gets less data than announced in header
+			logger.Errorf("could not decode BLOB %s.%s.%s: %s", header.Device, header.Property, header.Element, err)
+		} else if int(written) != header.Size {
+			logger.Errorf("BLOB %s.%s.%s size is %d, %d was expected", header.Device, header.Property,
+				header.Element, written, header.Size)
+		}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("could not write BLOB: %w", err)
+		}
+	}
+}
+
+// decodedLen returns length of base64 data with line breaks after decoding
+func decodedLen(data []byte) int {
+	chars, padding := 0, 0
+	for _, b := range data {
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '=':
+			padding++
+		}
+		chars++
+	}
+	return chars/4*3 - padding
+}
@@ -0,0 +1,126 @@
+package apiserver
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+
+	"github.com/indihub-space/agent/proxy"
+)
+
+// GuestManager is implemented by modes which let host manage guest connections
+type GuestManager interface {
+	Connections() []proxy.ConnInfo
+	PauseConnection(cNum uint32, drop bool) error
+	ResumeConnection(cNum uint32) error
+	CloseConnection(cNum uint32, message string) error
+}
+
+func (s *APIServer) guestManager(c echo.Context) (GuestManager, bool) {
+	manager, ok := s.currentAgentMode().(GuestManager)
+	if !ok {
+		c.JSON(
+			http.StatusNotFound,
+			map[string]interface{}{
+				"message": "there are no guest connections in mode " + s.CurrentMode(),
+			},
+		)
+	}
+	return manager, ok
+}
+
+func connNumParam(c echo.Context) (uint32, bool) {
+	cNum, err := strconv.ParseUint(c.Param("conn"), 10, 32)
+	if err != nil {
+		c.JSON(
+			http.StatusBadRequest,
+			map[string]interface{}{
+				"message": "bad connection number: " + c.Param("conn"),
+			},
+		)
+		return 0, false
+	}
+	return uint32(cNum), true
+}
+
+func connActionResult(c echo.Context, err error) error {
+	if err == proxy.ErrUnknownConn {
+		c.JSON(
+			http.StatusNotFound,
+			map[string]interface{}{
+				"message": "unknown connection: " + c.Param("conn"),
+			},
+		)
+		return nil
+	}
+	if err != nil {
+		c.JSON(
+			http.StatusInternalServerError,
+			map[string]interface{}{
+				"message": err.Error(),
+			},
+		)
+		return nil
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{"message": "OK"})
+	return nil
+}
+
+func (s *APIServer) getConnections(c echo.Context) error {
+	manager, ok := s.guestManager(c)
+	if !ok {
+		return nil
+	}
+
+	c.JSONPretty(http.StatusOK, manager.Connections(), "    ")
+
+	return nil
+}
+
+func (s *APIServer) pauseConnection(c echo.Context) error {
+	manager, ok := s.guestManager(c)
+	if !ok {
+		return nil
+	}
+	cNum, ok := connNumParam(c)
+	if !ok {
+		return nil
+	}
+
+	drop, _ := strconv.ParseBool(c.QueryParam("drop"))
+
+	return connActionResult(c, manager.PauseConnection(cNum, drop))
+}
+
+func (s *APIServer) resumeConnection(c echo.Context) error {
+	manager, ok := s.guestManager(c)
+	if !ok {
+		return nil
+	}
+	cNum, ok := connNumParam(c)
+	if !ok {
+		return nil
+	}
+
+	return connActionResult(c, manager.ResumeConnection(cNum))
+}
+
+func (s *APIServer) closeConnection(c echo.Context) error {
+	manager, ok := s.guestManager(c)
+	if !ok {
+		return nil
+	}
+	cNum, ok := connNumParam(c)
+	if !ok {
+		return nil
+	}
+
+	message := c.QueryParam("message")
+	if message == "" {
+		message = "INDIHUB: your connection was closed by host"
+	}
+
+	return connActionResult(c, manager.CloseConnection(cNum, message))
+}
@@ -0,0 +1,140 @@
+package apiserver
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"github.com/indihub-space/agent/audit"
+	"github.com/indihub-space/agent/hostutils"
+	"github.com/indihub-space/agent/indiclient"
+	"github.com/indihub-space/agent/lib"
+	"github.com/indihub-space/agent/safety"
+)
+
+const defaultEmergencyTimeout = 120 * time.Second
+
+func (s *APIServer) emergencyStop(c echo.Context) error {
+	timeout := defaultEmergencyTimeout
+	if val := c.QueryParam("timeout"); val != "" {
+		var err error
+		if timeout, err = time.ParseDuration(val); err != nil {
+			c.JSON(
+				http.StatusBadRequest,
+				map[string]interface{}{
+					"message": "bad timeout value: " + err.Error(),
+				},
+			)
+			return nil
+		}
+	}
+
+	logger.Warnf("EMERGENCY STOP requested!")
+
+	// block guest slews and exposures before anything else, block stays until operator clears it
+	if s.filter != nil {
+		s.filter.Block(hostutils.BlockEmergency, "emergency stop at "+time.Now().Format(time.RFC3339))
+	}
+
+	// stop guest traffic while equipment is being stopped, tearing mode down can take a while
+	// and must not delay abort commands
+	stoppedMode := ""
+	var switchResult chan error
+	if mode := s.CurrentMode(); mode != lib.ModeSolo {
+		stoppedMode = mode
+		switchResult = make(chan error, 1)
+		go func() {
+			switchResult <- s.SwitchMode(lib.ModeSolo)
+		}()
+	}
+
+	result := map[string]interface{}{
+		"stoppedMode": stoppedMode,
+	}
+
+	// talk to equipment directly
+	client, err := indiclient.Dial(s.indiServerAddr)
+	if err != nil {
+		result["message"] = "could not connect to INDI-server: " + err.Error()
+		s.addModeSwitchResult(result, switchResult, timeout)
+		c.JSON(http.StatusBadGateway, result)
+		return nil
+	}
+	defer client.Close()
+	clientAddr := c.RealIP()
+	client.SetSentHook(func(cmd []byte) {
+		s.auditCommand(audit.SourceREST, clientAddr, cmd)
+	})
+	client.WaitDefs(time.Second, 5*time.Second)
+
+	reports := safety.EmergencyStop(client, timeout)
+	allOK := true
+	for _, r := range reports {
+		allOK = allOK && r.OK
+	}
+	logger.Infof("Emergency stop finished, all devices OK: %t", allOK)
+
+	result["devices"] = reports
+	if !s.addModeSwitchResult(result, switchResult, timeout) {
+		allOK = false
+	}
+	result["ok"] = allOK
+
+	c.JSONPretty(http.StatusOK, result, "    ")
+
+	return nil
+}
+
+// addModeSwitchResult waits for switch to solo-mode and adds its result, returns false if switch failed
+func (s *APIServer) addModeSwitchResult(result map[string]interface{}, switchResult <-chan error, timeout time.Duration) bool {
+	if switchResult == nil {
+		return true
+	}
+
+	var err error
+	select {
+	case err = <-switchResult:
+	case <-time.After(timeout):
+		err = errors.New("timeout waiting for solo-mode")
+	}
+	result["mode"] = s.CurrentMode()
+	result["modeSwitched"] = err == nil
+	if err != nil {
+		logger.Errorf("Emergency stop: could not switch to solo-mode: %v", err)
+		result["modeSwitchError"] = err.Error()
+		return false
+	}
+	return true
+}
+
+// clearEmergencyStop lets guest commands through again after emergency stop
+func (s *APIServer) clearEmergencyStop(c echo.Context) error {
+	if s.filter == nil {
+		c.JSON(
+			http.StatusBadRequest,
+			map[string]interface{}{
+				"message": "guest commands are not filtered",
+			},
+		)
+		return nil
+	}
+
+	if blocked, _ := s.filter.IsBlockedBy(hostutils.BlockEmergency); !blocked {
+		c.JSON(
+			http.StatusBadRequest,
+			map[string]interface{}{
+				"message": "emergency stop is not active",
+			},
+		)
+		return nil
+	}
+
+	s.filter.Unblock(hostutils.BlockEmergency)
+	logger.Infof("Emergency stop is cleared, guest commands are unblocked")
+
+	c.JSONPretty(http.StatusOK, s.agentStatus(), "    ")
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+
+	"github.com/indihub-space/agent/hostutils"
+	"github.com/indihub-space/agent/lib"
+)
+
+// unusedAddr returns local address nobody listens on
+func unusedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func callHandler(t *testing.T, handler echo.HandlerFunc, target string) (int, map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, target, nil), rec)
+	if err := handler(c); err != nil {
+		t.Fatal(err)
+	}
+	resp := map[string]interface{}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("bad response %s: %s", rec.Body, err)
+	}
+	return rec.Code, resp
+}
+
+func TestEmergencyStopBlocksUntilCleared(t *testing.T) {
+	s := NewAPIServer("token", unusedAddr(t), "", 0, false, "", lib.ModeShare, "",
+		map[string]AgentMode{
+			lib.ModeSolo:  newFakeMode(nil),
+			lib.ModeShare: newFakeMode(nil),
+		},
+	)
+	filter := hostutils.NewINDIFilter(&hostutils.INDIFilterConfig{})
+	s.SetFilter(filter)
+	if err := s.modes.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// equipment can't be reached but guests are stopped anyway
+	code, resp := callHandler(t, s.emergencyStop, "/emergency-stop?timeout=1s")
+	if code != http.StatusBadGateway {
+		t.Fatalf("unexpected response %d: %v", code, resp)
+	}
+	if resp["stoppedMode"] != lib.ModeShare || resp["modeSwitched"] != true || resp["mode"] != lib.ModeSolo {
+		t.Errorf("switch to solo-mode is not reported: %v", resp)
+	}
+	if blocked, _ := filter.IsBlockedBy(hostutils.BlockEmergency); !blocked {
+		t.Fatal("guest commands are not blocked")
+	}
+	status := s.agentStatus()["emergencyStop"].(map[string]interface{})
+	if status["blocking"] != true {
+		t.Errorf("emergency block is not shown in status: %v", status)
+	}
+
+	// safety supervisor doesn't lift emergency block
+	filter.Block(hostutils.BlockSafety, "rain")
+	filter.Unblock(hostutils.BlockSafety)
+	if blocked, _ := filter.IsBlocked(); !blocked {
+		t.Fatal("emergency block is lifted by safety supervisor")
+	}
+
+	if code, resp := callHandler(t, s.clearEmergencyStop, "/emergency-stop/clear"); code != http.StatusOK {
+		t.Fatalf("unexpected response %d: %v", code, resp)
+	}
+	if blocked, _ := filter.IsBlocked(); blocked {
+		t.Fatal("guest commands are still blocked")
+	}
+	if code, _ := callHandler(t, s.clearEmergencyStop, "/emergency-stop/clear"); code != http.StatusBadRequest {
+		t.Errorf("clearing inactive emergency stop returned %d", code)
+	}
+}
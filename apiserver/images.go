@@ -0,0 +1,136 @@
+package apiserver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+
+	"github.com/indihub-space/agent/fits"
+	"github.com/indihub-space/agent/images"
+	"github.com/indihub-space/agent/lib"
+)
+
+var setBLOBVector = []byte("<setBLOBVector")
+
+// CatalogueProvider is implemented by modes keeping local catalogue of captured frames
+type CatalogueProvider interface {
+	Catalogue() *images.Catalogue
+}
+
+// previewParams returns preview format and size from query params, format is empty if previews are not requested
+func (s *APIServer) previewParams(c echo.Context, formatParam string, sizeParam string,
+	defaultFormat string) (string, int, error) {
+	format := c.QueryParam(formatParam)
+	if format == "" {
+		format = defaultFormat
+	}
+	if format == "" {
+		return "", 0, nil
+	}
+	if format != fits.FormatJPEG && format != fits.FormatPNG {
+		return "", 0, fmt.Errorf("unknown preview format '%s', should be '%s' or '%s'",
+			format, fits.FormatJPEG, fits.FormatPNG)
+	}
+	if s.images == nil {
+		return "", 0, fmt.Errorf("image previews are not enabled")
+	}
+
+	size := images.DefaultPreviewSize
+	if val := c.QueryParam(sizeParam); val != "" {
+		var err error
+		if size, err = strconv.Atoi(val); err != nil || size <= 0 {
+			return "", 0, fmt.Errorf("bad %s value '%s'", sizeParam, val)
+		}
+	}
+
+	return format, size, nil
+}
+
+func (s *APIServer) getLatestImage(c echo.Context) error {
+	device := c.QueryParam("device")
+	if device == "" {
+		c.JSON(
+			http.StatusBadRequest,
+			map[string]interface{}{
+				"message": "device is required",
+				"devices": s.images.Devices(),
+			},
+		)
+		return nil
+	}
+
+	format, size, err := s.previewParams(c, "format", "size", fits.FormatJPEG)
+	if err != nil {
+		c.JSON(
+			http.StatusBadRequest,
+			map[string]interface{}{
+				"message": err.Error(),
+			},
+		)
+		return nil
+	}
+
+	preview, err := s.images.Preview(device, size, format)
+	if err == images.ErrNoFrame {
+		c.JSON(
+			http.StatusNotFound,
+			map[string]interface{}{
+				"message": fmt.Sprintf("no frames captured from '%s'", device),
+			},
+		)
+		return nil
+	}
+	if err != nil {
+		c.JSON(
+			http.StatusUnprocessableEntity,
+			map[string]interface{}{
+				"message": "could not make preview: " + err.Error(),
+			},
+		)
+		return nil
+	}
+
+	c.Response().Header().Set("Last-Modified", preview.Frame.Time.UTC().Format(http.TimeFormat))
+	return c.Blob(http.StatusOK, "image/"+format, preview.Data)
+}
+
+func (s *APIServer) getCatalogue(c echo.Context) error {
+	var catalogue *images.Catalogue
+	if provider, ok := s.agentModes[lib.ModeSolo].(CatalogueProvider); ok {
+		catalogue = provider.Catalogue()
+	}
+	if catalogue == nil {
+		c.JSON(
+			http.StatusNotFound,
+			map[string]interface{}{
+				"message": "no solo sessions yet",
+			},
+		)
+		return nil
+	}
+
+	c.JSONPretty(
+		http.StatusOK,
+		map[string]interface{}{
+			"sessionID": catalogue.SessionID,
+			"started":   catalogue.Started,
+			"summary":   catalogue.Summary(),
+			"frames":    catalogue.Entries(),
+		},
+		"    ",
+	)
+
+	return nil
+}
+
+// previewElement replaces FITS frames in setBLOBVector with previews, original element is returned on failure
+func (s *APIServer) previewElement(el []byte, size int, format string) []byte {
+	preview, err := s.images.PreviewBLOBVector(el, size, format)
+	if err != nil {
+		logger.Errorf("could not make preview, sending original BLOB: %v", err)
+		return el
+	}
+	return preview
+}
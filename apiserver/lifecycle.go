@@ -0,0 +1,294 @@
+package apiserver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// states of agent mode
+const (
+	StateStarting = "starting"
+	StateRunning  = "running"
+	StateStopping = "stopping"
+	StateStopped  = "stopped"
+	StateFailed   = "failed"
+)
+
+// time for mode to open tunnels and get public addresses
+var modeStartTimeout = time.Minute
+
+// TransitionError describes failed start or stop of agent mode
+type TransitionError struct {
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Message string    `json:"error"`
+	Time    time.Time `json:"time"`
+}
+
+func (e *TransitionError) Error() string {
+	if e.From == "" || e.From == e.To {
+		return fmt.Sprintf("%s-mode: %s", e.To, e.Message)
+	}
+	return fmt.Sprintf("switching from %s-mode to %s-mode: %s", e.From, e.To, e.Message)
+}
+
+// modeSupervisor starts and stops agent modes, transitions are done one at a time
+type modeSupervisor struct {
+	modes    map[string]AgentMode
+	onStart  func(mode string)
+	onState  func(mode string, state string)
+	transMu  sync.Mutex // held during whole transition
+	mu       sync.Mutex // guards fields below
+	mode     string
+	state    string
+	since    time.Time
+	cancel   context.CancelFunc
+	lastErr  *TransitionError
+	failures int
+}
+
+func newModeSupervisor(mode string, modes map[string]AgentMode, onStart func(mode string),
+	onState func(mode string, state string)) *modeSupervisor {
+	sv := &modeSupervisor{
+		modes:   modes,
+		onStart: onStart,
+		onState: onState,
+		mode:    mode,
+		state:   StateStopped,
+		since:   time.Now(),
+	}
+	for name, agentMode := range modes {
+		if reporter, ok := agentMode.(FailureReporter); ok {
+			name := name
+			reporter.SetFailureListener(func(err error) {
+				sv.modeFailed(name, err)
+			})
+		}
+	}
+	return sv
+}
+
+// current returns current mode and its state
+func (sv *modeSupervisor) current() (string, string) {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	return sv.mode, sv.state
+}
+
+// start starts current mode if it is not running
+func (sv *modeSupervisor) start() error {
+	sv.transMu.Lock()
+	defer sv.transMu.Unlock()
+
+	mode, state := sv.current()
+	if state == StateRunning {
+		return nil
+	}
+	return sv.startMode(mode, mode)
+}
+
+// stop stops current mode, mode which is being started is cancelled
+func (sv *modeSupervisor) stop() error {
+	sv.mu.Lock()
+	if sv.state == StateStarting && sv.cancel != nil {
+		sv.cancel()
+	}
+	sv.mu.Unlock()
+
+	sv.transMu.Lock()
+	defer sv.transMu.Unlock()
+
+	return sv.stopMode()
+}
+
+// restart stops current mode and starts it again
+func (sv *modeSupervisor) restart() error {
+	sv.transMu.Lock()
+	defer sv.transMu.Unlock()
+
+	mode, _ := sv.current()
+	stopErr := sv.stopMode()
+	if err := sv.startMode(mode, mode); err != nil {
+		return err
+	}
+	return stopErr
+}
+
+// switchTo stops current mode and starts a new one, gate can forbid the switch,
+// the new mode is started even if current one failed to stop, so guests are cut off in any case
+func (sv *modeSupervisor) switchTo(newMode string, gate func(mode string) error) error {
+	sv.transMu.Lock()
+	defer sv.transMu.Unlock()
+
+	if _, ok := sv.modes[newMode]; !ok {
+		return fmt.Errorf("unknown indihub-agent mode: %s", newMode)
+	}
+
+	// don't do anything if agent is already running in this mode
+	mode, state := sv.current()
+	if newMode == mode && state == StateRunning {
+		return nil
+	}
+
+	if gate != nil {
+		if err := gate(newMode); err != nil {
+			return err
+		}
+	}
+
+	stopErr := sv.stopMode()
+	if err := sv.startMode(mode, newMode); err != nil {
+		return err
+	}
+	return stopErr
+}
+
+// startMode starts mode, it should be called with transMu held
+func (sv *modeSupervisor) startMode(from string, mode string) error {
+	agentMode, ok := sv.modes[mode]
+	if !ok {
+		return sv.fail(from, mode, fmt.Errorf("unknown indihub-agent mode: %s", mode))
+	}
+	sv.setState(mode, StateStarting)
+
+	// mode is cancelled if it can't start in time, i.e. the cloud doesn't respond
+	ctx, cancel := context.WithCancel(context.Background())
+	sv.mu.Lock()
+	sv.cancel = cancel
+	sv.mu.Unlock()
+	timer := time.AfterFunc(modeStartTimeout, cancel)
+	err := agentMode.Start(ctx)
+	if !timer.Stop() {
+		if err == nil {
+			agentMode.Stop()
+		}
+		err = fmt.Errorf("not started in %s", modeStartTimeout)
+	}
+	if err != nil {
+		sv.mu.Lock()
+		sv.cancel = nil
+		sv.mu.Unlock()
+		cancel()
+		return sv.fail(from, mode, err)
+	}
+
+	if !sv.changeState(mode, StateRunning, StateStarting) {
+		// mode failed on its own right after start, failure is recorded by modeFailed
+		return &TransitionError{From: from, To: mode, Message: "failed right after start", Time: time.Now()}
+	}
+	logger.Infof("agent is running in %s-mode", mode)
+
+	if sv.onStart != nil {
+		sv.onStart(mode)
+	}
+	return nil
+}
+
+// stopMode stops current mode if it is not stopped, it should be called with transMu held
+func (sv *modeSupervisor) stopMode() error {
+	mode, state := sv.current()
+	if state == StateStopped {
+		return nil
+	}
+	// failed mode is stopped too as it could start partially
+	sv.setState(mode, StateStopping)
+
+	var err error
+	if agentMode, ok := sv.modes[mode]; ok {
+		err = agentMode.Stop()
+	}
+
+	sv.mu.Lock()
+	if sv.cancel != nil {
+		sv.cancel()
+		sv.cancel = nil
+	}
+	sv.mu.Unlock()
+	sv.setState(mode, StateStopped)
+
+	if err != nil {
+		sv.record(mode, mode, fmt.Errorf("could not stop: %w", err))
+		return err
+	}
+	return nil
+}
+
+func (sv *modeSupervisor) setState(mode string, state string) {
+	sv.mu.Lock()
+	sv.mode = mode
+	sv.state = state
+	sv.since = time.Now()
+	sv.mu.Unlock()
+
+	if sv.onState != nil {
+		sv.onState(mode, state)
+	}
+}
+
+// changeState sets state of mode if it is current one in one of from states
+func (sv *modeSupervisor) changeState(mode string, state string, from ...string) bool {
+	sv.mu.Lock()
+	ok := false
+	for _, st := range from {
+		ok = ok || (sv.mode == mode && sv.state == st)
+	}
+	if ok {
+		sv.state = state
+		sv.since = time.Now()
+	}
+	sv.mu.Unlock()
+
+	if ok && sv.onState != nil {
+		sv.onState(mode, state)
+	}
+	return ok
+}
+
+// modeFailed sets failed state of mode which failed on its own, mode stopped by supervisor is not changed
+func (sv *modeSupervisor) modeFailed(mode string, err error) {
+	if !sv.changeState(mode, StateFailed, StateStarting, StateRunning) {
+		return
+	}
+	logger.Errorf("%s", sv.record(mode, mode, err))
+}
+
+// fail sets failed state of mode and returns transition error
+func (sv *modeSupervisor) fail(from string, mode string, err error) error {
+	sv.setState(mode, StateFailed)
+	transErr := sv.record(from, mode, err)
+	logger.Errorf("%s", transErr)
+	return transErr
+}
+
+func (sv *modeSupervisor) record(from string, to string, err error) *TransitionError {
+	transErr := &TransitionError{
+		From:    from,
+		To:      to,
+		Message: err.Error(),
+		Time:    time.Now(),
+	}
+
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+	sv.lastErr = transErr
+	sv.failures++
+	return transErr
+}
+
+// GetStatus returns state of current mode and the last transition error
+func (sv *modeSupervisor) GetStatus() map[string]interface{} {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	status := map[string]interface{}{
+		"state":    sv.state,
+		"since":    sv.since,
+		"failures": sv.failures,
+	}
+	if sv.lastErr != nil {
+		status["lastError"] = sv.lastErr
+	}
+	return status
+}
@@ -0,0 +1,276 @@
+package apiserver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeMode is agent mode which checks that transitions don't overlap
+type fakeMode struct {
+	startErr   error
+	waitCancel bool   // Start waits until it is cancelled
+	busy       *int32 // number of Start and Stop calls in progress, shared by modes
+
+	mu        sync.Mutex
+	running   bool
+	starts    int
+	overlaps  int
+	onFailure func(err error)
+}
+
+func newFakeMode(busy *int32) *fakeMode {
+	if busy == nil {
+		busy = new(int32)
+	}
+	return &fakeMode{busy: busy}
+}
+
+func (m *fakeMode) enter() {
+	if atomic.AddInt32(m.busy, 1) > 1 {
+		m.mu.Lock()
+		m.overlaps++
+		m.mu.Unlock()
+	}
+	// give other transitions a chance to overlap
+	time.Sleep(time.Millisecond)
+}
+
+func (m *fakeMode) leave() {
+	atomic.AddInt32(m.busy, -1)
+}
+
+func (m *fakeMode) Start(ctx context.Context) error {
+	m.enter()
+	defer m.leave()
+
+	m.mu.Lock()
+	m.starts++
+	m.mu.Unlock()
+	if m.waitCancel {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if m.startErr != nil {
+		return m.startErr
+	}
+
+	m.mu.Lock()
+	m.running = true
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *fakeMode) Stop() error {
+	m.enter()
+	defer m.leave()
+
+	m.mu.Lock()
+	m.running = false
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *fakeMode) GetStatus() map[string]interface{} {
+	return map[string]interface{}{}
+}
+
+func (m *fakeMode) SetFailureListener(fn func(err error)) {
+	m.onFailure = fn
+}
+
+func (m *fakeMode) isRunning() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.running
+}
+
+func TestTransitionsAreSerialized(t *testing.T) {
+	busy := new(int32)
+	modes := map[string]AgentMode{
+		"solo":  newFakeMode(busy),
+		"share": newFakeMode(busy),
+		"robot": newFakeMode(busy),
+	}
+	sv := newModeSupervisor("solo", modes, nil, nil)
+	if err := sv.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			switch i % 4 {
+			case 0:
+				err = sv.switchTo("share", nil)
+			case 1:
+				err = sv.switchTo("robot", nil)
+			case 2:
+				err = sv.restart()
+			case 3:
+				sv.GetStatus()
+				err = sv.switchTo("solo", nil)
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	mode, state := sv.current()
+	running := 0
+	for name, m := range modes {
+		fm := m.(*fakeMode)
+		if fm.overlaps > 0 {
+			t.Errorf("%s-mode had %d overlapping transitions", name, fm.overlaps)
+		}
+		if fm.isRunning() {
+			running++
+			if name != mode {
+				t.Errorf("%s-mode is running, current is %s", name, mode)
+			}
+		}
+	}
+	if running != 1 || state != StateRunning {
+		t.Errorf("expected only %s-mode running, %d modes are running in state %s", mode, running, state)
+	}
+}
+
+func TestGateForbidsSwitch(t *testing.T) {
+	sv := newModeSupervisor("solo", map[string]AgentMode{"solo": newFakeMode(nil), "share": newFakeMode(nil)}, nil, nil)
+	if err := sv.start(); err != nil {
+		t.Fatal(err)
+	}
+	gateErr := errors.New("unsafe")
+	err := sv.switchTo("share", func(mode string) error {
+		return gateErr
+	})
+	if err != gateErr {
+		t.Fatalf("expected gate error, got %v", err)
+	}
+	if mode, state := sv.current(); mode != "solo" || state != StateRunning {
+		t.Errorf("mode is changed by forbidden switch: %s %s", mode, state)
+	}
+	if err := sv.switchTo("unknown", nil); err == nil {
+		t.Error("unknown mode is accepted")
+	}
+}
+
+func TestStartTimeout(t *testing.T) {
+	defer func(timeout time.Duration) {
+		modeStartTimeout = timeout
+	}(modeStartTimeout)
+	modeStartTimeout = 50 * time.Millisecond
+
+	share := newFakeMode(nil)
+	share.waitCancel = true
+	sv := newModeSupervisor("solo", map[string]AgentMode{"solo": newFakeMode(nil), "share": share}, nil, nil)
+
+	err := sv.switchTo("share", nil)
+	var transErr *TransitionError
+	if !errors.As(err, &transErr) || transErr.To != "share" {
+		t.Fatalf("expected transition error, got %v", err)
+	}
+	if mode, state := sv.current(); mode != "share" || state != StateFailed {
+		t.Errorf("expected failed share-mode, got %s %s", mode, state)
+	}
+
+	// failed mode can be left
+	if err := sv.switchTo("solo", nil); err != nil {
+		t.Fatal(err)
+	}
+	if mode, state := sv.current(); mode != "solo" || state != StateRunning {
+		t.Errorf("expected running solo-mode, got %s %s", mode, state)
+	}
+}
+
+func TestStopWhileStarting(t *testing.T) {
+	share := newFakeMode(nil)
+	share.waitCancel = true
+	sv := newModeSupervisor("share", map[string]AgentMode{"share": share}, nil, nil)
+
+	started := make(chan error, 1)
+	go func() {
+		started <- sv.start()
+	}()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, state := sv.current(); state == StateStarting {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("mode is not starting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := sv.stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-started:
+		if err == nil {
+			t.Error("cancelled start succeeded")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("start is not cancelled by stop")
+	}
+	if _, state := sv.current(); state != StateStopped {
+		t.Errorf("expected stopped mode, got %s", state)
+	}
+}
+
+func TestFailedStateIsReported(t *testing.T) {
+	share := newFakeMode(nil)
+	share.startErr = errors.New("no tunnel")
+	states := []string{}
+	var mu sync.Mutex
+	sv := newModeSupervisor("solo", map[string]AgentMode{"solo": newFakeMode(nil), "share": share}, nil,
+		func(mode string, state string) {
+			mu.Lock()
+			states = append(states, mode+" "+state)
+			mu.Unlock()
+		},
+	)
+
+	if err := sv.switchTo("share", nil); err == nil {
+		t.Fatal("failed start is not reported")
+	}
+	status := sv.GetStatus()
+	lastErr, ok := status["lastError"].(*TransitionError)
+	if status["state"] != StateFailed || status["failures"] != 1 || !ok || lastErr.Message != "no tunnel" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	// running mode failing on its own
+	share.startErr = nil
+	if err := sv.switchTo("share", nil); err != nil {
+		t.Fatal(err)
+	}
+	share.onFailure(errors.New("tunnel is closed"))
+	status = sv.GetStatus()
+	lastErr, ok = status["lastError"].(*TransitionError)
+	if status["state"] != StateFailed || status["failures"] != 2 || !ok || lastErr.Message != "tunnel is closed" {
+		t.Errorf("mode failure is not reported: %+v", status)
+	}
+
+	// failure of mode which is not current is ignored
+	sv.switchTo("solo", nil)
+	share.onFailure(errors.New("late failure"))
+	if _, state := sv.current(); state != StateRunning {
+		t.Errorf("late failure of stopped mode changed state to %s", state)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if states[len(states)-1] != "solo running" {
+		t.Errorf("unexpected state changes: %v", states)
+	}
+}
@@ -0,0 +1,47 @@
+package apiserver
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+
+	"github.com/indihub-space/agent/logutil"
+)
+
+var logger = logutil.New("subsystem", "api")
+
+func (s *APIServer) getLogLevel(c echo.Context) error {
+	c.JSON(
+		http.StatusOK,
+		map[string]interface{}{
+			"level": logutil.GetLevel().String(),
+		},
+	)
+
+	return nil
+}
+
+func (s *APIServer) setLogLevel(c echo.Context) error {
+	level, err := logutil.ParseLevel(c.Param("level"))
+	if err != nil {
+		c.JSON(
+			http.StatusBadRequest,
+			map[string]interface{}{
+				"message": err.Error(),
+			},
+		)
+		return nil
+	}
+
+	logutil.SetLevel(level)
+	logger.Infof("log level changed to %s", level)
+
+	c.JSON(
+		http.StatusOK,
+		map[string]interface{}{
+			"message": "log level changed to " + level.String(),
+		},
+	)
+
+	return nil
+}
@@ -0,0 +1,514 @@
+package apiserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo"
+
+	"github.com/indihub-space/agent/audit"
+	"github.com/indihub-space/agent/indiclient"
+	"github.com/indihub-space/agent/indijson"
+)
+
+const (
+	rpcVersion           = "2.0"
+	defaultSetTimeout    = 60 * time.Second
+	rpcDefsQuietPeriod   = time.Second
+	rpcDefsMaxWait       = 5 * time.Second
+	rpcNotifyMethod      = "property"
+	rpcErrParse          = -32700
+	rpcErrInvalidRequest = -32600
+	rpcErrNoMethod       = -32601
+	rpcErrInvalidParams  = -32602
+	rpcErrInternal       = -32603
+	rpcErrINDIServer     = -32000 // connection to INDI-server is lost
+	rpcErrUnknownProp    = -32001
+	rpcErrTimeout        = -32002
+	rpcErrAlert          = -32003
+	rpcErrBlocked        = -32004
+)
+
+// RPCError is JSON-RPC error object
+type RPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+type rpcRequest struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+type rpcNotification struct {
+	Version string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type propertyParams struct {
+	Device string `json:"device"`
+	Name   string `json:"name"`
+}
+
+type setPropertyParams struct {
+	Device   string            `json:"device"`
+	Name     string            `json:"name"`
+	Elements []json.RawMessage `json:"elements"`
+	Timeout  float64           `json:"timeout"` // seconds
+}
+
+type enableBLOBParams struct {
+	Device string `json:"device"`
+	Name   string `json:"name"`
+	Policy string `json:"policy"`
+}
+
+type unsubscribeParams struct {
+	Subscription int `json:"subscription"`
+}
+
+// rpcSubscription is device and property name patterns like in path.Match, empty pattern matches everything
+type rpcSubscription struct {
+	device string
+	name   string
+}
+
+func (sub *rpcSubscription) match(msg *indiclient.Message) bool {
+	if sub.device != "" {
+		if ok, _ := path.Match(sub.device, msg.Device); !ok {
+			return false
+		}
+	}
+	if sub.name != "" && msg.Name != "" {
+		if ok, _ := path.Match(sub.name, msg.Name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// rpcConn is JSON-RPC connection on top of INDI-client with its own cache of properties and BLOB policy
+type rpcConn struct {
+	ws     *websocket.Conn
+	client *indiclient.Client
+	ready  chan struct{} // closed when INDI-server sent definitions of properties
+
+	writeMu sync.Mutex
+
+	subsMu  sync.Mutex
+	subs    map[int]*rpcSubscription
+	lastSub int
+}
+
+func (s *APIServer) newRPCConnection(c echo.Context) error {
+	// upgrade to WS connection
+	ws, err := s.upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	client, err := indiclient.Dial(s.indiServerAddr)
+	if err != nil {
+		closeWS(ws, websocket.CloseTryAgainLater, "could not connect to INDI-server")
+		return err
+	}
+	defer client.Close()
+	defer s.trackConn(ws)()
+	clientAddr := c.RealIP()
+	client.SetSentHook(func(cmd []byte) {
+		s.auditCommand(audit.SourceWebSocket, clientAddr, cmd)
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	keepAlive(ws, done)
+
+	rc := &rpcConn{
+		ws:     ws,
+		client: client,
+		ready:  make(chan struct{}),
+		subs:   map[int]*rpcSubscription{},
+	}
+	go func() {
+		client.WaitDefs(rpcDefsQuietPeriod, rpcDefsMaxWait)
+		close(rc.ready)
+	}()
+	unsubscribe := client.Subscribe(rc.notify)
+	defer unsubscribe()
+
+	// WS-connection is closed when connection to INDI-server is lost, so client can reconnect
+	go func() {
+		<-client.Done()
+		ws.Close()
+	}()
+
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			return nil
+		}
+		go rc.handle(msg)
+	}
+}
+
+// handle handles request or batch of requests, requests of batch run concurrently and answered together
+func (rc *rpcConn) handle(msg []byte) {
+	msg = bytes.TrimSpace(msg)
+	if len(msg) == 0 || msg[0] != '[' {
+		if resp := rc.call(msg); resp != nil {
+			rc.write(resp)
+		}
+		return
+	}
+
+	batch := []json.RawMessage{}
+	if err := json.Unmarshal(msg, &batch); err != nil {
+		rc.write(errorResponse(nil, &RPCError{Code: rpcErrParse, Message: err.Error()}))
+		return
+	}
+	if len(batch) == 0 {
+		rc.write(errorResponse(nil, &RPCError{Code: rpcErrInvalidRequest, Message: "empty batch"}))
+		return
+	}
+
+	responses := make([]*rpcResponse, len(batch))
+	wg := sync.WaitGroup{}
+	for i, req := range batch {
+		wg.Add(1)
+		go func(i int, req []byte) {
+			defer wg.Done()
+			responses[i] = rc.call(req)
+		}(i, req)
+	}
+	wg.Wait()
+
+	res := make([]*rpcResponse, 0, len(responses))
+	for _, resp := range responses {
+		if resp != nil {
+			res = append(res, resp)
+		}
+	}
+	// batch of notifications is not answered
+	if len(res) > 0 {
+		rc.write(res)
+	}
+}
+
+// call runs request and returns its response, nil is returned for notifications
+func (rc *rpcConn) call(msg []byte) *rpcResponse {
+	req := &rpcRequest{}
+	if err := json.Unmarshal(msg, req); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return errorResponse(nil, &RPCError{Code: rpcErrInvalidRequest, Message: err.Error()})
+		}
+		return errorResponse(nil, &RPCError{Code: rpcErrParse, Message: err.Error()})
+	}
+	if req.Version != rpcVersion || req.Method == "" {
+		return errorResponse(req.ID, &RPCError{Code: rpcErrInvalidRequest, Message: "not a JSON-RPC 2.0 request"})
+	}
+
+	result, err := rc.run(req.Method, req.Params)
+	if req.ID == nil {
+		return nil
+	}
+	if err != nil {
+		rpcErr, ok := err.(*RPCError)
+		if !ok {
+			rpcErr = &RPCError{Code: rpcErrInternal, Message: err.Error()}
+		}
+		return errorResponse(req.ID, rpcErr)
+	}
+	// result is marshalled here as empty results like [] are still results
+	data, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(req.ID, &RPCError{Code: rpcErrInternal, Message: err.Error()})
+	}
+	return &rpcResponse{
+		Version: rpcVersion,
+		ID:      req.ID,
+		Result:  data,
+	}
+}
+
+func (rc *rpcConn) run(method string, params json.RawMessage) (interface{}, error) {
+	switch method {
+	case "getDevices":
+		return rc.getDevices()
+	case "getProperties":
+		p := &propertyParams{}
+		if err := parseParams(params, p); err != nil {
+			return nil, err
+		}
+		return rc.getProperties(p)
+	case "getProperty":
+		p := &propertyParams{}
+		if err := parseParams(params, p); err != nil {
+			return nil, err
+		}
+		return rc.getProperty(p)
+	case "setProperty":
+		p := &setPropertyParams{}
+		if err := parseParams(params, p); err != nil {
+			return nil, err
+		}
+		return rc.setProperty(p)
+	case "subscribe":
+		p := &propertyParams{}
+		if err := parseParams(params, p); err != nil {
+			return nil, err
+		}
+		return rc.subscribe(p)
+	case "unsubscribe":
+		p := &unsubscribeParams{}
+		if err := parseParams(params, p); err != nil {
+			return nil, err
+		}
+		return rc.unsubscribe(p)
+	case "enableBLOB":
+		p := &enableBLOBParams{}
+		if err := parseParams(params, p); err != nil {
+			return nil, err
+		}
+		return rc.enableBLOB(p)
+	}
+	return nil, &RPCError{Code: rpcErrNoMethod, Message: "method not found: " + method}
+}
+
+// waitReady waits for definitions of properties so cache is filled
+func (rc *rpcConn) waitReady() error {
+	select {
+	case <-rc.ready:
+	case <-rc.client.Done():
+	}
+	select {
+	case <-rc.client.Done():
+		return &RPCError{Code: rpcErrINDIServer, Message: indiclient.ErrClosed.Error()}
+	default:
+		return nil
+	}
+}
+
+func (rc *rpcConn) getDevices() (interface{}, error) {
+	if err := rc.waitReady(); err != nil {
+		return nil, err
+	}
+	return rc.client.Devices(), nil
+}
+
+func (rc *rpcConn) getProperties(p *propertyParams) (interface{}, error) {
+	if p.Device == "" {
+		return nil, &RPCError{Code: rpcErrInvalidParams, Message: "device is required"}
+	}
+	if err := rc.waitReady(); err != nil {
+		return nil, err
+	}
+
+	props := rc.client.Properties(p.Device)
+	res := make([]*indijson.Message, 0, len(props))
+	for _, v := range props {
+		res = append(res, defMessage(v))
+	}
+	return res, nil
+}
+
+func (rc *rpcConn) getProperty(p *propertyParams) (interface{}, error) {
+	if p.Device == "" || p.Name == "" {
+		return nil, &RPCError{Code: rpcErrInvalidParams, Message: "device and name are required"}
+	}
+	if err := rc.waitReady(); err != nil {
+		return nil, err
+	}
+
+	v, ok := rc.client.Property(p.Device, p.Name)
+	if !ok {
+		return nil, unknownProp(p.Device, p.Name)
+	}
+	return defMessage(v), nil
+}
+
+// setProperty sends new values and answers when property state is not Busy any more,
+// Alert state and timeout are returned as errors with the property as data
+func (rc *rpcConn) setProperty(p *setPropertyParams) (interface{}, error) {
+	if p.Device == "" || p.Name == "" || len(p.Elements) == 0 {
+		return nil, &RPCError{Code: rpcErrInvalidParams, Message: "device, name and elements are required"}
+	}
+	timeout := defaultSetTimeout
+	if p.Timeout > 0 {
+		timeout = time.Duration(p.Timeout * float64(time.Second))
+	}
+	if err := rc.waitReady(); err != nil {
+		return nil, err
+	}
+
+	v, ok := rc.client.Property(p.Device, p.Name)
+	if !ok {
+		return nil, unknownProp(p.Device, p.Name)
+	}
+	cmd := &indijson.Command{Device: p.Device, Name: p.Name, Elements: p.Elements}
+	values, err := cmd.Values(v.Kind)
+	if err != nil {
+		return nil, &RPCError{Code: rpcErrInvalidParams, Message: err.Error()}
+	}
+
+	state, err := rc.client.SetAndWait(p.Device, p.Name, values, timeout)
+	if err != nil {
+		switch {
+		case errors.Is(err, indiclient.ErrTimeout):
+			return nil, &RPCError{Code: rpcErrTimeout, Message: "property is still " + state, Data: rc.property(p)}
+		case errors.Is(err, indiclient.ErrBlocked):
+			return nil, &RPCError{Code: rpcErrBlocked, Message: err.Error()}
+		case errors.Is(err, indiclient.ErrUnknownElement):
+			return nil, &RPCError{Code: rpcErrInvalidParams, Message: err.Error()}
+		case errors.Is(err, indiclient.ErrUnknownProp):
+			return nil, unknownProp(p.Device, p.Name)
+		}
+		return nil, &RPCError{Code: rpcErrINDIServer, Message: err.Error()}
+	}
+	if state == indiclient.StateAlert {
+		return nil, &RPCError{Code: rpcErrAlert, Message: "property state is Alert", Data: rc.property(p)}
+	}
+	return rc.property(p), nil
+}
+
+func (rc *rpcConn) property(p *setPropertyParams) *indijson.Message {
+	v, ok := rc.client.Property(p.Device, p.Name)
+	if !ok {
+		return nil
+	}
+	return defMessage(v)
+}
+
+// subscribe starts sending of def*, set*, delProperty and message elements matching patterns as notifications
+func (rc *rpcConn) subscribe(p *propertyParams) (interface{}, error) {
+	for _, pattern := range []string{p.Device, p.Name} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, &RPCError{Code: rpcErrInvalidParams, Message: fmt.Sprintf("bad pattern '%s'", pattern)}
+		}
+	}
+
+	rc.subsMu.Lock()
+	defer rc.subsMu.Unlock()
+
+	rc.lastSub++
+	rc.subs[rc.lastSub] = &rpcSubscription{device: p.Device, name: p.Name}
+
+	return map[string]interface{}{"subscription": rc.lastSub}, nil
+}
+
+func (rc *rpcConn) unsubscribe(p *unsubscribeParams) (interface{}, error) {
+	rc.subsMu.Lock()
+	defer rc.subsMu.Unlock()
+
+	if _, ok := rc.subs[p.Subscription]; !ok {
+		return nil, &RPCError{Code: rpcErrInvalidParams, Message: fmt.Sprintf("unknown subscription %d", p.Subscription)}
+	}
+	delete(rc.subs, p.Subscription)
+
+	return true, nil
+}
+
+func (rc *rpcConn) enableBLOB(p *enableBLOBParams) (interface{}, error) {
+	if p.Device == "" {
+		return nil, &RPCError{Code: rpcErrInvalidParams, Message: "device is required"}
+	}
+	if p.Policy != "Never" && p.Policy != "Also" && p.Policy != "Only" {
+		return nil, &RPCError{Code: rpcErrInvalidParams, Message: "policy should be Never, Also or Only"}
+	}
+	if err := rc.client.EnableBLOB(p.Device, p.Name, p.Policy); err != nil {
+		return nil, &RPCError{Code: rpcErrINDIServer, Message: err.Error()}
+	}
+	return true, nil
+}
+
+// notify sends message from INDI-server to all matching subscriptions
+func (rc *rpcConn) notify(msg *indiclient.Message) {
+	rc.subsMu.Lock()
+	ids := []int{}
+	for id, sub := range rc.subs {
+		if sub.match(msg) {
+			ids = append(ids, id)
+		}
+	}
+	rc.subsMu.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+
+	typed, err := indijson.FromMessage(msg)
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		rc.write(&rpcNotification{
+			Version: rpcVersion,
+			Method:  rpcNotifyMethod,
+			Params: map[string]interface{}{
+				"subscription": id,
+				"message":      typed,
+			},
+		})
+	}
+}
+
+func (rc *rpcConn) write(v interface{}) {
+	rc.writeMu.Lock()
+	defer rc.writeMu.Unlock()
+
+	rc.ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := rc.ws.WriteJSON(v); err != nil {
+		rc.ws.Close()
+	}
+}
+
+func parseParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &RPCError{Code: rpcErrInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+func errorResponse(id json.RawMessage, err *RPCError) *rpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &rpcResponse{
+		Version: rpcVersion,
+		ID:      id,
+		Error:   err,
+	}
+}
+
+func unknownProp(device string, name string) *RPCError {
+	return &RPCError{Code: rpcErrUnknownProp, Message: fmt.Sprintf("unknown property %s.%s", device, name)}
+}
+
+// defMessage returns property from cache as its definition
+func defMessage(v *indiclient.Vector) *indijson.Message {
+	return indijson.FromVector("def"+v.Kind+"Vector", v)
+}
@@ -2,13 +2,15 @@ package apiserver
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
-	"time"
+	"sync"
+	"sync/atomic"
 
 	"github.com/indihub-space/agent/version"
 
@@ -17,8 +19,14 @@ import (
 	"github.com/labstack/echo/middleware"
 	elog "github.com/labstack/gommon/log"
 
+	"github.com/indihub-space/agent/audit"
+	"github.com/indihub-space/agent/hostutils"
+	"github.com/indihub-space/agent/images"
+	"github.com/indihub-space/agent/journal"
 	"github.com/indihub-space/agent/lib"
 	"github.com/indihub-space/agent/logutil"
+	"github.com/indihub-space/agent/recorder"
+	"github.com/indihub-space/agent/scheduler"
 )
 
 var allowedOrigins = map[string]bool{
@@ -27,13 +35,31 @@ var allowedOrigins = map[string]bool{
 	"kids.indihub.space": true,
 }
 
-// AgentMode provides interface to operate with agent from API-server
+// AgentMode provides interface to operate with agent from API-server.
+// Start returns when mode is running, the mode is stopped when ctx is cancelled or Stop is called,
+// Stop can be called for mode which is already stopped or failed to start.
 type AgentMode interface {
-	Start()
-	Stop()
+	Start(ctx context.Context) error
+	Stop() error
 	GetStatus() map[string]interface{}
 }
 
+// StatusProvider adds its status to agent status
+type StatusProvider interface {
+	GetStatus() map[string]interface{}
+}
+
+// GuestNotifier is implemented by modes which can send messages to connected guests
+type GuestNotifier interface {
+	NotifyGuests(message string)
+}
+
+// FailureReporter is implemented by modes which can fail on their own while running,
+// i.e. tunnel is closed by the cloud or connection to INDI-server is lost
+type FailureReporter interface {
+	SetFailureListener(fn func(err error))
+}
+
 type APIServer struct {
 	token          string
 	indiServerAddr string
@@ -44,11 +70,25 @@ type APIServer struct {
 
 	e        *echo.Echo
 	upgrader websocket.Upgrader
-	connList []net.Conn
+	connMu   sync.Mutex
+	conns    map[io.Closer]struct{}
+	connNum  uint32
+
+	recorder  *recorder.Recorder
+	scheduler *scheduler.Scheduler
+	images    *images.Store
+	journal   *journal.Journal
+	audit     *audit.Log
+	filter    *hostutils.INDIFilter
+
+	modeGate        func(mode string) error
+	modeListeners   []func(mode string)
+	stateListeners  []func(mode string, state string)
+	statusProviders map[string]StatusProvider
 
 	indiProfile string
-	currMode    string
 	agentModes  map[string]AgentMode
+	modes       *modeSupervisor
 }
 
 func NewAPIServer(token string, indiServerAddr string, phd2ServerAddr string, port uint64, isTLS bool, origins string,
@@ -63,12 +103,14 @@ func NewAPIServer(token string, indiServerAddr string, phd2ServerAddr string, po
 		e:              echo.New(),
 		upgrader: websocket.Upgrader{
 			EnableCompression: true,
+			Subprotocols:      []string{subprotocolV2},
 		},
-		connList:    []net.Conn{},
-		indiProfile: indiProfile,
-		currMode:    currMode,
-		agentModes:  agentModes,
+		conns:           map[io.Closer]struct{}{},
+		statusProviders: map[string]StatusProvider{},
+		indiProfile:     indiProfile,
+		agentModes:      agentModes,
 	}
+	apiServer.modes = newModeSupervisor(currMode, agentModes, apiServer.notifyMode, apiServer.notifyState)
 
 	if logutil.IsDev {
 		allowedOrigins["localhost"] = true
@@ -101,83 +143,228 @@ func NewAPIServer(token string, indiServerAddr string, phd2ServerAddr string, po
 	return apiServer
 }
 
+// SetRecorder enables recording of INDI traffic of WS-connections
+func (s *APIServer) SetRecorder(rec *recorder.Recorder) {
+	s.recorder = rec
+}
+
+// SetImageStore sets store of captured frames used for image previews
+func (s *APIServer) SetImageStore(store *images.Store) {
+	s.images = store
+}
+
+// SetJournal sets local journal of sessions
+func (s *APIServer) SetJournal(j *journal.Journal) {
+	s.journal = j
+}
+
+// SetAudit sets audit log for commands sent via API
+func (s *APIServer) SetAudit(log *audit.Log) {
+	s.audit = log
+}
+
+// SetFilter sets INDI filter of guest commands blocked by emergency stop
+func (s *APIServer) SetFilter(filter *hostutils.INDIFilter) {
+	s.filter = filter
+}
+
+// SetScheduler sets scheduler of sharing sessions
+func (s *APIServer) SetScheduler(sched *scheduler.Scheduler) {
+	s.scheduler = sched
+	s.AddStatusProvider("schedule", sched)
+}
+
+// SetModeGate sets check which can forbid switching to a mode
+func (s *APIServer) SetModeGate(gate func(mode string) error) {
+	s.modeGate = gate
+}
+
+// AddModeListener adds function called when agent is started in a mode
+func (s *APIServer) AddModeListener(fn func(mode string)) {
+	s.modeListeners = append(s.modeListeners, fn)
+}
+
+func (s *APIServer) notifyMode(mode string) {
+	for _, fn := range s.modeListeners {
+		fn(mode)
+	}
+}
+
+// AddStateListener adds function called on every state change of agent mode: starting, running, stopping, stopped or failed
+func (s *APIServer) AddStateListener(fn func(mode string, state string)) {
+	s.stateListeners = append(s.stateListeners, fn)
+}
+
+func (s *APIServer) notifyState(mode string, state string) {
+	for _, fn := range s.stateListeners {
+		fn(mode, state)
+	}
+}
+
+// AddStatusProvider adds status of subsystem to agent status under the key
+func (s *APIServer) AddStatusProvider(key string, provider StatusProvider) {
+	s.statusProviders[key] = provider
+}
+
 func (s *APIServer) newIndiConnection(c echo.Context) error {
+	// message format, previews and binary BLOBs are requested with query parameters
+	format, err := s.wsFormatParams(c)
+	if err != nil {
+		c.JSON(
+			http.StatusBadRequest,
+			map[string]interface{}{
+				"message": err.Error(),
+			},
+		)
+		return nil
+	}
+
 	// upgrade to WS connection
 	ws, err := s.upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
 		return err
 	}
 	defer ws.Close()
+	if ws.Subprotocol() == subprotocolV2 {
+		format.v2 = true
+	}
 
 	// open connection to INDI-Server
 	conn, err := net.Dial("tcp", s.indiServerAddr)
 	if err != nil {
+		closeWS(ws, websocket.CloseTryAgainLater, "could not connect to INDI-server")
 		return err
 	}
+	defer conn.Close()
 
 	// add to connection list
-	s.connList = append(s.connList, conn)
-
-	// read messages from INDI-server and write them to WS
-	go func(indiConn net.Conn, wsConn *websocket.Conn) {
+	defer s.trackConn(conn)()
+	cNum := recorder.WSConnBase + atomic.AddUint32(&s.connNum, 1)
+	defer s.recorder.CloseConn(cNum)
+
+	done := make(chan struct{})
+	defer close(done)
+	keepAlive(ws, done)
+
+	// read messages from INDI-server and queue them, so slow WS-client doesn't block INDI-server
+	queue := newSendQueue(format.queuePolicy)
+	go func() {
+		defer queue.close()
 		buf := make([]byte, lib.INDIServerMaxSendMsgSize, lib.INDIServerMaxSendMsgSize)
 		xmlFlattener := lib.NewXmlFlattener()
 		for {
 			// read from INDI-server
-			n, err := indiConn.Read(buf)
+			n, err := conn.Read(buf)
 			if err != nil {
-				indiConn.Close()
 				return
 			}
 
-			jsonMessages := xmlFlattener.ConvertChunkToJSON(buf[:n])
+			s.recorder.Record(cNum, recorder.ToClient, buf[:n])
 
-			// Write to WS
-			for _, m := range jsonMessages {
-				err = wsConn.WriteMessage(websocket.TextMessage, m)
-				if err != nil {
-					indiConn.Close()
+			for _, el := range xmlFlattener.FeedChunk(buf[:n]) {
+				if !queue.push(el) {
 					return
 				}
 			}
 		}
-	}(conn, ws)
+	}()
+
+	// write queued messages to WS
+	go func() {
+		unconverted := 0
+		for {
+			el, ok := queue.pop()
+			if !ok {
+				break
+			}
+			err := s.writeElement(ws, format, el)
+			queue.done()
+			if errors.Is(err, errConvert) {
+				logger.Debugf("WS-client %d: %s", cNum, err)
+				unconverted++
+				continue
+			}
+			if err != nil {
+				ws.Close()
+				return
+			}
+		}
+		if unconverted > 0 {
+			logger.Warnf("WS-client %d: %d messages could not be converted to JSON", cNum, unconverted)
+		}
+
+		dropped, err := queue.stats()
+		if err != nil {
+			logger.Warnf("WS-client %d is too slow, closing connection: %s", cNum, err)
+			closeWS(ws, websocket.CloseTryAgainLater, "client is too slow")
+			return
+		}
+		if dropped > 0 {
+			logger.Infof("WS-client %d: %d stale messages were dropped", cNum, dropped)
+		}
+		closeWS(ws, websocket.CloseGoingAway, "INDI-server closed connection")
+	}()
 
 	// read messages from WS and write them to INDI-server
 	xmlFlattener := lib.NewXmlFlattener()
+	auditFlattener := lib.NewXmlFlattener()
+	client := c.RealIP()
 	for {
 		// Read from WS
 		_, msg, err := ws.ReadMessage()
 		if err != nil {
-			conn.Close()
-			return err
+			queue.close()
+			return nil
 		}
 
-		xmlMsg, err := xmlFlattener.ConvertJSONToXML(msg)
+		xmlMsg, err := format.toXML(xmlFlattener, msg)
 		if err != nil {
-			log.Printf("could not convert json '%s' to xml: %s", string(msg), err)
+			logger.Errorf("could not convert json '%s' to xml: %s", string(msg), err)
 			continue
 		}
 
+		s.recorder.Record(cNum, recorder.ToServer, xmlMsg)
+		if s.audit != nil {
+			for _, el := range auditFlattener.FeedChunk(xmlMsg) {
+				s.auditCommand(audit.SourceWebSocket, client, el)
+			}
+		}
+
 		// write to INDI server
 		_, err = conn.Write(xmlMsg)
 		if err != nil {
-			conn.Close()
 			return err
 		}
 	}
 }
 
+// trackConn adds connection to list of connections closed on API-server stop, returns func removing it
+func (s *APIServer) trackConn(conn io.Closer) func() {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	s.conns[conn] = struct{}{}
+
+	return func() {
+		s.connMu.Lock()
+		defer s.connMu.Unlock()
+		delete(s.conns, conn)
+	}
+}
+
 func (s *APIServer) newPHD2Connection(c echo.Context) error {
 	return nil
 }
 
 func (s *APIServer) getRestart(c echo.Context) error {
 	// restart current mode
-	if curAgentMode, ok := s.agentModes[s.currMode]; ok {
-		curAgentMode.Stop()
-		time.Sleep(1 * time.Second)
-		curAgentMode.Start()
+	if err := s.modes.restart(); err != nil {
+		c.JSON(
+			http.StatusInternalServerError,
+			map[string]interface{}{
+				"message": err.Error(),
+			},
+		)
+		return nil
 	}
 
 	c.JSONPretty(http.StatusOK, s.agentStatus(), "    ")
@@ -194,44 +381,96 @@ func (s *APIServer) getStatus(c echo.Context) error {
 func (s *APIServer) changeMode(c echo.Context) error {
 	newMode := c.Param("new_mode")
 
-	// don't do anything if agent is laready in this mode
-	if newMode == s.currMode {
-		c.JSONPretty(http.StatusOK, s.agentStatus(), "    ")
-		return nil
-	}
-
-	// get agent new mode
-	newAgentMode, ok := s.agentModes[newMode]
-	if !ok {
+	if err := s.SwitchMode(newMode); err != nil {
+		code := http.StatusBadRequest
+		var transErr *TransitionError
+		if errors.As(err, &transErr) {
+			code = http.StatusInternalServerError
+		}
 		c.JSON(
-			http.StatusBadRequest,
+			code,
 			map[string]interface{}{
-				"message": "unknown indihub-agent mode: " + newMode,
+				"message": err.Error(),
 			},
 		)
 		return nil
 	}
 
-	// stop current mode
-	if curAgentMode, ok := s.agentModes[s.currMode]; ok {
-		curAgentMode.Stop()
+	c.JSONPretty(http.StatusOK, s.agentStatus(), "    ")
+
+	return nil
+}
+
+// CurrentMode returns name of current agent mode
+func (s *APIServer) CurrentMode() string {
+	mode, _ := s.modes.current()
+	return mode
+}
+
+// currentAgentMode returns current mode if it is running
+func (s *APIServer) currentAgentMode() AgentMode {
+	mode, state := s.modes.current()
+	if state != StateRunning {
+		return nil
 	}
+	return s.agentModes[mode]
+}
 
-	time.Sleep(1 * time.Second)
+// SwitchMode stops current mode and starts agent in a new one, switches are done one at a time,
+// *TransitionError is returned if the new mode failed to start
+func (s *APIServer) SwitchMode(newMode string) error {
+	return s.modes.switchTo(newMode, s.modeGate)
+}
 
-	// start agent in new mode
-	s.currMode = newMode
-	newAgentMode.Start()
+// NotifyGuests sends message to guests of current mode if it has any
+func (s *APIServer) NotifyGuests(message string) {
+	if notifier, ok := s.currentAgentMode().(GuestNotifier); ok {
+		notifier.NotifyGuests(message)
+	}
+}
 
-	c.JSONPretty(http.StatusOK, s.agentStatus(), "    ")
+func (s *APIServer) getSchedule(c echo.Context) error {
+	c.JSONPretty(
+		http.StatusOK,
+		map[string]interface{}{
+			"schedule": s.scheduler.Get(),
+			"upcoming": s.scheduler.Upcoming(7),
+		},
+		"    ",
+	)
 
 	return nil
 }
 
+func (s *APIServer) setSchedule(c echo.Context) error {
+	schedule := &scheduler.Schedule{}
+	if err := c.Bind(schedule); err != nil {
+		c.JSON(
+			http.StatusBadRequest,
+			map[string]interface{}{
+				"message": "could not parse schedule: " + err.Error(),
+			},
+		)
+		return nil
+	}
+
+	if err := s.scheduler.Set(schedule); err != nil {
+		c.JSON(
+			http.StatusBadRequest,
+			map[string]interface{}{
+				"message": err.Error(),
+			},
+		)
+		return nil
+	}
+
+	return s.getSchedule(c)
+}
+
 func (s *APIServer) agentStatus() map[string]interface{} {
 	agentStatus := map[string]interface{}{
 		"version":     version.AgentVersion,
-		"mode":        s.currMode,
+		"mode":        s.CurrentMode(),
 		"indiProfile": s.indiProfile,
 		"indiServer":  s.indiServerAddr,
 		"phd2Server":  s.phd2ServerAddr,
@@ -243,11 +482,24 @@ func (s *APIServer) agentStatus() map[string]interface{} {
 	}
 	agentStatus["supportedModes"] = supportedModes
 
-	if agentMode, ok := s.agentModes[s.currMode]; ok {
+	if agentMode, ok := s.agentModes[s.CurrentMode()]; ok {
 		for key, val := range agentMode.GetStatus() {
 			agentStatus[key] = val
 		}
 	}
+	agentStatus["modeState"] = s.modes.GetStatus()
+
+	if s.filter != nil {
+		blocked, reason := s.filter.IsBlockedBy(hostutils.BlockEmergency)
+		agentStatus["emergencyStop"] = map[string]interface{}{
+			"blocking": blocked,
+			"reason":   reason,
+		}
+	}
+
+	for key, provider := range s.statusProviders {
+		agentStatus[key] = provider.GetStatus()
+	}
 
 	return agentStatus
 }
@@ -291,58 +543,93 @@ func (s *APIServer) Start() {
 	// setup routing for WS and RESTful APIs
 
 	// protected WS-API
+	wsAuthMiddleware := middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+		KeyLookup: "query:token",
+		Validator: func(token string, eCtx echo.Context) (b bool, err error) {
+			return token == s.token, nil
+		},
+	})
 	wsGroup := s.e.Group(
 		"/websocket",
 		// set auth middleware
-		middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
-			KeyLookup: "query:token",
-			Validator: func(token string, eCtx echo.Context) (b bool, err error) {
-				return token == s.token, nil
-			},
-		}),
+		wsAuthMiddleware,
 	)
 	wsGroup.GET("/indiserver", s.newIndiConnection)
 	wsGroup.GET("/phd2server", s.newPHD2Connection)
 
 	// protected RESTful API
-	s.e.POST(
-		"/mode/:new_mode",
-		s.changeMode,
-		// set auth middleware
-		middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
-			KeyLookup: "header:Authorization",
-			Validator: func(token string, eCtx echo.Context) (b bool, err error) {
-				return token == s.token, nil
-			},
-		}),
-	)
+	authMiddleware := middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+		KeyLookup: "header:Authorization",
+		Validator: func(token string, eCtx echo.Context) (b bool, err error) {
+			return token == s.token, nil
+		},
+	})
+
+	// JSON-RPC API takes token in Authorization header like RESTful API or in query like WS-API for browsers
+	rpcAuthMiddleware := func(next echo.HandlerFunc) echo.HandlerFunc {
+		headerAuth, queryAuth := authMiddleware(next), wsAuthMiddleware(next)
+		return func(c echo.Context) error {
+			if c.Request().Header.Get(echo.HeaderAuthorization) != "" {
+				return headerAuth(c)
+			}
+			return queryAuth(c)
+		}
+	}
+	s.e.GET("/websocket/rpc", s.newRPCConnection, rpcAuthMiddleware)
+	s.e.POST("/mode/:new_mode", s.changeMode, authMiddleware)
+	s.e.POST("/emergency-stop", s.emergencyStop, authMiddleware)
+	s.e.POST("/emergency-stop/clear", s.clearEmergencyStop, authMiddleware)
+	s.e.GET("/log-level", s.getLogLevel, authMiddleware)
+	s.e.POST("/log-level/:level", s.setLogLevel, authMiddleware)
+	if s.images != nil {
+		s.e.GET("/images/latest", s.getLatestImage, authMiddleware)
+	}
+	s.e.GET("/catalogue", s.getCatalogue, authMiddleware)
+	if s.journal != nil {
+		s.e.GET("/sessions", s.getSessions, authMiddleware)
+		s.e.GET("/sessions/:id", s.getSession, authMiddleware)
+	}
+	if s.audit != nil {
+		s.e.GET("/audit", s.getAudit, authMiddleware)
+		s.e.GET("/audit/verify", s.verifyAudit, authMiddleware)
+	}
+	s.e.GET("/connections", s.getConnections, authMiddleware)
+	s.e.POST("/connections/:conn/pause", s.pauseConnection, authMiddleware)
+	s.e.POST("/connections/:conn/resume", s.resumeConnection, authMiddleware)
+	s.e.POST("/connections/:conn/close", s.closeConnection, authMiddleware)
+	if s.scheduler != nil {
+		s.e.GET("/schedule", s.getSchedule, authMiddleware)
+		s.e.POST("/schedule", s.setSchedule, authMiddleware)
+	}
 
 	// public RESTful API
 	s.e.GET("/status", s.getStatus)
+	s.e.GET("/websocket/schema/v2", s.getSchemaV2)
 	s.e.GET("/restart", s.getRestart)
 
-	// start agent in a required mode
-	agentMode, ok := s.agentModes[s.currMode]
-	if !ok {
-		log.Println("unknown agent mode:", s.currMode)
+	// start agent in a required mode, API-server is started anyway so mode can be restarted or switched
+	if _, ok := s.agentModes[s.CurrentMode()]; !ok {
+		logger.Errorf("unknown agent mode: %v", s.CurrentMode())
 		return
 	}
-	agentMode.Start()
+	if err := s.modes.start(); err != nil {
+		logger.Errorf("could not start agent: %v", err)
+	}
 
 	// check if we are running TLS
 	if s.isTLS {
 		// generate self-signed cert to serve WS over TLS
 		keyFile, certFile, err := getSelfSignedCert()
 		if err != nil {
-			log.Println("could not start API-server, self-signed certificate generating failed:", err)
+			logger.Errorf("could not start API-server, self-signed certificate generating failed: %v", err)
 			return
 		}
 		// start HTTP/WS API server over TLS
 		err = s.e.StartTLS(fmt.Sprintf(":%d", s.port), certFile, keyFile)
 		if err != nil && err != http.ErrServerClosed {
-			log.Println("API-server error:", err)
+			logger.Errorf("API-server error: %v", err)
 		} else {
-			log.Println("API-server was shutdown gracefully")
+			logger.Infof("API-server was shutdown gracefully")
 		}
 		return
 	}
@@ -350,18 +637,20 @@ func (s *APIServer) Start() {
 	// start HTTP/WS API server
 	err := s.e.Start(fmt.Sprintf(":%d", s.port))
 	if err != nil && err != http.ErrServerClosed {
-		log.Println("API-server error:", err)
+		logger.Errorf("API-server error: %v", err)
 	} else {
-		log.Println("API-server was shutdown gracefully")
+		logger.Infof("API-server was shutdown gracefully")
 	}
 }
 
 func (s *APIServer) Stop() {
-	if agentMode, ok := s.agentModes[s.currMode]; ok {
-		agentMode.Stop()
+	if err := s.modes.stop(); err != nil {
+		logger.Errorf("could not stop agent: %v", err)
 	}
-	for _, conn := range s.connList {
+	s.connMu.Lock()
+	for conn := range s.conns {
 		conn.Close()
 	}
+	s.connMu.Unlock()
 	s.e.Shutdown(context.Background())
 }
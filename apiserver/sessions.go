@@ -0,0 +1,30 @@
+package apiserver
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+func (s *APIServer) getSessions(c echo.Context) error {
+	c.JSONPretty(http.StatusOK, s.journal.Records(), "    ")
+
+	return nil
+}
+
+func (s *APIServer) getSession(c echo.Context) error {
+	rec, ok := s.journal.Record(c.Param("id"))
+	if !ok {
+		c.JSON(
+			http.StatusNotFound,
+			map[string]interface{}{
+				"message": "unknown session " + c.Param("id"),
+			},
+		)
+		return nil
+	}
+
+	c.JSONPretty(http.StatusOK, rec, "    ")
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package apiserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo"
+
+	"github.com/indihub-space/agent/indijson"
+	"github.com/indihub-space/agent/lib"
+)
+
+// WS-subprotocol to request v2 messages instead of "format=v2" query parameter
+const subprotocolV2 = "indihub." + indijson.Version
+
+// errConvert is returned by writeElement for element which can't be converted to JSON, connection can go on
+var errConvert = errors.New("could not convert element to JSON")
+
+// wsFormat is format of messages of WS-connection to INDI-server
+type wsFormat struct {
+	v2            bool
+	blobFrames    bool
+	previewFormat string
+	previewSize   int
+	queuePolicy   string
+}
+
+// wsFormatParams returns format and queue policy requested with query parameters, v2 can be also requested with subprotocol
+func (s *APIServer) wsFormatParams(c echo.Context) (*wsFormat, error) {
+	f := &wsFormat{}
+
+	// optional replacing of FITS BLOBs with smaller previews
+	var err error
+	f.previewFormat, f.previewSize, err = s.previewParams(c, "preview", "preview-size", "")
+	if err != nil {
+		return nil, err
+	}
+
+	// optional sending of BLOBs as binary frames
+	switch blobs := c.QueryParam("blobs"); blobs {
+	case "", "json":
+	case blobsBinary:
+		f.blobFrames = true
+	default:
+		return nil, fmt.Errorf("unknown blobs value '%s', should be 'json' or '%s'", blobs, blobsBinary)
+	}
+
+	// what to drop when client is too slow
+	if f.queuePolicy, err = queuePolicy(c.QueryParam("queue")); err != nil {
+		return nil, err
+	}
+
+	switch format := c.QueryParam("format"); format {
+	case "", "v1":
+	case indijson.Version:
+		f.v2 = true
+	default:
+		return nil, fmt.Errorf("unknown format '%s', should be 'v1' or '%s'", format, indijson.Version)
+	}
+
+	return f, nil
+}
+
+// toJSON converts INDI XML-element to JSON message
+func (f *wsFormat) toJSON(el []byte) ([]byte, error) {
+	if f.v2 {
+		return indijson.FromXML(el)
+	}
+	return lib.ConvertElementToJSON(el)
+}
+
+// toXML converts JSON command to INDI XML-command
+func (f *wsFormat) toXML(xmlFlattener *lib.XmlFlattener, msg []byte) ([]byte, error) {
+	if f.v2 {
+		return indijson.ToXML(msg)
+	}
+	return xmlFlattener.ConvertJSONToXML(msg)
+}
+
+// writeElement converts INDI XML-element from INDI-server to JSON and writes it to WS,
+// BLOBs are written as header and binary frames if they were requested
+func (s *APIServer) writeElement(ws *websocket.Conn, f *wsFormat, el []byte) error {
+	ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+
+	if bytes.HasPrefix(el, setBLOBVector) {
+		if f.previewFormat != "" {
+			el = s.previewElement(el, f.previewSize, f.previewFormat)
+		}
+		if f.blobFrames && bytes.Contains(el, oneBLOBStart) {
+			return writeBLOBFrames(ws, el)
+		}
+	}
+
+	jsonEl, err := f.toJSON(el)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errConvert, err)
+	}
+	return ws.WriteMessage(websocket.TextMessage, jsonEl)
+}
+
+func (s *APIServer) getSchemaV2(c echo.Context) error {
+	return c.Blob(http.StatusOK, "application/schema+json", []byte(indijson.Schema))
+}
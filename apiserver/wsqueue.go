@@ -0,0 +1,240 @@
+package apiserver
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/indihub-space/agent/indiclient"
+	"github.com/indihub-space/agent/lib"
+)
+
+// policies of send queue when WS-client can't keep up with INDI-server
+const (
+	queueCoalesce  = "coalesce"   // queued set*Vector is replaced with newer one for the same property
+	queueSkipBLOBs = "skip-blobs" // BLOBs are dropped while client didn't receive previous ones
+)
+
+const (
+	sendQueueMaxItems = 4096
+	sendQueueMaxBytes = 128 * 1024 * 1024
+
+	wsWriteTimeout = 10 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	wsPingPeriod   = wsPongTimeout * 9 / 10
+)
+
+var (
+	setVectorPrefix  = []byte("<set")
+	errQueueOverflow = fmt.Errorf("send queue overflow: more than %d messages or %d bytes", sendQueueMaxItems, sendQueueMaxBytes)
+)
+
+type queueItem struct {
+	el   []byte
+	key  string // device and name of set*Vector, empty for other elements
+	blob bool
+}
+
+// sendQueue is bounded queue of INDI XML-elements waiting to be written to WS-client,
+// INDI-server is never blocked by the client: stale messages are dropped by policy and overflow closes the queue
+type sendQueue struct {
+	policy string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	items   []*queueItem
+	writing *queueItem // element returned by pop and not written yet
+	size    int
+	blobs   int // BLOBs queued or being written
+	dropped int
+	err     error
+	closed  bool
+}
+
+func newSendQueue(policy string) *sendQueue {
+	q := &sendQueue{policy: policy}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// queuePolicy returns send queue policy requested with query parameter
+func queuePolicy(val string) (string, error) {
+	switch val {
+	case "", queueCoalesce:
+		return queueCoalesce, nil
+	case queueSkipBLOBs:
+		return queueSkipBLOBs, nil
+	}
+	return "", fmt.Errorf("unknown queue value '%s', should be '%s' or '%s'", val, queueCoalesce, queueSkipBLOBs)
+}
+
+// push adds copy of element to queue, false is returned if queue is closed or overflowed
+func (q *sendQueue) push(el []byte) bool {
+	// elements returned by XmlFlattener share its buffer reused for the next chunk
+	el = append([]byte(nil), el...)
+	item := &queueItem{el: el}
+	if bytes.HasPrefix(el, setVectorPrefix) {
+		item.key = lib.ElementAttr(el, "device") + "\x00" + lib.ElementAttr(el, "name")
+		item.blob = bytes.HasPrefix(el, setBLOBVector)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+
+	switch {
+	case q.policy == queueSkipBLOBs && item.blob && q.blobs > 0:
+		q.dropped++
+		return true
+	case q.policy == queueCoalesce && item.key != "":
+		q.removeStale(item)
+	}
+
+	if len(q.items) >= sendQueueMaxItems || q.size+len(el) > sendQueueMaxBytes {
+		q.err = errQueueOverflow
+		q.closeLocked()
+		return false
+	}
+
+	q.items = append(q.items, item)
+	q.size += len(el)
+	if item.blob {
+		q.blobs++
+	}
+	q.cond.Signal()
+
+	return true
+}
+
+// removeStale removes queued set*Vector of the same property if the new one updates all its elements
+func (q *sendQueue) removeStale(item *queueItem) {
+	for i, queued := range q.items {
+		if queued.key != item.key {
+			continue
+		}
+		if !coversElements(item.el, queued.el) {
+			return
+		}
+		q.items = append(q.items[:i], q.items[i+1:]...)
+		q.size -= len(queued.el)
+		if queued.blob {
+			q.blobs--
+		}
+		q.dropped++
+		return
+	}
+}
+
+// pop waits for element, false is returned when queue is closed and drained,
+// done should be called when returned element is written
+func (q *sendQueue) pop() ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.items) == 0 || q.err != nil {
+		return nil, false
+	}
+
+	item := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	q.size -= len(item.el)
+	q.writing = item
+
+	return item.el, true
+}
+
+// done marks element returned by pop as written, so skip-blobs policy queues BLOBs again
+func (q *sendQueue) done() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.writing != nil && q.writing.blob {
+		q.blobs--
+	}
+	q.writing = nil
+}
+
+// close closes queue, elements already queued are still returned by pop
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closeLocked()
+}
+
+func (q *sendQueue) closeLocked() {
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// stats returns number of dropped elements and overflow error if any
+func (q *sendQueue) stats() (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped, q.err
+}
+
+// coversElements checks if set*Vector newer has values of all elements of older one
+func coversElements(newer []byte, older []byte) bool {
+	newMsg, err := indiclient.Parse(newer)
+	if err != nil || newMsg.Vector == nil {
+		return false
+	}
+	oldMsg, err := indiclient.Parse(older)
+	if err != nil || oldMsg.Vector == nil {
+		return false
+	}
+	if oldMsg.Vector.Message != "" && newMsg.Vector.Message == "" {
+		// message of older update would be lost
+		return false
+	}
+	for _, e := range oldMsg.Vector.Elements {
+		if _, ok := newMsg.Vector.Element(e.Name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// keepAlive pings WS-client and closes connection if it doesn't answer in time, stops when done is closed
+func keepAlive(ws *websocket.Conn, done <-chan struct{}) {
+	ws.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	go func() {
+		ticker := time.NewTicker(wsPingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+					ws.Close()
+					return
+				}
+			}
+		}
+	}()
+}
+
+// closeWS sends close frame with reason before closing connection
+func closeWS(ws *websocket.Conn, code int, reason string) {
+	ws.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(wsWriteTimeout),
+	)
+	ws.Close()
+}
@@ -0,0 +1,84 @@
+package apiserver
+
+import (
+	"testing"
+
+	"github.com/indihub-space/agent/lib"
+)
+
+func blobElement(value string) []byte {
+	return []byte(`<setBLOBVector device="CCD" name="CCD1"><oneBLOB name="CCD1" size="4" format=".fits">` + value +
+		`</oneBLOB></setBLOBVector>`)
+}
+
+func TestSkipBLOBsUntilWritten(t *testing.T) {
+	q := newSendQueue(queueSkipBLOBs)
+
+	q.push(blobElement("AAAA"))
+	if _, ok := q.pop(); !ok {
+		t.Fatal("expected BLOB to be popped")
+	}
+
+	// the first BLOB is still being written to client
+	q.push(blobElement("BBBB"))
+	if dropped, _ := q.stats(); dropped != 1 {
+		t.Fatalf("expected BLOB to be dropped while previous one is written, dropped %d", dropped)
+	}
+
+	q.done()
+	q.push(blobElement("CCCC"))
+	if dropped, _ := q.stats(); dropped != 1 {
+		t.Fatalf("expected BLOB to be queued after previous one is written, dropped %d", dropped)
+	}
+	el, ok := q.pop()
+	if !ok || string(el) != string(blobElement("CCCC")) {
+		t.Fatalf("unexpected element %s", el)
+	}
+}
+
+func TestCoalesceReplacesStaleUpdate(t *testing.T) {
+	q := newSendQueue(queueCoalesce)
+
+	q.push([]byte(`<setNumberVector device="Telescope" name="EQUATORIAL_EOD_COORD"><oneNumber name="RA">1</oneNumber></setNumberVector>`))
+	q.push([]byte(`<message device="Telescope" message="Slewing"/>`))
+	q.push([]byte(`<setNumberVector device="Telescope" name="EQUATORIAL_EOD_COORD"><oneNumber name="RA">2</oneNumber></setNumberVector>`))
+	q.close()
+
+	elements := []string{}
+	for {
+		el, ok := q.pop()
+		if !ok {
+			break
+		}
+		q.done()
+		elements = append(elements, string(el))
+	}
+	if len(elements) != 2 || elements[1] != `<setNumberVector device="Telescope" name="EQUATORIAL_EOD_COORD"><oneNumber name="RA">2</oneNumber></setNumberVector>` {
+		t.Fatalf("unexpected elements %q", elements)
+	}
+}
+
+func TestQueuedElementsSurviveNextChunk(t *testing.T) {
+	q := newSendQueue(queueCoalesce)
+	xmlFlattener := lib.NewXmlFlattener()
+
+	for _, chunk := range []string{`<message device="A" message="first"/>`, `<message device="B" message="XXXXX"/>`} {
+		for _, el := range xmlFlattener.FeedChunk([]byte(chunk)) {
+			q.push(el)
+		}
+	}
+	q.close()
+
+	elements := []string{}
+	for {
+		el, ok := q.pop()
+		if !ok {
+			break
+		}
+		q.done()
+		elements = append(elements, string(el))
+	}
+	if len(elements) != 2 || elements[0] != `<message device="A" message="first"/>` {
+		t.Fatalf("queued element is overwritten by next chunk: %q", elements)
+	}
+}
@@ -0,0 +1,35 @@
+package astro
+
+import (
+	"math"
+	"time"
+)
+
+const deg = math.Pi / 180
+
+// SiderealTime returns local mean sidereal time in hours for longitude in degrees (east is positive)
+func SiderealTime(t time.Time, longitude float64) float64 {
+	days := float64(t.UTC().UnixNano())/float64(24*time.Hour) - 10957.5 // days since J2000.0
+	return Normalize(18.697374558+24.06570982441908*days+longitude/15, 24)
+}
+
+// Horizontal converts equatorial coordinates (hours, degrees) to altitude and azimuth (degrees, from North to East)
+func Horizontal(ra float64, dec float64, latitude float64, lst float64) (float64, float64) {
+	ha := (lst - ra) * 15 * deg
+	dec *= deg
+	lat := latitude * deg
+
+	alt := math.Asin(math.Sin(dec)*math.Sin(lat) + math.Cos(dec)*math.Cos(lat)*math.Cos(ha))
+	az := math.Atan2(-math.Cos(dec)*math.Sin(ha), math.Sin(dec)*math.Cos(lat)-math.Cos(dec)*math.Sin(lat)*math.Cos(ha))
+
+	return alt / deg, Normalize(az/deg, 360)
+}
+
+// Normalize returns value in range [0, period)
+func Normalize(val float64, period float64) float64 {
+	val = math.Mod(val, period)
+	if val < 0 {
+		val += period
+	}
+	return val
+}
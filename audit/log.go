@@ -0,0 +1,503 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/indihub-space/agent/indiclient"
+	"github.com/indihub-space/agent/logutil"
+)
+
+var logger = logutil.New("subsystem", "audit")
+
+// sources of commands
+const (
+	SourceTunnel    = "tunnel"    // guest connection from INDIHUB cloud
+	SourceWebSocket = "websocket" // WS-API and JSON-RPC API clients
+	SourceREST      = "rest"      // RESTful API requests
+	SourceAlpaca    = "alpaca"    // ASCOM Alpaca clients
+	SourceMQTT      = "mqtt"      // commands from MQTT set topics
+	SourceTelescope = "telescope" // Stellarium and LX200 telescope control clients
+	SourceAudit     = "audit"     // problems audit log found in itself when opened
+)
+
+// command of entries added by audit log itself
+const CommandCheck = "check"
+
+// decisions of INDI filter about command
+const (
+	Allowed   = "allowed"
+	Denied    = "denied"
+	Rewritten = "rewritten"
+)
+
+var (
+	elementNew           = []byte("<new")
+	elementGetProperties = []byte("<getProperties")
+	elementEnableBLOB    = []byte("<enableBLOB")
+
+	ErrTampered = errors.New("audit log is tampered")
+	ErrRepaired = errors.New("audit log was repaired")
+	ErrNoKey    = errors.New("audit log key is empty")
+)
+
+// Entry is audit log record of one command sent to equipment
+type Entry struct {
+	Seq       uint64            `json:"seq"`
+	Time      time.Time         `json:"time"`
+	Source    string            `json:"source"`
+	Client    string            `json:"client"`          // guest connection number or client address
+	Token     string            `json:"token,omitempty"` // fingerprint of API token
+	Mode      string            `json:"mode"`
+	SessionID uint64            `json:"sessionID,omitempty"`
+	Command   string            `json:"command"`
+	Device    string            `json:"device,omitempty"`
+	Property  string            `json:"property,omitempty"`
+	Values    map[string]string `json:"values,omitempty"`
+	Decision  string            `json:"decision"`
+	Reason    string            `json:"reason,omitempty"`
+	PrevHash  string            `json:"prevHash"`
+	Hash      string            `json:"hash"`
+}
+
+// Query selects audit log entries, empty fields match everything
+type Query struct {
+	From      time.Time
+	To        time.Time
+	Source    string
+	Client    string
+	Mode      string
+	SessionID uint64
+	Device    string
+	Property  string
+	Decision  string
+	Limit     int // max number of the newest entries, 0 - all
+}
+
+// Log is append-only JSON-lines file of commands, every entry contains keyed hash of the previous one
+// and hash of the last entry is kept in head checkpoint file, so changed, removed or truncated entries
+// are detected by Verify
+type Log struct {
+	fileName string
+	key      []byte
+
+	mu       sync.Mutex
+	file     *os.File
+	head     *os.File
+	size     int64 // size of complete entries, scans don't read past it
+	seq      uint64
+	lastHash string
+	problems []error // found when log was opened
+}
+
+// IsCommand checks if INDI XML-element is a command which is logged: new*Vector, getProperties or enableBLOB
+func IsCommand(el []byte) bool {
+	return bytes.HasPrefix(el, elementNew) || bytes.HasPrefix(el, elementGetProperties) ||
+		bytes.HasPrefix(el, elementEnableBLOB)
+}
+
+// TokenID returns fingerprint of API token, so entries tell tokens apart without storing them
+func TokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:4])
+}
+
+// Open opens audit log file to append new entries signed with key, the file is created if it doesn't exist.
+// Partial last entry left by crash is removed, problems found in log are reported by Verify
+// and written to log as entries with source "audit"
+func Open(fileName string, key []byte) (*Log, error) {
+	if len(key) == 0 {
+		return nil, ErrNoKey
+	}
+	l := &Log{fileName: fileName, key: key}
+
+	var err error
+	l.file, err = os.OpenFile(fileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l.head, err = os.OpenFile(headFileName(fileName), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		l.file.Close()
+		return nil, err
+	}
+
+	prevHash, err := l.readTail()
+	if err == nil {
+		err = l.checkHead(prevHash)
+	}
+	if err != nil {
+		l.file.Close()
+		l.head.Close()
+		return nil, err
+	}
+
+	for _, p := range l.problems {
+		logger.Warnf("%s", p)
+		err := l.Append(Entry{Source: SourceAudit, Command: CommandCheck, Reason: p.Error()})
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// readTail reads sequence number and hash of the last entry, partial last line is truncated,
+// hash of the entry before the last one is returned
+func (l *Log) readTail() (string, error) {
+	prevHash := ""
+	r := bufio.NewReader(l.file)
+	line := 1
+	for ; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		l.size += int64(len(data))
+
+		e := &Entry{}
+		if len(bytes.TrimSpace(data)) == 0 || json.Unmarshal(data, e) != nil {
+			// bad complete lines are left to Verify
+			continue
+		}
+		prevHash = l.lastHash
+		l.seq = e.Seq
+		l.lastHash = e.Hash
+	}
+
+	fi, err := l.file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if fi.Size() > l.size {
+		if err := l.file.Truncate(l.size); err != nil {
+			return "", err
+		}
+		l.problems = append(l.problems, fmt.Errorf("%w: partial entry in line %d removed", ErrRepaired, line))
+	}
+
+	return prevHash, nil
+}
+
+// checkHead compares the last entry with head checkpoint, checkpoint which is one entry behind
+// is left by crash between writing entry and checkpoint
+func (l *Log) checkHead(prevHash string) error {
+	data, err := ioutil.ReadAll(l.head)
+	if err != nil {
+		return err
+	}
+
+	if len(data) == 0 {
+		if l.seq > 0 {
+			l.problems = append(l.problems, fmt.Errorf("%w: head checkpoint is missing", ErrTampered))
+		}
+		return nil
+	}
+
+	seq, hash, ok := l.parseHead(data)
+	switch {
+	case !ok:
+		l.problems = append(l.problems, fmt.Errorf("%w: head checkpoint is changed", ErrTampered))
+	case seq == l.seq && hash == l.lastHash,
+		seq+1 == l.seq && hash == prevHash:
+	case seq > l.seq:
+		l.problems = append(l.problems, fmt.Errorf("%w: entries %d-%d were removed", ErrTampered, l.seq+1, seq))
+	default:
+		l.problems = append(l.problems, fmt.Errorf("%w: entry %d doesn't match head checkpoint", ErrTampered, seq))
+	}
+	return nil
+}
+
+// writeHead writes sequence number and hash of the last entry to head checkpoint,
+// checkpoint has fixed length so it is overwritten in place
+func (l *Log) writeHead() error {
+	head := fmt.Sprintf("%020d %s", l.seq, l.lastHash)
+	_, err := l.head.WriteAt([]byte(head+" "+l.sign([]byte(head))+"\n"), 0)
+	return err
+}
+
+func (l *Log) parseHead(data []byte) (uint64, string, bool) {
+	parts := strings.Fields(string(data))
+	if len(parts) != 3 {
+		return 0, "", false
+	}
+	head := parts[0] + " " + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(l.sign([]byte(head)))) {
+		return 0, "", false
+	}
+	var seq uint64
+	if _, err := fmt.Sscanf(parts[0], "%d", &seq); err != nil {
+		return 0, "", false
+	}
+	return seq, parts[1], true
+}
+
+// LoadKey reads hex key signing audit log entries, new random key is written to file if it doesn't exist.
+// Keep the key away from guests and backups of audit log: entries can be forged with it
+func LoadKey(fileName string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(fileName, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		logger.Infof("New audit log key is written to %s", fileName)
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("bad audit log key in %s: %s", fileName, err)
+	}
+	if len(key) == 0 {
+		return nil, ErrNoKey
+	}
+	return key, nil
+}
+
+func headFileName(fileName string) string {
+	return fileName + ".head"
+}
+
+// Close closes audit log file
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.head.Close()
+	return l.file.Close()
+}
+
+// Record adds entry for INDI XML-element if it is a command, nil log ignores all entries
+func (l *Log) Record(e Entry, el []byte) {
+	if l == nil || !IsCommand(el) {
+		return
+	}
+
+	msg, err := indiclient.Parse(el)
+	if err != nil {
+		e.Command = "invalid"
+		e.Reason = err.Error()
+	} else {
+		e.Command = msg.Tag
+		e.Device = msg.Device
+		e.Property = msg.Name
+		e.Values = commandValues(msg, el)
+	}
+
+	if err := l.Append(e); err != nil {
+		logger.Errorf("could not write audit log entry: %s", err)
+	}
+}
+
+// Append sets sequence number, time and hashes of entry and writes it to the file
+func (l *Log) Append(e Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Seq = l.seq + 1
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	// UTC time is marshalled back to the same string, so hash can be checked
+	e.Time = e.Time.UTC()
+	e.PrevHash = l.lastHash
+	hash, err := l.hash(e)
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	l.size += int64(len(data) + 1)
+	l.seq = e.Seq
+	l.lastHash = e.Hash
+	return l.writeHead()
+}
+
+// Query returns entries matching query, the newest first. Entries are read without blocking Append,
+// ones appended during query are not returned
+func (l *Log) Query(q Query) ([]Entry, error) {
+	l.mu.Lock()
+	size := l.size
+	l.mu.Unlock()
+
+	list := []Entry{}
+	err := scan(l.fileName, size, func(e *Entry, line int, err error) error {
+		if err == nil && q.match(e) {
+			list = append(list, *e)
+			if q.Limit > 0 && len(list) > q.Limit {
+				list = list[1:]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list, nil
+}
+
+// Verify checks hash chain of all entries and problems found when log was opened,
+// number of checked entries is returned
+func (l *Log) Verify() (int, error) {
+	l.mu.Lock()
+	size := l.size
+	lastHash := l.lastHash
+	problems := l.problems
+	l.mu.Unlock()
+
+	count := 0
+	prevHash := ""
+	err := scan(l.fileName, size, func(e *Entry, line int, err error) error {
+		if err != nil {
+			return fmt.Errorf("%w: bad entry in line %d: %s", ErrTampered, line, err)
+		}
+		if e.PrevHash != prevHash {
+			return fmt.Errorf("%w: entry %d in line %d doesn't follow the previous one", ErrTampered, e.Seq, line)
+		}
+		hash, err := l.hash(*e)
+		if err != nil {
+			return err
+		}
+		if hash != e.Hash {
+			return fmt.Errorf("%w: entry %d in line %d was changed", ErrTampered, e.Seq, line)
+		}
+		prevHash = e.Hash
+		count++
+		return nil
+	})
+	if err == nil && prevHash != lastHash {
+		err = fmt.Errorf("%w: entries after %d were removed", ErrTampered, count)
+	}
+	if err == nil && len(problems) > 0 {
+		err = problems[0]
+		for _, p := range problems[1:] {
+			err = fmt.Errorf("%w; %s", err, p)
+		}
+	}
+	return count, err
+}
+
+// hash returns hex HMAC-SHA256 of entry JSON without hash itself
+func (l *Log) hash(e Entry) (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	return l.sign(data), nil
+}
+
+func (l *Log) sign(data []byte) string {
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (q *Query) match(e *Entry) bool {
+	switch {
+	case !q.From.IsZero() && e.Time.Before(q.From),
+		!q.To.IsZero() && e.Time.After(q.To),
+		q.Source != "" && e.Source != q.Source,
+		q.Client != "" && e.Client != q.Client,
+		q.Mode != "" && e.Mode != q.Mode,
+		q.SessionID != 0 && e.SessionID != q.SessionID,
+		q.Device != "" && e.Device != q.Device,
+		q.Property != "" && e.Property != q.Property,
+		q.Decision != "" && e.Decision != q.Decision:
+		return false
+	}
+	return true
+}
+
+// scan calls fn for every entry in the first size bytes of audit log file with error for bad entries
+func scan(fileName string, size int64, fn func(e *Entry, line int, err error) error) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(io.LimitReader(f, size))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		e := &Entry{}
+		if err := fn(e, line, json.Unmarshal(scanner.Bytes(), e)); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// commandValues returns element values of new*Vector, BLOBs are replaced with their size and format,
+// enableBLOB has its policy as value
+func commandValues(msg *indiclient.Message, el []byte) map[string]string {
+	if bytes.HasPrefix(el, elementEnableBLOB) {
+		return map[string]string{"policy": enableBLOBPolicy(el)}
+	}
+	if msg.Vector == nil || len(msg.Vector.Elements) == 0 {
+		return nil
+	}
+
+	values := map[string]string{}
+	for _, e := range msg.Vector.Elements {
+		if msg.Vector.Kind == indiclient.KindBLOB {
+			values[e.Name] = fmt.Sprintf("BLOB %s, size %s", e.Format, e.Size)
+			continue
+		}
+		values[e.Name] = e.Value
+	}
+	return values
+}
+
+func enableBLOBPolicy(el []byte) string {
+	start := bytes.IndexByte(el, '>')
+	end := bytes.LastIndex(el, []byte("</"))
+	if start < 0 || end <= start {
+		return ""
+	}
+	return string(bytes.TrimSpace(el[start+1 : end]))
+}
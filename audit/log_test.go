@@ -0,0 +1,327 @@
+package audit
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("0123456789abcdef")
+
+func tempLog(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "audit.jsonl"), func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func openLog(t *testing.T, fileName string) *Log {
+	t.Helper()
+	l, err := Open(fileName, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// writeEntries opens log, records commands and closes it
+func writeEntries(t *testing.T, fileName string, commands ...string) {
+	t.Helper()
+	l := openLog(t, fileName)
+	defer l.Close()
+	for i, cmd := range commands {
+		l.Record(Entry{Source: SourceTunnel, Client: "1", Mode: "share", Decision: Allowed, Time: time.Unix(int64(1000+i), 0)}, []byte(cmd))
+	}
+}
+
+func readLines(t *testing.T, fileName string) []string {
+	t.Helper()
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.SplitAfter(string(data), "\n")
+}
+
+func writeLines(t *testing.T, fileName string, lines []string) {
+	t.Helper()
+	if err := ioutil.WriteFile(fileName, []byte(strings.Join(lines, "")), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const (
+	slew   = `<newNumberVector device="Mount" name="EQUATORIAL_EOD_COORD"><oneNumber name="RA">5.5</oneNumber><oneNumber name="DEC">10</oneNumber></newNumberVector>`
+	expose = `<newNumberVector device="CCD" name="CCD_EXPOSURE"><oneNumber name="CCD_EXPOSURE_VALUE">30</oneNumber></newNumberVector>`
+	blob   = `<enableBLOB device="CCD">Also</enableBLOB>`
+)
+
+func TestAppendAndQuery(t *testing.T) {
+	fileName, cleanup := tempLog(t)
+	defer cleanup()
+
+	l := openLog(t, fileName)
+	defer l.Close()
+	l.Record(Entry{Source: SourceTunnel, Client: "1", Decision: Allowed}, []byte(slew))
+	l.Record(Entry{Source: SourceREST, Client: "127.0.0.1", Decision: Denied}, []byte(expose))
+	l.Record(Entry{Source: SourceTunnel, Client: "2", Decision: Allowed}, []byte(blob))
+	// not a command
+	l.Record(Entry{Source: SourceTunnel, Client: "2", Decision: Allowed}, []byte(`<setNumberVector device="CCD" name="CCD_TEMPERATURE"></setNumberVector>`))
+
+	all, err := l.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 || all[0].Seq != 3 || all[2].Seq != 1 {
+		t.Fatalf("expected 3 entries the newest first, got %+v", all)
+	}
+	if e := all[2]; e.Command != "newNumberVector" || e.Device != "Mount" || e.Property != "EQUATORIAL_EOD_COORD" ||
+		e.Values["RA"] != "5.5" || e.Values["DEC"] != "10" || e.PrevHash != "" || e.Hash == "" {
+		t.Errorf("unexpected slew entry: %+v", e)
+	}
+	if e := all[0]; e.Command != "enableBLOB" || e.Values["policy"] != "Also" || e.PrevHash != all[1].Hash {
+		t.Errorf("unexpected enableBLOB entry: %+v", e)
+	}
+
+	for _, c := range []struct {
+		q    Query
+		seqs []uint64
+	}{
+		{Query{Source: SourceTunnel}, []uint64{3, 1}},
+		{Query{Decision: Denied}, []uint64{2}},
+		{Query{Device: "CCD", Limit: 1}, []uint64{3}},
+		{Query{Property: "CCD_EXPOSURE", Client: "127.0.0.1"}, []uint64{2}},
+		{Query{To: time.Now().Add(-time.Hour)}, []uint64{}},
+	} {
+		list, err := l.Query(c.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs := []uint64{}
+		for _, e := range list {
+			seqs = append(seqs, e.Seq)
+		}
+		if len(seqs) != len(c.seqs) || (len(seqs) > 0 && seqs[0] != c.seqs[0]) {
+			t.Errorf("query %+v: expected %v, got %v", c.q, c.seqs, seqs)
+		}
+	}
+
+	if count, err := l.Verify(); err != nil || count != 3 {
+		t.Errorf("verify of intact log: %d entries, %v", count, err)
+	}
+}
+
+func TestReopenContinuesChain(t *testing.T) {
+	fileName, cleanup := tempLog(t)
+	defer cleanup()
+
+	writeEntries(t, fileName, slew, expose)
+	writeEntries(t, fileName, blob)
+
+	l := openLog(t, fileName)
+	defer l.Close()
+	count, err := l.Verify()
+	if err != nil || count != 3 {
+		t.Fatalf("verify of re-opened log: %d entries, %v", count, err)
+	}
+}
+
+func TestQueryDoesNotBlockAppend(t *testing.T) {
+	fileName, cleanup := tempLog(t)
+	defer cleanup()
+
+	l := openLog(t, fileName)
+	defer l.Close()
+	for i := 0; i < 100; i++ {
+		l.Record(Entry{Source: SourceTunnel, Decision: Allowed}, []byte(slew))
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			l.Record(Entry{Source: SourceTunnel, Decision: Allowed}, []byte(expose))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			// every query sees complete entries only
+			if _, err := l.Verify(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	if count, err := l.Verify(); err != nil || count != 200 {
+		t.Errorf("verify after concurrent appends: %d entries, %v", count, err)
+	}
+}
+
+func TestVerifyFindsTampering(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		tamper func(lines []string) []string
+	}{
+		{"changed", func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], "CCD_EXPOSURE_VALUE\":\"30", "CCD_EXPOSURE_VALUE\":\"300", 1)
+			return lines
+		}},
+		{"removed", func(lines []string) []string {
+			return append(lines[:1:1], lines[2:]...)
+		}},
+		{"reordered", func(lines []string) []string {
+			lines[0], lines[1] = lines[1], lines[0]
+			return lines
+		}},
+		{"truncated", func(lines []string) []string {
+			return lines[:2]
+		}},
+		{"bad entry", func(lines []string) []string {
+			lines[1] = "{bad\n"
+			return lines
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			fileName, cleanup := tempLog(t)
+			defer cleanup()
+			writeEntries(t, fileName, slew, expose, blob)
+			writeLines(t, fileName, c.tamper(readLines(t, fileName)))
+
+			l := openLog(t, fileName)
+			defer l.Close()
+			if _, err := l.Verify(); !errors.Is(err, ErrTampered) {
+				t.Errorf("tampering is not found: %v", err)
+			}
+		})
+	}
+}
+
+func TestForgedChainIsFound(t *testing.T) {
+	fileName, cleanup := tempLog(t)
+	defer cleanup()
+	writeEntries(t, fileName, slew, expose)
+
+	// chain re-written with other key is not accepted
+	other := fileName + ".other"
+	l, err := Open(other, []byte("other key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Record(Entry{Source: SourceTunnel, Decision: Allowed}, []byte(blob))
+	l.Close()
+	data, err := ioutil.ReadFile(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fileName, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l = openLog(t, fileName)
+	defer l.Close()
+	if _, err := l.Verify(); !errors.Is(err, ErrTampered) {
+		t.Errorf("forged chain is not found: %v", err)
+	}
+}
+
+func TestPartialLastEntryIsRemoved(t *testing.T) {
+	fileName, cleanup := tempLog(t)
+	defer cleanup()
+	writeEntries(t, fileName, slew, expose)
+
+	// crash in the middle of writing entry
+	lines := readLines(t, fileName)
+	writeLines(t, fileName, append(lines, `{"seq":3,"time":"2020-10`))
+
+	l := openLog(t, fileName)
+	count, err := l.Verify()
+	if !errors.Is(err, ErrRepaired) || errors.Is(err, ErrTampered) || count != 3 {
+		t.Errorf("expected repaired log with 3 entries, got %d: %v", count, err)
+	}
+	list, err := l.Query(Query{Source: SourceAudit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Seq != 3 || !strings.Contains(list[0].Reason, "partial entry in line 3") {
+		t.Errorf("repair is not written to log: %+v", list)
+	}
+	l.Record(Entry{Source: SourceTunnel, Decision: Allowed}, []byte(blob))
+	l.Close()
+
+	// repair is kept in log, but chain is intact
+	l = openLog(t, fileName)
+	defer l.Close()
+	if count, err := l.Verify(); err != nil || count != 4 {
+		t.Errorf("verify of repaired log: %d entries, %v", count, err)
+	}
+}
+
+func TestHeadCheckpoint(t *testing.T) {
+	fileName, cleanup := tempLog(t)
+	defer cleanup()
+	writeEntries(t, fileName, slew, expose, blob)
+	head, err := ioutil.ReadFile(headFileName(fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// crash between writing entry and checkpoint
+	lines := readLines(t, fileName)
+	writeEntries(t, fileName, slew)
+	writeLines(t, fileName, append(lines[:3], readLines(t, fileName)[3]))
+	if err := ioutil.WriteFile(headFileName(fileName), head, 0600); err != nil {
+		t.Fatal(err)
+	}
+	l := openLog(t, fileName)
+	if count, err := l.Verify(); err != nil || count != 4 {
+		t.Errorf("checkpoint behind by one entry: %d entries, %v", count, err)
+	}
+	l.Close()
+
+	for _, c := range []struct {
+		name string
+		head []byte
+	}{
+		{"missing", []byte{}},
+		{"changed", []byte(strings.Replace(string(head), "3", "2", 1))},
+	} {
+		if err := ioutil.WriteFile(headFileName(fileName), c.head, 0600); err != nil {
+			t.Fatal(err)
+		}
+		l := openLog(t, fileName)
+		if _, err := l.Verify(); !errors.Is(err, ErrTampered) {
+			t.Errorf("%s checkpoint is not found: %v", c.name, err)
+		}
+		l.Close()
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	fileName, cleanup := tempLog(t)
+	defer cleanup()
+	keyFile := fileName + ".key"
+
+	key, err := LoadKey(keyFile)
+	if err != nil || len(key) != 32 {
+		t.Fatalf("new key: %x, %v", key, err)
+	}
+	again, err := LoadKey(keyFile)
+	if err != nil || string(again) != string(key) {
+		t.Errorf("key is not read back: %x, %v", again, err)
+	}
+	if _, err := Open(fileName, nil); err != ErrNoKey {
+		t.Errorf("log is opened without key: %v", err)
+	}
+}
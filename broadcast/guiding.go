@@ -0,0 +1,204 @@
+package broadcast
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/indihub-space/agent/indiclient"
+)
+
+const (
+	// guiding stats are published to viewers as this property
+	guideStatsDevice   = "PHD2"
+	guideStatsProperty = "GUIDE_STATS"
+
+	// RMS and peak errors are computed over this many latest guide steps
+	guideStatsSteps = 100
+
+	// connection to PHD2 event server is retried after this delay
+	phd2RetryInterval = 10 * time.Second
+)
+
+// pixelScaleRequest asks PHD2 for arcsec per pixel of guide camera
+var pixelScaleRequest = []byte("{\"method\":\"get_pixel_scale\",\"id\":1}\r\n")
+
+// phd2Event is event or response to RPC sent by PHD2 event server
+type phd2Event struct {
+	Event          string          `json:"Event"`
+	RADistanceRaw  float64         `json:"RADistanceRaw"`
+	DECDistanceRaw float64         `json:"DECDistanceRaw"`
+	ID             *int            `json:"id"`
+	Result         json.RawMessage `json:"result"`
+}
+
+type guideStep struct {
+	ra  float64
+	dec float64
+}
+
+// guideStats is RMS and peak guiding error over the latest guide steps
+type guideStats struct {
+	steps []guideStep
+	scale float64 // arcsec per pixel, 0 if unknown
+	state string
+}
+
+func newGuideStats() *guideStats {
+	return &guideStats{state: indiclient.StateIdle}
+}
+
+func (s *guideStats) add(ra, dec float64) {
+	s.steps = append(s.steps, guideStep{ra: ra, dec: dec})
+	if len(s.steps) > guideStatsSteps {
+		s.steps = s.steps[len(s.steps)-guideStatsSteps:]
+	}
+	s.state = indiclient.StateOk
+}
+
+// vector returns stats as INDI number vector, errors are in arcsec if pixel scale is known and in pixels otherwise
+func (s *guideStats) vector() *indiclient.Vector {
+	scale := s.scale
+	if scale <= 0 {
+		scale = 1
+	}
+
+	var raErr, decErr, raRMS, decRMS, raPeak, decPeak float64
+	if n := float64(len(s.steps)); n > 0 {
+		var raSum, decSum, raSq, decSq float64
+		for _, st := range s.steps {
+			raSum += st.ra
+			decSum += st.dec
+			raSq += st.ra * st.ra
+			decSq += st.dec * st.dec
+			raPeak = math.Max(raPeak, math.Abs(st.ra))
+			decPeak = math.Max(decPeak, math.Abs(st.dec))
+		}
+		// RMS is standard deviation of error as PHD2 shows it
+		raRMS = math.Sqrt(math.Max(raSq/n-(raSum/n)*(raSum/n), 0))
+		decRMS = math.Sqrt(math.Max(decSq/n-(decSum/n)*(decSum/n), 0))
+		last := s.steps[len(s.steps)-1]
+		raErr, decErr = last.ra, last.dec
+	}
+
+	number := func(name, label string, value float64) indiclient.Element {
+		return indiclient.Element{
+			Name:   name,
+			Label:  label,
+			Value:  fmt.Sprintf("%.2f", value),
+			Format: "%.2f",
+			Min:    "0",
+			Max:    "0",
+			Step:   "0",
+		}
+	}
+	return &indiclient.Vector{
+		Kind:      indiclient.KindNumber,
+		Device:    guideStatsDevice,
+		Name:      guideStatsProperty,
+		Label:     "Guiding",
+		Group:     "Guiding",
+		State:     s.state,
+		Perm:      "ro",
+		Timestamp: time.Now().UTC().Format("2006-01-02T15:04:05"),
+		Elements: []indiclient.Element{
+			number("RMS_RA", "RMS RA", raRMS*scale),
+			number("RMS_DEC", "RMS DEC", decRMS*scale),
+			number("RMS_TOTAL", "RMS total", math.Hypot(raRMS, decRMS)*scale),
+			number("PEAK_RA", "Peak RA", raPeak*scale),
+			number("PEAK_DEC", "Peak DEC", decPeak*scale),
+			number("ERR_RA", "Last RA error", raErr*scale),
+			number("ERR_DEC", "Last DEC error", decErr*scale),
+			number("PIXEL_SCALE", "Pixel scale (arcsec/px)", s.scale),
+		},
+	}
+}
+
+// watchGuiding reads guide steps from PHD2 event server until ctx is done, update is called after each change of stats
+func watchGuiding(ctx context.Context, addr string, stats *guideStats, update func(v *indiclient.Vector)) {
+	for {
+		err := readPHD2(ctx, addr, stats, update)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Warnf("Lost PHD2 event stream in broadcast mode: %s, reconnecting in %s", err, phd2RetryInterval)
+		if stats.state != indiclient.StateIdle {
+			stats.state = indiclient.StateAlert
+			update(stats.vector())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(phd2RetryInterval):
+		}
+	}
+}
+
+func readPHD2(ctx context.Context, addr string, stats *guideStats, update func(v *indiclient.Vector)) error {
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if _, err := conn.Write(pixelScaleRequest); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		ev := phd2Event{}
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			continue
+		}
+
+		// pixel scale is null if PHD2 doesn't know it
+		if ev.ID != nil {
+			scale := 0.0
+			json.Unmarshal(ev.Result, &scale)
+			stats.scale = scale
+			update(stats.vector())
+			continue
+		}
+
+		switch ev.Event {
+		case "StartGuiding":
+			stats.steps = nil
+			stats.state = indiclient.StateBusy
+			// guide camera or its binning may be changed since the last request
+			if _, err := conn.Write(pixelScaleRequest); err != nil {
+				return err
+			}
+		case "GuideStep":
+			stats.add(ev.RADistanceRaw, ev.DECDistanceRaw)
+		case "StarLost":
+			stats.state = indiclient.StateAlert
+		case "GuidingStopped":
+			stats.state = indiclient.StateIdle
+		default:
+			continue
+		}
+		update(stats.vector())
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("connection is closed by PHD2")
+}
@@ -0,0 +1,113 @@
+package broadcast
+
+import (
+	"bufio"
+	"context"
+	"math"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/indihub-space/agent/indiclient"
+)
+
+func element(t *testing.T, v *indiclient.Vector, name string) float64 {
+	t.Helper()
+	e, ok := v.Element(name)
+	if !ok {
+		t.Fatalf("no %s in %s", name, v.Name)
+	}
+	val, err := strconv.ParseFloat(e.Value, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return val
+}
+
+func TestGuideStats(t *testing.T) {
+	s := newGuideStats()
+	v := s.vector()
+	if v.State != indiclient.StateIdle || v.Device != guideStatsDevice || v.Name != guideStatsProperty ||
+		element(t, v, "RMS_TOTAL") != 0 {
+		t.Errorf("unexpected stats without guide steps: %v", v)
+	}
+
+	// the oldest steps with large error are out of window
+	s.add(10, 10)
+	for i := 0; i < guideStatsSteps; i++ {
+		s.add(float64(1-2*(i%2)), 0.5)
+	}
+	v = s.vector()
+	if v.State != indiclient.StateOk || element(t, v, "RMS_RA") != 1 || element(t, v, "RMS_DEC") != 0 ||
+		element(t, v, "PEAK_RA") != 1 || element(t, v, "PEAK_DEC") != 0.5 || element(t, v, "ERR_RA") != -1 {
+		t.Errorf("unexpected stats in pixels: %v", v.Elements)
+	}
+
+	s.scale = 2
+	v = s.vector()
+	if element(t, v, "RMS_RA") != 2 || element(t, v, "RMS_TOTAL") != 2 || element(t, v, "ERR_DEC") != 1 ||
+		element(t, v, "PIXEL_SCALE") != 2 {
+		t.Errorf("unexpected stats in arcsec: %v", v.Elements)
+	}
+}
+
+func TestWatchGuiding(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if line, _ := r.ReadString('\n'); line != string(pixelScaleRequest) {
+			return
+		}
+		conn.Write([]byte("{\"Event\":\"Version\",\"PHDVersion\":\"2.6.9\"}\r\n"))
+		conn.Write([]byte("{\"jsonrpc\":\"2.0\",\"result\":1.5,\"id\":1}\r\n"))
+		conn.Write([]byte("{\"Event\":\"StartGuiding\"}\r\n"))
+		conn.Write([]byte("{\"Event\":\"GuideStep\",\"Frame\":1,\"RADistanceRaw\":0.4,\"DECDistanceRaw\":-0.2}\r\n"))
+		conn.Write([]byte("{\"Event\":\"GuideStep\",\"Frame\":2,\"RADistanceRaw\":-0.4,\"DECDistanceRaw\":0.2}\r\n"))
+		conn.Write([]byte("{\"Event\":\"GuidingStopped\"}\r\n"))
+		// keep connection open until guiding is watched
+		r.ReadString('\n')
+		time.Sleep(time.Second)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan *indiclient.Vector, 16)
+	go watchGuiding(ctx, l.Addr().String(), newGuideStats(), func(v *indiclient.Vector) {
+		updates <- v
+	})
+
+	states := []string{}
+	var last *indiclient.Vector
+	for len(states) < 5 {
+		select {
+		case v := <-updates:
+			states = append(states, v.State)
+			last = v
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout waiting for guiding stats, got %v", states)
+		}
+	}
+	expected := []string{indiclient.StateIdle, indiclient.StateBusy, indiclient.StateOk, indiclient.StateOk,
+		indiclient.StateIdle}
+	for i := range expected {
+		if states[i] != expected[i] {
+			t.Fatalf("expected states %v, got %v", expected, states)
+		}
+	}
+	// errors are in arcsec
+	if element(t, last, "PIXEL_SCALE") != 1.5 || math.Abs(element(t, last, "RMS_RA")-0.6) > 0.01 ||
+		math.Abs(element(t, last, "RMS_DEC")-0.3) > 0.01 || element(t, last, "ERR_RA") != -0.6 {
+		t.Errorf("unexpected stats %v", last.Elements)
+	}
+}
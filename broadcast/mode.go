@@ -0,0 +1,632 @@
+package broadcast
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/golang/protobuf/proto"
+
+	"github.com/indihub-space/agent/indiclient"
+	"github.com/indihub-space/agent/journal"
+	"github.com/indihub-space/agent/lib"
+	"github.com/indihub-space/agent/logutil"
+	"github.com/indihub-space/agent/proto/indihub"
+	"github.com/indihub-space/agent/proxy"
+)
+
+var logger = logutil.New("mode", lib.ModeBroadcast)
+
+const (
+	queueSize = 1024
+
+	// properties are sent to viewers not more often than this
+	defaultUpdateInterval = 2 * time.Second
+	// previews are sent to viewers not more often than this
+	defaultPreviewInterval = 10 * time.Second
+)
+
+// publishedProperties is read-only view of the session shown to viewers
+var publishedProperties = map[string]bool{
+	// mount position
+	"EQUATORIAL_EOD_COORD":  true,
+	"HORIZONTAL_COORD":      true,
+	"TELESCOPE_INFO":        true,
+	"TELESCOPE_PARK":        true,
+	"TELESCOPE_TRACK_STATE": true,
+	// current exposure
+	"CCD_EXPOSURE":    true,
+	"CCD_INFO":        true,
+	"CCD_TEMPERATURE": true,
+	"CCD_BINNING":     true,
+	"FILTER_SLOT":     true,
+	"FILTER_NAME":     true,
+	// guiding pulses, RMS and errors are published from PHD2 as GUIDE_STATS
+	"GUIDER_EXPOSURE":          true,
+	"TELESCOPE_TIMED_GUIDE_NS": true,
+	"TELESCOPE_TIMED_GUIDE_WE": true,
+	// focus and observatory
+	"ABS_FOCUS_POSITION": true,
+	"FOCUS_TEMPERATURE":  true,
+	"DOME_SHUTTER":       true,
+	"WEATHER_STATUS":     true,
+	"SAFETY_STATUS":      true,
+	// previews
+	"CCD1": true,
+}
+
+// previewFormats are BLOB formats viewers can display
+var previewFormats = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+}
+
+// PreviewConverter makes preview image viewers can display from BLOB, i.e. JPEG from FITS
+type PreviewConverter func(format string, data []byte) (string, []byte, error)
+
+type viewer struct {
+	blobs bool
+}
+
+// Mode publishes read-only throttled view of equipment state to many viewers
+type Mode struct {
+	indiHubClient  indihub.INDIHubClient
+	host           *indihub.INDIHubHost
+	regInfo        *indihub.RegisterInfo
+	indiServerAddr string
+	phd2ServerAddr string
+
+	updateInterval  time.Duration
+	previewInterval time.Duration
+	previewRate     int64
+	converter       PreviewConverter
+	journal         *journal.Journal
+	tunnelLost      func(mode string, err error)
+	onFailure       func(err error)
+
+	mu        sync.Mutex
+	status    string
+	addrData  []proxy.PublicServerAddr
+	viewers   map[uint32]*viewer
+	pending   map[string]*indiclient.Vector
+	preview   *indiclient.Vector
+	guiding   *indiclient.Vector
+	respCh    chan *indihub.Response
+	cancel    context.CancelFunc
+	bucket    *lib.TokenBucket
+	sentBytes uint64
+	session   *journal.Session
+	// every broadcast is registered as its own broadcast session
+	sessionInfo *indihub.RegisterInfo
+
+	droppedBytes uint64
+}
+
+// NewMode creates broadcast mode, host registered with regInfo is registered again as broadcast host on each start,
+// previewRate limits bytes per second of previews sent to all viewers
+func NewMode(indiHubClient indihub.INDIHubClient, host *indihub.INDIHubHost, regInfo *indihub.RegisterInfo,
+	indiServerAddr string, previewRate int64) *Mode {
+	return &Mode{
+		indiHubClient:   indiHubClient,
+		host:            host,
+		regInfo:         regInfo,
+		indiServerAddr:  indiServerAddr,
+		updateInterval:  defaultUpdateInterval,
+		previewInterval: defaultPreviewInterval,
+		previewRate:     previewRate,
+		addrData:        []proxy.PublicServerAddr{},
+		status:          "stopped",
+	}
+}
+
+// SetPreviewConverter sets converter of BLOBs to images viewers can display
+func (m *Mode) SetPreviewConverter(converter PreviewConverter) {
+	m.converter = converter
+}
+
+// SetPHD2Server sets address of PHD2 event server guiding stats are read from
+func (m *Mode) SetPHD2Server(addr string) {
+	m.phd2ServerAddr = addr
+}
+
+// SetJournal sets journal to record sessions in
+func (m *Mode) SetJournal(j *journal.Journal) {
+	m.journal = j
+}
+
+// SetTunnelLostListener sets function called when running broadcast fails because tunnel is closed by the cloud
+func (m *Mode) SetTunnelLostListener(fn func(mode string, err error)) {
+	m.tunnelLost = fn
+}
+
+// SetFailureListener sets function called when running broadcast fails on its own
+func (m *Mode) SetFailureListener(fn func(err error)) {
+	m.onFailure = fn
+}
+
+// Start opens broadcast tunnel and waits for public address, broadcast lasts until Stop is called or ctx is cancelled
+func (m *Mode) Start(ctx context.Context) error {
+	m.mu.Lock()
+	if m.cancel != nil {
+		m.mu.Unlock()
+		return errors.New("broadcast is already started")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	m.cancel = cancel
+	m.status = "starting"
+	m.mu.Unlock()
+
+	sAddr, err := m.start(ctx)
+	if err != nil {
+		m.stop()
+		m.mu.Lock()
+		m.status = "failed"
+		m.mu.Unlock()
+		return err
+	}
+
+	m.mu.Lock()
+	m.addrData = append(m.addrData, sAddr)
+	m.status = "running"
+	m.mu.Unlock()
+
+	c := color.New(color.FgCyan)
+	gc := color.New(color.FgGreen)
+	c.Println()
+	c.Println("                                ************************************************************")
+	c.Println("                                *               INDIHUB broadcast started!!                *")
+	c.Println("                                ************************************************************")
+	c.Println("                                                                                            ")
+	gc.Printf("                                   %s: %s\n", sAddr.Name, sAddr.Addr)
+	c.Println("                                                                                            ")
+	c.Println("                                Viewers can watch your equipment state, but can't control it")
+	c.Println()
+
+	return nil
+}
+
+func (m *Mode) start(ctx context.Context) (proxy.PublicServerAddr, error) {
+	logger.Infof("Starting INDIHUB agent in broadcast mode: equipment state is published read-only")
+
+	// host is registered in mode it was started in, so broadcast session is registered on its own
+	host := proto.Clone(m.host).(*indihub.INDIHubHost)
+	host.Token = m.regInfo.Token
+	host.SoloMode = false
+	host.IsRobotic = false
+	host.IsBroadcast = true
+	sessionInfo, err := m.indiHubClient.RegisterHost(ctx, host)
+	if err != nil {
+		return proxy.PublicServerAddr{}, fmt.Errorf("could not register broadcast session: %w", err)
+	}
+	logger.Infof("Broadcast session token: %s", sessionInfo.SessionIDPublic)
+
+	logger.Infof("Starting broadcast INDI-Server in the cloud...")
+	tunnel, err := m.indiHubClient.INDIServer(ctx)
+	if err != nil {
+		return proxy.PublicServerAddr{}, fmt.Errorf("could not start broadcast in the cloud: %w", err)
+	}
+	logger.Infof("...OK")
+
+	session := m.journal.Begin(lib.ModeBroadcast, sessionInfo.SessionID)
+
+	client, err := indiclient.Dial(m.indiServerAddr)
+	if err != nil {
+		session.AddError(fmt.Sprintf("could not connect to INDI-server: %s", err))
+		session.End()
+		tunnel.CloseSend()
+		return proxy.PublicServerAddr{}, fmt.Errorf("could not connect to INDI-server in broadcast mode: %w", err)
+	}
+	client.WaitDefs(time.Second, 5*time.Second)
+
+	// previews are taken from main imaging cameras
+	for _, device := range client.DevicesWithProperty("CCD1") {
+		if err := client.EnableBLOB(device, "CCD1", proxy.BLOBPolicyAlso); err != nil {
+			logger.Errorf("Could not enable BLOBs for %s in broadcast mode: %s", device, err)
+		}
+	}
+
+	m.mu.Lock()
+	m.viewers = map[uint32]*viewer{}
+	m.pending = map[string]*indiclient.Vector{}
+	m.preview = nil
+	m.guiding = nil
+	m.respCh = make(chan *indihub.Response, queueSize)
+	m.bucket = lib.NewTokenBucket(m.previewRate, m.previewRate)
+	m.session = session
+	m.sessionInfo = sessionInfo
+	respCh := m.respCh
+	m.mu.Unlock()
+
+	unsubscribe := client.Subscribe(m.onMessage)
+
+	// guiding stats are defined for viewers before PHD2 sends the first guide step
+	if m.phd2ServerAddr != "" {
+		stats := newGuideStats()
+		m.onGuiding(stats.vector())
+		go watchGuiding(ctx, m.phd2ServerAddr, stats, m.onGuiding)
+	}
+
+	// send responses to tunnel from one go-routine
+	go func() {
+		for {
+			select {
+			case resp := <-respCh:
+				if err := tunnel.Send(resp); err != nil {
+					logger.Errorf("Failed to send a response to broadcast tunnel: %v", err)
+					session.AddError(fmt.Sprintf("failed to send a response to broadcast tunnel: %v", err))
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		logger.Infof("Closing broadcast-session")
+		unsubscribe()
+		client.Close()
+		tunnel.CloseSend()
+	}()
+
+	addrCh := make(chan proxy.PublicServerAddr, 1)
+	exitCh := make(chan struct{})
+	go func() {
+		defer close(exitCh)
+		m.readViewers(ctx, tunnel, client, session, addrCh)
+	}()
+	go m.publish(ctx.Done())
+
+	select {
+	case sAddr := <-addrCh:
+		session.AddEndpoint(sAddr.Name, sAddr.Addr)
+		return sAddr, nil
+	case <-exitCh:
+		return proxy.PublicServerAddr{}, errors.New("broadcast tunnel was closed")
+	case <-ctx.Done():
+		return proxy.PublicServerAddr{}, ctx.Err()
+	}
+}
+
+// readViewers handles requests from viewers: only getProperties and enableBLOB are respected
+func (m *Mode) readViewers(ctx context.Context, tunnel indihub.INDIHub_INDIServerClient, client *indiclient.Client,
+	session *journal.Session, addrCh chan proxy.PublicServerAddr) {
+
+	addrReceived := false
+	flatteners := map[uint32]*lib.XmlFlattener{}
+	for {
+		in, err := tunnel.Recv()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == io.EOF {
+			logger.Infof("Exiting. Got EOF from broadcast tunnel.")
+			m.failed(errors.New("broadcast tunnel was closed by the cloud"))
+			return
+		}
+		if err != nil {
+			logger.Errorf("Exiting. Failed to receive a request from broadcast tunnel: %v", err)
+			session.AddError(fmt.Sprintf("failed to receive a request from broadcast tunnel: %v", err))
+			m.failed(fmt.Errorf("failed to receive a request from broadcast tunnel: %w", err))
+			return
+		}
+
+		// 1st message always with server address
+		if !addrReceived && in.Conn == 0 {
+			addrCh <- proxy.PublicServerAddr{
+				Name: "INDI-Server broadcast",
+				Addr: string(in.Data),
+			}
+			addrReceived = true
+			continue
+		}
+
+		if in.Closed {
+			m.mu.Lock()
+			delete(m.viewers, in.Conn)
+			m.mu.Unlock()
+			delete(flatteners, in.Conn)
+			continue
+		}
+
+		if flatteners[in.Conn] == nil {
+			flatteners[in.Conn] = lib.NewXmlFlattener()
+		}
+		for _, cmd := range flatteners[in.Conn].FeedChunk(in.Data) {
+			switch lib.ElementTag(cmd) {
+			case "getProperties":
+				m.sendDefs(in.Conn, client)
+			case "enableBLOB":
+				end := bytes.Index(cmd, []byte("</enableBLOB>"))
+				start := bytes.IndexByte(cmd, '>')
+				if start == -1 || end < start {
+					continue
+				}
+				policy := strings.TrimSpace(string(cmd[start+1 : end]))
+				m.mu.Lock()
+				if v, ok := m.viewers[in.Conn]; ok {
+					v.blobs = policy == proxy.BLOBPolicyAlso || policy == proxy.BLOBPolicyOnly
+				}
+				m.mu.Unlock()
+			}
+		}
+	}
+}
+
+// sendDefs sends definitions of all published properties to new viewer
+func (m *Mode) sendDefs(cNum uint32, client *indiclient.Client) {
+	m.mu.Lock()
+	if _, ok := m.viewers[cNum]; !ok {
+		m.viewers[cNum] = &viewer{}
+		m.session.AddGuestConnection()
+	}
+	m.mu.Unlock()
+
+	for _, device := range client.Devices() {
+		for _, v := range client.Properties(device) {
+			if !publishedProperties[v.Name] {
+				continue
+			}
+			m.send(cNum, v.DefXML(true))
+		}
+	}
+
+	m.mu.Lock()
+	guiding := m.guiding
+	m.mu.Unlock()
+	if guiding != nil {
+		m.send(cNum, guiding.DefXML(true))
+	}
+}
+
+// onGuiding queues guiding stats read from PHD2 to be published with other properties
+func (m *Mode) onGuiding(v *indiclient.Vector) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.guiding = v
+	m.pending[v.Device+"."+v.Name] = v
+}
+
+func (m *Mode) onMessage(msg *indiclient.Message) {
+	if msg.Vector == nil || !publishedProperties[msg.Name] || !strings.HasPrefix(msg.Tag, "set") {
+		return
+	}
+
+	// BLOBs are converted to previews by publish, so INDI-server connection is not held up by conversion
+	v := msg.Vector.Copy()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if v.Kind == indiclient.KindBLOB {
+		m.preview = v
+		return
+	}
+	m.pending[v.Device+"."+v.Name] = v
+}
+
+// toPreview converts BLOBs of vector to previews viewers can display, false is returned if there are none
+func (m *Mode) toPreview(v *indiclient.Vector) (*indiclient.Vector, bool) {
+	v = v.Copy()
+	elements := v.Elements[:0]
+	for _, e := range v.Elements {
+		format := strings.ToLower(e.Format)
+		if previewFormats[format] {
+			elements = append(elements, e)
+			continue
+		}
+		if m.converter == nil || e.Value == "" {
+			continue
+		}
+		data, err := indiclient.DecodeBLOB(e.Value)
+		if err != nil {
+			logger.Errorf("Could not decode BLOB from %s in broadcast mode: %s", v.Device, err)
+			continue
+		}
+		prevFormat, prevData, err := m.converter(format, data)
+		if err != nil {
+			logger.Errorf("Could not make preview for %s in broadcast mode: %s", v.Device, err)
+			continue
+		}
+		e.Format = prevFormat
+		e.Value = indiclient.EncodeBLOB(prevData)
+		e.Size = fmt.Sprintf("%d", len(prevData))
+		elements = append(elements, e)
+	}
+	v.Elements = elements
+
+	return v, len(elements) > 0
+}
+
+// publish sends throttled property updates and previews to all viewers
+func (m *Mode) publish(done <-chan struct{}) {
+	updateTicker := time.NewTicker(m.updateInterval)
+	defer updateTicker.Stop()
+	previewTicker := time.NewTicker(m.previewInterval)
+	defer previewTicker.Stop()
+
+	// the latest BLOB which was converted and its preview
+	var converted, preview *indiclient.Vector
+	hasPreview := false
+
+	for {
+		select {
+		case <-done:
+			return
+
+		case <-updateTicker.C:
+			m.mu.Lock()
+			pending := m.pending
+			m.pending = map[string]*indiclient.Vector{}
+			viewers := m.viewerConns(false)
+			m.mu.Unlock()
+
+			for _, v := range pending {
+				data := v.SetXML()
+				for _, cNum := range viewers {
+					m.send(cNum, data)
+				}
+			}
+
+		case <-previewTicker.C:
+			m.mu.Lock()
+			blob := m.preview
+			viewers := m.viewerConns(true)
+			m.mu.Unlock()
+			if blob == nil || len(viewers) == 0 {
+				continue
+			}
+
+			// only the latest frame is converted and it is converted once
+			if blob != converted {
+				converted = blob
+				preview, hasPreview = m.toPreview(blob)
+			}
+
+			// own traffic shaping: skip this preview if rate limit is exceeded, the next one will be sent later
+			var data []byte
+			if hasPreview {
+				data = preview.SetXML()
+				if m.bucket.TryTake(len(data)*len(viewers)) > 0 {
+					continue
+				}
+			}
+
+			m.mu.Lock()
+			if m.preview == blob {
+				m.preview = nil
+			}
+			m.mu.Unlock()
+			if data == nil {
+				continue
+			}
+			for _, cNum := range viewers {
+				m.send(cNum, data)
+			}
+		}
+	}
+}
+
+// viewerConns returns connection numbers of viewers, only ones receiving BLOBs if blobs is set
+func (m *Mode) viewerConns(blobs bool) []uint32 {
+	conns := make([]uint32, 0, len(m.viewers))
+	for cNum, v := range m.viewers {
+		if !blobs || v.blobs {
+			conns = append(conns, cNum)
+		}
+	}
+	return conns
+}
+
+// send queues data to viewer without waiting, data is dropped if tunnel doesn't keep up
+func (m *Mode) send(cNum uint32, data []byte) {
+	m.mu.Lock()
+	respCh := m.respCh
+	session := m.session
+	sessionInfo := m.sessionInfo
+	m.mu.Unlock()
+
+	if respCh == nil {
+		return
+	}
+	resp := &indihub.Response{
+		Data:         data,
+		Conn:         cNum,
+		SessionID:    sessionInfo.GetSessionID(),
+		SessionToken: sessionInfo.GetSessionIDPublic(),
+	}
+	select {
+	case respCh <- resp:
+	default:
+		m.mu.Lock()
+		m.droppedBytes += uint64(len(data))
+		m.mu.Unlock()
+		return
+	}
+
+	m.mu.Lock()
+	m.sentBytes += uint64(len(data))
+	m.mu.Unlock()
+	session.AddBytes(0, len(data))
+}
+
+// failed marks running broadcast as failed when tunnel is closed by the cloud
+func (m *Mode) failed(err error) {
+	m.mu.Lock()
+	running := m.status == "running"
+	if running {
+		m.status = "failed"
+	}
+	m.mu.Unlock()
+
+	if running && m.tunnelLost != nil {
+		m.tunnelLost(lib.ModeBroadcast, err)
+	}
+	if running && m.onFailure != nil {
+		m.onFailure(err)
+	}
+}
+
+// Stop closes broadcast tunnel and connection to INDI-server, it is safe to call it twice
+func (m *Mode) Stop() error {
+	addrData, ok := m.stop()
+	if !ok {
+		return nil
+	}
+
+	c := color.New(color.FgCyan)
+	rc := color.New(color.FgMagenta)
+	c.Println()
+	c.Println("                                ************************************************************")
+	c.Println("                                *               INDIHUB broadcast finished!!               *")
+	c.Println("                                ************************************************************")
+	for _, sAddr := range addrData {
+		rc.Printf("                                   %s: %s - CLOSED!!\n", sAddr.Name, sAddr.Addr)
+	}
+	c.Println("                                ************************************************************")
+
+	return nil
+}
+
+// stop cancels broadcast and returns its public addresses, false is returned if broadcast is not started
+func (m *Mode) stop() ([]proxy.PublicServerAddr, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.cancel == nil {
+		return nil, false
+	}
+	m.cancel()
+	m.cancel = nil
+	// channel is not closed as viewers may be sending to it, its reader exits when ctx is cancelled
+	m.respCh = nil
+	m.status = "stopped"
+	m.session.End()
+	m.session = nil
+	m.sessionInfo = nil
+	addrData := m.addrData
+	m.addrData = []proxy.PublicServerAddr{}
+	return addrData, true
+}
+
+func (m *Mode) GetStatus() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return map[string]interface{}{
+		"status":          m.status,
+		"sessionToken":    m.sessionInfo.GetSessionIDPublic(),
+		"publicEndpoints": m.addrData,
+		"viewers":         len(m.viewers),
+		"bytesSent":       m.sentBytes,
+		"bytesDropped":    m.droppedBytes,
+	}
+}
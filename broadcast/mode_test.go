@@ -0,0 +1,81 @@
+package broadcast
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/indihub-space/agent/proto/indihub"
+)
+
+// fakeHubClient registers hosts and has no tunnels
+type fakeHubClient struct {
+	indihub.INDIHubClient
+	registered []*indihub.INDIHubHost
+}
+
+func (c *fakeHubClient) RegisterHost(ctx context.Context, in *indihub.INDIHubHost, opts ...grpc.CallOption) (
+	*indihub.RegisterInfo, error) {
+	c.registered = append(c.registered, in)
+	return &indihub.RegisterInfo{Token: in.Token, SessionID: uint64(len(c.registered)), SessionIDPublic: "broadcast"}, nil
+}
+
+func (c *fakeHubClient) INDIServer(ctx context.Context, opts ...grpc.CallOption) (indihub.INDIHub_INDIServerClient, error) {
+	return nil, errors.New("no tunnel")
+}
+
+func TestSendDoesNotBlockOnFullQueue(t *testing.T) {
+	m := NewMode(nil, &indihub.INDIHubHost{}, &indihub.RegisterInfo{}, "", 0)
+	m.respCh = make(chan *indihub.Response, 1)
+
+	done := make(chan struct{})
+	go func() {
+		m.send(1, []byte("first"))
+		m.send(2, []byte("second"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("send is blocked by full queue")
+	}
+
+	status := m.GetStatus()
+	if status["bytesSent"] != uint64(5) || status["bytesDropped"] != uint64(6) {
+		t.Errorf("unexpected status: %v", status)
+	}
+
+	// viewers may still send after broadcast is stopped
+	m.respCh = nil
+	m.send(1, []byte("late"))
+}
+
+func TestStartRegistersBroadcastSession(t *testing.T) {
+	client := &fakeHubClient{}
+	// agent is started in share-mode and switched to broadcast
+	host := &indihub.INDIHubHost{IsPHD2: true}
+	m := NewMode(client, host, &indihub.RegisterInfo{Token: "token", SessionID: 1}, "", 0)
+
+	for i := 0; i < 2; i++ {
+		if err := m.Start(context.Background()); err == nil {
+			t.Fatal("broadcast is started without tunnel")
+		}
+	}
+	if len(client.registered) != 2 {
+		t.Fatalf("expected session registered on each start, got %d", len(client.registered))
+	}
+	for _, reg := range client.registered {
+		if !reg.IsBroadcast || reg.SoloMode || reg.IsRobotic || !reg.IsPHD2 || reg.Token != "token" {
+			t.Errorf("unexpected registration %v", reg)
+		}
+	}
+	if host.IsBroadcast || host.Token != "" {
+		t.Errorf("host of agent is changed: %v", host)
+	}
+	if status := m.GetStatus(); status["status"] != "failed" || status["sessionToken"] != "" {
+		t.Errorf("unexpected status %v", status)
+	}
+}
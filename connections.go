@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/indihub-space/agent/config"
+	"github.com/indihub-space/agent/proxy"
+)
+
+// runConnections implements 'connections' command: manages guest connections of running agent via its API
+func runConnections(args []string) {
+	fs := flag.NewFlagSet("connections", flag.ExitOnError)
+	apiAddr := fs.String("api", fmt.Sprintf("localhost:%d", defaultAPIPort), "API-server address of running agent (host:port)")
+	apiTLS := fs.Bool("api-tls", false, "API-server is running over TLS")
+	token := fs.String("token", "", "agent token (read from config file by default)")
+	confFile := fs.String("conf", "indihub.json", "INDIHub Agent config file path")
+	conn := fs.Int64("conn", -1, "guest connection number, required for pause, resume and close")
+	drop := fs.Bool("drop", false, "drop commands of paused connection instead of buffering them")
+	message := fs.String("message", "", "message to send to guest when closing connection")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s connections [list|pause|resume|close] [parameters]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	action := "list"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action = args[0]
+		args = args[1:]
+	}
+	fs.Parse(args)
+
+	if action != "list" && (*conn < 0 || *conn > math.MaxUint32) {
+		logger.Fatalf("'conn' parameter is required for %s", action)
+	}
+
+	if *token == "" {
+		if conf, err := config.Read(*confFile); err == nil {
+			*token = conf.Token
+		}
+	}
+
+	scheme := "http"
+	if *apiTLS {
+		scheme = "https"
+		// API-server uses self-signed certificate
+		httpClientSM.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+	baseURL := fmt.Sprintf("%s://%s/connections", scheme, *apiAddr)
+
+	var (
+		respData []byte
+		err      error
+	)
+	switch action {
+	case "list":
+		respData, err = apiRequest(http.MethodGet, baseURL, *token)
+		if err != nil {
+			break
+		}
+		conns := []proxy.ConnInfo{}
+		if err = json.Unmarshal(respData, &conns); err != nil {
+			break
+		}
+		printConnections(conns)
+		return
+	case "pause":
+		respData, err = apiRequest(http.MethodPost, fmt.Sprintf("%s/%d/pause?drop=%t", baseURL, *conn, *drop), *token)
+	case "resume":
+		respData, err = apiRequest(http.MethodPost, fmt.Sprintf("%s/%d/resume", baseURL, *conn), *token)
+	case "close":
+		respData, err = apiRequest(http.MethodPost,
+			fmt.Sprintf("%s/%d/close?message=%s", baseURL, *conn, url.QueryEscape(*message)), *token)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	fmt.Println(string(respData))
+}
+
+// apiRequest makes request to API-server of running agent
+func apiRequest(method string, reqURL string, token string) ([]byte, error) {
+	req, err := http.NewRequest(method, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := httpClientSM.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API-server response code %d: %s", resp.StatusCode, strings.TrimSpace(string(respData)))
+	}
+
+	return respData, nil
+}
+
+func printConnections(conns []proxy.ConnInfo) {
+	if len(conns) == 0 {
+		fmt.Println("No guest connections")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CONN\tSTARTED\tBYTES IN\tBYTES OUT\tSTATE\tLAST COMMAND\tDEVICES")
+	for _, c := range conns {
+		state := "active"
+		if c.Paused {
+			state = fmt.Sprintf("paused (%d buffered)", c.Buffered)
+			if c.DropPaused {
+				state = "paused (dropping)"
+			}
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%s\t%s\t%s\n",
+			c.Conn,
+			c.Started.Format(time.RFC3339),
+			c.BytesIn,
+			c.BytesOut,
+			state,
+			c.LastCommand,
+			strings.Join(c.Devices, ", "),
+		)
+	}
+	w.Flush()
+}
@@ -0,0 +1,122 @@
+package fits
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	blockSize = 2880
+	cardSize  = 80
+)
+
+// Card is one keyword record of FITS header
+type Card struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// Header is FITS header of HDU, keeps order of cards
+type Header struct {
+	Cards []Card
+}
+
+// Get returns value of keyword, string values are returned without quotes
+func (h *Header) Get(key string) (string, bool) {
+	for _, c := range h.Cards {
+		if c.Key == key {
+			return c.Value, true
+		}
+	}
+	return "", false
+}
+
+// String returns string value of keyword or empty string
+func (h *Header) String(key string) string {
+	val, _ := h.Get(key)
+	return val
+}
+
+// Int returns integer value of keyword
+func (h *Header) Int(key string) (int, bool) {
+	val, ok := h.Get(key)
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		// some writers put integer keywords as floats
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return 0, false
+		}
+		return int(f), true
+	}
+	return i, true
+}
+
+// Float returns float value of keyword
+func (h *Header) Float(key string) (float64, bool) {
+	val, ok := h.Get(key)
+	if !ok {
+		return 0, false
+	}
+	// Fortran-style exponent
+	f, err := strconv.ParseFloat(strings.Replace(val, "D", "E", 1), 64)
+	if err != nil {
+		return 0, false
+	}
+	return f, true
+}
+
+// parseHeader reads header cards until END card, returns header and its size in bytes
+func parseHeader(data []byte) (*Header, int, error) {
+	h := &Header{Cards: []Card{}}
+	for pos := 0; pos+cardSize <= len(data); pos += cardSize {
+		card := string(data[pos : pos+cardSize])
+		key := strings.TrimSpace(card[:8])
+		if key == "END" {
+			// header is padded to the full block
+			size := (pos/blockSize + 1) * blockSize
+			return h, size, nil
+		}
+		if key == "" || key == "COMMENT" || key == "HISTORY" || card[8:10] != "= " {
+			continue
+		}
+		value, comment := parseValue(card[10:])
+		h.Cards = append(h.Cards, Card{Key: key, Value: value, Comment: comment})
+	}
+	return nil, 0, ErrBadFormat
+}
+
+// parseValue parses value and comment of card, quotes of string values are removed
+func parseValue(s string) (string, string) {
+	s = strings.TrimLeft(s, " ")
+	if strings.HasPrefix(s, "'") {
+		value := &strings.Builder{}
+		i := 1
+		for ; i < len(s); i++ {
+			if s[i] == '\'' {
+				// two quotes are escaped quote
+				if i+1 < len(s) && s[i+1] == '\'' {
+					value.WriteByte('\'')
+					i++
+					continue
+				}
+				break
+			}
+			value.WriteByte(s[i])
+		}
+		comment := ""
+		if n := strings.IndexByte(s[i:], '/'); n != -1 {
+			comment = strings.TrimSpace(s[i+n+1:])
+		}
+		return strings.TrimRight(value.String(), " "), comment
+	}
+
+	if n := strings.IndexByte(s, '/'); n != -1 {
+		return strings.TrimSpace(s[:n]), strings.TrimSpace(s[n+1:])
+	}
+	return strings.TrimSpace(s), ""
+}
@@ -0,0 +1,179 @@
+package fits
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// max length of image axis, larger images are not made by cameras and their size can overflow
+const maxAxis = 1 << 16
+
+var (
+	ErrBadFormat   = errors.New("not a FITS file")
+	ErrUnsupported = errors.New("unsupported FITS image")
+)
+
+// Image is image from primary HDU of FITS file, pixels are physical values (BZERO and BSCALE applied)
+type Image struct {
+	Header   *Header
+	Width    int
+	Height   int
+	Bitpix   int
+	Channels [][]float32 // one plane for mono, three planes for RGB
+}
+
+// Decode reads image from primary HDU of FITS file
+func Decode(data []byte) (*Image, error) {
+	if len(data) < blockSize || !strings.HasPrefix(string(data[:cardSize]), "SIMPLE  =") {
+		return nil, ErrBadFormat
+	}
+
+	h, hSize, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	bitpix, _ := h.Int("BITPIX")
+	naxis, _ := h.Int("NAXIS")
+	width, _ := h.Int("NAXIS1")
+	height, _ := h.Int("NAXIS2")
+	planes := 1
+	if naxis == 3 {
+		planes, _ = h.Int("NAXIS3")
+	}
+	if naxis < 2 || naxis > 3 || width <= 0 || height <= 0 || width > maxAxis || height > maxAxis ||
+		(planes != 1 && planes != 3) {
+		return nil, fmt.Errorf("%w: NAXIS=%d %dx%dx%d", ErrUnsupported, naxis, width, height, planes)
+	}
+
+	bytesPerPixel := 0
+	switch bitpix {
+	case 8:
+		bytesPerPixel = 1
+	case 16:
+		bytesPerPixel = 2
+	case 32, -32:
+		bytesPerPixel = 4
+	case -64:
+		bytesPerPixel = 8
+	default:
+		return nil, fmt.Errorf("%w: BITPIX=%d", ErrUnsupported, bitpix)
+	}
+
+	// size is checked in 64 bits, so it doesn't overflow on 32-bit hosts
+	planeSize := width * height
+	pixels := data[hSize:]
+	if int64(len(pixels)) < int64(width)*int64(height)*int64(planes*bytesPerPixel) {
+		return nil, fmt.Errorf("%w: data is truncated", ErrBadFormat)
+	}
+
+	bzero, _ := h.Float("BZERO")
+	bscale, ok := h.Float("BSCALE")
+	if !ok || bscale == 0 {
+		bscale = 1
+	}
+
+	img := &Image{
+		Header:   h,
+		Width:    width,
+		Height:   height,
+		Bitpix:   bitpix,
+		Channels: make([][]float32, planes),
+	}
+	for p := 0; p < planes; p++ {
+		plane := make([]float32, planeSize)
+		offset := p * planeSize * bytesPerPixel
+		for i := range plane {
+			b := pixels[offset+i*bytesPerPixel:]
+			var raw float64
+			switch bitpix {
+			case 8:
+				raw = float64(b[0])
+			case 16:
+				raw = float64(int16(binary.BigEndian.Uint16(b)))
+			case 32:
+				raw = float64(int32(binary.BigEndian.Uint32(b)))
+			case -32:
+				raw = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+			case -64:
+				raw = math.Float64frombits(binary.BigEndian.Uint64(b))
+			}
+			plane[i] = float32(bzero + bscale*raw)
+		}
+		img.Channels[p] = plane
+	}
+
+	return img, nil
+}
+
+// TopDown checks if rows of image go from top to bottom, FITS rows go bottom-up unless stated otherwise
+func (img *Image) TopDown() bool {
+	return strings.ToUpper(img.Header.String("ROWORDER")) == "TOP-DOWN"
+}
+
+// BayerPattern returns Bayer pattern of mono image taken by color camera (i.e. "RGGB") or empty string
+func (img *Image) BayerPattern() string {
+	if len(img.Channels) != 1 {
+		return ""
+	}
+	pattern := strings.ToUpper(img.Header.String("BAYERPAT"))
+	if len(pattern) != 4 || strings.Trim(pattern, "RGB") != "" {
+		return ""
+	}
+
+	// pattern offsets shift pattern by a row or a column
+	xOff, _ := img.Header.Int("XBAYROFF")
+	yOff, _ := img.Header.Int("YBAYROFF")
+	if xOff%2 == 1 {
+		pattern = string([]byte{pattern[1], pattern[0], pattern[3], pattern[2]})
+	}
+	if yOff%2 == 1 {
+		pattern = pattern[2:] + pattern[:2]
+	}
+	return pattern
+}
+
+// Debayer returns color image with half width and height made from 2x2 Bayer cells (superpixel method),
+// images without Bayer pattern are returned as is
+func (img *Image) Debayer() *Image {
+	pattern := img.BayerPattern()
+	if pattern == "" {
+		return img
+	}
+
+	w, h := img.Width/2, img.Height/2
+	rgb := &Image{
+		Header:   img.Header,
+		Width:    w,
+		Height:   h,
+		Bitpix:   img.Bitpix,
+		Channels: [][]float32{make([]float32, w*h), make([]float32, w*h), make([]float32, w*h)},
+	}
+	src := img.Channels[0]
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i0 := 2*y*img.Width + 2*x
+			cell := [4]float32{src[i0], src[i0+1], src[i0+img.Width], src[i0+img.Width+1]}
+			var r, g, b float32
+			for k, color := range pattern {
+				switch color {
+				case 'R':
+					r = cell[k]
+				case 'G':
+					g += cell[k] / 2
+				case 'B':
+					b = cell[k]
+				}
+			}
+			i := y*w + x
+			rgb.Channels[0][i] = r
+			rgb.Channels[1][i] = g
+			rgb.Channels[2][i] = b
+		}
+	}
+
+	return rgb
+}
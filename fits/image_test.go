@@ -0,0 +1,276 @@
+package fits
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"strings"
+	"testing"
+)
+
+// makeFITS builds FITS file with cards in "KEY = value" form and big-endian pixel data
+func makeFITS(cards []string, pixels []byte) []byte {
+	buf := &bytes.Buffer{}
+	for _, c := range append([]string{"SIMPLE = T"}, cards...) {
+		parts := strings.SplitN(c, "=", 2)
+		fmt.Fprintf(buf, "%-8s= %-70s", strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	fmt.Fprintf(buf, "%-80s", "END")
+	for buf.Len()%blockSize != 0 {
+		buf.WriteByte(' ')
+	}
+	buf.Write(pixels)
+	for buf.Len()%blockSize != 0 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// encodePixels encodes values as pixels of BITPIX type
+func encodePixels(bitpix int, values ...float64) []byte {
+	buf := &bytes.Buffer{}
+	for _, v := range values {
+		switch bitpix {
+		case 8:
+			buf.WriteByte(uint8(v))
+		case 16:
+			binary.Write(buf, binary.BigEndian, int16(v))
+		case 32:
+			binary.Write(buf, binary.BigEndian, int32(v))
+		case -32:
+			binary.Write(buf, binary.BigEndian, float32(v))
+		case -64:
+			binary.Write(buf, binary.BigEndian, v)
+		}
+	}
+	return buf.Bytes()
+}
+
+func monoFITS(bitpix int, width int, height int, extra []string, values ...float64) []byte {
+	cards := append([]string{
+		fmt.Sprintf("BITPIX = %d", bitpix),
+		"NAXIS = 2",
+		fmt.Sprintf("NAXIS1 = %d", width),
+		fmt.Sprintf("NAXIS2 = %d", height),
+	}, extra...)
+	return makeFITS(cards, encodePixels(bitpix, values...))
+}
+
+func TestDecodeBitpix(t *testing.T) {
+	for _, c := range []struct {
+		bitpix int
+		values []float64
+	}{
+		{8, []float64{0, 1, 128, 255}},
+		{16, []float64{-32768, -1, 0, 32767}},
+		{32, []float64{-100000, 0, 7, 100000}},
+		{-32, []float64{-1.5, 0, 0.25, 1e6}},
+		{-64, []float64{-2.75, 0, 1e-3, 3.5e6}},
+	} {
+		img, err := Decode(monoFITS(c.bitpix, 2, 2, nil, c.values...))
+		if err != nil {
+			t.Errorf("BITPIX=%d: %s", c.bitpix, err)
+			continue
+		}
+		if img.Width != 2 || img.Height != 2 || img.Bitpix != c.bitpix || len(img.Channels) != 1 {
+			t.Errorf("BITPIX=%d: unexpected image %dx%d %d", c.bitpix, img.Width, img.Height, img.Bitpix)
+			continue
+		}
+		for i, v := range c.values {
+			if got := float64(img.Channels[0][i]); math.Abs(got-v) > math.Abs(v)*1e-6 {
+				t.Errorf("BITPIX=%d: pixel %d is %g, expected %g", c.bitpix, i, got, v)
+			}
+		}
+	}
+}
+
+func TestDecodeScaling(t *testing.T) {
+	// unsigned 16-bit camera data is stored with BZERO 32768
+	img, err := Decode(monoFITS(16, 2, 1, []string{"BZERO = 32768", "BSCALE = 1"}, -32768, 32767))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Channels[0][0] != 0 || img.Channels[0][1] != 65535 {
+		t.Errorf("unsigned pixels are %v", img.Channels[0])
+	}
+
+	img, err = Decode(monoFITS(8, 2, 1, []string{"BZERO = -10.0", "BSCALE = 0.5D0"}, 20, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Channels[0][0] != 0 || img.Channels[0][1] != 40 {
+		t.Errorf("scaled pixels are %v", img.Channels[0])
+	}
+
+	// zero BSCALE is ignored
+	img, err = Decode(monoFITS(8, 1, 1, []string{"BSCALE = 0"}, 9))
+	if err != nil || img.Channels[0][0] != 9 {
+		t.Errorf("zero BSCALE: %v %v", img, err)
+	}
+}
+
+func TestDecodeRGB(t *testing.T) {
+	data := makeFITS(
+		[]string{"BITPIX = 8", "NAXIS = 3", "NAXIS1 = 2", "NAXIS2 = 1", "NAXIS3 = 3"},
+		encodePixels(8, 1, 2, 3, 4, 5, 6),
+	)
+	img, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.Channels) != 3 || img.Channels[0][1] != 2 || img.Channels[1][0] != 3 || img.Channels[2][1] != 6 {
+		t.Errorf("unexpected planes %v", img.Channels)
+	}
+}
+
+func TestDecodeBadImages(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"not FITS", bytes.Repeat([]byte{' '}, blockSize), ErrBadFormat},
+		{"short", []byte("SIMPLE  ="), ErrBadFormat},
+		{"truncated", monoFITS(16, 100, 100, nil, 1, 2, 3), ErrBadFormat},
+		{"BITPIX", monoFITS(64, 1, 1, nil), ErrUnsupported},
+		{"NAXIS", makeFITS([]string{"BITPIX = 8", "NAXIS = 1", "NAXIS1 = 4"}, []byte{1, 2, 3, 4}), ErrUnsupported},
+		{"planes", makeFITS([]string{"BITPIX = 8", "NAXIS = 3", "NAXIS1 = 1", "NAXIS2 = 1", "NAXIS3 = 2"}, []byte{1, 2}), ErrUnsupported},
+		{"negative", monoFITS(8, -1, 1, nil), ErrUnsupported},
+		// size of these overflows int and must not panic
+		{"huge", monoFITS(-64, 1<<31-1, 1<<31-1, nil, 1), ErrUnsupported},
+		{"huge RGB", makeFITS([]string{"BITPIX = -64", "NAXIS = 3", "NAXIS1 = 65536", "NAXIS2 = 65536", "NAXIS3 = 3"}, []byte{1}), ErrBadFormat},
+	} {
+		if _, err := Decode(c.data); !errors.Is(err, c.err) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestBayer(t *testing.T) {
+	// 4x2 RGGB frame: R=100, G=50 and 70, B=10 in the first cell, doubled in the second one
+	values := []float64{
+		100, 50, 200, 100,
+		70, 10, 140, 20,
+	}
+	img, err := Decode(monoFITS(16, 4, 2, []string{"BAYERPAT = 'RGGB    '"}, values...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := img.BayerPattern(); p != "RGGB" {
+		t.Fatalf("unexpected pattern %s", p)
+	}
+	rgb := img.Debayer()
+	if rgb.Width != 2 || rgb.Height != 1 || len(rgb.Channels) != 3 {
+		t.Fatalf("unexpected debayered image %dx%d with %d planes", rgb.Width, rgb.Height, len(rgb.Channels))
+	}
+	if rgb.Channels[0][0] != 100 || rgb.Channels[1][0] != 60 || rgb.Channels[2][0] != 10 ||
+		rgb.Channels[0][1] != 200 || rgb.Channels[1][1] != 120 || rgb.Channels[2][1] != 20 {
+		t.Errorf("unexpected debayered planes %v", rgb.Channels)
+	}
+
+	for _, c := range []struct {
+		cards   []string
+		pattern string
+	}{
+		{[]string{"BAYERPAT = 'RGGB'", "XBAYROFF = 1"}, "GRBG"},
+		{[]string{"BAYERPAT = 'RGGB'", "YBAYROFF = 1"}, "GBRG"},
+		{[]string{"BAYERPAT = 'RGGB'", "XBAYROFF = 1", "YBAYROFF = 1"}, "BGGR"},
+		{[]string{"BAYERPAT = 'XYZW'"}, ""},
+		{nil, ""},
+	} {
+		img, err := Decode(monoFITS(8, 2, 2, c.cards, 1, 2, 3, 4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p := img.BayerPattern(); p != c.pattern {
+			t.Errorf("%v: expected pattern %q, got %q", c.cards, c.pattern, p)
+		}
+	}
+}
+
+// noisyFrame returns width x height frame with background of 1000, noise and a bright square
+func noisyFrame(width int, height int) []float64 {
+	values := make([]float64, width*height)
+	seed := uint32(1)
+	for i := range values {
+		seed = seed*1664525 + 1013904223
+		values[i] = 1000 + float64(seed>>24)/8
+	}
+	for y := height/2 - 2; y < height/2+2; y++ {
+		for x := width/2 - 2; x < width/2+2; x++ {
+			values[y*width+x] = 20000
+		}
+	}
+	return values
+}
+
+func TestStretch(t *testing.T) {
+	img, err := Decode(monoFITS(16, 64, 64, nil, noisyFrame(64, 64)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	planes := img.Stretch()
+	if len(planes) != 1 || len(planes[0]) != 64*64 {
+		t.Fatalf("unexpected stretched planes")
+	}
+	median := Median(func() []float64 {
+		values := []float64{}
+		for _, v := range planes[0] {
+			values = append(values, float64(v))
+		}
+		return values
+	}())
+	// background goes to target level and the bright square is white
+	if median < 40 || median > 90 {
+		t.Errorf("stretched background is %g, expected about %g", median, 255*targetBackground)
+	}
+	if v := planes[0][32*64+32]; v != 255 {
+		t.Errorf("bright pixel is stretched to %d", v)
+	}
+
+	// flat image is black
+	flat, _ := Decode(monoFITS(8, 2, 2, nil, 7, 7, 7, 7))
+	for _, v := range flat.Stretch()[0] {
+		if v != 0 {
+			t.Fatalf("flat image is stretched to %v", flat.Stretch()[0])
+		}
+	}
+}
+
+func TestEncodePreview(t *testing.T) {
+	data := monoFITS(16, 64, 32, []string{"BAYERPAT = 'RGGB'"}, noisyFrame(64, 32)...)
+
+	jpg, err := EncodePreview(data, 16, FormatJPEG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(jpg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// debayered to 32x16 and binned to fit 16
+	if b := img.Bounds(); b.Dx() != 16 || b.Dy() != 8 {
+		t.Errorf("unexpected preview size %v", b)
+	}
+
+	pngData, err := EncodePreview(monoFITS(8, 4, 4, nil, noisyFrame(4, 4)...), 0, FormatPNG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mono, err := png.Decode(bytes.NewReader(pngData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mono.(*image.Gray); !ok || mono.Bounds().Dx() != 4 {
+		t.Errorf("unexpected mono preview %T %v", mono, mono.Bounds())
+	}
+
+	if _, err := EncodePreview(data, 16, "gif"); err == nil {
+		t.Error("unknown format is accepted")
+	}
+}
@@ -0,0 +1,239 @@
+package fits
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"sort"
+)
+
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+
+	// auto-stretch parameters of screen transfer function
+	shadowsClip      = -2.8
+	targetBackground = 0.25
+
+	maxSamples  = 100000
+	jpegQuality = 85
+)
+
+// Binned returns image downscaled by averaging so that no side is larger than maxSize
+func (img *Image) Binned(maxSize int) *Image {
+	factor := 1
+	if maxSize > 0 {
+		for img.Width/factor > maxSize || img.Height/factor > maxSize {
+			factor++
+		}
+	}
+	if factor == 1 {
+		return img
+	}
+
+	w, h := img.Width/factor, img.Height/factor
+	binned := &Image{
+		Header:   img.Header,
+		Width:    w,
+		Height:   h,
+		Bitpix:   -32,
+		Channels: make([][]float32, len(img.Channels)),
+	}
+	norm := float32(factor * factor)
+	for c, src := range img.Channels {
+		dst := make([]float32, w*h)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				var sum float32
+				for dy := 0; dy < factor; dy++ {
+					row := (y*factor + dy) * img.Width
+					for dx := 0; dx < factor; dx++ {
+						sum += src[row+x*factor+dx]
+					}
+				}
+				dst[y*w+x] = sum / norm
+			}
+		}
+		binned.Channels[c] = dst
+	}
+
+	return binned
+}
+
+// Stretch returns 8-bit planes auto-stretched with median/MAD screen transfer function
+func (img *Image) Stretch() [][]uint8 {
+	planes := make([][]uint8, len(img.Channels))
+	for c, src := range img.Channels {
+		planes[c] = stretchPlane(src)
+	}
+	return planes
+}
+
+func stretchPlane(src []float32) []uint8 {
+	dst := make([]uint8, len(src))
+	if len(src) == 0 {
+		return dst
+	}
+
+	// normalize to [0, 1]
+	lo, hi := float64(src[0]), float64(src[0])
+	for _, v := range src {
+		if float64(v) < lo {
+			lo = float64(v)
+		}
+		if float64(v) > hi {
+			hi = float64(v)
+		}
+	}
+	if hi <= lo {
+		return dst
+	}
+	scale := 1 / (hi - lo)
+
+	samples := sample(src)
+	for i := range samples {
+		samples[i] = (samples[i] - lo) * scale
+	}
+	median := Median(samples)
+	for i := range samples {
+		samples[i] = math.Abs(samples[i] - median)
+	}
+	madn := 1.4826 * Median(samples)
+
+	shadows := 0.0
+	if madn > 0 {
+		shadows = math.Min(math.Max(median+shadowsClip*madn, 0), 1)
+	}
+	midtones := mtf(targetBackground, median-shadows)
+
+	for i, v := range src {
+		x := (float64(v) - lo) * scale
+		if x <= shadows {
+			continue
+		}
+		x = (x - shadows) / (1 - shadows)
+		dst[i] = uint8(math.Round(255 * mtf(midtones, x)))
+	}
+
+	return dst
+}
+
+// mtf is midtones transfer function
+func mtf(m float64, x float64) float64 {
+	switch {
+	case x <= 0:
+		return 0
+	case x >= 1:
+		return 1
+	case x == m:
+		return 0.5
+	}
+	return (m - 1) * x / ((2*m-1)*x - m)
+}
+
+// sample returns up to maxSamples evenly taken values
+func sample(src []float32) []float64 {
+	step := len(src)/maxSamples + 1
+	samples := make([]float64, 0, len(src)/step+1)
+	for i := 0; i < len(src); i += step {
+		v := float64(src[i])
+		if !math.IsNaN(v) {
+			samples = append(samples, v)
+		}
+	}
+	return samples
+}
+
+// Median returns median of values, values are sorted in place
+func Median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 0 {
+		return (values[n/2-1] + values[n/2]) / 2
+	}
+	return values[n/2]
+}
+
+// Preview returns debayered, downscaled and auto-stretched image ready to be displayed
+func (img *Image) Preview(maxSize int) image.Image {
+	binned := img.Debayer().Binned(maxSize)
+	planes := binned.Stretch()
+
+	flip := !img.TopDown()
+	row := func(y int) int {
+		if flip {
+			return binned.Height - 1 - y
+		}
+		return y
+	}
+
+	rect := image.Rect(0, 0, binned.Width, binned.Height)
+	if len(planes) == 1 {
+		gray := image.NewGray(rect)
+		for y := 0; y < binned.Height; y++ {
+			copy(gray.Pix[y*gray.Stride:], planes[0][row(y)*binned.Width:(row(y)+1)*binned.Width])
+		}
+		return gray
+	}
+
+	rgba := image.NewRGBA(rect)
+	for y := 0; y < binned.Height; y++ {
+		for x := 0; x < binned.Width; x++ {
+			i := row(y)*binned.Width + x
+			rgba.SetRGBA(x, y, color.RGBA{R: planes[0][i], G: planes[1][i], B: planes[2][i], A: 255})
+		}
+	}
+	return rgba
+}
+
+// EncodePreview makes JPEG or PNG preview from FITS file
+func EncodePreview(data []byte, maxSize int, format string) ([]byte, error) {
+	img, err := Decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	switch format {
+	case FormatJPEG:
+		err = jpeg.Encode(buf, img.Preview(maxSize), &jpeg.Options{Quality: jpegQuality})
+	case FormatPNG:
+		err = png.Encode(buf, img.Preview(maxSize))
+	default:
+		return nil, fmt.Errorf("unknown preview format '%s'", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// NewBLOBConverter returns converter of FITS BLOBs to previews, i.e. for broadcast mode
+func NewBLOBConverter(maxSize int, format string) func(blobFormat string, data []byte) (string, []byte, error) {
+	return func(blobFormat string, data []byte) (string, []byte, error) {
+		if blobFormat != ".fits" && blobFormat != ".fit" {
+			return "", nil, fmt.Errorf("%w: BLOB format '%s'", ErrUnsupported, blobFormat)
+		}
+		preview, err := EncodePreview(data, maxSize, format)
+		if err != nil {
+			return "", nil, err
+		}
+		return Extension(format), preview, nil
+	}
+}
+
+// Extension returns file extension of preview format to be used as BLOB format
+func Extension(format string) string {
+	if format == FormatJPEG {
+		return ".jpg"
+	}
+	return "." + format
+}
@@ -0,0 +1,243 @@
+package fits
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	starThreshold = 5.0 // in noise sigmas above background
+	starRadius    = 8
+	maxHFRStars   = 200 // HFR is median of the brightest stars
+)
+
+// Metadata is observation info from FITS header
+type Metadata struct {
+	Object  string   `json:"object,omitempty"`
+	ExpTime *float64 `json:"expTime,omitempty"`
+	Filter  string   `json:"filter,omitempty"`
+	CCDTemp *float64 `json:"ccdTemp,omitempty"`
+	RA      string   `json:"ra,omitempty"`
+	Dec     string   `json:"dec,omitempty"`
+	DateObs string   `json:"dateObs,omitempty"`
+	Gain    *float64 `json:"gain,omitempty"`
+}
+
+// Stats is basic statistics of image
+type Stats struct {
+	Width     int     `json:"width"`
+	Height    int     `json:"height"`
+	Min       float64 `json:"min"`
+	Max       float64 `json:"max"`
+	Mean      float64 `json:"mean"`
+	Median    float64 `json:"median"`
+	Noise     float64 `json:"noise"`
+	Saturated int     `json:"saturated"`
+	Stars     int     `json:"stars"`
+	HFR       float64 `json:"hfr,omitempty"`
+}
+
+// Metadata returns observation info from header
+func (h *Header) Metadata() Metadata {
+	md := Metadata{
+		Object:  h.String("OBJECT"),
+		Filter:  h.String("FILTER"),
+		DateObs: h.String("DATE-OBS"),
+		ExpTime: h.floatPtr("EXPTIME"),
+		CCDTemp: h.floatPtr("CCD-TEMP"),
+		Gain:    h.floatPtr("GAIN"),
+	}
+	if md.ExpTime == nil {
+		md.ExpTime = h.floatPtr("EXPOSURE")
+	}
+
+	md.RA, md.Dec = h.String("OBJCTRA"), h.String("OBJCTDEC")
+	if md.RA == "" {
+		md.RA, md.Dec = h.String("RA"), h.String("DEC")
+	}
+
+	return md
+}
+
+func (h *Header) floatPtr(key string) *float64 {
+	if f, ok := h.Float(key); ok {
+		return &f
+	}
+	return nil
+}
+
+// Stats returns statistics of image, color images are measured by luminance. Stars are found in luminance
+// binned so that no side is larger than maxSize (0 - not binned), HFR is in pixels of image
+func (img *Image) Stats(maxSize int) Stats {
+	lum := img.Debayer().luminance()
+	data := lum.Channels[0]
+
+	st := Stats{
+		Width:  img.Width,
+		Height: img.Height,
+	}
+	if len(data) == 0 {
+		return st
+	}
+
+	saturation := img.saturationLevel()
+	st.Min, st.Max = math.Inf(1), math.Inf(-1)
+	sum := 0.0
+	for _, v := range data {
+		fv := float64(v)
+		sum += fv
+		st.Min = math.Min(st.Min, fv)
+		st.Max = math.Max(st.Max, fv)
+		if fv >= saturation {
+			st.Saturated++
+		}
+	}
+	st.Mean = sum / float64(len(data))
+	st.Median, st.Noise = background(data)
+
+	// binning lowers noise, so stars are found against background of binned image
+	binned := lum.Binned(maxSize)
+	median, noise := st.Median, st.Noise
+	if binned != lum {
+		median, noise = background(binned.Channels[0])
+	}
+	var hfrs []float64
+	st.Stars, hfrs = findStars(binned.Channels[0], binned.Width, binned.Height, median, noise, saturation)
+	if len(hfrs) > 0 {
+		// HFR of debayered or binned image is in its larger pixels
+		st.HFR = Median(hfrs) * float64(img.Width) / float64(binned.Width)
+	}
+
+	return st
+}
+
+// background returns median and noise (normalized MAD) of values
+func background(data []float32) (float64, float64) {
+	samples := sample(data)
+	median := Median(samples)
+	for i := range samples {
+		samples[i] = math.Abs(samples[i] - median)
+	}
+	return median, 1.4826 * Median(samples)
+}
+
+// luminance returns mono image, color planes are averaged
+func (img *Image) luminance() *Image {
+	if len(img.Channels) == 1 {
+		return img
+	}
+	lum := make([]float32, img.Width*img.Height)
+	for _, plane := range img.Channels {
+		for i, v := range plane {
+			lum[i] += v / float32(len(img.Channels))
+		}
+	}
+	return &Image{
+		Header:   img.Header,
+		Width:    img.Width,
+		Height:   img.Height,
+		Bitpix:   img.Bitpix,
+		Channels: [][]float32{lum},
+	}
+}
+
+// saturationLevel returns value of saturated pixel from DATAMAX or from pixel type
+func (img *Image) saturationLevel() float64 {
+	if max, ok := img.Header.Float("DATAMAX"); ok && max > 0 {
+		return max
+	}
+	bzero, _ := img.Header.Float("BZERO")
+	switch img.Bitpix {
+	case 8:
+		return 255
+	case 16:
+		return 32767 + bzero
+	case 32:
+		return 2147483647 + bzero
+	}
+	return math.Inf(1)
+}
+
+// findStars finds local maxima above threshold and returns number of stars and half flux radiuses
+// of the brightest ones
+func findStars(data []float32, w int, h int, background float64, noise float64, saturation float64) (int, []float64) {
+	if noise <= 0 {
+		return 0, nil
+	}
+	threshold := float32(background + starThreshold*noise)
+
+	type star struct {
+		x, y int
+		peak float32
+	}
+	stars := []star{}
+	for y := starRadius; y < h-starRadius; y++ {
+		for x := starRadius; x < w-starRadius; x++ {
+			v := data[y*w+x]
+			if v < threshold || float64(v) >= saturation || !isLocalMax(data, w, x, y) {
+				continue
+			}
+			stars = append(stars, star{x: x, y: y, peak: v})
+		}
+	}
+
+	// hot pixels and noise are single pixels, stars are spread
+	sort.Slice(stars, func(i, j int) bool {
+		return stars[i].peak > stars[j].peak
+	})
+	count := 0
+	hfrs := make([]float64, 0, maxHFRStars)
+	for _, s := range stars {
+		hfr, ok := halfFluxRadius(data, w, s.x, s.y, background)
+		if !ok {
+			continue
+		}
+		count++
+		if len(hfrs) < maxHFRStars {
+			hfrs = append(hfrs, hfr)
+		}
+	}
+
+	return count, hfrs
+}
+
+// isLocalMax checks if pixel is maximum in 5x5 box, ties are resolved to the first pixel
+func isLocalMax(data []float32, w int, x int, y int) bool {
+	v := data[y*w+x]
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			n := data[(y+dy)*w+x+dx]
+			if n > v || (n == v && (dy < 0 || (dy == 0 && dx < 0))) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// halfFluxRadius returns flux-weighted mean distance from star center, false for single hot pixels
+func halfFluxRadius(data []float32, w int, x int, y int, background float64) (float64, bool) {
+	flux, weighted := 0.0, 0.0
+	lit := 0
+	for dy := -starRadius; dy <= starRadius; dy++ {
+		for dx := -starRadius; dx <= starRadius; dx++ {
+			dist := math.Sqrt(float64(dx*dx + dy*dy))
+			if dist > starRadius {
+				continue
+			}
+			f := float64(data[(y+dy)*w+x+dx]) - background
+			if f <= 0 {
+				continue
+			}
+			if dist <= 1.5 {
+				lit++
+			}
+			flux += f
+			weighted += f * dist
+		}
+	}
+	if flux == 0 || lit < 3 {
+		return 0, false
+	}
+	return weighted / flux, true
+}
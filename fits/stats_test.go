@@ -0,0 +1,136 @@
+package fits
+
+import (
+	"math"
+	"testing"
+)
+
+// starField returns size x size 16-bit frame with background of 1000 and grid of gaussian stars every 24 pixels
+func starField(size int, sigma float64) ([]float64, int) {
+	values := make([]float64, size*size)
+	seed := uint32(7)
+	for i := range values {
+		seed = seed*1664525 + 1013904223
+		values[i] = 1000 + float64(seed>>24)/16
+	}
+	stars := 0
+	for cy := 16; cy < size-16; cy += 24 {
+		for cx := 16; cx < size-16; cx += 24 {
+			stars++
+			for dy := -8; dy <= 8; dy++ {
+				for dx := -8; dx <= 8; dx++ {
+					r2 := float64(dx*dx + dy*dy)
+					values[(cy+dy)*size+cx+dx] += 10000 * math.Exp(-r2/(2*sigma*sigma))
+				}
+			}
+		}
+	}
+	return values, stars
+}
+
+func TestStatsCountsAllStars(t *testing.T) {
+	values, stars := starField(512, 1.5)
+	if stars <= maxHFRStars {
+		t.Fatalf("test field has only %d stars", stars)
+	}
+	img, err := Decode(monoFITS(16, 512, 512, []string{"BZERO = 32768"}, func() []float64 {
+		raw := make([]float64, len(values))
+		for i, v := range values {
+			raw[i] = v - 32768
+		}
+		return raw
+	}()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := img.Stats(0)
+	if st.Width != 512 || st.Height != 512 {
+		t.Errorf("unexpected size %dx%d", st.Width, st.Height)
+	}
+	if st.Stars != stars {
+		t.Errorf("expected %d stars, found %d", stars, st.Stars)
+	}
+	if st.Median < 1000 || st.Median > 1016 || st.Noise <= 0 || st.Noise > 10 {
+		t.Errorf("unexpected background: median %g, noise %g", st.Median, st.Noise)
+	}
+	if st.Min < 1000 || st.Max < 11000 || st.Mean <= st.Median || st.Saturated != 0 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+	// mean distance from center of gaussian is sigma*sqrt(pi/2)
+	if math.Abs(st.HFR-1.5*math.Sqrt(math.Pi/2)) > 0.3 {
+		t.Errorf("unexpected HFR %g", st.HFR)
+	}
+
+	// stars found in binned image have the same HFR in pixels of image
+	binned := img.Stats(256)
+	if binned.Stars != stars || binned.Width != 512 || math.Abs(binned.HFR-st.HFR) > 0.5 {
+		t.Errorf("unexpected stats of binned image: %+v, full: %+v", binned, st)
+	}
+	if binned.Median != st.Median || binned.Noise != st.Noise {
+		t.Errorf("background is measured on binned image: %+v", binned)
+	}
+}
+
+func TestStatsSaturationAndHotPixels(t *testing.T) {
+	values, _ := starField(64, 1.5)
+	// single hot pixels are not stars, saturated pixels are counted
+	values[5*64+40] = 30000
+	values[40*64+5] = 30000
+	values[50*64+50] = 65535
+	img, err := Decode(monoFITS(-32, 64, 64, []string{"DATAMAX = 65535"}, values...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := img.Stats(0)
+	if st.Saturated != 1 {
+		t.Errorf("expected 1 saturated pixel, got %d", st.Saturated)
+	}
+	if st.Stars != 4 {
+		t.Errorf("expected 4 stars, got %d", st.Stars)
+	}
+
+	// flat frame has no stars
+	flat, _ := Decode(monoFITS(8, 32, 32, nil, make([]float64, 32*32)...))
+	if st := flat.Stats(0); st.Stars != 0 || st.HFR != 0 || st.Saturated != 0 || st.Noise != 0 {
+		t.Errorf("unexpected stats of flat frame: %+v", st)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	img, err := Decode(monoFITS(8, 1, 1, []string{
+		"OBJECT = 'M 31    '",
+		"EXPTIME = 1.2E2",
+		"FILTER = 'Ha'",
+		"CCD-TEMP = -10.5",
+		"OBJCTRA = '00 42 44'",
+		"OBJCTDEC = '+41 16 09'",
+		"RA = 10.68",
+		"DEC = 41.27",
+		"DATE-OBS = '2020-10-18T20:47:15'",
+		"GAIN = 120",
+	}, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := img.Header.Metadata()
+	if md.Object != "M 31" || md.Filter != "Ha" || md.RA != "00 42 44" || md.Dec != "+41 16 09" ||
+		md.DateObs != "2020-10-18T20:47:15" {
+		t.Errorf("unexpected metadata: %+v", md)
+	}
+	if md.ExpTime == nil || *md.ExpTime != 120 || md.CCDTemp == nil || *md.CCDTemp != -10.5 ||
+		md.Gain == nil || *md.Gain != 120 {
+		t.Errorf("unexpected numeric metadata: %+v", md)
+	}
+
+	// EXPOSURE and RA/DEC are used when EXPTIME and OBJCTRA/OBJCTDEC are missing
+	img, err = Decode(monoFITS(8, 1, 1, []string{"EXPOSURE = 30", "RA = 10.68", "DEC = 41.27"}, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md = img.Header.Metadata()
+	if md.ExpTime == nil || *md.ExpTime != 30 || md.RA != "10.68" || md.Dec != "41.27" ||
+		md.CCDTemp != nil || md.Gain != nil || md.Object != "" {
+		t.Errorf("unexpected fallback metadata: %+v", md)
+	}
+}
@@ -1,5 +1,41 @@
 package hostutils
 
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/indihub-space/agent/lib"
+	"github.com/indihub-space/agent/logutil"
+)
+
+var logger = logutil.New("subsystem", "filter")
+
+// gatedProperties are properties guests can't change while filter is blocked (slews and exposures)
+var gatedProperties = map[string]bool{
+	"EQUATORIAL_EOD_COORD": true,
+	"EQUATORIAL_COORD":     true,
+	"HORIZONTAL_COORD":     true,
+	"TELESCOPE_MOTION_NS":  true,
+	"TELESCOPE_MOTION_WE":  true,
+	"TELESCOPE_PARK":       true,
+	"CCD_EXPOSURE":         true,
+	"GUIDER_EXPOSURE":      true,
+	"DOME_SHUTTER":         true,
+	"DOME_PARK":            true,
+	"ABS_DOME_POSITION":    true,
+	"DOME_MOTION":          true,
+}
+
+var elementNew = []byte("<new")
+
+// sources of filter blocks, every source is blocked and unblocked on its own
+const (
+	BlockSafety    = "safety"
+	BlockEmergency = "emergency"
+)
+
 // INDIFilterConfig contains config for incoming and outgoinf traffic rules
 type INDIFilterConfig struct {
 	IncomingRules map[string]interface{} // TODO: design format for rules
@@ -9,12 +45,69 @@ type INDIFilterConfig struct {
 // INDIFilter provides logic for incoming/outgoing traffic
 type INDIFilter struct {
 	config *INDIFilterConfig
+
+	mu     sync.RWMutex
+	blocks map[string]string // reason by source
 }
 
 func NewINDIFilter(config *INDIFilterConfig) *INDIFilter {
 	return &INDIFilter{
 		config: config,
+		blocks: map[string]string{},
+	}
+}
+
+// Block makes filter drop incoming commands slewing mounts, opening domes and starting exposures
+// until source unblocks it
+func (f *INDIFilter) Block(source string, reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.blocks[source] = reason
+}
+
+// Unblock removes block of source, commands are let through when no other source blocks filter
+func (f *INDIFilter) Unblock(source string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.blocks, source)
+}
+
+// IsBlockedBy returns true and reason if filter is blocked by source
+func (f *INDIFilter) IsBlockedBy(source string) (bool, string) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	reason, ok := f.blocks[source]
+	return ok, reason
+}
+
+// IsBlocked returns true and reasons of all sources if filter is blocked
+func (f *INDIFilter) IsBlocked() (bool, string) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if len(f.blocks) == 0 {
+		return false, ""
+	}
+	reasons := make([]string, 0, len(f.blocks))
+	for _, reason := range f.blocks {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	return true, strings.Join(reasons, "; ")
+}
+
+// IsAllowed checks if single incoming command can be sent to equipment
+func (f *INDIFilter) IsAllowed(cmd []byte) bool {
+	allowed, _ := f.Check(cmd)
+	return allowed
+}
+
+// Check checks if single incoming command can be sent to equipment, block reason is returned for denied command
+func (f *INDIFilter) Check(cmd []byte) (bool, string) {
+	blocked, reason := f.IsBlocked()
+	if !blocked || !bytes.HasPrefix(cmd, elementNew) || !gatedProperties[lib.ElementAttr(cmd, "name")] {
+		return true, ""
 	}
+	return false, reason
 }
 
 // FilterOutgoing filters out outgoing traffic
@@ -26,5 +119,20 @@ func (f *INDIFilter) FilterOutgoing(data [][]byte) [][]byte {
 // FilterIncoming filters out outgoing traffic
 func (f *INDIFilter) FilterIncoming(data [][]byte) [][]byte {
 	// TODO: apply f.IncomingRules
-	return data
+
+	blocked, reason := f.IsBlocked()
+	if !blocked {
+		return data
+	}
+
+	allowed := data[:0]
+	for _, cmd := range data {
+		if !f.IsAllowed(cmd) {
+			logger.Warnf("Command to %s.%s blocked: %s",
+				lib.ElementAttr(cmd, "device"), lib.ElementAttr(cmd, "name"), reason)
+			continue
+		}
+		allowed = append(allowed, cmd)
+	}
+	return allowed
 }
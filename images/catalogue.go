@@ -0,0 +1,233 @@
+package images
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/indihub-space/agent/fits"
+)
+
+const (
+	analyzeQueueSize  = 16
+	analyzeQueueBytes = 256 << 20 // frames waiting to be analyzed
+	analyzeSize       = 2048      // frames are binned to this size to find stars
+)
+
+// Entry is catalogue record of one captured frame
+type Entry struct {
+	Time     time.Time      `json:"time"`
+	Device   string         `json:"device"`
+	Format   string         `json:"format"`
+	Size     int            `json:"size"`
+	Header   []fits.Card    `json:"header,omitempty"`
+	Metadata *fits.Metadata `json:"metadata,omitempty"`
+	Stats    *fits.Stats    `json:"stats,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// Summary is summary of frames in catalogue
+type Summary struct {
+	Frames   int                `json:"frames"`
+	Analyzed int                `json:"analyzed"`
+	Objects  []string           `json:"objects"`
+	Exposure map[string]float64 `json:"exposure"` // total exposure seconds per filter
+	MeanHFR  float64            `json:"meanHFR,omitempty"`
+}
+
+// Catalogue is local catalogue of frames captured during one session
+type Catalogue struct {
+	SessionID uint64    `json:"sessionID"`
+	Started   time.Time `json:"started"`
+
+	mu       sync.Mutex
+	entries  []*Entry
+	queue    chan *Frame
+	queued   int // bytes of queued frames
+	closed   bool
+	done     chan struct{}
+	listener func(e *Entry)
+}
+
+// NewCatalogue creates catalogue and starts analyzing of added frames
+func NewCatalogue(sessionID uint64) *Catalogue {
+	c := &Catalogue{
+		SessionID: sessionID,
+		Started:   time.Now(),
+		entries:   []*Entry{},
+		queue:     make(chan *Frame, analyzeQueueSize),
+		done:      make(chan struct{}),
+	}
+	go c.analyzeFrames()
+	return c
+}
+
+// SetListener sets function called with every new entry when the frame is analyzed or skipped
+func (c *Catalogue) SetListener(fn func(e *Entry)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listener = fn
+}
+
+// Add queues frame to be analyzed, frames are skipped if analyzing can't keep up
+func (c *Catalogue) Add(frame *Frame) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	// the first frame is queued even if it is larger than the limit
+	if c.queued > 0 && c.queued+frame.Size > analyzeQueueBytes {
+		c.mu.Unlock()
+		c.add(newEntry(frame, "skipped: analyzing queue is full"))
+		return
+	}
+	select {
+	case c.queue <- frame:
+		c.queued += frame.Size
+		c.mu.Unlock()
+	default:
+		c.mu.Unlock()
+		c.add(newEntry(frame, "skipped: analyzing queue is full"))
+	}
+}
+
+// add adds entry and notifies listener
+func (c *Catalogue) add(entry *Entry) {
+	c.mu.Lock()
+	c.entries = append(c.entries, entry)
+	listener := c.listener
+	c.mu.Unlock()
+
+	if listener != nil {
+		listener(entry)
+	}
+}
+
+// Close waits for queued frames to be analyzed
+func (c *Catalogue) Close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	close(c.queue)
+	c.mu.Unlock()
+
+	<-c.done
+}
+
+// Entries returns all entries sorted by time
+func (c *Catalogue) Entries() []*Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := append([]*Entry{}, c.entries...)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	return entries
+}
+
+// Summary returns summary of frames in catalogue
+func (c *Catalogue) Summary() Summary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := Summary{
+		Frames:   len(c.entries),
+		Objects:  []string{},
+		Exposure: map[string]float64{},
+	}
+	objects := map[string]bool{}
+	hfrSum, hfrNum := 0.0, 0
+	for _, e := range c.entries {
+		if e.Metadata == nil || e.Stats == nil {
+			continue
+		}
+		s.Analyzed++
+		if e.Metadata.Object != "" && !objects[e.Metadata.Object] {
+			objects[e.Metadata.Object] = true
+			s.Objects = append(s.Objects, e.Metadata.Object)
+		}
+		if e.Metadata.ExpTime != nil {
+			filter := e.Metadata.Filter
+			if filter == "" {
+				filter = "none"
+			}
+			s.Exposure[filter] += *e.Metadata.ExpTime
+		}
+		if e.Stats.HFR > 0 {
+			hfrSum += e.Stats.HFR
+			hfrNum++
+		}
+	}
+	if hfrNum > 0 {
+		s.MeanHFR = hfrSum / float64(hfrNum)
+	}
+
+	return s
+}
+
+// String returns summary to be printed at the end of session
+func (s Summary) String() string {
+	filters := make([]string, 0, len(s.Exposure))
+	for filter, exp := range s.Exposure {
+		filters = append(filters, fmt.Sprintf("%s: %.0fs", filter, exp))
+	}
+	sort.Strings(filters)
+
+	return fmt.Sprintf("frames: %d (analyzed %d), objects: %s, exposure: %s, mean HFR: %.2f px",
+		s.Frames, s.Analyzed, strings.Join(s.Objects, ", "), strings.Join(filters, ", "), s.MeanHFR)
+}
+
+func (c *Catalogue) analyzeFrames() {
+	defer close(c.done)
+
+	for frame := range c.queue {
+		entry := analyze(frame)
+		c.mu.Lock()
+		c.queued -= frame.Size
+		c.mu.Unlock()
+		c.add(entry)
+	}
+}
+
+func newEntry(frame *Frame, errMsg string) *Entry {
+	return &Entry{
+		Time:   frame.Time,
+		Device: frame.Device,
+		Format: frame.Format,
+		Size:   frame.Size,
+		Error:  errMsg,
+	}
+}
+
+func analyze(frame *Frame) *Entry {
+	format := strings.ToLower(frame.Format)
+	if format != ".fits" && format != ".fit" {
+		return newEntry(frame, "not a FITS frame")
+	}
+
+	start := time.Now()
+	img, err := fits.Decode(frame.data)
+	if err != nil {
+		logger.Errorf("could not read FITS frame from %s: %s", frame.Device, err)
+		return newEntry(frame, err.Error())
+	}
+
+	md := img.Header.Metadata()
+	st := img.Stats(analyzeSize)
+	logger.Infof("Frame from %s: object '%s', median %.1f, noise %.1f, %d stars, HFR %.2f (analyzed in %s)",
+		frame.Device, md.Object, st.Median, st.Noise, st.Stars, st.HFR, time.Since(start))
+
+	entry := newEntry(frame, "")
+	entry.Header = img.Header.Cards
+	entry.Metadata = &md
+	entry.Stats = &st
+
+	return entry
+}
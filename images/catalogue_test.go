@@ -0,0 +1,69 @@
+package images
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCatalogueQueueIsBoundByBytes(t *testing.T) {
+	c := NewCatalogue(1)
+
+	// the first entry blocks analyzing until released
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	first := true
+	c.SetListener(func(e *Entry) {
+		if first {
+			first = false
+			close(entered)
+			<-release
+		}
+	})
+
+	frame := func(name string, size int) *Frame {
+		return &Frame{Device: "CCD", Name: name, Format: ".fits", Size: size, Time: time.Now()}
+	}
+	// frame larger than the limit is analyzed when queue is empty
+	c.Add(frame("huge", analyzeQueueBytes*2))
+	<-entered
+	c.Add(frame("big", analyzeQueueBytes*3/4))
+	c.Add(frame("skipped", analyzeQueueBytes/2))
+	close(release)
+	c.Close()
+
+	entries := c.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	skipped := 0
+	for _, e := range entries {
+		if e.Error == "skipped: analyzing queue is full" {
+			skipped++
+			if e.Size != analyzeQueueBytes/2 {
+				t.Errorf("wrong frame is skipped: %+v", e)
+			}
+		}
+	}
+	if skipped != 1 {
+		t.Errorf("expected 1 skipped frame, got %d", skipped)
+	}
+}
+
+func TestCatalogueSummary(t *testing.T) {
+	c := NewCatalogue(1)
+	s := NewStore()
+	c.Add(s.Put("CCD", "CCD1", ".fits", monoFITS(32, 32)))
+	c.Add(s.Put("CCD", "CCD1", ".fits", []byte("not a FITS")))
+	c.Add(s.Put("CCD", "CCD1", ".jpg", []byte{1}))
+	c.Close()
+
+	entries := c.Entries()
+	if len(entries) != 3 || entries[0].Stats == nil || entries[0].Stats.Width != 32 || entries[1].Error == "" ||
+		entries[2].Error != "not a FITS frame" {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	summary := c.Summary()
+	if summary.Frames != 3 || summary.Analyzed != 1 {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+}
@@ -0,0 +1,211 @@
+package images
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/indihub-space/agent/fits"
+	"github.com/indihub-space/agent/indiclient"
+	"github.com/indihub-space/agent/logutil"
+)
+
+var logger = logutil.New("subsystem", "images")
+
+const DefaultPreviewSize = 1024
+
+var ErrNoFrame = errors.New("no frames captured")
+
+// Frame is the latest BLOB captured from camera
+type Frame struct {
+	Device string    `json:"device"`
+	Name   string    `json:"name"`
+	Format string    `json:"format"`
+	Size   int       `json:"size"`
+	Time   time.Time `json:"time"`
+
+	data []byte
+	seq  uint64
+}
+
+// Preview is JPEG or PNG preview of frame
+type Preview struct {
+	Frame  *Frame
+	Format string
+	Data   []byte
+
+	maxSize int
+	seq     uint64
+}
+
+// Store keeps the latest frames captured from cameras and makes previews from them
+type Store struct {
+	mu       sync.Mutex
+	seq      uint64
+	frames   map[string]*Frame
+	previews map[string]*Preview
+}
+
+func NewStore() *Store {
+	return &Store{
+		frames:   map[string]*Frame{},
+		previews: map[string]*Preview{},
+	}
+}
+
+// Put stores frame as the latest one of device
+func (s *Store) Put(device string, name string, format string, data []byte) *Frame {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	frame := &Frame{
+		Device: device,
+		Name:   name,
+		Format: format,
+		Size:   len(data),
+		Time:   time.Now(),
+		data:   data,
+		seq:    s.seq,
+	}
+	s.frames[device] = frame
+
+	return frame
+}
+
+// PutBLOBVector stores frames from setBLOBVector INDI XML-element, returns parsed vector and stored frames
+func (s *Store) PutBLOBVector(el []byte) (*indiclient.Vector, []*Frame, error) {
+	msg, err := indiclient.Parse(el)
+	if err != nil {
+		return nil, nil, err
+	}
+	if msg.Tag != "setBLOBVector" {
+		return nil, nil, fmt.Errorf("not a setBLOBVector: %s", msg.Tag)
+	}
+
+	frames := []*Frame{}
+	for _, e := range msg.Vector.Elements {
+		if e.Value == "" {
+			continue
+		}
+		data, err := indiclient.DecodeBLOB(e.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		frames = append(frames, s.Put(msg.Device, e.Name, e.Format, data))
+	}
+
+	return msg.Vector, frames, nil
+}
+
+// Latest returns the latest frame of device
+func (s *Store) Latest(device string) (*Frame, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	frame, ok := s.frames[device]
+	return frame, ok
+}
+
+// Devices returns names of devices with captured frames
+func (s *Store) Devices() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	devices := make([]string, 0, len(s.frames))
+	for device := range s.frames {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+
+	return devices
+}
+
+// Preview returns preview of the latest frame of device, previews are cached until the next frame
+func (s *Store) Preview(device string, maxSize int, format string) (*Preview, error) {
+	frame, ok := s.Latest(device)
+	if !ok {
+		return nil, ErrNoFrame
+	}
+	return s.preview(frame, maxSize, format)
+}
+
+// preview returns preview of frame, preview is cached if frame is the latest one of its device
+func (s *Store) preview(frame *Frame, maxSize int, format string) (*Preview, error) {
+	key := frame.Device + "/" + format
+	s.mu.Lock()
+	cached, ok := s.previews[key]
+	s.mu.Unlock()
+	if ok && cached.seq == frame.seq && cached.maxSize == maxSize {
+		return cached, nil
+	}
+
+	data, err := makePreview(frame.Format, frame.data, maxSize, format)
+	if err != nil {
+		return nil, err
+	}
+	preview := &Preview{
+		Frame:   frame,
+		Format:  format,
+		Data:    data,
+		maxSize: maxSize,
+		seq:     frame.seq,
+	}
+
+	s.mu.Lock()
+	if latest, ok := s.frames[frame.Device]; ok && latest.seq == frame.seq {
+		s.previews[key] = preview
+	}
+	s.mu.Unlock()
+
+	return preview, nil
+}
+
+// PreviewBLOBVector replaces FITS frames in setBLOBVector INDI XML-element with previews,
+// every element gets preview of its own frame
+func (s *Store) PreviewBLOBVector(el []byte, maxSize int, format string) ([]byte, error) {
+	v, frames, err := s.PutBLOBVector(el)
+	if err != nil {
+		return nil, err
+	}
+	if len(frames) == 0 {
+		return nil, ErrNoFrame
+	}
+
+	for _, frame := range frames {
+		preview, err := s.preview(frame, maxSize, format)
+		if err != nil {
+			return nil, err
+		}
+		for i := range v.Elements {
+			if v.Elements[i].Name != frame.Name {
+				continue
+			}
+			v.Elements[i].Format = fits.Extension(format)
+			v.Elements[i].Size = fmt.Sprintf("%d", len(preview.Data))
+			v.Elements[i].Value = indiclient.EncodeBLOB(preview.Data)
+		}
+	}
+
+	return v.SetXML(), nil
+}
+
+func makePreview(blobFormat string, data []byte, maxSize int, format string) ([]byte, error) {
+	blobFormat = strings.ToLower(blobFormat)
+	if blobFormat != ".fits" && blobFormat != ".fit" {
+		return nil, fmt.Errorf("%w: BLOB format '%s'", fits.ErrUnsupported, blobFormat)
+	}
+
+	start := time.Now()
+	preview, err := fits.EncodePreview(data, maxSize, format)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Made %s preview (%d bytes) of %d bytes frame in %s", format, len(preview), len(data),
+		time.Since(start))
+
+	return preview, nil
+}
@@ -0,0 +1,123 @@
+package images
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"testing"
+
+	"github.com/indihub-space/agent/fits"
+	"github.com/indihub-space/agent/indiclient"
+)
+
+// monoFITS builds 8-bit FITS frame with gradient
+func monoFITS(width int, height int) []byte {
+	buf := &bytes.Buffer{}
+	for _, c := range []string{"SIMPLE  = T", "BITPIX  = 8", "NAXIS   = 2",
+		fmt.Sprintf("NAXIS1  = %d", width), fmt.Sprintf("NAXIS2  = %d", height), "END"} {
+		fmt.Fprintf(buf, "%-80s", c)
+	}
+	for buf.Len()%2880 != 0 {
+		buf.WriteByte(' ')
+	}
+	for i := 0; i < width*height; i++ {
+		buf.WriteByte(byte(i))
+	}
+	for buf.Len()%2880 != 0 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func blobVector(device string, frames map[string][]byte) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "<setBLOBVector device=\"%s\" name=\"CCD1\" state=\"Ok\">\n", device)
+	for _, name := range []string{"CCD1", "CCD2"} {
+		if data, ok := frames[name]; ok {
+			fmt.Fprintf(buf, "<oneBLOB name=\"%s\" size=\"%d\" format=\".fits\">%s</oneBLOB>\n",
+				name, len(data), indiclient.EncodeBLOB(data))
+		}
+	}
+	buf.WriteString("</setBLOBVector>")
+	return buf.Bytes()
+}
+
+// previewSize decodes PNG preview of BLOB element and returns its size
+func previewSize(t *testing.T, v *indiclient.Vector, name string) (int, int) {
+	t.Helper()
+	for _, e := range v.Elements {
+		if e.Name != name {
+			continue
+		}
+		if e.Format != ".png" {
+			t.Fatalf("%s is not replaced with preview: %s", name, e.Format)
+		}
+		data, err := indiclient.DecodeBLOB(e.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img.Bounds().Dx(), img.Bounds().Dy()
+	}
+	t.Fatalf("no element %s", name)
+	return 0, 0
+}
+
+func TestPreviewBLOBVector(t *testing.T) {
+	s := NewStore()
+
+	// every element gets preview of its own frame, not of the latest frame of device
+	el, err := s.PreviewBLOBVector(blobVector("CCD", map[string][]byte{
+		"CCD1": monoFITS(8, 4),
+		"CCD2": monoFITS(4, 6),
+	}), 0, fits.FormatPNG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := indiclient.Parse(el)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, h := previewSize(t, msg.Vector, "CCD1"); w != 8 || h != 4 {
+		t.Errorf("CCD1 preview is %dx%d", w, h)
+	}
+	if w, h := previewSize(t, msg.Vector, "CCD2"); w != 4 || h != 6 {
+		t.Errorf("CCD2 preview is %dx%d", w, h)
+	}
+
+	// frames are stored and the latest one is previewed
+	if devices := s.Devices(); len(devices) != 1 || devices[0] != "CCD" {
+		t.Errorf("unexpected devices %v", devices)
+	}
+	preview, err := s.Preview("CCD", 0, fits.FormatPNG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Frame.Name != "CCD2" {
+		t.Errorf("preview of %s is not the latest frame", preview.Frame.Name)
+	}
+	if cached, _ := s.Preview("CCD", 0, fits.FormatPNG); cached != preview {
+		t.Error("preview is not cached")
+	}
+	if _, err := s.Preview("Guider", 0, fits.FormatPNG); err != ErrNoFrame {
+		t.Errorf("expected no frame, got %v", err)
+	}
+}
+
+func TestPreviewBLOBVectorErrors(t *testing.T) {
+	s := NewStore()
+
+	if _, err := s.PreviewBLOBVector(blobVector("CCD", nil), 0, fits.FormatPNG); err != ErrNoFrame {
+		t.Errorf("empty vector: expected no frame, got %v", err)
+	}
+	if _, err := s.PreviewBLOBVector([]byte(`<setNumberVector device="CCD" name="CCD_TEMPERATURE"></setNumberVector>`), 0, fits.FormatPNG); err == nil {
+		t.Error("number vector is previewed")
+	}
+	bad := []byte(`<setBLOBVector device="CCD" name="CCD1"><oneBLOB name="CCD1" size="3" format=".fits">AAAA</oneBLOB></setBLOBVector>`)
+	if _, err := s.PreviewBLOBVector(bad, 0, fits.FormatPNG); err == nil {
+		t.Error("bad FITS is previewed")
+	}
+}
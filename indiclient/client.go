@@ -0,0 +1,436 @@
+package indiclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/indihub-space/agent/lib"
+	"github.com/indihub-space/agent/logutil"
+)
+
+var logger = logutil.New("subsystem", "indiclient")
+
+var (
+	ErrTimeout        = errors.New("timeout")
+	ErrClosed         = errors.New("connection to INDI-server is closed")
+	ErrUnknownProp    = errors.New("unknown property")
+	ErrUnknownElement = errors.New("unknown element")
+	ErrBlocked        = errors.New("command is blocked")
+)
+
+// Client is INDI-client keeping cache of all properties of INDI-server
+type Client struct {
+	addr string
+	conn net.Conn
+
+	writeMu sync.Mutex
+	allow   func(cmd []byte) bool
+	sent    func(cmd []byte)
+
+	propsMu sync.RWMutex
+	props   map[string]map[string]*Vector
+	lastDef time.Time
+
+	subsMu  sync.Mutex
+	subs    map[int]func(*Message)
+	lastSub int
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Dial connects to INDI-server and requests all properties
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		addr:    addr,
+		conn:    conn,
+		props:   map[string]map[string]*Vector{},
+		subs:    map[int]func(*Message){},
+		done:    make(chan struct{}),
+		lastDef: time.Now(),
+	}
+
+	go c.readLoop()
+
+	if err := c.Send([]byte("<getProperties version=\"1.7\"/>\n")); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Close closes connection to INDI-server
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		c.conn.Close()
+	})
+}
+
+// Done is closed when connection to INDI-server is lost or closed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Addr returns INDI-server address
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+// Send sends raw INDI XML to INDI-server
+func (c *Client) Send(data []byte) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_, err := c.conn.Write(data)
+	if err == nil && c.sent != nil {
+		c.sent(data)
+	}
+	return err
+}
+
+// SetCommandFilter sets check of new*Vector commands sent by SetValues and alike, i.e. INDIFilter.IsAllowed,
+// blocked commands are not sent and ErrBlocked is returned
+func (c *Client) SetCommandFilter(allow func(cmd []byte) bool) {
+	c.allow = allow
+}
+
+// SetSentHook sets function called with every command successfully sent to INDI-server, i.e. to audit them
+func (c *Client) SetSentHook(sent func(cmd []byte)) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.sent = sent
+}
+
+// EnableBLOB sets BLOB policy for device (and property if name is not empty)
+func (c *Client) EnableBLOB(device string, name string, policy string) error {
+	if name == "" {
+		return c.Send([]byte(fmt.Sprintf("<enableBLOB device=\"%s\">%s</enableBLOB>\n", escape(device), policy)))
+	}
+	return c.Send([]byte(fmt.Sprintf("<enableBLOB device=\"%s\" name=\"%s\">%s</enableBLOB>\n",
+		escape(device), escape(name), policy)))
+}
+
+func (c *Client) readLoop() {
+	defer close(c.done)
+	defer c.Close()
+
+	buf := make([]byte, lib.INDIServerMaxRecvMsgSize)
+	xmlFlattener := lib.NewXmlFlattener()
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for _, el := range xmlFlattener.FeedChunk(buf[:n]) {
+			msg, err := Parse(el)
+			if err != nil {
+				logger.Errorf("INDI-client %s: could not parse element: %s", c.addr, err)
+				continue
+			}
+			c.update(msg)
+			c.notify(msg)
+		}
+	}
+}
+
+func (c *Client) update(msg *Message) {
+	c.propsMu.Lock()
+	defer c.propsMu.Unlock()
+
+	switch {
+	case msg.Tag == "delProperty":
+		if msg.Name == "" {
+			delete(c.props, msg.Device)
+		} else if devProps, ok := c.props[msg.Device]; ok {
+			delete(devProps, msg.Name)
+		}
+	case msg.Vector == nil:
+		return
+	case msg.Tag[:3] == "def":
+		devProps, ok := c.props[msg.Device]
+		if !ok {
+			devProps = map[string]*Vector{}
+			c.props[msg.Device] = devProps
+		}
+		devProps[msg.Name] = msg.Vector.Copy()
+		c.lastDef = time.Now()
+	case msg.Tag[:3] == "set":
+		if v, ok := c.props[msg.Device][msg.Name]; ok {
+			v.Update(msg.Vector)
+		}
+	}
+}
+
+func (c *Client) notify(msg *Message) {
+	c.subsMu.Lock()
+	subs := make([]func(*Message), 0, len(c.subs))
+	for _, fn := range c.subs {
+		subs = append(subs, fn)
+	}
+	c.subsMu.Unlock()
+
+	for _, fn := range subs {
+		fn(msg)
+	}
+}
+
+// Subscribe calls fn for every message from INDI-server (after cache is updated), returns unsubscribe func
+func (c *Client) Subscribe(fn func(*Message)) func() {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	c.lastSub++
+	id := c.lastSub
+	c.subs[id] = fn
+
+	return func() {
+		c.subsMu.Lock()
+		defer c.subsMu.Unlock()
+		delete(c.subs, id)
+	}
+}
+
+// WaitDefs waits until INDI-server stops sending property definitions for quiet period or max time passes
+func (c *Client) WaitDefs(quiet time.Duration, max time.Duration) {
+	deadline := time.Now().Add(max)
+	for time.Now().Before(deadline) {
+		c.propsMu.RLock()
+		lastDef := c.lastDef
+		c.propsMu.RUnlock()
+		if time.Since(lastDef) >= quiet {
+			return
+		}
+		select {
+		case <-c.done:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Devices returns sorted names of all devices
+func (c *Client) Devices() []string {
+	c.propsMu.RLock()
+	defer c.propsMu.RUnlock()
+
+	devices := make([]string, 0, len(c.props))
+	for device := range c.props {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+
+	return devices
+}
+
+// Property returns copy of property
+func (c *Client) Property(device string, name string) (*Vector, bool) {
+	c.propsMu.RLock()
+	defer c.propsMu.RUnlock()
+
+	v, ok := c.props[device][name]
+	if !ok {
+		return nil, false
+	}
+	return v.Copy(), true
+}
+
+// Properties returns copies of all properties of device sorted by name
+func (c *Client) Properties(device string) []*Vector {
+	c.propsMu.RLock()
+	defer c.propsMu.RUnlock()
+
+	props := make([]*Vector, 0, len(c.props[device]))
+	for _, v := range c.props[device] {
+		props = append(props, v.Copy())
+	}
+	sort.Slice(props, func(i, j int) bool {
+		return props[i].Name < props[j].Name
+	})
+
+	return props
+}
+
+// HasProperty checks if device has property
+func (c *Client) HasProperty(device string, name string) bool {
+	c.propsMu.RLock()
+	defer c.propsMu.RUnlock()
+
+	_, ok := c.props[device][name]
+	return ok
+}
+
+// DevicesWithProperty returns sorted names of devices having property
+func (c *Client) DevicesWithProperty(name string) []string {
+	c.propsMu.RLock()
+	defer c.propsMu.RUnlock()
+
+	devices := []string{}
+	for device, devProps := range c.props {
+		if _, ok := devProps[name]; ok {
+			devices = append(devices, device)
+		}
+	}
+	sort.Strings(devices)
+
+	return devices
+}
+
+// SetValues sends new*Vector command with element values for property
+func (c *Client) SetValues(device string, name string, values map[string]string) error {
+	v, ok := c.Property(device, name)
+	if !ok {
+		return ErrUnknownProp
+	}
+	for elName := range values {
+		if _, ok := v.Element(elName); !ok {
+			return fmt.Errorf("%s: %s.%s.%s", ErrUnknownElement, device, name, elName)
+		}
+	}
+
+	cmd := NewVectorXML(v.Kind, device, name, values)
+	if c.allow != nil && !c.allow(cmd) {
+		return fmt.Errorf("%w: %s.%s", ErrBlocked, device, name)
+	}
+	return c.Send(cmd)
+}
+
+// SetNumbers sends newNumberVector for property
+func (c *Client) SetNumbers(device string, name string, values map[string]float64) error {
+	strValues := make(map[string]string, len(values))
+	for elName, val := range values {
+		strValues[elName] = strconv.FormatFloat(val, 'f', -1, 64)
+	}
+	return c.SetValues(device, name, strValues)
+}
+
+// SetSwitch turns on switch element of property, for OneOfMany switches other elements are turned off
+func (c *Client) SetSwitch(device string, name string, element string) error {
+	values, err := c.switchValues(device, name, element)
+	if err != nil {
+		return err
+	}
+	return c.SetValues(device, name, values)
+}
+
+// SetSwitchAndWait turns on switch element of property and waits for result like SetAndWait
+func (c *Client) SetSwitchAndWait(device string, name string, element string, timeout time.Duration) (string, error) {
+	values, err := c.switchValues(device, name, element)
+	if err != nil {
+		return "", err
+	}
+	return c.SetAndWait(device, name, values, timeout)
+}
+
+func (c *Client) switchValues(device string, name string, element string) (map[string]string, error) {
+	v, ok := c.Property(device, name)
+	if !ok {
+		return nil, ErrUnknownProp
+	}
+
+	values := map[string]string{element: SwitchOn}
+	if v.Rule == "OneOfMany" {
+		for _, e := range v.Elements {
+			if e.Name != element {
+				values[e.Name] = SwitchOff
+			}
+		}
+	}
+
+	return values, nil
+}
+
+// SetAndWait sends new*Vector command and waits for INDI-server to reply with property state other than Busy
+func (c *Client) SetAndWait(device string, name string, values map[string]string, timeout time.Duration) (string, error) {
+	updates := make(chan string, 16)
+	unsubscribe := c.Subscribe(func(msg *Message) {
+		if msg.Vector == nil || msg.Tag[:3] != "set" || msg.Device != device || msg.Name != name {
+			return
+		}
+		select {
+		case updates <- msg.Vector.State:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	if err := c.SetValues(device, name, values); err != nil {
+		return "", err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	state := ""
+	for {
+		select {
+		case st := <-updates:
+			if st == "" {
+				// state was not changed
+				if v, ok := c.Property(device, name); ok {
+					st = v.State
+				}
+			}
+			state = st
+			if state != StateBusy {
+				return state, nil
+			}
+		case <-c.done:
+			return state, ErrClosed
+		case <-timer.C:
+			return state, ErrTimeout
+		}
+	}
+}
+
+// WaitState waits until state of property satisfies check, returns the last state seen
+func (c *Client) WaitState(device string, name string, timeout time.Duration, check func(state string) bool) (string, error) {
+	changed := make(chan struct{}, 1)
+	unsubscribe := c.Subscribe(func(msg *Message) {
+		if msg.Device == device && msg.Name == name {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer unsubscribe()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		v, ok := c.Property(device, name)
+		if !ok {
+			return "", ErrUnknownProp
+		}
+		if check(v.State) {
+			return v.State, nil
+		}
+
+		select {
+		case <-changed:
+		case <-c.done:
+			return v.State, ErrClosed
+		case <-timer.C:
+			return v.State, ErrTimeout
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package indiclient
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+const (
+	KindNumber = "Number"
+	KindSwitch = "Switch"
+	KindText   = "Text"
+	KindLight  = "Light"
+	KindBLOB   = "BLOB"
+
+	StateIdle  = "Idle"
+	StateOk    = "Ok"
+	StateBusy  = "Busy"
+	StateAlert = "Alert"
+
+	SwitchOn  = "On"
+	SwitchOff = "Off"
+)
+
+// Element is one element of INDI vector property
+type Element struct {
+	Name   string `json:"name"`
+	Label  string `json:"label,omitempty"`
+	Value  string `json:"value"`
+	Format string `json:"format,omitempty"`
+	Min    string `json:"min,omitempty"`
+	Max    string `json:"max,omitempty"`
+	Step   string `json:"step,omitempty"`
+	Size   string `json:"size,omitempty"`
+}
+
+// Vector is INDI vector property
+type Vector struct {
+	Kind      string    `json:"kind"`
+	Device    string    `json:"device"`
+	Name      string    `json:"name"`
+	Label     string    `json:"label,omitempty"`
+	Group     string    `json:"group,omitempty"`
+	State     string    `json:"state,omitempty"`
+	Perm      string    `json:"perm,omitempty"`
+	Rule      string    `json:"rule,omitempty"`
+	Timeout   string    `json:"timeout,omitempty"`
+	Timestamp string    `json:"timestamp,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Elements  []Element `json:"elements"`
+}
+
+// Message is parsed INDI XML-element
+type Message struct {
+	Tag       string  // i.e. defNumberVector, setSwitchVector, delProperty, message
+	Vector    *Vector // set for def*, set* and new* vectors
+	Device    string
+	Name      string
+	Text      string // message attribute of message and delProperty elements
+	Timestamp string
+}
+
+type xmlElement struct {
+	XMLName xml.Name
+	Name    string `xml:"name,attr"`
+	Label   string `xml:"label,attr"`
+	Format  string `xml:"format,attr"`
+	Min     string `xml:"min,attr"`
+	Max     string `xml:"max,attr"`
+	Step    string `xml:"step,attr"`
+	Size    string `xml:"size,attr"`
+	Value   string `xml:",chardata"`
+}
+
+type xmlVector struct {
+	XMLName   xml.Name
+	Device    string       `xml:"device,attr"`
+	Name      string       `xml:"name,attr"`
+	Label     string       `xml:"label,attr"`
+	Group     string       `xml:"group,attr"`
+	State     string       `xml:"state,attr"`
+	Perm      string       `xml:"perm,attr"`
+	Rule      string       `xml:"rule,attr"`
+	Timeout   string       `xml:"timeout,attr"`
+	Timestamp string       `xml:"timestamp,attr"`
+	Message   string       `xml:"message,attr"`
+	Elements  []xmlElement `xml:",any"`
+}
+
+// Parse parses INDI XML-element
+func Parse(el []byte) (*Message, error) {
+	xv := &xmlVector{}
+	if err := xml.Unmarshal(bytes.TrimSpace(el), xv); err != nil {
+		return nil, err
+	}
+
+	msg := &Message{
+		Tag:       xv.XMLName.Local,
+		Device:    xv.Device,
+		Name:      xv.Name,
+		Text:      xv.Message,
+		Timestamp: xv.Timestamp,
+	}
+
+	kind := VectorKind(msg.Tag)
+	if kind == "" {
+		return msg, nil
+	}
+
+	msg.Vector = &Vector{
+		Kind:      kind,
+		Device:    xv.Device,
+		Name:      xv.Name,
+		Label:     xv.Label,
+		Group:     xv.Group,
+		State:     xv.State,
+		Perm:      xv.Perm,
+		Rule:      xv.Rule,
+		Timeout:   xv.Timeout,
+		Timestamp: xv.Timestamp,
+		Message:   xv.Message,
+		Elements:  make([]Element, 0, len(xv.Elements)),
+	}
+	for _, xe := range xv.Elements {
+		msg.Vector.Elements = append(msg.Vector.Elements, Element{
+			Name:   xe.Name,
+			Label:  xe.Label,
+			Value:  strings.TrimSpace(xe.Value),
+			Format: xe.Format,
+			Min:    xe.Min,
+			Max:    xe.Max,
+			Step:   xe.Step,
+			Size:   xe.Size,
+		})
+	}
+
+	return msg, nil
+}
+
+// VectorKind returns kind of vector for tags like defNumberVector, setSwitchVector or newTextVector
+func VectorKind(tag string) string {
+	if !strings.HasSuffix(tag, "Vector") || len(tag) < len("defVector")+1 {
+		return ""
+	}
+	prefix := tag[:3]
+	if prefix != "def" && prefix != "set" && prefix != "new" {
+		return ""
+	}
+	return tag[3 : len(tag)-len("Vector")]
+}
+
+// Element returns element by name
+func (v *Vector) Element(name string) (Element, bool) {
+	for _, e := range v.Elements {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	return Element{}, false
+}
+
+// Copy returns deep copy of vector
+func (v *Vector) Copy() *Vector {
+	vCopy := *v
+	vCopy.Elements = append([]Element{}, v.Elements...)
+	return &vCopy
+}
+
+// Update applies values and state from set-vector
+func (v *Vector) Update(set *Vector) {
+	if set.State != "" {
+		v.State = set.State
+	}
+	if set.Timestamp != "" {
+		v.Timestamp = set.Timestamp
+	}
+	if set.Timeout != "" {
+		v.Timeout = set.Timeout
+	}
+	v.Message = set.Message
+	for _, se := range set.Elements {
+		for i := range v.Elements {
+			if v.Elements[i].Name == se.Name {
+				v.Elements[i].Value = se.Value
+				if se.Format != "" {
+					v.Elements[i].Format = se.Format
+				}
+				if se.Size != "" {
+					v.Elements[i].Size = se.Size
+				}
+				break
+			}
+		}
+	}
+}
+
+// NewVectorXML returns INDI new*Vector command setting values of elements
+func NewVectorXML(kind string, device string, name string, values map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "<new%sVector device=\"%s\" name=\"%s\">\n", kind, escape(device), escape(name))
+	for elName, val := range values {
+		fmt.Fprintf(buf, "  <one%s name=\"%s\">%s</one%s>\n", kind, escape(elName), escape(val), kind)
+	}
+	fmt.Fprintf(buf, "</new%sVector>\n", kind)
+	return buf.Bytes()
+}
+
+func escape(s string) string {
+	buf := &bytes.Buffer{}
+	xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
+
+// DefXML returns def*Vector element defining property, perm is forced to "ro" if readOnly is set
+func (v *Vector) DefXML(readOnly bool) []byte {
+	perm := v.Perm
+	if readOnly && v.Kind != KindLight {
+		perm = "ro"
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "<def%sVector device=\"%s\" name=\"%s\" label=\"%s\" group=\"%s\" state=\"%s\"",
+		v.Kind, escape(v.Device), escape(v.Name), escape(v.Label), escape(v.Group), v.State)
+	if v.Kind != KindLight {
+		fmt.Fprintf(buf, " perm=\"%s\"", perm)
+	}
+	if v.Kind == KindSwitch {
+		fmt.Fprintf(buf, " rule=\"%s\"", v.Rule)
+	}
+	if v.Timeout != "" && v.Kind != KindLight {
+		fmt.Fprintf(buf, " timeout=\"%s\"", v.Timeout)
+	}
+	if v.Timestamp != "" {
+		fmt.Fprintf(buf, " timestamp=\"%s\"", v.Timestamp)
+	}
+	buf.WriteString(">\n")
+
+	for _, e := range v.Elements {
+		fmt.Fprintf(buf, "  <def%s name=\"%s\" label=\"%s\"", v.Kind, escape(e.Name), escape(e.Label))
+		if v.Kind == KindNumber {
+			fmt.Fprintf(buf, " format=\"%s\" min=\"%s\" max=\"%s\" step=\"%s\"",
+				escape(e.Format), e.Min, e.Max, e.Step)
+		}
+		if v.Kind == KindBLOB {
+			buf.WriteString("/>\n")
+			continue
+		}
+		fmt.Fprintf(buf, ">%s</def%s>\n", escape(e.Value), v.Kind)
+	}
+	fmt.Fprintf(buf, "</def%sVector>\n", v.Kind)
+
+	return buf.Bytes()
+}
+
+// SetXML returns set*Vector element with current values and state of property
+func (v *Vector) SetXML() []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "<set%sVector device=\"%s\" name=\"%s\" state=\"%s\"",
+		v.Kind, escape(v.Device), escape(v.Name), v.State)
+	if v.Timestamp != "" {
+		fmt.Fprintf(buf, " timestamp=\"%s\"", v.Timestamp)
+	}
+	if v.Message != "" {
+		fmt.Fprintf(buf, " message=\"%s\"", escape(v.Message))
+	}
+	buf.WriteString(">\n")
+
+	for _, e := range v.Elements {
+		fmt.Fprintf(buf, "  <one%s name=\"%s\"", v.Kind, escape(e.Name))
+		if v.Kind == KindBLOB {
+			fmt.Fprintf(buf, " size=\"%s\" format=\"%s\"", e.Size, escape(e.Format))
+		}
+		fmt.Fprintf(buf, ">%s</one%s>\n", escape(e.Value), v.Kind)
+	}
+	fmt.Fprintf(buf, "</set%sVector>\n", v.Kind)
+
+	return buf.Bytes()
+}
+
+// DecodeBLOB decodes base64 value of BLOB element, INDI-server splits it to lines
+func DecodeBLOB(value string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+}
+
+// EncodeBLOB encodes data as base64 value of BLOB element
+func EncodeBLOB(data []byte) string {
+	return base64.StdEncoding.EncodeToString(data)
+}
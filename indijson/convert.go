@@ -0,0 +1,297 @@
+package indijson
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/indihub-space/agent/indiclient"
+)
+
+// Version is name of the typed JSON format of WebSocket API
+const Version = "v2"
+
+var (
+	ErrUnknownType = errors.New("unknown message type")
+	ErrBadValue    = errors.New("bad element value")
+)
+
+// Message is typed JSON representation of INDI vector, elements are always sent even if there are none
+type Message struct {
+	Type      string     `json:"type"` // INDI tag, i.e. defNumberVector, setSwitchVector
+	Device    string     `json:"device,omitempty"`
+	Name      string     `json:"name,omitempty"`
+	Label     string     `json:"label,omitempty"`
+	Group     string     `json:"group,omitempty"`
+	State     string     `json:"state,omitempty"`
+	Perm      string     `json:"perm,omitempty"`
+	Rule      string     `json:"rule,omitempty"`
+	Timeout   *float64   `json:"timeout,omitempty"`
+	Timestamp string     `json:"timestamp,omitempty"`
+	Message   string     `json:"message,omitempty"`
+	Elements  []*Element `json:"elements"`
+}
+
+// Notice is typed JSON representation of message, delProperty and getProperties INDI XML-elements
+type Notice struct {
+	Type      string `json:"type"`
+	Device    string `json:"device,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Timestamp string `json:"timestamp,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// Element is element of vector, Value is float64 for numbers, bool for switches, state for lights
+// and string for texts and base64 BLOBs
+type Element struct {
+	Name   string      `json:"name"`
+	Label  string      `json:"label,omitempty"`
+	Value  interface{} `json:"value"`
+	Text   string      `json:"text,omitempty"` // number as it was sent by INDI-server, i.e. "12:30:00"
+	Format string      `json:"format,omitempty"`
+	Min    *float64    `json:"min,omitempty"`
+	Max    *float64    `json:"max,omitempty"`
+	Step   *float64    `json:"step,omitempty"`
+	Size   *int64      `json:"size,omitempty"`
+}
+
+// Command is typed JSON command sent by client: getProperties, enableBLOB or new*Vector
+type Command struct {
+	Type     string            `json:"type"`
+	Device   string            `json:"device"`
+	Name     string            `json:"name"`
+	Policy   string            `json:"policy"` // for enableBLOB: Never, Also or Only
+	Elements []json.RawMessage `json:"elements"`
+}
+
+type commandElement struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+// FromXML converts INDI XML-element from INDI-server to typed JSON
+func FromXML(el []byte) ([]byte, error) {
+	msg, err := indiclient.Parse(el)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := FromMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(res)
+}
+
+// FromMessage returns typed JSON representation of parsed INDI XML-element, *Message for vectors and *Notice for others
+func FromMessage(msg *indiclient.Message) (interface{}, error) {
+	if msg.Vector != nil {
+		return FromVector(msg.Tag, msg.Vector), nil
+	}
+
+	switch msg.Tag {
+	case "message", "delProperty", "getProperties":
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownType, msg.Tag)
+	}
+	return &Notice{
+		Type:      msg.Tag,
+		Device:    msg.Device,
+		Name:      msg.Name,
+		Timestamp: msg.Timestamp,
+		Message:   msg.Text,
+	}, nil
+}
+
+// FromVector returns typed JSON representation of vector sent with tag, i.e. property from INDI-client cache
+func FromVector(tag string, v *indiclient.Vector) *Message {
+	res := &Message{
+		Type:      tag,
+		Device:    v.Device,
+		Name:      v.Name,
+		Label:     v.Label,
+		Group:     v.Group,
+		State:     v.State,
+		Perm:      v.Perm,
+		Rule:      v.Rule,
+		Timeout:   optNumber(v.Timeout),
+		Timestamp: v.Timestamp,
+		Message:   v.Message,
+		Elements:  make([]*Element, 0, len(v.Elements)),
+	}
+	for _, e := range v.Elements {
+		res.Elements = append(res.Elements, convertElement(v.Kind, e))
+	}
+	return res
+}
+
+func convertElement(kind string, e indiclient.Element) *Element {
+	res := &Element{
+		Name:   e.Name,
+		Label:  e.Label,
+		Format: e.Format,
+	}
+	switch kind {
+	case indiclient.KindNumber:
+		res.Text = e.Value
+		if n, err := ParseNumber(e.Value); err == nil {
+			res.Value = n
+		}
+		res.Min = optNumber(e.Min)
+		res.Max = optNumber(e.Max)
+		res.Step = optNumber(e.Step)
+	case indiclient.KindSwitch:
+		res.Value = e.Value == indiclient.SwitchOn
+	case indiclient.KindBLOB:
+		res.Value = e.Value
+		if size, err := strconv.ParseInt(e.Size, 10, 64); err == nil {
+			res.Size = &size
+		}
+	default:
+		res.Value = e.Value
+	}
+	return res
+}
+
+// ToXML converts typed JSON command from client to INDI XML-command
+func ToXML(data []byte) ([]byte, error) {
+	cmd := &Command{}
+	if err := json.Unmarshal(data, cmd); err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	switch cmd.Type {
+	case "getProperties":
+		buf.WriteString(`<getProperties version="1.7"`)
+		writeAttr(buf, "device", cmd.Device)
+		writeAttr(buf, "name", cmd.Name)
+		buf.WriteString("/>\n")
+		return buf.Bytes(), nil
+
+	case "enableBLOB":
+		if cmd.Policy != "Never" && cmd.Policy != "Also" && cmd.Policy != "Only" {
+			return nil, fmt.Errorf("%w: BLOB policy '%s'", ErrBadValue, cmd.Policy)
+		}
+		buf.WriteString("<enableBLOB")
+		writeAttr(buf, "device", cmd.Device)
+		writeAttr(buf, "name", cmd.Name)
+		fmt.Fprintf(buf, ">%s</enableBLOB>\n", cmd.Policy)
+		return buf.Bytes(), nil
+	}
+
+	kind := indiclient.VectorKind(cmd.Type)
+	// BLOBs can be uploaded with v1 messages only as they need size and format
+	if !strings.HasPrefix(cmd.Type, "new") || kind == "" || kind == indiclient.KindLight || kind == indiclient.KindBLOB {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownType, cmd.Type)
+	}
+	if cmd.Device == "" || cmd.Name == "" {
+		return nil, errors.New("device and name are required")
+	}
+
+	values, err := cmd.Values(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	return indiclient.NewVectorXML(kind, cmd.Device, cmd.Name, values), nil
+}
+
+// Values returns INDI values of command elements for vector of kind
+func (cmd *Command) Values(kind string) (map[string]string, error) {
+	values := make(map[string]string, len(cmd.Elements))
+	for _, raw := range cmd.Elements {
+		e := &commandElement{}
+		if err := json.Unmarshal(raw, e); err != nil {
+			return nil, err
+		}
+		value, err := commandValue(kind, e.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s.%s: %w", cmd.Device, cmd.Name, e.Name, err)
+		}
+		values[e.Name] = value
+	}
+	return values, nil
+}
+
+// commandValue returns INDI value of element, numbers can be sent as sexagesimal strings
+func commandValue(kind string, value interface{}) (string, error) {
+	switch kind {
+	case indiclient.KindNumber:
+		switch v := value.(type) {
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case string:
+			n, err := ParseNumber(v)
+			if err != nil {
+				return "", err
+			}
+			return strconv.FormatFloat(n, 'f', -1, 64), nil
+		}
+	case indiclient.KindSwitch:
+		if v, ok := value.(bool); ok {
+			if v {
+				return indiclient.SwitchOn, nil
+			}
+			return indiclient.SwitchOff, nil
+		}
+	default:
+		if v, ok := value.(string); ok {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %v", ErrBadValue, value)
+}
+
+// ParseNumber parses INDI number which can be decimal or sexagesimal like "-12:30:00", "12 30" or "12;30:15.5"
+func ParseNumber(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return 0, fmt.Errorf("%w: number '%s'", ErrBadValue, s)
+		}
+		return n, nil
+	}
+
+	parts := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ':' || r == ';' || r == ' '
+	})
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("%w: number '%s'", ErrBadValue, s)
+	}
+	negative := strings.HasPrefix(parts[0], "-")
+	value := 0.0
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) || (i > 0 && (n < 0 || n >= 60)) {
+			return 0, fmt.Errorf("%w: number '%s'", ErrBadValue, s)
+		}
+		value += math.Abs(n) / math.Pow(60, float64(i))
+	}
+	if negative {
+		value = -value
+	}
+	return value, nil
+}
+
+func optNumber(s string) *float64 {
+	n, err := ParseNumber(s)
+	if err != nil {
+		return nil
+	}
+	return &n
+}
+
+func writeAttr(buf *bytes.Buffer, name string, value string) {
+	if value == "" {
+		return
+	}
+	fmt.Fprintf(buf, ` %s="`, name)
+	xml.EscapeText(buf, []byte(value))
+	buf.WriteByte('"')
+}
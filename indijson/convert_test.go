@@ -0,0 +1,369 @@
+package indijson
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseNumber(t *testing.T) {
+	for _, c := range []struct {
+		text  string
+		value float64
+	}{
+		{"12.5", 12.5},
+		{" -3e2 ", -300},
+		{"12:30:00", 12.5},
+		{"-12:30:00", -12.5},
+		// sign of zero degrees is kept
+		{"-00:30:00", -0.5},
+		{"-0:30", -0.5},
+		{"+00:30", 0.5},
+		{"12 30", 12.5},
+		{"12;30:15.5", 12 + 30.0/60 + 15.5/3600},
+		{"359:59:59.9", 359 + 59.0/60 + 59.9/3600},
+	} {
+		n, err := ParseNumber(c.text)
+		if err != nil {
+			t.Errorf("%q: %s", c.text, err)
+			continue
+		}
+		if math.Abs(n-c.value) > 1e-9 {
+			t.Errorf("%q is parsed to %g, expected %g", c.text, n, c.value)
+		}
+	}
+
+	for _, text := range []string{"", "abc", "12:60", "12:-5", "12:30:60", "1:2:3:4", "NaN", "Inf", "12:NaN", "12::"} {
+		if n, err := ParseNumber(text); !errors.Is(err, ErrBadValue) {
+			t.Errorf("%q is parsed to %g, %v", text, n, err)
+		}
+	}
+}
+
+// fromXML converts INDI XML-element and decodes resulting JSON
+func fromXML(t *testing.T, el string) map[string]interface{} {
+	t.Helper()
+	data, err := FromXML([]byte(el))
+	if err != nil {
+		t.Fatalf("%s: %s", el, err)
+	}
+	res := map[string]interface{}{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func elements(t *testing.T, msg map[string]interface{}) []map[string]interface{} {
+	t.Helper()
+	list, ok := msg["elements"].([]interface{})
+	if !ok {
+		t.Fatalf("elements are not array: %v", msg["elements"])
+	}
+	res := []map[string]interface{}{}
+	for _, e := range list {
+		res = append(res, e.(map[string]interface{}))
+	}
+	return res
+}
+
+func TestFromXMLElementsAreArrays(t *testing.T) {
+	// single element is array too
+	msg := fromXML(t, `<setNumberVector device="CCD" name="CCD_TEMPERATURE" state="Busy" timeout="60">
+<oneNumber name="CCD_TEMPERATURE_VALUE">-10.5</oneNumber>
+</setNumberVector>`)
+	els := elements(t, msg)
+	if len(els) != 1 || els[0]["name"] != "CCD_TEMPERATURE_VALUE" || els[0]["value"] != -10.5 || els[0]["text"] != "-10.5" {
+		t.Errorf("unexpected elements %v", els)
+	}
+	if msg["type"] != "setNumberVector" || msg["state"] != "Busy" || msg["timeout"] != 60.0 {
+		t.Errorf("unexpected message %v", msg)
+	}
+
+	// vector without elements has empty array
+	msg = fromXML(t, `<setTextVector device="Mount" name="TIME_UTC" state="Ok"></setTextVector>`)
+	if els := elements(t, msg); len(els) != 0 {
+		t.Errorf("unexpected elements %v", els)
+	}
+}
+
+func TestFromXMLValues(t *testing.T) {
+	msg := fromXML(t, `<defNumberVector device="Mount" name="EQUATORIAL_EOD_COORD" label="Eq. Coordinates" group="Main" state="Ok" perm="rw">
+<defNumber name="RA" label="RA" format="%010.6m" min="0" max="24" step="0">5:30:00</defNumber>
+<defNumber name="DEC" format="%010.6m" min="-90" max="90" step="0">-00:30:00</defNumber>
+<defNumber name="BAD" format="%g" min="" max="x" step="0">x</defNumber>
+</defNumberVector>`)
+	els := elements(t, msg)
+	if len(els) != 3 {
+		t.Fatalf("unexpected elements %v", els)
+	}
+	if els[0]["value"] != 5.5 || els[0]["text"] != "5:30:00" || els[0]["min"] != 0.0 || els[0]["max"] != 24.0 ||
+		els[0]["format"] != "%010.6m" {
+		t.Errorf("unexpected RA %v", els[0])
+	}
+	if els[1]["value"] != -0.5 || els[1]["min"] != -90.0 {
+		t.Errorf("unexpected DEC %v", els[1])
+	}
+	// number which can't be parsed has null value and keeps its text
+	if v, ok := els[2]["value"]; !ok || v != nil || els[2]["text"] != "x" || els[2]["min"] != nil || els[2]["max"] != nil {
+		t.Errorf("unexpected bad number %v", els[2])
+	}
+
+	// switches are booleans
+	msg = fromXML(t, `<defSwitchVector device="Mount" name="TELESCOPE_PARK" state="Ok" perm="rw" rule="OneOfMany">
+<defSwitch name="PARK">On</defSwitch>
+<defSwitch name="UNPARK">Off</defSwitch>
+</defSwitchVector>`)
+	els = elements(t, msg)
+	if len(els) != 2 || els[0]["value"] != true || els[1]["value"] != false || msg["rule"] != "OneOfMany" {
+		t.Errorf("unexpected switches %v", msg)
+	}
+
+	msg = fromXML(t, `<setLightVector device="Weather" name="WEATHER_STATUS" state="Alert">
+<oneLight name="WEATHER_RAIN_HOUR">Alert</oneLight>
+</setLightVector>`)
+	if els := elements(t, msg); els[0]["value"] != "Alert" {
+		t.Errorf("unexpected light %v", els)
+	}
+
+	msg = fromXML(t, `<setBLOBVector device="CCD" name="CCD1" state="Ok">
+<oneBLOB name="CCD1" size="3" format=".fits">QUJD</oneBLOB>
+</setBLOBVector>`)
+	if els := elements(t, msg); els[0]["value"] != "QUJD" || els[0]["size"] != 3.0 || els[0]["format"] != ".fits" {
+		t.Errorf("unexpected BLOB %v", els)
+	}
+
+	msg = fromXML(t, `<message device="Mount" timestamp="2020-10-18T20:47:15" message="Slew complete"/>`)
+	if msg["type"] != "message" || msg["message"] != "Slew complete" || msg["elements"] != nil {
+		t.Errorf("unexpected notice %v", msg)
+	}
+
+	if _, err := FromXML([]byte(`<enableBLOB device="CCD">Also</enableBLOB>`)); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("expected unknown type, got %v", err)
+	}
+}
+
+func TestToXML(t *testing.T) {
+	for _, c := range []struct {
+		cmd   string
+		parts []string
+	}{
+		{`{"type": "getProperties"}`, []string{`<getProperties version="1.7"/>`}},
+		{`{"type": "getProperties", "device": "A&B"}`, []string{`<getProperties version="1.7" device="A&amp;B"/>`}},
+		{`{"type": "enableBLOB", "device": "CCD", "policy": "Only"}`, []string{`<enableBLOB device="CCD">Only</enableBLOB>`}},
+		{`{"type": "newSwitchVector", "device": "Mount", "name": "TELESCOPE_PARK",
+			"elements": [{"name": "PARK", "value": true}, {"name": "UNPARK", "value": false}]}`,
+			[]string{`<newSwitchVector device="Mount" name="TELESCOPE_PARK">`,
+				`<oneSwitch name="PARK">On</oneSwitch>`, `<oneSwitch name="UNPARK">Off</oneSwitch>`}},
+		{`{"type": "newNumberVector", "device": "Mount", "name": "EQUATORIAL_EOD_COORD",
+			"elements": [{"name": "RA", "value": "5:30:00"}, {"name": "DEC", "value": "-00:30:00"}]}`,
+			[]string{`<oneNumber name="RA">5.5</oneNumber>`, `<oneNumber name="DEC">-0.5</oneNumber>`}},
+		{`{"type": "newNumberVector", "device": "CCD", "name": "CCD_EXPOSURE",
+			"elements": [{"name": "CCD_EXPOSURE_VALUE", "value": 0.001}]}`,
+			[]string{`<oneNumber name="CCD_EXPOSURE_VALUE">0.001</oneNumber>`}},
+		{`{"type": "newTextVector", "device": "Mount", "name": "TIME_UTC",
+			"elements": [{"name": "UTC", "value": "2020-10-18T20:47:15"}]}`,
+			[]string{`<oneText name="UTC">2020-10-18T20:47:15</oneText>`}},
+	} {
+		el, err := ToXML([]byte(c.cmd))
+		if err != nil {
+			t.Errorf("%s: %s", c.cmd, err)
+			continue
+		}
+		for _, part := range c.parts {
+			if !strings.Contains(string(el), part) {
+				t.Errorf("%s: %s doesn't contain %s", c.cmd, el, part)
+			}
+		}
+	}
+
+	for _, c := range []struct {
+		cmd string
+		err error
+	}{
+		{`{"type": "enableBLOB", "device": "CCD", "policy": "Sometimes"}`, ErrBadValue},
+		{`{"type": "newSwitchVector", "device": "Mount", "name": "TELESCOPE_PARK", "elements": [{"name": "PARK", "value": "On"}]}`, ErrBadValue},
+		{`{"type": "newNumberVector", "device": "Mount", "name": "EQUATORIAL_EOD_COORD", "elements": [{"name": "RA", "value": "5:60"}]}`, ErrBadValue},
+		{`{"type": "newNumberVector", "device": "Mount", "name": "EQUATORIAL_EOD_COORD", "elements": [{"name": "RA", "value": true}]}`, ErrBadValue},
+		{`{"type": "newTextVector", "device": "Mount", "name": "TIME_UTC", "elements": [{"name": "UTC", "value": 1}]}`, ErrBadValue},
+		{`{"type": "newBLOBVector", "device": "CCD", "name": "CCD1", "elements": []}`, ErrUnknownType},
+		{`{"type": "newLightVector", "device": "Weather", "name": "WEATHER_STATUS", "elements": []}`, ErrUnknownType},
+		{`{"type": "setNumberVector", "device": "CCD", "name": "CCD_EXPOSURE", "elements": []}`, ErrUnknownType},
+	} {
+		if _, err := ToXML([]byte(c.cmd)); !errors.Is(err, c.err) {
+			t.Errorf("%s: expected %v, got %v", c.cmd, c.err, err)
+		}
+	}
+	if _, err := ToXML([]byte(`{"type": "newNumberVector", "name": "CCD_EXPOSURE", "elements": []}`)); err == nil {
+		t.Error("command without device is accepted")
+	}
+}
+
+// validate checks value against JSON schema, only keywords used by Schema are supported
+func validate(root map[string]interface{}, schema map[string]interface{}, value interface{}) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/definitions/")
+		return validate(root, root["definitions"].(map[string]interface{})[name].(map[string]interface{}), value)
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		errs := []string{}
+		for _, sub := range anyOf {
+			err := validate(root, sub.(map[string]interface{}), value)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err.Error())
+		}
+		return fmt.Errorf("no schema matches: %s", strings.Join(errs, "; "))
+	}
+	if c, ok := schema["const"]; ok && c != value {
+		return fmt.Errorf("%v is not %v", value, c)
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == value
+		}
+		if !found {
+			return fmt.Errorf("%v is not one of %v", value, enum)
+		}
+	}
+	if t, ok := schema["type"]; ok {
+		types := []interface{}{t}
+		if list, ok := t.([]interface{}); ok {
+			types = list
+		}
+		matched := false
+		for _, typ := range types {
+			switch v := value.(type) {
+			case nil:
+				matched = matched || typ == "null"
+			case bool:
+				matched = matched || typ == "boolean"
+			case float64:
+				matched = matched || typ == "number" || (typ == "integer" && v == math.Trunc(v))
+			case string:
+				matched = matched || typ == "string"
+			case []interface{}:
+				matched = matched || typ == "array"
+			case map[string]interface{}:
+				matched = matched || typ == "object"
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%v is not %v", value, t)
+		}
+	}
+	if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(value.(string)) {
+		return fmt.Errorf("%v doesn't match %s", value, pattern)
+	}
+	if obj, ok := value.(map[string]interface{}); ok {
+		for _, name := range asList(schema["required"]) {
+			if _, ok := obj[name.(string)]; !ok {
+				return fmt.Errorf("%s is required", name)
+			}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		for name, v := range obj {
+			if sub, ok := props[name].(map[string]interface{}); ok {
+				if err := validate(root, sub, v); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+			}
+		}
+	}
+	if list, ok := value.([]interface{}); ok {
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, v := range list {
+				if err := validate(root, items, v); err != nil {
+					return fmt.Errorf("[%d]: %w", i, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func asList(v interface{}) []interface{} {
+	list, _ := v.([]interface{})
+	return list
+}
+
+func TestSchema(t *testing.T) {
+	root := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(Schema), &root); err != nil {
+		t.Fatalf("schema is not valid JSON: %s", err)
+	}
+
+	samples := []string{
+		`<defNumberVector device="Mount" name="EQUATORIAL_EOD_COORD" label="Eq. Coordinates" group="Main" state="Ok" perm="rw" timeout="60" timestamp="2020-10-18T20:47:15">
+<defNumber name="RA" label="RA" format="%010.6m" min="0" max="24" step="0">5:30:00</defNumber>
+<defNumber name="DEC" format="%010.6m" min="-90" max="90" step="0">x</defNumber>
+</defNumberVector>`,
+		`<setNumberVector device="CCD" name="CCD_TEMPERATURE" state="Busy">
+<oneNumber name="CCD_TEMPERATURE_VALUE">-10.5</oneNumber>
+</setNumberVector>`,
+		`<defSwitchVector device="Mount" name="TELESCOPE_PARK" state="Ok" perm="rw" rule="OneOfMany">
+<defSwitch name="PARK">On</defSwitch>
+</defSwitchVector>`,
+		`<defTextVector device="Mount" name="TIME_UTC" state="Idle" perm="rw">
+<defText name="UTC">2020-10-18T20:47:15</defText>
+</defTextVector>`,
+		`<defLightVector device="Weather" name="WEATHER_STATUS" state="Ok">
+<defLight name="WEATHER_RAIN_HOUR">Ok</defLight>
+</defLightVector>`,
+		`<setBLOBVector device="CCD" name="CCD1" state="Ok">
+<oneBLOB name="CCD1" size="3" format=".fits">QUJD</oneBLOB>
+</setBLOBVector>`,
+		`<setTextVector device="Mount" name="TIME_UTC" state="Ok"></setTextVector>`,
+		`<message device="Mount" timestamp="2020-10-18T20:47:15" message="Slew complete"/>`,
+		`<delProperty device="Mount" name="TELESCOPE_PARK"/>`,
+	}
+	for _, el := range samples {
+		data, err := FromXML([]byte(el))
+		if err != nil {
+			t.Fatalf("%s: %s", el, err)
+		}
+		var value interface{}
+		json.Unmarshal(data, &value)
+		if err := validate(root, root, value); err != nil {
+			t.Errorf("%s doesn't match schema: %s", data, err)
+		}
+	}
+
+	// commands accepted by ToXML match schema
+	for _, cmd := range []string{
+		`{"type": "getProperties", "device": "Mount"}`,
+		`{"type": "enableBLOB", "device": "CCD", "policy": "Also"}`,
+		`{"type": "newNumberVector", "device": "Mount", "name": "EQUATORIAL_EOD_COORD", "elements": [{"name": "RA", "value": "5:30:00"}, {"name": "DEC", "value": 41.27}]}`,
+		`{"type": "newSwitchVector", "device": "Mount", "name": "TELESCOPE_PARK", "elements": [{"name": "PARK", "value": true}]}`,
+	} {
+		if _, err := ToXML([]byte(cmd)); err != nil {
+			t.Errorf("%s: %s", cmd, err)
+		}
+		var value interface{}
+		json.Unmarshal([]byte(cmd), &value)
+		if err := validate(root, root, value); err != nil {
+			t.Errorf("%s doesn't match schema: %s", cmd, err)
+		}
+	}
+
+	// schema isn't matched by everything
+	for _, doc := range []string{
+		`{"type": "setSwitchVector", "device": "Mount", "name": "TELESCOPE_PARK", "elements": {"name": "PARK", "value": "On"}}`,
+		`{"type": "setNumberVector", "device": "CCD", "name": "CCD_TEMPERATURE", "elements": [{"name": "CCD_TEMPERATURE_VALUE", "value": -10.5}]}`,
+		`{"type": "setLightVector", "device": "Weather", "name": "WEATHER_STATUS", "state": "Red", "elements": []}`,
+		`{"type": "enableBLOB", "device": "CCD", "policy": "Sometimes"}`,
+		`{"type": "newBLOBVector", "device": "CCD", "name": "CCD1", "elements": []}`,
+	} {
+		var value interface{}
+		json.Unmarshal([]byte(doc), &value)
+		if err := validate(root, root, value); err == nil {
+			t.Errorf("%s matches schema", doc)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package indijson
+
+// Schema is JSON Schema of v2 messages from INDI-server and commands to INDI-server
+const Schema = `{
+    "$schema": "http://json-schema.org/draft-07/schema#",
+    "title": "INDIHUB agent WebSocket INDI API v2",
+    "anyOf": [
+        {"$ref": "#/definitions/vector"},
+        {"$ref": "#/definitions/notice"},
+        {"$ref": "#/definitions/getProperties"},
+        {"$ref": "#/definitions/enableBLOB"},
+        {"$ref": "#/definitions/newVector"}
+    ],
+    "definitions": {
+        "state": {
+            "type": "string",
+            "enum": ["Idle", "Ok", "Busy", "Alert"]
+        },
+        "vector": {
+            "description": "Property definition or update sent by INDI-server",
+            "type": "object",
+            "required": ["type", "device", "name", "elements"],
+            "properties": {
+                "type": {
+                    "type": "string",
+                    "pattern": "^(def|set)(Number|Switch|Text|Light|BLOB)Vector$"
+                },
+                "device": {"type": "string"},
+                "name": {"type": "string"},
+                "label": {"type": "string"},
+                "group": {"type": "string"},
+                "state": {"$ref": "#/definitions/state"},
+                "perm": {"type": "string", "enum": ["ro", "wo", "rw"]},
+                "rule": {"type": "string", "enum": ["OneOfMany", "AtMostOne", "AnyOfMany"]},
+                "timeout": {"type": "number"},
+                "timestamp": {"type": "string"},
+                "message": {"type": "string"},
+                "elements": {
+                    "type": "array",
+                    "items": {
+                        "anyOf": [
+                            {"$ref": "#/definitions/numberElement"},
+                            {"$ref": "#/definitions/switchElement"},
+                            {"$ref": "#/definitions/lightElement"},
+                            {"$ref": "#/definitions/textElement"}
+                        ]
+                    }
+                }
+            }
+        },
+        "numberElement": {
+            "description": "Number element, value is null if text couldn't be parsed",
+            "type": "object",
+            "required": ["name", "value", "text"],
+            "properties": {
+                "name": {"type": "string"},
+                "label": {"type": "string"},
+                "value": {"type": ["number", "null"]},
+                "text": {"type": "string", "description": "value as sent by INDI-server, i.e. sexagesimal 12:30:00"},
+                "format": {"type": "string"},
+                "min": {"type": "number"},
+                "max": {"type": "number"},
+                "step": {"type": "number"}
+            }
+        },
+        "switchElement": {
+            "type": "object",
+            "required": ["name", "value"],
+            "properties": {
+                "name": {"type": "string"},
+                "label": {"type": "string"},
+                "value": {"type": "boolean"}
+            }
+        },
+        "lightElement": {
+            "type": "object",
+            "required": ["name", "value"],
+            "properties": {
+                "name": {"type": "string"},
+                "label": {"type": "string"},
+                "value": {"$ref": "#/definitions/state"}
+            }
+        },
+        "textElement": {
+            "description": "Text element or BLOB element with base64 value",
+            "type": "object",
+            "required": ["name", "value"],
+            "properties": {
+                "name": {"type": "string"},
+                "label": {"type": "string"},
+                "value": {"type": "string"},
+                "format": {"type": "string"},
+                "size": {"type": "integer"}
+            }
+        },
+        "notice": {
+            "description": "Message or property deletion sent by INDI-server",
+            "type": "object",
+            "required": ["type"],
+            "properties": {
+                "type": {"type": "string", "enum": ["message", "delProperty", "getProperties"]},
+                "device": {"type": "string"},
+                "name": {"type": "string"},
+                "timestamp": {"type": "string"},
+                "message": {"type": "string"}
+            }
+        },
+        "getProperties": {
+            "description": "Command to get property definitions of all devices, one device or one property",
+            "type": "object",
+            "required": ["type"],
+            "properties": {
+                "type": {"const": "getProperties"},
+                "device": {"type": "string"},
+                "name": {"type": "string"}
+            }
+        },
+        "enableBLOB": {
+            "type": "object",
+            "required": ["type", "device", "policy"],
+            "properties": {
+                "type": {"const": "enableBLOB"},
+                "device": {"type": "string"},
+                "name": {"type": "string"},
+                "policy": {"type": "string", "enum": ["Never", "Also", "Only"]}
+            }
+        },
+        "newVector": {
+            "description": "Command to set values, numbers can be sent as sexagesimal strings",
+            "type": "object",
+            "required": ["type", "device", "name", "elements"],
+            "properties": {
+                "type": {
+                    "type": "string",
+                    "pattern": "^new(Number|Switch|Text)Vector$"
+                },
+                "device": {"type": "string"},
+                "name": {"type": "string"},
+                "elements": {
+                    "type": "array",
+                    "items": {
+                        "type": "object",
+                        "required": ["name", "value"],
+                        "properties": {
+                            "name": {"type": "string"},
+                            "value": {"type": ["number", "string", "boolean"]}
+                        }
+                    }
+                }
+            }
+        }
+    }
+}
+`
@@ -0,0 +1,380 @@
+package indimux
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/indihub-space/agent/indiclient"
+	"github.com/indihub-space/agent/lib"
+	"github.com/indihub-space/agent/logutil"
+)
+
+// policies for devices with the same name on several INDI-servers
+const (
+	PolicyFirst  = "first"  // device of the first INDI-server in list is used, others are hidden
+	PolicyRename = "rename" // devices of other INDI-servers are renamed to "<device> @<server name>"
+)
+
+const (
+	dialTimeout    = 5 * time.Second
+	discoveryQuiet = time.Second
+	discoveryMax   = 10 * time.Second
+)
+
+var logger = logutil.New("subsystem", "indimux")
+
+// Upstream is INDI-server merged into stream
+type Upstream struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+}
+
+// ParseUpstreams parses comma-separated list of INDI-server addresses with optional names,
+// i.e. "pier1=pi1.local:7624,pi2.local:7624", unnamed servers are named by their addresses
+func ParseUpstreams(list string) ([]Upstream, error) {
+	upstreams := []Upstream{}
+	names := map[string]bool{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		u := Upstream{Addr: item}
+		if n := strings.Index(item, "="); n != -1 {
+			u.Name, u.Addr = strings.TrimSpace(item[:n]), strings.TrimSpace(item[n+1:])
+		}
+		if _, _, err := net.SplitHostPort(u.Addr); err != nil {
+			return nil, fmt.Errorf("bad INDI-server address '%s', the 'host:port' format is expected", u.Addr)
+		}
+		if u.Name == "" {
+			u.Name = u.Addr
+		}
+		if names[u.Name] {
+			return nil, fmt.Errorf("duplicate INDI-server name '%s'", u.Name)
+		}
+		names[u.Name] = true
+		upstreams = append(upstreams, u)
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no INDI-server addresses in '%s'", list)
+	}
+	return upstreams, nil
+}
+
+// Conflict is device found on several INDI-servers
+type Conflict struct {
+	Device string `json:"device"`
+	Server string `json:"server"` // server of duplicate
+	Owner  string `json:"owner"`  // server of device used under original name
+	Alias  string `json:"alias,omitempty"`
+}
+
+type route struct {
+	upstream int
+	device   string // device name on INDI-server
+}
+
+type deviceKey struct {
+	upstream int
+	device   string
+}
+
+// Mux serves several INDI-servers as one merged INDI-server, commands are routed by device names
+type Mux struct {
+	upstreams []Upstream
+	policy    string
+
+	mu        sync.Mutex
+	routes    map[string]route     // device name in merged stream -> INDI-server device
+	names     map[deviceKey]string // INDI-server device -> name in merged stream, empty for hidden duplicates
+	conflicts []Conflict
+	listener  net.Listener
+	conns     map[net.Conn]bool
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// New creates mux of INDI-servers with policy for duplicate device names
+func New(upstreams []Upstream, policy string) (*Mux, error) {
+	if policy != PolicyFirst && policy != PolicyRename {
+		return nil, fmt.Errorf("unknown policy for duplicate devices '%s'", policy)
+	}
+	return &Mux{
+		upstreams: upstreams,
+		policy:    policy,
+		routes:    map[string]route{},
+		names:     map[deviceKey]string{},
+		conns:     map[net.Conn]bool{},
+		stopCh:    make(chan struct{}),
+	}, nil
+}
+
+// Discover reads devices of all INDI-servers in order they are listed,
+// so devices are assigned to servers deterministically and not in order their definitions arrive
+func (m *Mux) Discover() {
+	for i, u := range m.upstreams {
+		client, err := indiclient.Dial(u.Addr)
+		if err != nil {
+			logger.Warnf("could not read devices of INDI-server %s: %s", u.Name, err)
+			continue
+		}
+		client.WaitDefs(discoveryQuiet, discoveryMax)
+		for _, device := range client.Devices() {
+			m.resolve(i, device)
+		}
+		client.Close()
+	}
+}
+
+// Listen starts merged INDI-server on address and returns its actual address
+func (m *Mux) Listen(addr string) (string, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	m.listener = l
+	m.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				select {
+				case <-m.stopCh:
+				default:
+					logger.Errorf("INDI mux listener error: %s", err)
+				}
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+
+	return l.Addr().String(), nil
+}
+
+// Stop closes merged INDI-server and all its connections
+func (m *Mux) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopCh)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.listener != nil {
+			m.listener.Close()
+		}
+		for conn := range m.conns {
+			conn.Close()
+		}
+	})
+}
+
+// GetStatus returns INDI-servers with their devices and conflicts to be shown in agent status
+func (m *Mux) GetStatus() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	devices := map[string][]string{}
+	for name, r := range m.routes {
+		server := m.upstreams[r.upstream].Name
+		devices[server] = append(devices[server], name)
+	}
+	for _, list := range devices {
+		sort.Strings(list)
+	}
+
+	return map[string]interface{}{
+		"servers":   m.upstreams,
+		"policy":    m.policy,
+		"devices":   devices,
+		"conflicts": append([]Conflict{}, m.conflicts...),
+	}
+}
+
+// resolve returns name of INDI-server device in merged stream, false for hidden duplicates
+func (m *Mux) resolve(upstream int, device string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := deviceKey{upstream: upstream, device: device}
+	if name, ok := m.names[key]; ok {
+		return name, name != ""
+	}
+
+	owner, ok := m.routes[device]
+	if !ok {
+		m.routes[device] = route{upstream: upstream, device: device}
+		m.names[key] = device
+		return device, true
+	}
+
+	conflict := Conflict{
+		Device: device,
+		Server: m.upstreams[upstream].Name,
+		Owner:  m.upstreams[owner.upstream].Name,
+	}
+	name := ""
+	if m.policy == PolicyRename {
+		name = device + " @" + m.upstreams[upstream].Name
+		conflict.Alias = name
+		m.routes[name] = route{upstream: upstream, device: device}
+		logger.Warnf("device '%s' of INDI-server %s is also on %s, it is renamed to '%s'",
+			device, conflict.Server, conflict.Owner, name)
+	} else {
+		logger.Warnf("device '%s' of INDI-server %s is also on %s, it is hidden",
+			device, conflict.Server, conflict.Owner)
+	}
+	m.names[key] = name
+	m.conflicts = append(m.conflicts, conflict)
+	return name, name != ""
+}
+
+func (m *Mux) route(device string) (route, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, ok := m.routes[device]
+	return r, ok
+}
+
+// serve connects client to all INDI-servers, client is disconnected when any of connected servers is
+func (m *Mux) serve(conn net.Conn) {
+	m.mu.Lock()
+	m.conns[conn] = true
+	m.mu.Unlock()
+
+	servers := make([]net.Conn, len(m.upstreams))
+	connected := 0
+	for i, u := range m.upstreams {
+		c, err := net.DialTimeout("tcp", u.Addr, dialTimeout)
+		if err != nil {
+			logger.Warnf("could not connect to INDI-server %s: %s", u.Name, err)
+			continue
+		}
+		servers[i] = c
+		connected++
+	}
+
+	var closeOnce sync.Once
+	closeAll := func() {
+		closeOnce.Do(func() {
+			conn.Close()
+			for _, c := range servers {
+				if c != nil {
+					c.Close()
+				}
+			}
+			m.mu.Lock()
+			delete(m.conns, conn)
+			m.mu.Unlock()
+		})
+	}
+	defer closeAll()
+
+	if connected == 0 {
+		return
+	}
+
+	var writeMu sync.Mutex
+	for i, c := range servers {
+		if c == nil {
+			continue
+		}
+		go func(i int, c net.Conn) {
+			defer closeAll()
+			m.toClient(i, c, conn, &writeMu)
+		}(i, c)
+	}
+
+	m.toServers(conn, servers)
+}
+
+// toClient copies elements from INDI-server to client renaming or hiding duplicate devices,
+// elements of devices which are not renamed are written as they are
+func (m *Mux) toClient(upstream int, server net.Conn, client net.Conn, writeMu *sync.Mutex) {
+	buf := make([]byte, lib.INDIServerMaxRecvMsgSize)
+	xmlFlattener := lib.NewXmlFlattener()
+	for {
+		n, err := server.Read(buf)
+		if err != nil {
+			if err != io.EOF {
+				logger.Debugf("INDI-server %s read error: %s", m.upstreams[upstream].Name, err)
+			}
+			return
+		}
+
+		// elements of one chunk go to client with one write
+		out := net.Buffers{}
+		for _, el := range xmlFlattener.FeedChunk(buf[:n]) {
+			if device := lib.ElementAttr(el, "device"); device != "" {
+				name, ok := m.resolve(upstream, device)
+				if !ok {
+					continue
+				}
+				if name != device {
+					el = lib.SetElementAttr(el, "device", name)
+				}
+			}
+			out = append(out, el)
+		}
+		if len(out) == 0 {
+			continue
+		}
+
+		writeMu.Lock()
+		_, err = out.WriteTo(client)
+		writeMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// toServers routes client commands to INDI-servers by device, commands without device are sent to all servers
+func (m *Mux) toServers(client net.Conn, servers []net.Conn) {
+	buf := make([]byte, lib.INDIServerMaxRecvMsgSize)
+	xmlFlattener := lib.NewXmlFlattener()
+	for {
+		n, err := client.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for _, el := range xmlFlattener.FeedChunk(buf[:n]) {
+			device := lib.ElementAttr(el, "device")
+			r, ok := m.route(device)
+			if device == "" || (!ok && lib.ElementTag(el) == "getProperties") {
+				// device may not be defined yet, so servers decide themselves
+				for _, s := range servers {
+					if s != nil {
+						s.Write(el)
+					}
+				}
+				continue
+			}
+			if !ok {
+				logger.Debugf("command to unknown device '%s' is dropped", device)
+				continue
+			}
+
+			server := servers[r.upstream]
+			if server == nil {
+				continue
+			}
+			if r.device != device {
+				el = lib.SetElementAttr(el, "device", r.device)
+			}
+			if _, err := server.Write(el); err != nil {
+				return
+			}
+		}
+	}
+}
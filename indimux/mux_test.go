@@ -0,0 +1,162 @@
+package indimux
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer answers getProperties with defs and keeps lines it receives
+type fakeServer struct {
+	l    net.Listener
+	defs string
+
+	mu    sync.Mutex
+	conns []net.Conn
+	lines []string
+}
+
+func newFakeServer(t *testing.T, defs string) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{l: l, defs: defs}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, c)
+			s.mu.Unlock()
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(c net.Conn) {
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.lines = append(s.lines, strings.TrimSpace(line))
+		s.mu.Unlock()
+		if strings.HasPrefix(line, "<getProperties") {
+			c.Write([]byte(s.defs))
+		}
+	}
+}
+
+func (s *fakeServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.lines...)
+}
+
+func (s *fakeServer) close() {
+	s.l.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+func defSwitch(device string) string {
+	return `<defSwitchVector device="` + device + `" name="CONNECTION" state="Ok" perm="rw" rule="OneOfMany">
+<defSwitch name="CONNECT">On</defSwitch>
+</defSwitchVector>
+`
+}
+
+func TestMuxRenamesDuplicateDevices(t *testing.T) {
+	pier1 := newFakeServer(t, defSwitch("CCD Simulator")+defSwitch("Telescope Simulator"))
+	defer pier1.close()
+	pier2 := newFakeServer(t, defSwitch("CCD Simulator"))
+	defer pier2.close()
+
+	m, err := New([]Upstream{
+		{Name: "pier1", Addr: pier1.l.Addr().String()},
+		{Name: "pier2", Addr: pier2.l.Addr().String()},
+	}, PolicyRename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same as Discover but without waiting for definitions
+	m.resolve(0, "CCD Simulator")
+	m.resolve(0, "Telescope Simulator")
+	m.resolve(1, "CCD Simulator")
+
+	addr, err := m.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("<getProperties version=\"1.7\"/>\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// read definitions of all three devices
+	expected := []string{
+		defSwitch("CCD Simulator"),
+		defSwitch("Telescope Simulator"),
+		defSwitch("CCD Simulator @pier2"),
+	}
+	received := ""
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 4096)
+	for {
+		done := true
+		for _, def := range expected {
+			done = done && strings.Contains(received, def)
+		}
+		if done {
+			break
+		}
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("could not read definitions: %s, got: %s", err, received)
+		}
+		received += string(buf[:n])
+	}
+	if strings.Count(received, `device="CCD Simulator"`) != 1 {
+		t.Errorf("duplicate device is not renamed: %s", received)
+	}
+
+	// commands to renamed device go to its INDI-server under original name
+	cmd := `<newSwitchVector device="CCD Simulator @pier2" name="CONNECTION"><oneSwitch name="CONNECT">On</oneSwitch></newSwitchVector>` + "\n"
+	if _, err := client.Write([]byte(cmd)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		lines := pier2.received()
+		if len(lines) > 0 && strings.HasPrefix(lines[len(lines)-1], `<newSwitchVector device="CCD Simulator" `) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("command is not routed to pier2, got: %q", lines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, line := range pier1.received() {
+		if strings.HasPrefix(line, "<newSwitchVector") {
+			t.Errorf("command to pier2 device is sent to pier1: %s", line)
+		}
+	}
+}
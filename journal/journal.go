@@ -0,0 +1,294 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	StatusRunning     = "running"
+	StatusFinished    = "finished"
+	StatusInterrupted = "interrupted" // agent was stopped without finishing the session
+
+	maxErrors    = 100
+	saveInterval = time.Minute
+
+	// events of session listeners
+	EventStarted = "started"
+	EventEnded   = "ended"
+)
+
+// Endpoint is public address of session
+type Endpoint struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+}
+
+// Record is journal record of one session
+type Record struct {
+	ID               string     `json:"id"`
+	Mode             string     `json:"mode"`
+	Status           string     `json:"status"`
+	SessionID        uint64     `json:"sessionID"`
+	Started          time.Time  `json:"started"`
+	Ended            *time.Time `json:"ended,omitempty"`
+	PublicEndpoints  []Endpoint `json:"publicEndpoints"`
+	GuestConnections int        `json:"guestConnections"`
+	ImagesCaptured   int        `json:"imagesCaptured"`
+	BytesIn          uint64     `json:"bytesIn"`
+	BytesOut         uint64     `json:"bytesOut"`
+	Reconnects       int        `json:"reconnects"`
+	Errors           []string   `json:"errors"`
+}
+
+// Journal is local log of sessions stored as JSON-lines file, record is appended on every update
+// and the last line of session wins, file is compacted to one line per session when journal is opened
+type Journal struct {
+	mu      sync.Mutex
+	file    *os.File
+	records map[string]*Record
+	order   []string
+	active  map[string]*Session
+
+	listeners []func(event string, rec Record)
+}
+
+// ReadFile reads all records from journal file, the newest first
+func ReadFile(fileName string) ([]Record, error) {
+	records, order, err := readRecords(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Record, 0, len(order))
+	for i := len(order) - 1; i >= 0; i-- {
+		list = append(list, *records[order[i]])
+	}
+	return list, nil
+}
+
+func readRecords(fileName string) (map[string]*Record, []string, error) {
+	records := map[string]*Record{}
+	order := []string{}
+
+	f, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return records, order, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		rec := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil || rec.ID == "" {
+			// i.e. partial last line written when agent or host crashed
+			logger.Warnf("Skipping bad record in line %d of %s", line, fileName)
+			continue
+		}
+		if _, ok := records[rec.ID]; !ok {
+			order = append(order, rec.ID)
+		}
+		records[rec.ID] = rec
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return records, order, nil
+}
+
+// Open reads journal file, compacts it and opens it to append new records
+func Open(fileName string) (*Journal, error) {
+	records, order, err := readRecords(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	// sessions running when agent was stopped last time
+	for _, rec := range records {
+		if rec.Status == StatusRunning {
+			rec.Status = StatusInterrupted
+		}
+	}
+
+	if err := compact(fileName, records, order); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Journal{
+		file:    f,
+		records: records,
+		order:   order,
+		active:  map[string]*Session{},
+	}, nil
+}
+
+// compact replaces journal file with the last record of every session, bad lines are dropped
+func compact(fileName string, records map[string]*Record, order []string) error {
+	tmpName := fileName + ".tmp"
+	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, id := range order {
+		data, err := json.Marshal(records[id])
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(data)
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return os.Rename(tmpName, fileName)
+}
+
+// Close closes journal file
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.file.Close()
+}
+
+// Records returns all records, the newest first
+func (j *Journal) Records() []Record {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	list := make([]Record, 0, len(j.order))
+	for i := len(j.order) - 1; i >= 0; i-- {
+		list = append(list, j.current(j.order[i]))
+	}
+	return list
+}
+
+// Record returns record of session by ID
+func (j *Journal) Record(id string) (Record, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, ok := j.records[id]; !ok {
+		return Record{}, false
+	}
+	return j.current(id), true
+}
+
+// current returns live record of running session or the last saved one
+func (j *Journal) current(id string) Record {
+	if s, ok := j.active[id]; ok {
+		return s.snapshot()
+	}
+	return *j.records[id]
+}
+
+// Begin starts journal record of a new session, nil journal returns nil session which ignores all updates
+func (j *Journal) Begin(mode string, sessionID uint64) *Session {
+	if j == nil {
+		return nil
+	}
+
+	now := time.Now()
+	id := now.Format("20060102-150405") + "-" + mode
+	j.mu.Lock()
+	for n := 2; j.records[id] != nil; n++ {
+		id = fmt.Sprintf("%s-%s-%d", now.Format("20060102-150405"), mode, n)
+	}
+	j.mu.Unlock()
+
+	s := &Session{
+		journal: j,
+		rec: Record{
+			ID:              id,
+			Mode:            mode,
+			Status:          StatusRunning,
+			SessionID:       sessionID,
+			Started:         now,
+			PublicEndpoints: []Endpoint{},
+			Errors:          []string{},
+		},
+	}
+	j.mu.Lock()
+	j.active[id] = s
+	j.mu.Unlock()
+	s.save()
+	j.notify(EventStarted, s.snapshot())
+
+	return s
+}
+
+// AddListener adds function called when session starts or ends
+func (j *Journal) AddListener(fn func(event string, rec Record)) {
+	if j == nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.listeners = append(j.listeners, fn)
+}
+
+func (j *Journal) notify(event string, rec Record) {
+	j.mu.Lock()
+	listeners := append([]func(string, Record){}, j.listeners...)
+	j.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(event, rec)
+	}
+}
+
+func (j *Journal) write(rec Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, ok := j.records[rec.ID]; !ok {
+		j.order = append(j.order, rec.ID)
+	}
+	j.records[rec.ID] = &rec
+	if rec.Status != StatusRunning {
+		delete(j.active, rec.ID)
+	}
+
+	_, err = j.file.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,151 @@
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tempJournal(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "sessions.jsonl"), func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func openJournal(t *testing.T, fileName string) *Journal {
+	t.Helper()
+	j, err := Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func countLines(t *testing.T, fileName string) int {
+	t.Helper()
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "\n")
+}
+
+func TestSessionRecord(t *testing.T) {
+	fileName, cleanup := tempJournal(t)
+	defer cleanup()
+	j := openJournal(t, fileName)
+	defer j.Close()
+
+	events := []string{}
+	j.AddListener(func(event string, rec Record) {
+		events = append(events, event+" "+rec.Status)
+	})
+
+	s := j.Begin("share", 42)
+	s.AddEndpoint("INDI-Server", "node-1.indihub.io:5000")
+	s.AddGuestConnection()
+	s.AddImages(2)
+	s.AddBytes(100, 2000)
+	s.AddReconnect()
+	s.AddError("tunnel lost")
+
+	// counters of running session are live
+	rec, ok := j.Record(s.ID())
+	if !ok || rec.Status != StatusRunning || rec.GuestConnections != 1 || rec.ImagesCaptured != 2 ||
+		rec.BytesIn != 100 || rec.BytesOut != 2000 || rec.Reconnects != 1 || len(rec.Errors) != 1 {
+		t.Fatalf("unexpected running record: %+v", rec)
+	}
+
+	s.End()
+	s.End()
+	if len(events) != 2 || events[0] != "started running" || events[1] != "ended finished" {
+		t.Errorf("unexpected events: %v", events)
+	}
+
+	// nil session ignores updates
+	var nilSession *Session
+	nilSession.AddImages(1)
+	nilSession.End()
+
+	list, err := ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Status != StatusFinished || list[0].Ended == nil || list[0].SessionID != 42 ||
+		len(list[0].PublicEndpoints) != 1 || list[0].ImagesCaptured != 2 {
+		t.Errorf("unexpected saved records: %+v", list)
+	}
+}
+
+func TestOpenMarksInterruptedAndCompacts(t *testing.T) {
+	fileName, cleanup := tempJournal(t)
+	defer cleanup()
+
+	j := openJournal(t, fileName)
+	finished := j.Begin("solo", 0)
+	finished.AddError("first")
+	finished.End()
+	running := j.Begin("share", 7)
+	running.AddEndpoint("INDI-Server", "node-1.indihub.io:5000")
+	j.Close()
+	if n := countLines(t, fileName); n != 5 {
+		t.Fatalf("expected 5 saves, got %d", n)
+	}
+
+	j = openJournal(t, fileName)
+	defer j.Close()
+	if n := countLines(t, fileName); n != 2 {
+		t.Errorf("journal is not compacted to one line per session: %d lines", n)
+	}
+	list := j.Records()
+	if len(list) != 2 || list[0].ID != running.ID() || list[0].Status != StatusInterrupted ||
+		list[1].Status != StatusFinished || len(list[1].Errors) != 1 {
+		t.Errorf("unexpected records: %+v", list)
+	}
+	if _, err := os.Stat(fileName + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file is left: %v", err)
+	}
+}
+
+func TestBadLinesAreSkipped(t *testing.T) {
+	fileName, cleanup := tempJournal(t)
+	defer cleanup()
+
+	j := openJournal(t, fileName)
+	j.Begin("solo", 0).End()
+	j.Close()
+
+	// bad line in the middle and partial last line left by crash
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("garbage\n")
+	f.WriteString(`{"id":"20201018-204715-share","mode":"share","status":"running"}` + "\n")
+	f.WriteString(`{"id":"20201018-210000-share","mode":"sha`)
+	f.Close()
+
+	list, err := ReadFile(fileName)
+	if err != nil || len(list) != 2 {
+		t.Fatalf("expected 2 records, got %+v: %v", list, err)
+	}
+
+	j = openJournal(t, fileName)
+	list = j.Records()
+	if len(list) != 2 || list[0].ID != "20201018-204715-share" || list[0].Status != StatusInterrupted {
+		t.Errorf("unexpected records: %+v", list)
+	}
+
+	// new records follow complete lines
+	j.Begin("share", 1).End()
+	j.Close()
+	if list, err := ReadFile(fileName); err != nil || len(list) != 3 {
+		t.Errorf("expected 3 records, got %+v: %v", list, err)
+	}
+}
@@ -0,0 +1,138 @@
+package journal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/indihub-space/agent/logutil"
+)
+
+var logger = logutil.New("subsystem", "journal")
+
+// Session collects counters of running session, all methods are no-op for nil session
+type Session struct {
+	journal *Journal
+
+	mu       sync.Mutex
+	rec      Record
+	lastSave time.Time
+
+	// saves are serialized so that older state never overwrites newer one
+	saveMu sync.Mutex
+}
+
+// ID returns journal ID of session
+func (s *Session) ID() string {
+	if s == nil {
+		return ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rec.ID
+}
+
+// AddEndpoint adds public address of session
+func (s *Session) AddEndpoint(name string, addr string) {
+	s.update(true, func(rec *Record) {
+		rec.PublicEndpoints = append(rec.PublicEndpoints, Endpoint{Name: name, Addr: addr})
+	})
+}
+
+// AddGuestConnection counts new guest connection
+func (s *Session) AddGuestConnection() {
+	s.update(false, func(rec *Record) {
+		rec.GuestConnections++
+	})
+}
+
+// AddImages counts captured images
+func (s *Session) AddImages(n int) {
+	s.update(false, func(rec *Record) {
+		rec.ImagesCaptured += n
+	})
+}
+
+// AddBytes counts bytes transferred to local servers (in) and to the cloud (out)
+func (s *Session) AddBytes(in int, out int) {
+	s.update(false, func(rec *Record) {
+		rec.BytesIn += uint64(in)
+		rec.BytesOut += uint64(out)
+	})
+}
+
+// AddReconnect counts re-connects to local servers
+func (s *Session) AddReconnect() {
+	s.update(false, func(rec *Record) {
+		rec.Reconnects++
+	})
+}
+
+// AddError adds error of session
+func (s *Session) AddError(err string) {
+	s.update(true, func(rec *Record) {
+		rec.Errors = append(rec.Errors, time.Now().Format(time.RFC3339)+" "+err)
+		if len(rec.Errors) > maxErrors {
+			rec.Errors = rec.Errors[len(rec.Errors)-maxErrors:]
+		}
+	})
+}
+
+// End finishes session record
+func (s *Session) End() {
+	ended := false
+	s.update(true, func(rec *Record) {
+		if rec.Ended != nil {
+			return
+		}
+		now := time.Now()
+		rec.Ended = &now
+		rec.Status = StatusFinished
+		ended = true
+	})
+	if ended {
+		s.journal.notify(EventEnded, s.snapshot())
+	}
+}
+
+// update changes record and saves it right away if forced or periodically otherwise
+func (s *Session) update(force bool, fn func(rec *Record)) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	fn(&s.rec)
+	if !force && time.Since(s.lastSave) < saveInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+
+	s.save()
+}
+
+// snapshot returns copy of current record
+func (s *Session) snapshot() Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec := s.rec
+	rec.PublicEndpoints = append([]Endpoint{}, s.rec.PublicEndpoints...)
+	rec.Errors = append([]string{}, s.rec.Errors...)
+	return rec
+}
+
+func (s *Session) save() {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	rec := s.snapshot()
+	s.mu.Lock()
+	s.lastSave = time.Now()
+	s.mu.Unlock()
+
+	if err := s.journal.write(rec); err != nil {
+		logger.Errorf("could not write session journal: %s", err)
+	}
+}
@@ -7,7 +7,8 @@ const (
 	INDIServerMaxRecvMsgSize = 49152
 	INDIServerMaxSendMsgSize = 2048
 
-	ModeSolo    = "solo"
-	ModeShare   = "share"
-	ModeRobotic = "robotic"
+	ModeSolo      = "solo"
+	ModeShare     = "share"
+	ModeRobotic   = "robotic"
+	ModeBroadcast = "broadcast"
 )
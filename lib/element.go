@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"bytes"
+	"strings"
+)
+
+var (
+	xmlUnescaper = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&quot;", "\"", "&apos;", "'", "&amp;", "&")
+	xmlEscaper   = strings.NewReplacer("<", "&lt;", ">", "&gt;", "\"", "&quot;", "'", "&apos;", "&", "&amp;")
+)
+
+// ElementTag returns tag name of INDI XML-element, i.e. "newNumberVector"
+func ElementTag(el []byte) string {
+	el = bytes.TrimLeft(el, " \t\r\n")
+	if len(el) == 0 || el[0] != '<' {
+		return ""
+	}
+	end := bytes.IndexAny(el, " \t\r\n/>")
+	if end == -1 {
+		return ""
+	}
+	return string(el[1:end])
+}
+
+// ElementAttr returns value of attribute of INDI XML-element start tag, i.e. "device"
+func ElementAttr(el []byte, attr string) string {
+	start, end, ok := attrValue(el, attr)
+	if !ok {
+		return ""
+	}
+	return xmlUnescaper.Replace(string(el[start:end]))
+}
+
+// SetElementAttr returns copy of INDI XML-element with new value of existing attribute of start tag
+func SetElementAttr(el []byte, attr string, value string) []byte {
+	start, end, ok := attrValue(el, attr)
+	if !ok {
+		return el
+	}
+	escaped := xmlEscaper.Replace(value)
+	res := make([]byte, 0, len(el)-(end-start)+len(escaped))
+	res = append(res, el[:start]...)
+	res = append(res, escaped...)
+	return append(res, el[end:]...)
+}
+
+// attrValue returns position of raw attribute value in start tag
+func attrValue(el []byte, attr string) (int, int, bool) {
+	tagEnd := bytes.IndexByte(el, '>')
+	if tagEnd == -1 {
+		tagEnd = len(el)
+	}
+	startTag := el[:tagEnd]
+
+	for pos := 0; pos < len(startTag); {
+		n := bytes.Index(startTag[pos:], []byte(attr))
+		if n == -1 {
+			return 0, 0, false
+		}
+		n += pos
+		pos = n + len(attr)
+
+		// attribute name should be preceded by space and followed by '='
+		if n == 0 || !isSpace(startTag[n-1]) {
+			continue
+		}
+		rest := bytes.TrimLeft(startTag[pos:], " \t\r\n")
+		if len(rest) < 2 || rest[0] != '=' {
+			continue
+		}
+		rest = bytes.TrimLeft(rest[1:], " \t\r\n")
+		if len(rest) < 2 || (rest[0] != '"' && rest[0] != '\'') {
+			continue
+		}
+		end := bytes.IndexByte(rest[1:], rest[0])
+		if end == -1 {
+			return 0, 0, false
+		}
+		start := len(startTag) - len(rest) + 1
+		return start, start + end, true
+	}
+
+	return 0, 0, false
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket limits rate of bytes (tokens) per second, nil bucket means no limit
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns bucket with rate tokens per second and max burst, nil is returned for zero rate
+func NewTokenBucket(rate int64, burst int64) *TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < rate {
+		burst = rate
+	}
+	return &TokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// delay returns how long to wait before n tokens can be taken, bucket must be locked
+func (b *TokenBucket) delay(n int) time.Duration {
+	// requests bigger than burst are allowed when bucket is full and make it go negative
+	need := float64(n)
+	if need > b.burst {
+		need = b.burst
+	}
+	if b.tokens >= need {
+		return 0
+	}
+
+	return time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+}
+
+// TryTake takes n tokens if they are available, otherwise returns how long to wait and takes nothing
+func (b *TokenBucket) TryTake(n int) time.Duration {
+	return TakeTokens(n, b)
+}
+
+// Wait blocks until n tokens are available and takes them
+func (b *TokenBucket) Wait(n int) {
+	for {
+		d := b.TryTake(n)
+		if d == 0 {
+			return
+		}
+		time.Sleep(d)
+	}
+}
+
+// TakeTokens takes n tokens from every bucket if all of them have enough, otherwise returns the longest wait
+// and takes nothing. Buckets must be different and are locked in given order, nil buckets are skipped.
+func TakeTokens(n int, buckets ...*TokenBucket) time.Duration {
+	locked := make([]*TokenBucket, 0, len(buckets))
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		locked = append(locked, b)
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	for _, b := range locked {
+		b.refill(now)
+		if d := b.delay(n); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	for _, b := range locked {
+		b.tokens -= float64(n)
+	}
+	return 0
+}
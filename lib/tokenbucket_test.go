@@ -0,0 +1,36 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestTakeTokens(t *testing.T) {
+	conn := NewTokenBucket(1000, 1000)
+	session := NewTokenBucket(100, 100)
+
+	if d := TakeTokens(100, conn, session); d != 0 {
+		t.Fatalf("expected tokens to be taken, got delay %s", d)
+	}
+
+	// session bucket is empty, so nothing is taken from connection bucket too
+	if d := TakeTokens(100, conn, session); d <= 0 {
+		t.Fatal("expected delay when session bucket is empty")
+	}
+	if d := conn.TryTake(900); d != 0 {
+		t.Fatalf("connection bucket lost tokens: delay %s", d)
+	}
+	if d := conn.TryTake(900); d <= 0 {
+		t.Fatal("expected delay when connection bucket is empty")
+	}
+}
+
+func TestTokenBucketNil(t *testing.T) {
+	var b *TokenBucket
+	if NewTokenBucket(0, 100) != nil {
+		t.Fatal("expected nil bucket for zero rate")
+	}
+	if d := b.TryTake(1 << 20); d != 0 {
+		t.Fatalf("nil bucket must not limit, got delay %s", d)
+	}
+	b.Wait(1 << 20)
+}
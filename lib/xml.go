@@ -2,11 +2,14 @@ package lib
 
 import (
 	"bytes"
-	"log"
 
 	"github.com/clbanning/mxj"
+
+	"github.com/indihub-space/agent/logutil"
 )
 
+var logger = logutil.New("subsystem", "lib")
+
 var (
 	elementMessage       = []byte("<message")
 	elementDelProperty   = []byte("<delProperty")
@@ -19,6 +22,7 @@ var (
 type XmlFlattener struct {
 	buffer         []byte
 	nextEndElement []byte
+	searchFrom     int // end tag isn't in buffer before this offset, so big BLOBs aren't searched again on every chunk
 }
 
 func init() {
@@ -73,16 +77,22 @@ func (r *XmlFlattener) FeedChunk(chunk []byte) [][]byte {
 					r.nextEndElement = append(r.nextEndElement, '>')
 				}
 			}
+			r.searchFrom = 0
 		}
 
-		if n := bytes.Index(r.buffer, r.nextEndElement); n == -1 {
-			// should read next chunk
+		if n := bytes.Index(r.buffer[r.searchFrom:], r.nextEndElement); n == -1 {
+			// should read next chunk, end tag can start in the tail of this one
+			r.searchFrom = len(r.buffer) - len(r.nextEndElement) + 1
+			if r.searchFrom < 0 {
+				r.searchFrom = 0
+			}
 			return elements
 		} else {
-			// element closed, add it to return
-			end := n + len(r.nextEndElement) + 1
-			if end > len(r.buffer) {
-				end = len(r.buffer)
+			n += r.searchFrom
+			// element closed, add it to return with new line following it, but not with start of the next element
+			end := n + len(r.nextEndElement)
+			if end < len(r.buffer) && r.buffer[end] == '\n' {
+				end++
 			}
 			elements = append(elements, r.buffer[:end])
 			r.nextEndElement = r.nextEndElement[:0]
@@ -106,14 +116,8 @@ func (r *XmlFlattener) ConvertChunkToJSON(chunk []byte) [][]byte {
 
 	jsonElements := make([][]byte, 0, len(elements))
 	for _, el := range elements {
-		mapVal, err := mxj.NewMapXml(el, true)
+		jsonEl, err := ConvertElementToJSON(el)
 		if err != nil {
-			log.Println("could not parse XML chunk:", err)
-			continue
-		}
-		jsonEl, err := mapVal.Json()
-		if err != nil {
-			log.Println("could not convert map to JSON:", err)
 			continue
 		}
 		jsonElements = append(jsonElements, jsonEl)
@@ -122,6 +126,21 @@ func (r *XmlFlattener) ConvertChunkToJSON(chunk []byte) [][]byte {
 	return jsonElements
 }
 
+// ConvertElementToJSON converts single INDI XML-element to JSON
+func ConvertElementToJSON(el []byte) ([]byte, error) {
+	mapVal, err := mxj.NewMapXml(el, true)
+	if err != nil {
+		logger.Debugf("could not parse XML chunk: %s", err)
+		return nil, err
+	}
+	jsonEl, err := mapVal.Json()
+	if err != nil {
+		logger.Debugf("could not convert map to JSON: %s", err)
+		return nil, err
+	}
+	return jsonEl, nil
+}
+
 func (r *XmlFlattener) ConvertJSONToXML(jsonData []byte) ([]byte, error) {
 	mapVal, err := mxj.NewMapJson(jsonData)
 	if err != nil {
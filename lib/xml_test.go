@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func feedInChunks(f *XmlFlattener, data []byte, size int) []string {
+	elements := []string{}
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		for _, el := range f.FeedChunk(data[:n]) {
+			elements = append(elements, string(el))
+		}
+		data = data[n:]
+	}
+	return elements
+}
+
+func TestXmlFlattenerChunks(t *testing.T) {
+	blob := `<setBLOBVector device="CCD" name="CCD1" state="Ok">
+<oneBLOB name="CCD1" size="4" format=".fits">` + strings.Repeat("QUJD", 4096) + `</oneBLOB>
+</setBLOBVector>
+`
+	number := `<setNumberVector device="Telescope" name="EQUATORIAL_EOD_COORD" state="Ok">
+<oneNumber name="RA">5</oneNumber>
+</setNumberVector>
+`
+	message := `<message device="CCD" message="Exposure done"/>
+`
+	// elements are not always separated with new line
+	stream := []byte(number + blob + message + strings.TrimSpace(message) + number)
+
+	for _, size := range []int{1, 7, 100, 2048, len(stream)} {
+		elements := feedInChunks(NewXmlFlattener(), stream, size)
+		if len(elements) != 5 {
+			t.Fatalf("chunk size %d: expected 5 elements, got %d", size, len(elements))
+		}
+		for i, expected := range []string{number, blob, message, message, number} {
+			if strings.TrimSpace(elements[i]) != strings.TrimSpace(expected) {
+				t.Errorf("chunk size %d: element %d is %.80q", size, i, elements[i])
+			}
+		}
+	}
+}
+
+func BenchmarkXmlFlattenerBLOB(b *testing.B) {
+	data := []byte(`<setBLOBVector device="CCD" name="CCD1" state="Ok">
+<oneBLOB name="CCD1" size="8388608" format=".fits">` + strings.Repeat("A", 8*1024*1024) + `</oneBLOB>
+</setBLOBVector>
+`)
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		f := NewXmlFlattener()
+		n := 0
+		for chunk := data; len(chunk) > 0; {
+			size := 2048
+			if size > len(chunk) {
+				size = len(chunk)
+			}
+			n += len(f.FeedChunk(chunk[:size]))
+			chunk = chunk[size:]
+		}
+		if n != 1 || !bytes.HasSuffix(bytes.TrimSpace(data), []byte("</setBLOBVector>")) {
+			b.Fatalf("expected 1 element, got %d", n)
+		}
+	}
+}
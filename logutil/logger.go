@@ -0,0 +1,185 @@
+package logutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is logging level
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel parses level name: debug, info, warn or error
+func ParseLevel(name string) (Level, error) {
+	for l, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return l, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level '%s'", name)
+}
+
+var (
+	level = int32(LevelInfo)
+	out   = &output{w: os.Stderr, format: FormatText}
+	root  = &Logger{}
+)
+
+type output struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+}
+
+// SetLevel sets minimal level of messages to be written, can be changed at runtime
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+// GetLevel returns current logging level
+func GetLevel() Level {
+	return Level(atomic.LoadInt32(&level))
+}
+
+// SetFormat sets output format: text or json
+func SetFormat(format string) error {
+	if format != FormatText && format != FormatJSON {
+		return fmt.Errorf("unknown log format '%s'", format)
+	}
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	out.format = format
+	return nil
+}
+
+// SetOutput sets writer for all messages, messages of standard logger are written there too with info level
+func SetOutput(w io.Writer) {
+	out.mu.Lock()
+	out.w = w
+	out.mu.Unlock()
+
+	log.SetFlags(0)
+	log.SetOutput(stdWriter{})
+}
+
+// stdWriter passes lines of standard logger to structured output
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	root.logf(LevelInfo, "%s", bytes.TrimRight(p, "\n"))
+	return len(p), nil
+}
+
+// Logger writes levelled messages with fields, i.e. mode, proxy name, connection number or device
+type Logger struct {
+	fields []interface{} // key, value pairs
+}
+
+// New returns logger with fields given as key, value pairs
+func New(keyValues ...interface{}) *Logger {
+	return root.With(keyValues...)
+}
+
+// With returns logger with additional fields given as key, value pairs
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyValues))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyValues...)
+	if len(fields)%2 == 1 {
+		fields = append(fields, "")
+	}
+	return &Logger{fields: fields}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args...)
+}
+
+// Fatalf writes error message and exits
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args...)
+	os.Exit(1)
+}
+
+func (l *Logger) logf(lvl Level, format string, args ...interface{}) {
+	if lvl < GetLevel() {
+		return
+	}
+	l.write(lvl, strings.TrimRight(fmt.Sprintf(format, args...), "\n"))
+}
+
+func (l *Logger) write(lvl Level, msg string) {
+	now := time.Now()
+
+	out.mu.Lock()
+	defer out.mu.Unlock()
+
+	buf := &bytes.Buffer{}
+	if out.format == FormatJSON {
+		entry := map[string]interface{}{
+			"time":  now.Format(time.RFC3339Nano),
+			"level": lvl.String(),
+			"msg":   msg,
+		}
+		for i := 0; i < len(l.fields); i += 2 {
+			entry[fmt.Sprint(l.fields[i])] = l.fields[i+1]
+		}
+		json.NewEncoder(buf).Encode(entry)
+	} else {
+		fmt.Fprintf(buf, "%s %-5s %s", now.Format("2006/01/02 15:04:05"), strings.ToUpper(lvl.String()), msg)
+		for i := 0; i < len(l.fields); i += 2 {
+			fmt.Fprintf(buf, " %v=%v", l.fields[i], quote(fmt.Sprint(l.fields[i+1])))
+		}
+		buf.WriteByte('\n')
+	}
+	out.w.Write(buf.Bytes())
+}
+
+func quote(val string) string {
+	if val == "" || strings.ContainsAny(val, " \t\"=") {
+		return fmt.Sprintf("%q", val)
+	}
+	return val
+}
@@ -1,7 +1,6 @@
 package logutil
 
 import (
-	"log"
 	"os"
 )
 
@@ -9,6 +8,9 @@ var IsDev = false
 
 func init() {
 	IsDev = os.Getenv("INDIHUB_DEV") != ""
+	if IsDev {
+		SetLevel(LevelDebug)
+	}
 }
 
 func LogError(format string, args ...interface{}) {
@@ -16,5 +18,5 @@ func LogError(format string, args ...interface{}) {
 		return
 	}
 
-	log.Printf(format, args...)
+	root.Errorf(format, args...)
 }
@@ -0,0 +1,122 @@
+package logutil
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "20060102-150405.000"
+
+// RotatingFile is log file rotated by size and age, rotated files are kept with timestamp suffix
+type RotatingFile struct {
+	fileName   string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// NewRotatingFile opens log file to append, the file is rotated when it is bigger than maxSize bytes
+// or older than maxAge, only maxBackups newest rotated files are kept (zero values disable the limits)
+func NewRotatingFile(fileName string, maxSize int64, maxAge time.Duration, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{
+		fileName:   fileName,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.size > 0 && ((f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize) ||
+		(f.maxAge > 0 && time.Since(f.opened) > f.maxAge)) {
+		if err := f.rotate(); err != nil {
+			// keep writing to the current file
+			os.Stderr.WriteString("could not rotate log file: " + err.Error() + "\n")
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes log file
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Close()
+}
+
+func (f *RotatingFile) rotate() error {
+	backupName := f.fileName + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(f.fileName, backupName); err != nil {
+		return err
+	}
+	f.file.Close()
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	f.removeOldBackups()
+	return nil
+}
+
+// removeOldBackups removes rotated files above maxBackups
+func (f *RotatingFile) removeOldBackups() {
+	if f.maxBackups <= 0 {
+		return
+	}
+
+	backups, err := filepath.Glob(f.fileName + ".*")
+	if err != nil {
+		return
+	}
+	valid := backups[:0]
+	for _, name := range backups {
+		suffix := strings.TrimPrefix(name, f.fileName+".")
+		if _, err := time.Parse(backupTimeFormat, suffix); err == nil {
+			valid = append(valid, name)
+		}
+	}
+
+	// timestamp suffixes are sorted by time
+	sort.Strings(valid)
+	for len(valid) > f.maxBackups {
+		os.Remove(valid[0])
+		valid = valid[1:]
+	}
+}
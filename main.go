@@ -5,26 +5,42 @@ import (
 	"crypto/tls"
 	"flag"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	_ "google.golang.org/grpc/encoding/gzip"
 
+	"github.com/indihub-space/agent/alpaca"
 	"github.com/indihub-space/agent/apiserver"
+	"github.com/indihub-space/agent/audit"
+	"github.com/indihub-space/agent/broadcast"
 	"github.com/indihub-space/agent/config"
+	"github.com/indihub-space/agent/fits"
+	"github.com/indihub-space/agent/hostutils"
+	"github.com/indihub-space/agent/images"
+	"github.com/indihub-space/agent/indimux"
+	"github.com/indihub-space/agent/journal"
 	"github.com/indihub-space/agent/lib"
 	"github.com/indihub-space/agent/logutil"
 	"github.com/indihub-space/agent/manager"
+	"github.com/indihub-space/agent/mqtt"
 	"github.com/indihub-space/agent/proto/indihub"
+	"github.com/indihub-space/agent/proxy"
+	"github.com/indihub-space/agent/recorder"
+	"github.com/indihub-space/agent/safety"
+	"github.com/indihub-space/agent/scheduler"
 	"github.com/indihub-space/agent/share"
 	"github.com/indihub-space/agent/solo"
+	"github.com/indihub-space/agent/stellarium"
 	"github.com/indihub-space/agent/version"
+	"github.com/indihub-space/agent/webhook"
 )
 
 const (
@@ -44,9 +60,45 @@ var (
 	flagAPIOrigins            string
 	flagMode                  string
 	flagLogFile               string
+	flagRecordFile            string
+	flagRecordSkipBLOBs       bool
+	flagBLOBRate              uint64
+	flagSessionBLOBRate       uint64
+	flagBLOBPolicy            string
+	flagGuestMux              bool
+	flagScheduleFile          string
+	flagSafetyMonitor         bool
+	flagSafetyHold            time.Duration
+	flagBroadcastRate         uint64
+	flagJournalFile           string
+	flagAuditFile             string
+	flagAuditKeyFile          string
+	flagWebhooksFile          string
+	flagLogLevel              string
+	flagLogFormat             string
+	flagLogMaxSize            int64
+	flagLogMaxAge             time.Duration
+	flagLogKeep               int
+	flagAlpaca                bool
+	flagAlpacaAddr            string
+	flagMQTTBroker            string
+	flagMQTTUsername          string
+	flagMQTTPassword          string
+	flagMQTTTopic             string
+	flagStellariumPort        uint64
+	flagLX200Port             uint64
+	flagTelescope             string
+	flagTelescopeJ2000        bool
+	flagTelescopeBind         string
+	flagTelescopeMinAlt       float64
+	flagTelescopeHorizon      string
+	flagINDIDuplicates        string
+	flagINDIMuxAddr           string
 
 	indiServerAddr string
 
+	logger = logutil.New("subsystem", "main")
+
 	httpClientSM = http.Client{}
 )
 
@@ -58,13 +110,25 @@ func init() {
 		&flagINDIServerManagerAddr,
 		"indi-server-manager",
 		"raspberrypi.local:8624",
-		"INDI-server Manager address (host:port)",
+		"INDI-server Manager address (host:port), comma-separated list to serve INDI-profiles of several managers",
 	)
 	flag.StringVar(
 		&flagINDIServerAddr,
 		"indi-server",
 		"",
-		"INDI-server address (host:port) to connect without Web Manager",
+		"INDI-server address (host:port) to connect without Web Manager, comma-separated list of [name=]host:port to serve several INDI-servers",
+	)
+	flag.StringVar(
+		&flagINDIDuplicates,
+		"indi-duplicates",
+		indimux.PolicyFirst,
+		`how to serve devices with the same name on several INDI-servers: "first" - only device of the first server in list, "rename" - devices of other servers are renamed to "<device> @<server>"`,
+	)
+	flag.StringVar(
+		&flagINDIMuxAddr,
+		"indi-mux-addr",
+		"127.0.0.1:0",
+		"address of merged INDI-server when several INDI-servers are used (random local port by default)",
 	)
 	flag.StringVar(
 		&flagMode,
@@ -74,6 +138,7 @@ func init() {
 solo - equipment sharing is not possible, you are connected to INDIHUB and contributing images
 share - you are sharing equipment with another INDIHUB user (agent will output connection info)
 robotic - equipment sharing is not possible, your equipment is controlled by INDIHUB AI (you can still watch what it is doing!) 
+broadcast - your equipment state and image previews are published read-only for anyone to watch (agent will output connection info)
 `,
 	)
 	flag.BoolVar(
@@ -104,7 +169,7 @@ robotic - equipment sharing is not possible, your equipment is controlled by IND
 		&flagINDIProfile,
 		"indi-profile",
 		"",
-		"Name of INDI-profile to share via indihub",
+		"Name of INDI-profile to share via indihub, comma-separated list for several INDI-server managers",
 	)
 	flag.BoolVar(
 		&flagAPITLS,
@@ -130,23 +195,254 @@ robotic - equipment sharing is not possible, your equipment is controlled by IND
 		"",
 		"path to log file (STDOUT by default)",
 	)
+	flag.StringVar(
+		&flagLogLevel,
+		"log-level",
+		"",
+		"log level: debug, info, warn or error (info by default, debug in dev-mode)",
+	)
+	flag.StringVar(
+		&flagLogFormat,
+		"log-format",
+		logutil.FormatText,
+		"log format: text or json",
+	)
+	flag.Int64Var(
+		&flagLogMaxSize,
+		"log-max-size",
+		10,
+		"max size of log file in MiB before it is rotated, 0 disables rotation by size",
+	)
+	flag.DurationVar(
+		&flagLogMaxAge,
+		"log-max-age",
+		24*time.Hour,
+		"max age of log file before it is rotated, 0 disables rotation by age",
+	)
+	flag.IntVar(
+		&flagLogKeep,
+		"log-keep",
+		5,
+		"number of rotated log files to keep, 0 keeps all of them",
+	)
+	flag.StringVar(
+		&flagRecordFile,
+		"record-file",
+		"",
+		"path to file to record all INDI traffic of guests and WS-clients to (replay with 'replay' command)",
+	)
+	flag.BoolVar(
+		&flagRecordSkipBLOBs,
+		"record-skip-blobs",
+		false,
+		"don't write BLOB payloads to recording file",
+	)
+	flag.Uint64Var(
+		&flagBLOBRate,
+		"blob-rate",
+		0,
+		"max rate of BLOB traffic per guest connection in KiB/s (unlimited by default)",
+	)
+	flag.Uint64Var(
+		&flagSessionBLOBRate,
+		"session-blob-rate",
+		0,
+		"max rate of BLOB traffic for all guest connections in KiB/s (unlimited by default)",
+	)
+	flag.Uint64Var(
+		&flagBroadcastRate,
+		"broadcast-rate",
+		256,
+		"max rate of image previews sent to all viewers in broadcast mode in KiB/s",
+	)
+	flag.StringVar(
+		&flagBLOBPolicy,
+		"blob-policy",
+		"",
+		`BLOB policy to use instead of guest's "enableBLOB Also": "Never" or "Only" (guest's policy by default)`,
+	)
+	flag.BoolVar(
+		&flagGuestMux,
+		"guest-mux",
+		false,
+		"share connections to INDI-server between guest connections, so INDI-server sends every element and BLOB once",
+	)
+	flag.StringVar(
+		&flagScheduleFile,
+		"schedule",
+		"",
+		"path to JSON-file with schedule of sharing sessions (scheduler is disabled by default)",
+	)
+	flag.BoolVar(
+		&flagSafetyMonitor,
+		"safety-monitor",
+		false,
+		"watch INDI weather and safety devices: park equipment and stop sharing on Alert",
+	)
+	flag.DurationVar(
+		&flagSafetyHold,
+		"safety-hold",
+		30*time.Minute,
+		"how long safety conditions should stay OK before sharing is resumed",
+	)
+	flag.StringVar(
+		&flagJournalFile,
+		"journal-file",
+		"",
+		"session journal file, i.e. indihub-sessions.jsonl (disabled by default)",
+	)
+	flag.StringVar(
+		&flagAuditFile,
+		"audit-file",
+		"",
+		"audit log file of commands sent to equipment, i.e. indihub-audit.jsonl (disabled by default)",
+	)
+	flag.StringVar(
+		&flagAuditKeyFile,
+		"audit-key-file",
+		"",
+		"file with key signing audit log entries, created if it doesn't exist (default is audit log file with .key suffix)",
+	)
+	flag.StringVar(
+		&flagWebhooksFile,
+		"webhooks-file",
+		"",
+		"JSON file with webhooks to notify about agent events (disabled by default)",
+	)
+	flag.BoolVar(
+		&flagAlpaca,
+		"alpaca",
+		false,
+		"expose INDI devices as ASCOM Alpaca devices and answer Alpaca discovery on UDP port 32227",
+	)
+	flag.StringVar(
+		&flagAlpacaAddr,
+		"alpaca-addr",
+		alpaca.DefaultAddr,
+		"address of ASCOM Alpaca API without authorization, i.e. 0.0.0.0:11111 to let Alpaca clients in local network in",
+	)
+	flag.StringVar(
+		&flagMQTTBroker,
+		"mqtt-broker",
+		"",
+		"MQTT broker to publish equipment state and receive commands, i.e. tcp://localhost:1883 or ssl://host:8883 (disabled by default)",
+	)
+	flag.StringVar(
+		&flagMQTTUsername,
+		"mqtt-username",
+		"",
+		"MQTT broker user name",
+	)
+	flag.StringVar(
+		&flagMQTTPassword,
+		"mqtt-password",
+		"",
+		"MQTT broker password",
+	)
+	flag.StringVar(
+		&flagMQTTTopic,
+		"mqtt-topic",
+		"",
+		"MQTT topic prefix (indihub/<hostname> by default)",
+	)
+	flag.Uint64Var(
+		&flagStellariumPort,
+		"stellarium-port",
+		0,
+		"port to listen for Stellarium telescope control protocol, i.e. 10001 (disabled by default)",
+	)
+	flag.Uint64Var(
+		&flagLX200Port,
+		"lx200-port",
+		0,
+		"port to listen for LX200 telescope control protocol, i.e. 10002 (disabled by default)",
+	)
+	flag.StringVar(
+		&flagTelescope,
+		"telescope",
+		"",
+		"INDI telescope controlled via Stellarium and LX200 protocols (the first telescope by default)",
+	)
+	flag.BoolVar(
+		&flagTelescopeJ2000,
+		"telescope-j2000",
+		false,
+		"Stellarium and LX200 clients use J2000 coordinates instead of equinox of date (JNow)",
+	)
+	flag.StringVar(
+		&flagTelescopeBind,
+		"telescope-bind",
+		stellarium.DefaultBind,
+		"address of Stellarium and LX200 listeners without authorization, i.e. 0.0.0.0 to let clients in local network in",
+	)
+	flag.Float64Var(
+		&flagTelescopeMinAlt,
+		"telescope-min-alt",
+		0,
+		"minimal altitude in degrees of goto targets from Stellarium and LX200 clients, -90 disables altitude check",
+	)
+	flag.StringVar(
+		&flagTelescopeHorizon,
+		"telescope-horizon",
+		"",
+		"local horizon of goto targets from Stellarium and LX200 clients as azimuth:altitude pairs in degrees, i.e. 0:10,90:25,180:15,270:20",
+	)
 }
 
 func main() {
+	// sub-commands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		case "connections":
+			runConnections(os.Args[2:])
+			return
+		case "sessions":
+			runSessions(os.Args[2:])
+			return
+		case "update":
+			runUpdate(os.Args[2:])
+			return
+		case "version":
+			runVersion()
+			return
+		}
+	}
+
 	flag.Parse()
 
+	if flagLogLevel != "" {
+		level, err := logutil.ParseLevel(flagLogLevel)
+		if err != nil {
+			logger.Fatalf("%s", err)
+		}
+		logutil.SetLevel(level)
+	}
+	if err := logutil.SetFormat(flagLogFormat); err != nil {
+		logger.Fatalf("%s", err)
+	}
+
 	if flagLogFile != "" {
-		// redirect log output to file
-		logFile, err := os.OpenFile(flagLogFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		// redirect log output to rotated file
+		logFile, err := logutil.NewRotatingFile(flagLogFile, flagLogMaxSize*1024*1024, flagLogMaxAge, flagLogKeep)
 		if err != nil {
-			log.Fatalf("error opening log file '%s': %s\n", flagLogFile, err)
+			logger.Fatalf("error opening log file '%s': %s", flagLogFile, err)
 		}
 		defer logFile.Close()
-		log.SetOutput(logFile)
+		logutil.SetOutput(logFile)
+	} else {
+		logutil.SetOutput(os.Stderr)
+	}
+
+	if flagMode != lib.ModeSolo && flagMode != lib.ModeShare && flagMode != lib.ModeRobotic &&
+		flagMode != lib.ModeBroadcast {
+		logger.Fatalf("Unknown mode '%s' provided", flagMode)
 	}
 
-	if flagMode != lib.ModeSolo && flagMode != lib.ModeShare && flagMode != lib.ModeRobotic {
-		log.Fatalf("Unknown mode '%s' provided\n", flagMode)
+	if flagBLOBPolicy != "" && flagBLOBPolicy != proxy.BLOBPolicyNever && flagBLOBPolicy != proxy.BLOBPolicyOnly {
+		logger.Fatalf("Unknown BLOB policy '%s' provided", flagBLOBPolicy)
 	}
 
 	indiHubAddr := "relay.indihub.io:7668" // tls one
@@ -154,65 +450,40 @@ func main() {
 		indiHubAddr = "localhost:7667" // TODO: change this to optional DEV server
 	}
 
-	indiServerAddr := ""
+	var err error
+	indiServers := []indimux.Upstream{}
 	indiDrivers := []*lib.INDIDriver{}
 	indiProfile := &lib.INDIProfile{}
 	if flagINDIServerAddr != "" {
-		// connect to INDI-server directly without Web Manager
-		if _, _, err := net.SplitHostPort(flagINDIServerAddr); err != nil {
-			log.Fatal("Bad syntax for 'indi-server' parameter, the 'host:port' format is expected")
+		// connect to INDI-servers directly without Web Manager
+		indiServers, err = indimux.ParseUpstreams(flagINDIServerAddr)
+		if err != nil {
+			logger.Fatalf("Bad syntax for 'indi-server' parameter: %s", err)
 		}
-		log.Println("Will try to connect directly to INDI-server (Web Manager is not used)")
+		logger.Infof("Will try to connect directly to INDI-server (Web Manager is not used)")
 		indiProfile.Name = flagINDIServerAddr // to let backend know that no Web Manager was used
-		indiServerAddr = flagINDIServerAddr
 	} else {
-		// connect to INDI-server using info from Web Manager
-		indiHost, _, err := net.SplitHostPort(flagINDIServerManagerAddr)
-		if err != nil {
-			log.Fatal("Bad syntax for 'indi-server-manager' parameter, the 'host:port' format is expected")
-		}
+		// connect to INDI-servers using info from Web Managers, every manager runs its own profile
 		if flagINDIProfile == "" {
-			log.Fatal("'indi-profile' parameter is required")
+			logger.Fatalf("'indi-profile' parameter is required")
 		}
-
-		// connect to INDI-server Manager
-		log.Printf("Connection to local INDI-Server Manager on %s...\n", flagINDIServerManagerAddr)
-		managerClient := manager.NewClient(flagINDIServerManagerAddr)
-		running, currINDIProfile, err := managerClient.GetStatus()
-		if err != nil {
-			log.Fatal(err)
+		managerAddrs := strings.Split(flagINDIServerManagerAddr, ",")
+		profiles := strings.Split(flagINDIProfile, ",")
+		if len(managerAddrs) != len(profiles) {
+			logger.Fatalf("Number of 'indi-server-manager' addresses should be equal to number of 'indi-profile' names")
 		}
-		log.Println("...OK")
 
-		// start required profile if it is not active and running
-		if !running || currINDIProfile != flagINDIProfile {
-			log.Printf("Setting active INDI-profile to '%s'\n", flagINDIProfile)
-			if err := managerClient.StopServer(); err != nil {
-				log.Fatal(err)
-			}
-			if err := managerClient.StartProfile(flagINDIProfile); err != nil {
-				log.Fatal(err)
+		profileNames := []string{}
+		for i, profileName := range profiles {
+			addr, profile, drivers := startINDIProfile(strings.TrimSpace(managerAddrs[i]), strings.TrimSpace(profileName))
+			if i == 0 {
+				indiProfile = profile
 			}
-		} else {
-			log.Printf("INDI-server is running with active INDI-profile '%s'\n", flagINDIProfile)
-		}
-
-		// get profile connect data
-		indiProfile, err = managerClient.GetProfile(flagINDIProfile)
-		if err != nil {
-			log.Fatalf("could not get INDI-profile from INDI-server manager: %s", err)
-		}
-		indiServerAddr = fmt.Sprintf("%s:%d", indiHost, indiProfile.Port)
-
-		// get profile drivers data
-		indiDrivers, err = managerClient.GetDrivers()
-		if err != nil {
-			log.Fatalf("could not get INDI-drivers info from INDI-server manager: %s", err)
-		}
-		log.Println("INDIDrivers:")
-		for _, d := range indiDrivers {
-			log.Printf("%+v", *d)
+			profileNames = append(profileNames, profile.Name)
+			indiServers = append(indiServers, indimux.Upstream{Name: profile.Name, Addr: addr})
+			indiDrivers = append(indiDrivers, drivers...)
 		}
+		indiProfile.Name = strings.Join(profileNames, "+")
 	}
 
 	// read token from flag or from config file if exists
@@ -223,23 +494,43 @@ func main() {
 		}
 	}
 
-	// test connect to local INDI-server
-	log.Printf("Test connection to local INDI-Server on %s...\n", indiServerAddr)
-	indiConn, err := net.Dial("tcp", indiServerAddr)
-	if err != nil {
-		log.Fatal(err)
+	// test connect to local INDI-servers
+	for _, indiServer := range indiServers {
+		logger.Infof("Test connection to local INDI-Server on %s...", indiServer.Addr)
+		indiConn, err := net.Dial("tcp", indiServer.Addr)
+		if err != nil {
+			logger.Fatalf("%s", err)
+		}
+		indiConn.Close()
+		logger.Infof("...OK")
+	}
+
+	// several INDI-servers are served as one merged INDI-server to all modes
+	indiServerAddr := indiServers[0].Addr
+	var indiMux *indimux.Mux
+	if len(indiServers) > 1 {
+		indiMux, err = indimux.New(indiServers, flagINDIDuplicates)
+		if err != nil {
+			logger.Fatalf("%s", err)
+		}
+		logger.Infof("Reading devices of %d INDI-servers...", len(indiServers))
+		indiMux.Discover()
+		indiServerAddr, err = indiMux.Listen(flagINDIMuxAddr)
+		if err != nil {
+			logger.Fatalf("could not start merged INDI-server: %s", err)
+		}
+		defer indiMux.Stop()
+		logger.Infof("...OK, merged INDI-server is listening on %s", indiServerAddr)
 	}
-	indiConn.Close()
-	log.Println("...OK")
 
 	if flagPHD2ServerAddr != "" {
-		log.Printf("Test connection to local PHD2-Server on %s...\n", flagPHD2ServerAddr)
+		logger.Infof("Test connection to local PHD2-Server on %s...", flagPHD2ServerAddr)
 		phd2Conn, err := net.Dial("tcp", flagPHD2ServerAddr)
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatalf("%s", err)
 		}
 		phd2Conn.Close()
-		log.Println("...OK")
+		logger.Infof("...OK")
 	}
 
 	// prepare indihub-host data
@@ -256,7 +547,7 @@ func main() {
 		SoloMode:     flagMode == lib.ModeSolo,
 		IsPHD2:       flagPHD2ServerAddr != "",
 		IsRobotic:    flagMode == lib.ModeRobotic,
-		IsBroadcast:  false,
+		IsBroadcast:  false, // broadcast mode registers each of its sessions on its own
 		AgentVersion: version.AgentVersion,
 		Os:           runtime.GOOS,
 		Arch:         runtime.GOARCH,
@@ -273,7 +564,7 @@ func main() {
 		}
 	}
 
-	log.Println("Connecting to the indihub.space cloud...")
+	logger.Infof("Connecting to the indihub.space cloud...")
 	opts := []grpc.DialOption{
 		grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(lib.GRPCMaxSendMsgSize)),
 		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(lib.GRPCMaxRecvMsgSize)),
@@ -294,9 +585,9 @@ func main() {
 		opts...,
 	)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatalf("%s", err)
 	}
-	log.Println("...OK")
+	logger.Infof("...OK")
 	// close grpc client connection at the very end
 	defer conn.Close()
 
@@ -305,13 +596,13 @@ func main() {
 	// register host
 	regInfo, err := indiHubClient.RegisterHost(context.Background(), indiHubHost)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatalf("%s", err)
 	}
 
-	version.CheckAgentVersion(regInfo.AgentVersion)
+	outdated := version.CheckAgentVersion(regInfo.AgentVersion)
 
-	log.Printf("Access token: %s\n", regInfo.Token)
-	log.Printf("Host session token: %s\n", regInfo.SessionIDPublic)
+	logger.Infof("Access token: %s", regInfo.Token)
+	logger.Infof("Host session token: %s", regInfo.SessionIDPublic)
 
 	// create config for new host if flag wasn't provided
 	if flagToken == "" {
@@ -319,14 +610,91 @@ func main() {
 			Token: regInfo.Token,
 		}
 		if err := config.Write(flagConfFile, conf); err != nil {
-			log.Printf("Could not create config file %s: %s", flagConfFile, err)
+			logger.Errorf("Could not create config file %s: %s", flagConfFile, err)
+		}
+	}
+
+	// open INDI traffic recording if requested
+	var rec *recorder.Recorder
+	if flagRecordFile != "" {
+		rec, err = recorder.New(flagRecordFile, flagRecordSkipBLOBs)
+		if err != nil {
+			logger.Fatalf("could not create recording file '%s': %s", flagRecordFile, err)
+		}
+		defer rec.Close()
+		logger.Infof("Recording INDI traffic to %s", flagRecordFile)
+	}
+
+	// open local journal of sessions
+	var sessionJournal *journal.Journal
+	if flagJournalFile != "" {
+		sessionJournal, err = journal.Open(flagJournalFile)
+		if err != nil {
+			logger.Fatalf("could not open session journal '%s': %s", flagJournalFile, err)
+		}
+		defer sessionJournal.Close()
+	}
+
+	// open audit log of commands sent to equipment
+	var auditLog *audit.Log
+	if flagAuditFile != "" {
+		keyFile := flagAuditKeyFile
+		if keyFile == "" {
+			keyFile = flagAuditFile + ".key"
+		}
+		auditKey, err := audit.LoadKey(keyFile)
+		if err != nil {
+			logger.Fatalf("could not load audit log key '%s': %s", keyFile, err)
+		}
+		auditLog, err = audit.Open(flagAuditFile, auditKey)
+		if err != nil {
+			logger.Fatalf("could not open audit log '%s': %s", flagAuditFile, err)
+		}
+		defer auditLog.Close()
+		if _, err := auditLog.Verify(); err != nil {
+			logger.Warnf("Audit log '%s' check failed: %s", flagAuditFile, err)
 		}
 	}
 
+	// INDI filter for guest commands shared by all sharing modes
+	indiFilter := hostutils.NewINDIFilter(&hostutils.INDIFilterConfig{})
+
 	// prepare all modes
 	soloMode := solo.NewMode(indiHubClient, regInfo, indiServerAddr)
 	shareMode := share.NewMode(indiHubClient, regInfo, indiServerAddr, flagPHD2ServerAddr, lib.ModeShare)
 	roboticMode := share.NewMode(indiHubClient, regInfo, indiServerAddr, flagPHD2ServerAddr, lib.ModeRobotic)
+	shareMode.SetRecorder(rec)
+	roboticMode.SetRecorder(rec)
+	shareMode.SetFilter(indiFilter)
+	roboticMode.SetFilter(indiFilter)
+	shareMode.SetAudit(auditLog)
+	roboticMode.SetAudit(auditLog)
+
+	// without shaping flags responses of INDI-server go to tunnel as they are read
+	if flagBLOBRate > 0 || flagSessionBLOBRate > 0 || flagBLOBPolicy != "" {
+		shaping := &proxy.ShapingConfig{
+			BLOBRate:        int64(flagBLOBRate * 1024),
+			SessionBLOBRate: int64(flagSessionBLOBRate * 1024),
+			BLOBPolicy:      flagBLOBPolicy,
+		}
+		logger.Infof("Guest traffic shaping: %v", shaping)
+		shareMode.SetShaping(shaping)
+		roboticMode.SetShaping(shaping)
+	}
+	shareMode.SetMultiplexing(flagGuestMux)
+	roboticMode.SetMultiplexing(flagGuestMux)
+	soloMode.SetJournal(sessionJournal)
+	shareMode.SetJournal(sessionJournal)
+	roboticMode.SetJournal(sessionJournal)
+
+	// latest frames from CCDs to make previews
+	imageStore := images.NewStore()
+	soloMode.SetImageStore(imageStore)
+
+	broadcastMode := broadcast.NewMode(indiHubClient, indiHubHost, regInfo, indiServerAddr, int64(flagBroadcastRate*1024))
+	broadcastMode.SetPHD2Server(flagPHD2ServerAddr)
+	broadcastMode.SetPreviewConverter(fits.NewBLOBConverter(images.DefaultPreviewSize, fits.FormatJPEG))
+	broadcastMode.SetJournal(sessionJournal)
 
 	// start API-server
 	apiServer := apiserver.NewAPIServer(
@@ -339,18 +707,188 @@ func main() {
 		flagMode,
 		flagINDIProfile,
 		map[string]apiserver.AgentMode{
-			lib.ModeSolo:    soloMode,
-			lib.ModeShare:   shareMode,
-			lib.ModeRobotic: roboticMode,
+			lib.ModeSolo:      soloMode,
+			lib.ModeShare:     shareMode,
+			lib.ModeRobotic:   roboticMode,
+			lib.ModeBroadcast: broadcastMode,
 		},
 	)
 
+	apiServer.SetRecorder(rec)
+	if indiMux != nil {
+		apiServer.AddStatusProvider("indiServers", indiMux)
+	}
+	apiServer.SetImageStore(imageStore)
+	apiServer.SetJournal(sessionJournal)
+	apiServer.SetAudit(auditLog)
+	apiServer.SetFilter(indiFilter)
+
+	// start scheduler of sharing sessions
+	var sched *scheduler.Scheduler
+	if flagScheduleFile != "" {
+		sched, err = scheduler.New(flagScheduleFile, apiServer)
+		if err != nil {
+			logger.Fatalf("could not read schedule file '%s': %s", flagScheduleFile, err)
+		}
+		apiServer.SetScheduler(sched)
+		go sched.Run()
+	}
+
+	// start safety supervisor
+	var supervisor *safety.Supervisor
+	if flagSafetyMonitor {
+		supervisor = safety.NewSupervisor(indiServerAddr, flagSafetyHold, apiServer, indiFilter)
+		apiServer.SetModeGate(supervisor.AllowMode)
+		apiServer.AddStatusProvider("safety", supervisor)
+		go supervisor.Run()
+	}
+
+	// start ASCOM Alpaca server
+	var alpacaServer *alpaca.Server
+	if flagAlpaca {
+		alpacaServer = alpaca.NewServer(indiServerAddr, indiFilter)
+		if err := alpacaServer.Listen(flagAlpacaAddr); err != nil {
+			logger.Fatalf("%s", err)
+		}
+		alpacaServer.SetSentHook(apiServer.AuditHook(audit.SourceAlpaca, ""))
+		apiServer.AddStatusProvider("alpaca", alpacaServer)
+		go alpacaServer.Run()
+		go alpacaServer.RunDiscovery()
+	}
+
+	// start MQTT bridge
+	var mqttBridge *mqtt.Bridge
+	if flagMQTTBroker != "" {
+		hostname, _ := os.Hostname()
+		topic := flagMQTTTopic
+		if topic == "" {
+			topic = "indihub/" + mqtt.TopicSegment(hostname)
+		}
+		mqttBridge = mqtt.NewBridge(
+			mqtt.Options{
+				Broker:   flagMQTTBroker,
+				ClientID: "indihub-agent-" + hostname,
+				Username: flagMQTTUsername,
+				Password: flagMQTTPassword,
+			},
+			topic,
+			indiServerAddr,
+			indiFilter,
+		)
+		mqttBridge.SetSentHook(apiServer.AuditHook(audit.SourceMQTT, flagMQTTBroker))
+		apiServer.AddModeListener(mqttBridge.PublishMode)
+		sessionJournal.AddListener(mqttBridge.PublishSession)
+		apiServer.AddStatusProvider("mqtt", mqttBridge)
+		go mqttBridge.Run()
+	}
+
+	// start webhook notifications
+	var notifier *webhook.Notifier
+	if flagWebhooksFile != "" {
+		conf, err := webhook.ReadConfig(flagWebhooksFile)
+		if err != nil {
+			logger.Fatalf("could not read webhooks file '%s': %s", flagWebhooksFile, err)
+		}
+		notifier = webhook.NewNotifier(*conf)
+		notifier.WatchINDIServer(indiServerAddr)
+		apiServer.AddStateListener(func(mode string, state string) {
+			switch state {
+			case apiserver.StateRunning:
+				notifier.Notify(webhook.EventModeStarted, map[string]interface{}{"mode": mode})
+			case apiserver.StateStopped:
+				notifier.Notify(webhook.EventModeStopped, map[string]interface{}{"mode": mode})
+			}
+		})
+		guestListener := func(mode string, info proxy.ConnInfo, connected bool) {
+			event := webhook.EventGuestConnected
+			if !connected {
+				event = webhook.EventGuestDisconnected
+			}
+			notifier.Notify(event, map[string]interface{}{
+				"mode":     mode,
+				"conn":     info.Conn,
+				"started":  info.Started,
+				"bytesIn":  info.BytesIn,
+				"bytesOut": info.BytesOut,
+			})
+		}
+		shareMode.SetGuestListener(guestListener)
+		roboticMode.SetGuestListener(guestListener)
+		tunnelLostListener := func(mode string, err error) {
+			notifier.Notify(webhook.EventTunnelLost, map[string]interface{}{"mode": mode, "error": err.Error()})
+		}
+		shareMode.SetTunnelLostListener(tunnelLostListener)
+		roboticMode.SetTunnelLostListener(tunnelLostListener)
+		broadcastMode.SetTunnelLostListener(tunnelLostListener)
+		soloMode.SetImageListener(func(e *images.Entry) {
+			notifier.Notify(webhook.EventImageCaptured, e)
+		})
+		if outdated {
+			notifier.Notify(webhook.EventVersionOutdated, map[string]interface{}{
+				"version": version.AgentVersion,
+				"latest":  regInfo.AgentVersion,
+			})
+		}
+		apiServer.AddStatusProvider("webhooks", notifier)
+		go notifier.Run()
+	}
+
+	// start Stellarium and LX200 telescope control
+	var telescopeControl *stellarium.Server
+	if flagStellariumPort != 0 || flagLX200Port != 0 {
+		var limits *stellarium.Limits
+		if flagTelescopeMinAlt > -90 || flagTelescopeHorizon != "" {
+			limits = &stellarium.Limits{MinAltitude: flagTelescopeMinAlt}
+		}
+		if flagTelescopeHorizon != "" {
+			horizon, err := stellarium.ParseHorizon(flagTelescopeHorizon)
+			if err != nil {
+				logger.Fatalf("%s", err)
+			}
+			limits.Horizon = horizon
+		}
+		telescopeControl = stellarium.NewServer(
+			stellarium.Config{
+				StellariumPort: flagStellariumPort,
+				LX200Port:      flagLX200Port,
+				Telescope:      flagTelescope,
+				J2000:          flagTelescopeJ2000,
+				Bind:           flagTelescopeBind,
+				Limits:         limits,
+			},
+			indiServerAddr,
+			indiFilter,
+		)
+		if err := telescopeControl.Listen(); err != nil {
+			logger.Fatalf("%s", err)
+		}
+		telescopeControl.SetSentHook(apiServer.AuditHook(audit.SourceTelescope, ""))
+		apiServer.AddStatusProvider("telescopeControl", telescopeControl)
+		go telescopeControl.Run()
+	}
+
 	go func() {
 		sigint := make(chan os.Signal, 1)
 		signal.Notify(sigint, os.Interrupt)
 
 		sig := <-sigint
-		log.Println("Stopping API-server gracefully. OS signal received:", sig)
+		logger.Infof("Stopping API-server gracefully. OS signal received: %v", sig)
+
+		if sched != nil {
+			sched.Stop()
+		}
+		if supervisor != nil {
+			supervisor.Stop()
+		}
+		if alpacaServer != nil {
+			alpacaServer.Stop()
+		}
+		if mqttBridge != nil {
+			mqttBridge.Stop()
+		}
+		if telescopeControl != nil {
+			telescopeControl.Stop()
+		}
 
 		// close connections to local INDI-server
 		apiServer.Stop()
@@ -358,4 +896,57 @@ func main() {
 
 	// start API-server and indihub-agent in the current mode
 	apiServer.Start()
+
+	// deliver events of stopped agent
+	if notifier != nil {
+		notifier.Stop()
+	}
+}
+
+// startINDIProfile makes INDI-profile active via INDI-server Manager and returns INDI-server address with profile data
+func startINDIProfile(managerAddr string, profileName string) (string, *lib.INDIProfile, []*lib.INDIDriver) {
+	indiHost, _, err := net.SplitHostPort(managerAddr)
+	if err != nil {
+		logger.Fatalf("Bad syntax for 'indi-server-manager' parameter, the 'host:port' format is expected")
+	}
+
+	// connect to INDI-server Manager
+	logger.Infof("Connection to local INDI-Server Manager on %s...", managerAddr)
+	managerClient := manager.NewClient(managerAddr)
+	running, currINDIProfile, err := managerClient.GetStatus()
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	logger.Infof("...OK")
+
+	// start required profile if it is not active and running
+	if !running || currINDIProfile != profileName {
+		logger.Infof("Setting active INDI-profile to '%s'", profileName)
+		if err := managerClient.StopServer(); err != nil {
+			logger.Fatalf("%s", err)
+		}
+		if err := managerClient.StartProfile(profileName); err != nil {
+			logger.Fatalf("%s", err)
+		}
+	} else {
+		logger.Infof("INDI-server is running with active INDI-profile '%s'", profileName)
+	}
+
+	// get profile connect data
+	indiProfile, err := managerClient.GetProfile(profileName)
+	if err != nil {
+		logger.Fatalf("could not get INDI-profile from INDI-server manager: %s", err)
+	}
+
+	// get profile drivers data
+	indiDrivers, err := managerClient.GetDrivers()
+	if err != nil {
+		logger.Fatalf("could not get INDI-drivers info from INDI-server manager: %s", err)
+	}
+	logger.Debugf("INDIDrivers:")
+	for _, d := range indiDrivers {
+		logger.Debugf("%+v", *d)
+	}
+
+	return fmt.Sprintf("%s:%d", indiHost, indiProfile.Port), indiProfile, indiDrivers
 }
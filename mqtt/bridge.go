@@ -0,0 +1,430 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/indihub-space/agent/hostutils"
+	"github.com/indihub-space/agent/indiclient"
+	"github.com/indihub-space/agent/journal"
+	"github.com/indihub-space/agent/logutil"
+)
+
+const (
+	reconnectDelay = 10 * time.Second
+
+	// agent topics under prefix, underscore keeps them apart from INDI device names
+	topicStatus  = "_agent/status"
+	topicMode    = "_agent/mode"
+	topicSession = "_agent/session"
+
+	statusOnline  = "online"
+	statusOffline = "offline"
+)
+
+var logger = logutil.New("subsystem", "mqtt")
+
+// PropertyState is JSON payload of retained property topic
+type PropertyState struct {
+	Device    string                 `json:"device"`
+	Property  string                 `json:"property"`
+	Kind      string                 `json:"kind"`
+	Label     string                 `json:"label,omitempty"`
+	Group     string                 `json:"group,omitempty"`
+	State     string                 `json:"state"`
+	Perm      string                 `json:"perm,omitempty"`
+	Timestamp string                 `json:"timestamp,omitempty"`
+	Values    map[string]interface{} `json:"values"`
+}
+
+// CommandResult is JSON payload published to result topic after command from set topic
+type CommandResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type propertyRef struct {
+	device string
+	name   string
+}
+
+// Bridge publishes INDI properties to MQTT broker as retained topics <prefix>/<device>/<property>
+// and sends commands from <prefix>/<device>/<property>/set topics to INDI-server
+type Bridge struct {
+	opts           Options
+	prefix         string
+	indiServerAddr string
+	filter         *hostutils.INDIFilter
+	sentHook       func(cmd []byte)
+
+	mu        sync.Mutex
+	indi      *indiclient.Client
+	topics    map[string]propertyRef // property topic without prefix -> INDI property
+	pending   map[string]*Message
+	queue     []string
+	wake      chan struct{}
+	mode      *Message
+	session   *Message
+	connected bool
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// NewBridge creates MQTT bridge, commands to INDI devices are checked with filter like guest commands
+func NewBridge(opts Options, prefix string, indiServerAddr string, filter *hostutils.INDIFilter) *Bridge {
+	prefix = strings.TrimSuffix(prefix, "/")
+	opts.Will = &Message{
+		Topic:   prefix + "/" + topicStatus,
+		Payload: []byte(statusOffline),
+		Retain:  true,
+	}
+	return &Bridge{
+		opts:           opts,
+		prefix:         prefix,
+		indiServerAddr: indiServerAddr,
+		filter:         filter,
+		topics:         map[string]propertyRef{},
+		pending:        map[string]*Message{},
+		wake:           make(chan struct{}, 1),
+		stopCh:         make(chan struct{}),
+	}
+}
+
+// TopicSegment replaces characters not allowed in topic level
+func TopicSegment(name string) string {
+	if name == "" {
+		return "_"
+	}
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(name)
+}
+
+// SetSentHook sets function called with every command sent to INDI-server, i.e. to write audit log
+func (b *Bridge) SetSentHook(fn func(cmd []byte)) {
+	b.sentHook = fn
+}
+
+// Run keeps connections to MQTT broker and INDI-server until Stop is called
+func (b *Bridge) Run() {
+	for {
+		if err := b.run(); err != nil {
+			logger.Errorf("MQTT bridge error: %s", err)
+		}
+
+		select {
+		case <-b.stopCh:
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// Stop stops bridge
+func (b *Bridge) Stop() {
+	b.stopOnce.Do(func() {
+		close(b.stopCh)
+	})
+}
+
+// GetStatus returns state of bridge to be shown in agent status
+func (b *Bridge) GetStatus() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return map[string]interface{}{
+		"broker":     b.opts.Broker,
+		"topic":      b.prefix,
+		"connected":  b.connected,
+		"properties": len(b.topics),
+	}
+}
+
+// PublishMode publishes agent mode as retained message
+func (b *Bridge) PublishMode(mode string) {
+	msg := b.jsonMessage(topicMode, map[string]interface{}{
+		"mode":      mode,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	}, true)
+
+	b.mu.Lock()
+	b.mode = msg
+	b.mu.Unlock()
+	b.enqueue(msg)
+}
+
+// PublishSession publishes session event as retained message
+func (b *Bridge) PublishSession(event string, rec journal.Record) {
+	msg := b.jsonMessage(topicSession, map[string]interface{}{
+		"event":   event,
+		"session": rec,
+	}, true)
+
+	b.mu.Lock()
+	b.session = msg
+	b.mu.Unlock()
+	b.enqueue(msg)
+}
+
+func (b *Bridge) run() error {
+	indi, err := indiclient.Dial(b.indiServerAddr)
+	if err != nil {
+		return fmt.Errorf("could not connect to INDI-server: %s", err)
+	}
+	defer indi.Close()
+	if b.filter != nil {
+		indi.SetCommandFilter(b.filter.IsAllowed)
+	}
+	indi.SetSentHook(b.sentHook)
+
+	client, err := Dial(b.opts)
+	if err != nil {
+		return fmt.Errorf("could not connect to MQTT broker: %s", err)
+	}
+	defer client.Close()
+	logger.Infof("MQTT bridge is connected to %s", b.opts.Broker)
+
+	// everything is published again for new connection
+	b.mu.Lock()
+	b.indi = indi
+	b.connected = true
+	b.topics = map[string]propertyRef{}
+	b.pending = map[string]*Message{}
+	b.queue = nil
+	mode, session := b.mode, b.session
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.indi = nil
+		b.connected = false
+		b.mu.Unlock()
+	}()
+
+	if err := client.Publish(b.prefix+"/"+topicStatus, []byte(statusOnline), true); err != nil {
+		return err
+	}
+	if mode != nil {
+		b.enqueue(mode)
+	}
+	if session != nil {
+		b.enqueue(session)
+	}
+
+	unsubscribe := indi.Subscribe(b.onINDIMessage)
+	defer unsubscribe()
+	for _, device := range indi.Devices() {
+		for _, v := range indi.Properties(device) {
+			b.publishProperty(v)
+		}
+	}
+
+	if err := client.Subscribe(b.prefix+"/+/+/set", b.onCommand); err != nil {
+		return err
+	}
+
+	go b.writeLoop(client)
+
+	select {
+	case <-b.stopCh:
+		// will message is not sent by broker on graceful disconnect
+		client.Publish(b.prefix+"/"+topicStatus, []byte(statusOffline), true)
+		return nil
+	case <-client.Done():
+		return errors.New("connection to MQTT broker is lost")
+	case <-indi.Done():
+		return errors.New("connection to INDI-server is lost")
+	}
+}
+
+// writeLoop publishes queued messages, only the latest message of each topic is kept in queue
+func (b *Bridge) writeLoop(client *Client) {
+	for {
+		select {
+		case <-client.Done():
+			return
+		case <-b.wake:
+		}
+
+		for {
+			b.mu.Lock()
+			if len(b.queue) == 0 {
+				b.mu.Unlock()
+				break
+			}
+			topic := b.queue[0]
+			b.queue = b.queue[1:]
+			msg := b.pending[topic]
+			delete(b.pending, topic)
+			b.mu.Unlock()
+
+			if err := client.Publish(msg.Topic, msg.Payload, msg.Retain); err != nil {
+				logger.Warnf("could not publish to '%s': %s", msg.Topic, err)
+				return
+			}
+		}
+	}
+}
+
+func (b *Bridge) enqueue(msg *Message) {
+	b.mu.Lock()
+	if _, ok := b.pending[msg.Topic]; !ok {
+		b.queue = append(b.queue, msg.Topic)
+	}
+	b.pending[msg.Topic] = msg
+	b.mu.Unlock()
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (b *Bridge) jsonMessage(topic string, value interface{}, retain bool) *Message {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		logger.Errorf("could not encode MQTT payload for '%s': %s", topic, err)
+		payload = []byte("{}")
+	}
+	return &Message{Topic: b.prefix + "/" + topic, Payload: payload, Retain: retain}
+}
+
+func (b *Bridge) onINDIMessage(msg *indiclient.Message) {
+	if msg.Tag == "delProperty" {
+		b.clearProperties(msg.Device, msg.Name)
+		return
+	}
+	if msg.Vector == nil || strings.HasPrefix(msg.Tag, "new") {
+		return
+	}
+
+	b.mu.Lock()
+	indi := b.indi
+	b.mu.Unlock()
+	if indi == nil {
+		return
+	}
+
+	// set* messages carry changed elements only, so full property is taken from cache
+	if v, ok := indi.Property(msg.Device, msg.Name); ok {
+		b.publishProperty(v)
+	}
+}
+
+func (b *Bridge) publishProperty(v *indiclient.Vector) {
+	// BLOBs are too big for MQTT subscribers like home automation
+	if v.Kind == indiclient.KindBLOB {
+		return
+	}
+
+	state := PropertyState{
+		Device:    v.Device,
+		Property:  v.Name,
+		Kind:      v.Kind,
+		Label:     v.Label,
+		Group:     v.Group,
+		State:     v.State,
+		Perm:      v.Perm,
+		Timestamp: v.Timestamp,
+		Values:    make(map[string]interface{}, len(v.Elements)),
+	}
+	for _, e := range v.Elements {
+		state.Values[e.Name] = e.Value
+		if v.Kind == indiclient.KindNumber {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(e.Value), 64); err == nil {
+				state.Values[e.Name] = f
+			}
+		}
+	}
+
+	topic := TopicSegment(v.Device) + "/" + TopicSegment(v.Name)
+	b.mu.Lock()
+	b.topics[topic] = propertyRef{device: v.Device, name: v.Name}
+	b.mu.Unlock()
+
+	b.enqueue(b.jsonMessage(topic, state, true))
+}
+
+// clearProperties removes retained topics of deleted property or of all device properties
+func (b *Bridge) clearProperties(device string, name string) {
+	b.mu.Lock()
+	cleared := []string{}
+	for topic, ref := range b.topics {
+		if ref.device == device && (name == "" || ref.name == name) {
+			delete(b.topics, topic)
+			cleared = append(cleared, topic)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, topic := range cleared {
+		b.enqueue(&Message{Topic: b.prefix + "/" + topic, Payload: []byte{}, Retain: true})
+	}
+}
+
+// onCommand sends command from set topic to INDI-server, payload is JSON object with element values
+func (b *Bridge) onCommand(msg *Message) {
+	topic := strings.TrimSuffix(strings.TrimPrefix(msg.Topic, b.prefix+"/"), "/set")
+
+	b.mu.Lock()
+	ref, ok := b.topics[topic]
+	indi := b.indi
+	b.mu.Unlock()
+
+	var err error
+	switch {
+	case !ok || indi == nil:
+		err = fmt.Errorf("unknown property '%s'", topic)
+	default:
+		err = b.sendCommand(indi, ref, msg.Payload)
+	}
+
+	result := CommandResult{OK: err == nil}
+	if err != nil {
+		result.Error = err.Error()
+		logger.Warnf("MQTT command to '%s' failed: %s", topic, err)
+	} else {
+		logger.Infof("MQTT command to '%s': %s", topic, msg.Payload)
+	}
+	b.enqueue(b.jsonMessage(topic+"/result", result, false))
+}
+
+func (b *Bridge) sendCommand(indi *indiclient.Client, ref propertyRef, payload []byte) error {
+	v, ok := indi.Property(ref.device, ref.name)
+	if !ok {
+		return indiclient.ErrUnknownProp
+	}
+	if v.Perm == "ro" || v.Kind == indiclient.KindLight || v.Kind == indiclient.KindBLOB {
+		return fmt.Errorf("property %s.%s is read-only", ref.device, ref.name)
+	}
+
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return fmt.Errorf("payload should be JSON object with element values: %s", err)
+	}
+	if len(raw) == 0 {
+		return errors.New("no element values in payload")
+	}
+
+	values := make(map[string]string, len(raw))
+	for name, val := range raw {
+		switch val := val.(type) {
+		case float64:
+			values[name] = strconv.FormatFloat(val, 'f', -1, 64)
+		case bool:
+			values[name] = indiclient.SwitchOff
+			if val {
+				values[name] = indiclient.SwitchOn
+			}
+		case string:
+			values[name] = val
+		default:
+			return fmt.Errorf("bad value of element %s: %v", name, val)
+		}
+	}
+
+	return indi.SetValues(ref.device, ref.name, values)
+}
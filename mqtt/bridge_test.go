@@ -0,0 +1,345 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/indihub-space/agent/hostutils"
+)
+
+const testDefs = `<defNumberVector device="Telescope" name="EQUATORIAL_EOD_COORD" state="Ok" perm="rw">
+<defNumber name="RA" format="%m" min="0" max="24" step="0">1</defNumber>
+<defNumber name="DEC" format="%m" min="-90" max="90" step="0">0</defNumber>
+</defNumberVector>
+`
+
+// fakeBroker is embedded MQTT broker routing QoS 0 messages between its clients, all published messages are kept
+type fakeBroker struct {
+	l net.Listener
+
+	mu        sync.Mutex
+	conns     []net.Conn
+	subs      map[net.Conn][]string
+	published []*Message
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{l: l, subs: map[net.Conn][]string{}}
+	go b.accept()
+	return b
+}
+
+func (b *fakeBroker) url() string {
+	return "tcp://" + b.l.Addr().String()
+}
+
+func (b *fakeBroker) accept() {
+	for {
+		c, err := b.l.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.conns = append(b.conns, c)
+		b.mu.Unlock()
+		go b.serve(c)
+	}
+}
+
+func (b *fakeBroker) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		p, err := readPacket(r)
+		if err != nil {
+			return
+		}
+
+		switch p.typ {
+		case packetConnect:
+			b.write(c, &packet{typ: packetConnAck, body: []byte{0, 0}})
+		case packetSubscribe:
+			filter, _, err := readString(p.body[2:])
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.subs[c] = append(b.subs[c], filter)
+			b.mu.Unlock()
+			b.write(c, &packet{typ: packetSubAck, body: append(p.body[:2:2], 0)})
+		case packetPingReq:
+			b.write(c, &packet{typ: packetPingResp})
+		case packetPublish:
+			msg, _, err := parsePublish(p)
+			if err != nil {
+				return
+			}
+			b.publish(msg)
+		case packetDisconnect:
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) write(c net.Conn, p *packet) {
+	data, _ := p.bytes()
+	c.Write(data)
+}
+
+func (b *fakeBroker) publish(msg *Message) {
+	b.mu.Lock()
+	b.published = append(b.published, msg)
+	receivers := []net.Conn{}
+	for c, filters := range b.subs {
+		for _, filter := range filters {
+			if Match(filter, msg.Topic) {
+				receivers = append(receivers, c)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	for _, c := range receivers {
+		b.write(c, publishPacket(&Message{Topic: msg.Topic, Payload: msg.Payload}))
+	}
+}
+
+// waitMessage waits until message is published to topic and returns its payload
+func (b *fakeBroker) waitMessage(t *testing.T, topic string) []byte {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		b.mu.Lock()
+		for _, msg := range b.published {
+			if msg.Topic == topic {
+				b.mu.Unlock()
+				return msg.Payload
+			}
+		}
+		b.mu.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatalf("nothing is published to %s", topic)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitSubscription waits until some client subscribes with filter
+func (b *fakeBroker) waitSubscription(t *testing.T, filter string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		b.mu.Lock()
+		for _, filters := range b.subs {
+			for _, f := range filters {
+				if f == filter {
+					b.mu.Unlock()
+					return
+				}
+			}
+		}
+		b.mu.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatalf("nobody subscribed to %s", filter)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (b *fakeBroker) close() {
+	b.l.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.conns {
+		c.Close()
+	}
+}
+
+// fakeINDIServer answers getProperties with defs and keeps everything it receives
+type fakeINDIServer struct {
+	l net.Listener
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	received strings.Builder
+}
+
+func newFakeINDIServer(t *testing.T) *fakeINDIServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeINDIServer{l: l}
+	go s.accept()
+	return s
+}
+
+func (s *fakeINDIServer) accept() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, c)
+		s.mu.Unlock()
+		go s.serve(c)
+	}
+}
+
+func (s *fakeINDIServer) serve(c net.Conn) {
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.received.WriteString(line)
+		s.mu.Unlock()
+
+		if strings.HasPrefix(line, "<getProperties") {
+			c.Write([]byte(testDefs))
+		}
+	}
+}
+
+func (s *fakeINDIServer) data() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received.String()
+}
+
+// waitData waits until INDI-server receives all parts
+func (s *fakeINDIServer) waitData(t *testing.T, parts ...string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		data := s.data()
+		received := true
+		for _, part := range parts {
+			received = received && strings.Contains(data, part)
+		}
+		if received {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("INDI-server didn't receive command, got: %s", data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *fakeINDIServer) close() {
+	s.l.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+// startBridge runs bridge and returns MQTT client to publish commands when bridge subscribed to set topics
+func startBridge(t *testing.T, b *Bridge, broker *fakeBroker) (*Client, func()) {
+	done := make(chan struct{})
+	go func() {
+		b.Run()
+		close(done)
+	}()
+	broker.waitSubscription(t, "indihub/+/+/set")
+	broker.waitMessage(t, "indihub/Telescope/EQUATORIAL_EOD_COORD")
+
+	client, err := Dial(Options{Broker: broker.url(), ClientID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, func() {
+		client.Close()
+		b.Stop()
+		<-done
+	}
+}
+
+func waitResult(t *testing.T, broker *fakeBroker, topic string) CommandResult {
+	t.Helper()
+	result := CommandResult{}
+	if err := json.Unmarshal(broker.waitMessage(t, topic), &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestSetTopicSendsCommand(t *testing.T) {
+	broker := newFakeBroker(t)
+	defer broker.close()
+	server := newFakeINDIServer(t)
+	defer server.close()
+
+	b := NewBridge(Options{Broker: broker.url(), ClientID: "agent"}, "indihub/", server.l.Addr().String(), nil)
+	var mu sync.Mutex
+	sent := []string{}
+	b.SetSentHook(func(cmd []byte) {
+		mu.Lock()
+		sent = append(sent, string(cmd))
+		mu.Unlock()
+	})
+	client, stop := startBridge(t, b, broker)
+	defer stop()
+
+	if err := client.Publish("indihub/Telescope/EQUATORIAL_EOD_COORD/set", []byte(`{"RA":7.25}`), false); err != nil {
+		t.Fatal(err)
+	}
+	result := waitResult(t, broker, "indihub/Telescope/EQUATORIAL_EOD_COORD/result")
+	if !result.OK {
+		t.Fatalf("command failed: %s", result.Error)
+	}
+
+	server.waitData(t, `<newNumberVector device="Telescope" name="EQUATORIAL_EOD_COORD"`, `<oneNumber name="RA">7.25</oneNumber>`)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 1 || !strings.Contains(sent[0], "<newNumberVector") {
+		t.Errorf("command is not passed to sent hook: %q", sent)
+	}
+}
+
+func TestSetTopicIsCheckedByFilter(t *testing.T) {
+	broker := newFakeBroker(t)
+	defer broker.close()
+	server := newFakeINDIServer(t)
+	defer server.close()
+
+	filter := hostutils.NewINDIFilter(&hostutils.INDIFilterConfig{})
+	filter.Block(hostutils.BlockSafety, "roof is closed")
+	b := NewBridge(Options{Broker: broker.url(), ClientID: "agent"}, "indihub", server.l.Addr().String(), filter)
+	client, stop := startBridge(t, b, broker)
+	defer stop()
+
+	if err := client.Publish("indihub/Telescope/EQUATORIAL_EOD_COORD/set", []byte(`{"RA":7.25}`), false); err != nil {
+		t.Fatal(err)
+	}
+	result := waitResult(t, broker, "indihub/Telescope/EQUATORIAL_EOD_COORD/result")
+	if result.OK || !strings.Contains(result.Error, "blocked") {
+		t.Errorf("blocked command is not rejected: %+v", result)
+	}
+
+	// commands to unknown properties are rejected by bridge itself
+	if err := client.Publish("indihub/Telescope/UNKNOWN/set", []byte(`{"RA":7.25}`), false); err != nil {
+		t.Fatal(err)
+	}
+	if result := waitResult(t, broker, "indihub/Telescope/UNKNOWN/result"); result.OK {
+		t.Errorf("command to unknown property is not rejected: %+v", result)
+	}
+	if data := server.data(); strings.Contains(data, "<newNumberVector") {
+		t.Fatalf("blocked command is sent to INDI-server: %s", data)
+	}
+}
@@ -0,0 +1,302 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultKeepAlive = 60 * time.Second
+
+	dialTimeout  = 10 * time.Second
+	writeTimeout = 10 * time.Second
+	ackTimeout   = 10 * time.Second
+)
+
+var ErrClosed = errors.New("connection to MQTT broker is closed")
+
+// Message is MQTT application message
+type Message struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+// Options are MQTT connection parameters
+type Options struct {
+	Broker    string // tcp://host:port, ssl://host:port or tls://host:port
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+	Will      *Message // published by broker when connection is lost
+}
+
+type subscription struct {
+	filter  string
+	handler func(*Message)
+}
+
+// Client is minimal MQTT 3.1.1 client publishing with QoS 0 and subscribing with QoS 0
+type Client struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	keepAlive time.Duration
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	subs     []subscription
+	packetID uint16
+	subAcks  map[uint16]chan byte
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Dial connects to MQTT broker
+func Dial(opts Options) (*Client, error) {
+	u, err := url.Parse(opts.Broker)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("bad MQTT broker URL '%s', expected tcp://host:port or ssl://host:port", opts.Broker)
+	}
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		conn, err = net.DialTimeout("tcp", hostPort(u, "1883"), dialTimeout)
+	case "ssl", "tls", "mqtts":
+		conn, err = tls.DialWithDialer(
+			&net.Dialer{Timeout: dialTimeout},
+			"tcp",
+			hostPort(u, "8883"),
+			&tls.Config{ServerName: u.Hostname()},
+		)
+	default:
+		return nil, fmt.Errorf("unsupported MQTT broker scheme '%s'", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keepAlive := opts.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = DefaultKeepAlive
+	}
+
+	c := &Client{
+		conn:      conn,
+		reader:    bufio.NewReader(conn),
+		keepAlive: keepAlive,
+		subAcks:   map[uint16]chan byte{},
+		done:      make(chan struct{}),
+	}
+	if err := c.connect(&opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	go c.readLoop()
+	go c.pingLoop()
+
+	return c, nil
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+func (c *Client) connect(opts *Options) error {
+	if err := c.write(connectPacket(opts, uint16(c.keepAlive/time.Second))); err != nil {
+		return err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(ackTimeout))
+	p, err := readPacket(c.reader)
+	if err != nil {
+		return err
+	}
+	if p.typ != packetConnAck || len(p.body) != 2 {
+		return fmt.Errorf("unexpected MQTT packet type %d instead of CONNACK", p.typ)
+	}
+	if code := p.body[1]; code != 0 {
+		reason, ok := connAckErrors[code]
+		if !ok {
+			reason = fmt.Sprintf("return code %d", code)
+		}
+		return fmt.Errorf("MQTT broker refused connection: %s", reason)
+	}
+	return nil
+}
+
+// Close disconnects from broker
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		c.write(&packet{typ: packetDisconnect})
+		c.conn.Close()
+		close(c.done)
+	})
+}
+
+// Done returns channel closed when connection is lost or closed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Publish sends message to broker with QoS 0
+func (c *Client) Publish(topic string, payload []byte, retain bool) error {
+	return c.write(publishPacket(&Message{Topic: topic, Payload: payload, Retain: retain}))
+}
+
+// Subscribe subscribes to topic filter with wildcards and waits for broker acknowledgement
+func (c *Client) Subscribe(filter string, handler func(*Message)) error {
+	c.mu.Lock()
+	c.packetID++
+	if c.packetID == 0 {
+		c.packetID = 1
+	}
+	id := c.packetID
+	ack := make(chan byte, 1)
+	c.subAcks[id] = ack
+	c.subs = append(c.subs, subscription{filter: filter, handler: handler})
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.subAcks, id)
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(subscribePacket(id, filter)); err != nil {
+		return err
+	}
+
+	select {
+	case code := <-ack:
+		if code == 0x80 {
+			return fmt.Errorf("MQTT broker refused subscription to '%s'", filter)
+		}
+		return nil
+	case <-c.done:
+		return ErrClosed
+	case <-time.After(ackTimeout):
+		return fmt.Errorf("no MQTT subscription acknowledgement for '%s'", filter)
+	}
+}
+
+func (c *Client) write(p *packet) error {
+	data, err := p.bytes()
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := c.conn.Write(data); err != nil {
+		go c.Close()
+		return err
+	}
+	return nil
+}
+
+func (c *Client) readLoop() {
+	defer c.Close()
+
+	for {
+		// broker must answer PINGREQ sent every half of keep-alive period
+		c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		p, err := readPacket(c.reader)
+		if err != nil {
+			return
+		}
+
+		switch p.typ {
+		case packetPublish:
+			msg, id, err := parsePublish(p)
+			if err != nil {
+				return
+			}
+			if id != 0 {
+				c.write(&packet{typ: packetPubAck, body: appendUint16(nil, id)})
+			}
+			c.dispatch(msg)
+
+		case packetSubAck:
+			if len(p.body) < 3 {
+				return
+			}
+			id := uint16(p.body[0])<<8 | uint16(p.body[1])
+			c.mu.Lock()
+			ack, ok := c.subAcks[id]
+			c.mu.Unlock()
+			if ok {
+				ack <- p.body[2]
+			}
+		}
+	}
+}
+
+func (c *Client) dispatch(msg *Message) {
+	c.mu.Lock()
+	subs := append([]subscription{}, c.subs...)
+	c.mu.Unlock()
+
+	for _, sub := range subs {
+		if Match(sub.filter, msg.Topic) {
+			sub.handler(msg)
+		}
+	}
+}
+
+func (c *Client) pingLoop() {
+	ticker := time.NewTicker(c.keepAlive / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.write(&packet{typ: packetPingReq}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Match checks if topic matches filter with + and # wildcards
+func Match(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,185 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	packetConnect      = 1
+	packetConnAck      = 2
+	packetPublish      = 3
+	packetPubAck       = 4
+	packetSubscribe    = 8
+	packetSubAck       = 9
+	packetPingReq      = 12
+	packetPingResp     = 13
+	packetDisconnect   = 14
+	maxRemainingLen    = 268435455
+	protocolLevel311   = 4
+	connFlagUsername   = 0x80
+	connFlagPassword   = 0x40
+	connFlagWillRetain = 0x20
+	connFlagWill       = 0x04
+	connFlagClean      = 0x02
+	publishFlagRetain  = 0x01
+	publishFlagQoS     = 0x06
+)
+
+var connAckErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+var errMalformed = errors.New("malformed MQTT packet")
+
+// packet is MQTT control packet with its fixed header split to type and flags
+type packet struct {
+	typ   byte
+	flags byte
+	body  []byte
+}
+
+func readPacket(r *bufio.Reader) (*packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length := 0
+	for shift := uint(0); ; shift += 7 {
+		if shift > 21 {
+			return nil, errMalformed
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &packet{typ: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+func (p *packet) bytes() ([]byte, error) {
+	length := len(p.body)
+	if length > maxRemainingLen {
+		return nil, fmt.Errorf("MQTT packet is too big: %d bytes", length)
+	}
+
+	buf := []byte{p.typ<<4 | p.flags}
+	for {
+		b := byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(buf, p.body...), nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+func appendUint16(buf []byte, n uint16) []byte {
+	return append(buf, byte(n>>8), byte(n))
+}
+
+func readString(body []byte) (string, []byte, error) {
+	if len(body) < 2 {
+		return "", nil, errMalformed
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return "", nil, errMalformed
+	}
+	return string(body[2 : 2+n]), body[2+n:], nil
+}
+
+func connectPacket(opts *Options, keepAlive uint16) *packet {
+	flags := byte(connFlagClean)
+	if opts.Username != "" {
+		flags |= connFlagUsername
+	}
+	if opts.Password != "" {
+		flags |= connFlagPassword
+	}
+	if opts.Will != nil {
+		flags |= connFlagWill
+		if opts.Will.Retain {
+			flags |= connFlagWillRetain
+		}
+	}
+
+	body := appendString(nil, "MQTT")
+	body = append(body, protocolLevel311, flags)
+	body = appendUint16(body, keepAlive)
+	body = appendString(body, opts.ClientID)
+	if opts.Will != nil {
+		body = appendString(body, opts.Will.Topic)
+		body = appendUint16(body, uint16(len(opts.Will.Payload)))
+		body = append(body, opts.Will.Payload...)
+	}
+	if opts.Username != "" {
+		body = appendString(body, opts.Username)
+	}
+	if opts.Password != "" {
+		body = appendString(body, opts.Password)
+	}
+	return &packet{typ: packetConnect, body: body}
+}
+
+func publishPacket(msg *Message) *packet {
+	p := &packet{typ: packetPublish}
+	if msg.Retain {
+		p.flags |= publishFlagRetain
+	}
+	p.body = appendString(nil, msg.Topic)
+	p.body = append(p.body, msg.Payload...)
+	return p
+}
+
+// parsePublish returns message and packet ID which is not 0 for QoS 1 and 2 messages
+func parsePublish(p *packet) (*Message, uint16, error) {
+	topic, rest, err := readString(p.body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var id uint16
+	if p.flags&publishFlagQoS != 0 {
+		if len(rest) < 2 {
+			return nil, 0, errMalformed
+		}
+		id = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	return &Message{Topic: topic, Payload: rest, Retain: p.flags&publishFlagRetain != 0}, id, nil
+}
+
+func subscribePacket(id uint16, filter string) *packet {
+	body := appendUint16(nil, id)
+	body = appendString(body, filter)
+	body = append(body, 0)
+	return &packet{typ: packetSubscribe, flags: 0x02, body: body}
+}
@@ -84,6 +84,7 @@ type Response struct {
 	Conn                 uint32   `protobuf:"varint,2,opt,name=conn,proto3" json:"conn,omitempty"`
 	SessionID            uint64   `protobuf:"varint,3,opt,name=sessionID,proto3" json:"sessionID,omitempty"`
 	SessionToken         string   `protobuf:"bytes,4,opt,name=sessionToken,proto3" json:"sessionToken,omitempty"`
+	Closed               bool     `protobuf:"varint,5,opt,name=closed,proto3" json:"closed,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -142,6 +143,13 @@ func (m *Response) GetSessionToken() string {
 	return ""
 }
 
+func (m *Response) GetClosed() bool {
+	if m != nil {
+		return m.Closed
+	}
+	return false
+}
+
 type INDIProfile struct {
 	Id                   uint32   `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
 	Name                 string   `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
@@ -534,44 +542,45 @@ func init() {
 func init() { proto.RegisterFile("indihub.proto", fileDescriptor_84cfc05744c754a5) }
 
 var fileDescriptor_84cfc05744c754a5 = []byte{
-	// 592 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x54, 0x41, 0x6b, 0xdb, 0x4c,
-	0x10, 0x8d, 0x14, 0x27, 0x96, 0xd6, 0xf6, 0xf7, 0xc1, 0x52, 0x8a, 0x08, 0x3d, 0x18, 0x41, 0x5b,
-	0x5d, 0x2a, 0x8a, 0xfb, 0x03, 0x0a, 0xc5, 0x87, 0xf8, 0xd0, 0x10, 0xd6, 0xa5, 0xf7, 0x95, 0xb4,
-	0x49, 0x96, 0x4a, 0x1a, 0x77, 0x77, 0x15, 0xc8, 0x0f, 0xe8, 0xbd, 0x3f, 0xa4, 0xf4, 0xd2, 0x3f,
-	0x58, 0x66, 0xb4, 0xb6, 0xe4, 0x84, 0x42, 0x6e, 0xf3, 0xde, 0x2e, 0x9a, 0x79, 0x6f, 0xde, 0x8a,
-	0x2d, 0x74, 0x5b, 0xe9, 0xbb, 0xae, 0xc8, 0x77, 0x06, 0x1c, 0xa4, 0x1b, 0x36, 0x15, 0xea, 0x7b,
-	0xa7, 0xac, 0xe3, 0x9c, 0x4d, 0x2a, 0xe9, 0x64, 0x12, 0x2c, 0x83, 0x6c, 0x2e, 0xa8, 0x46, 0xae,
-	0x84, 0xb6, 0x4d, 0xc2, 0x65, 0x90, 0x2d, 0x04, 0xd5, 0xfc, 0x25, 0x3b, 0x2f, 0x6b, 0xb0, 0xaa,
-	0x4a, 0x4e, 0x97, 0x41, 0x16, 0x09, 0x8f, 0x52, 0xc7, 0x22, 0xa1, 0xec, 0x0e, 0x5a, 0xab, 0x9e,
-	0xfd, 0xad, 0x57, 0x2c, 0xb6, 0xca, 0x5a, 0x0d, 0xed, 0x66, 0x4d, 0x9f, 0x9b, 0x88, 0x81, 0xe0,
-	0x29, 0x9b, 0x7b, 0xf0, 0x05, 0xbe, 0xa9, 0x36, 0x99, 0x2c, 0x83, 0x2c, 0x16, 0x47, 0x5c, 0xfa,
-	0x23, 0x60, 0xb3, 0xcd, 0xd5, 0x7a, 0x73, 0x6d, 0xe0, 0x46, 0xd7, 0x8a, 0xff, 0xc7, 0x42, 0x5d,
-	0x51, 0xdf, 0x85, 0x08, 0x75, 0x85, 0x5d, 0x5b, 0xd9, 0x28, 0xea, 0x1a, 0x0b, 0xaa, 0x91, 0xdb,
-	0x81, 0x71, 0xd4, 0x70, 0x21, 0xa8, 0xc6, 0x49, 0x64, 0xe7, 0xc0, 0x3a, 0x69, 0x1c, 0x35, 0x5a,
-	0x88, 0x81, 0xe0, 0x4b, 0x36, 0x43, 0x80, 0x33, 0xab, 0xd2, 0x25, 0x67, 0x74, 0x3e, 0xa6, 0xd2,
-	0x5f, 0x01, 0x63, 0x38, 0xc7, 0xda, 0xe8, 0x7b, 0x65, 0xd0, 0xa4, 0x42, 0xb7, 0xd2, 0x3c, 0xd0,
-	0x28, 0xb1, 0xf0, 0x08, 0xf9, 0x1b, 0xd9, 0xe8, 0xfa, 0xc1, 0x0f, 0xe4, 0x11, 0x7f, 0xc1, 0xce,
-	0x6a, 0x59, 0xa8, 0x9a, 0x66, 0x8a, 0x45, 0x0f, 0x78, 0xc2, 0xa6, 0xf7, 0xca, 0xa0, 0x58, 0xaf,
-	0x7d, 0x0f, 0x51, 0x82, 0x81, 0x5a, 0xd1, 0x24, 0xb1, 0xa0, 0x9a, 0x16, 0xd3, 0x59, 0x07, 0x4d,
-	0x72, 0xee, 0x17, 0x43, 0xe8, 0x60, 0xc1, 0x74, 0xb0, 0x20, 0xfd, 0x1d, 0xf6, 0xb6, 0x5d, 0x76,
-	0xc5, 0x25, 0x58, 0x87, 0xfd, 0x1d, 0x79, 0xdc, 0x8f, 0xdb, 0x03, 0xfe, 0x86, 0x4d, 0x77, 0xbd,
-	0xaf, 0x34, 0xee, 0x6c, 0x35, 0xcf, 0x47, 0x5e, 0x8b, 0xfd, 0x21, 0x7f, 0xcd, 0xa6, 0x15, 0xe9,
-	0xb6, 0xc9, 0xe9, 0xf2, 0x34, 0x9b, 0xad, 0x66, 0xf9, 0xe0, 0x85, 0xd8, 0x9f, 0xf1, 0x0b, 0x16,
-	0x59, 0xa8, 0xe1, 0x33, 0x54, 0x8a, 0xf4, 0x44, 0xe2, 0x80, 0x71, 0x78, 0x6d, 0xaf, 0x2f, 0xd7,
-	0x2b, 0x92, 0x14, 0x09, 0x8f, 0x70, 0x2f, 0xda, 0x0a, 0x28, 0xc0, 0xe9, 0xd2, 0xeb, 0x1a, 0x08,
-	0x4c, 0x88, 0xbc, 0x55, 0xad, 0xfb, 0xea, 0x5d, 0xea, 0x25, 0x1e, 0x71, 0x98, 0x08, 0xb0, 0x49,
-	0x44, 0x27, 0x21, 0x58, 0xb4, 0x43, 0x9a, 0xf2, 0x2e, 0x89, 0x7b, 0x3b, 0xb0, 0xc6, 0xfd, 0x6a,
-	0xfb, 0xc9, 0x80, 0xac, 0x4a, 0x69, 0x5d, 0xc2, 0xa8, 0xcf, 0x98, 0x4a, 0x7f, 0x06, 0x6c, 0x2e,
-	0xd4, 0xad, 0xb6, 0x4e, 0x99, 0x4d, 0x7b, 0x03, 0xff, 0x70, 0xec, 0x28, 0xd0, 0xe1, 0xe3, 0x40,
-	0x67, 0xec, 0xff, 0x03, 0xb8, 0xee, 0x8a, 0x5a, 0x97, 0x7e, 0xdf, 0x8f, 0xe9, 0x27, 0xc2, 0x26,
-	0x4f, 0x85, 0xa5, 0x1f, 0xd9, 0x6c, 0x0b, 0x35, 0x6c, 0xbb, 0xa6, 0xc1, 0x68, 0xa1, 0x53, 0x8d,
-	0xbc, 0x55, 0xf6, 0xaa, 0x6b, 0x68, 0xa8, 0x89, 0x18, 0x88, 0xc3, 0x8b, 0x0c, 0x87, 0x17, 0xb9,
-	0xfa, 0x13, 0xb0, 0xa9, 0x0f, 0x01, 0x7f, 0x37, 0xc8, 0xa3, 0x40, 0xf4, 0x9b, 0xf6, 0xf1, 0xb8,
-	0x58, 0xe4, 0x63, 0xed, 0xe9, 0x09, 0x7f, 0xdb, 0xa7, 0x7d, 0xab, 0x0c, 0xa6, 0x3d, 0xce, 0xf7,
-	0x2f, 0xff, 0x22, 0xca, 0xfd, 0xff, 0x24, 0x3d, 0xc9, 0x82, 0xf7, 0x01, 0x5e, 0xc4, 0x3d, 0x3e,
-	0xe7, 0x62, 0xb4, 0xdd, 0x87, 0x61, 0x74, 0x6d, 0x9e, 0x8f, 0x34, 0xe2, 0xd5, 0xe2, 0x9c, 0xfe,
-	0x5c, 0x1f, 0xfe, 0x06, 0x00, 0x00, 0xff, 0xff, 0x92, 0x4a, 0x3d, 0x07, 0xca, 0x04, 0x00, 0x00,
+	// 593 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x54, 0xc1, 0x6a, 0xdb, 0x40,
+	0x14, 0x8c, 0x14, 0x27, 0x96, 0xd6, 0x56, 0x0b, 0x4b, 0x29, 0x22, 0xf4, 0x60, 0x04, 0x6d, 0x75,
+	0xa9, 0x28, 0xee, 0x07, 0x14, 0x8a, 0x0f, 0xf1, 0xa1, 0x21, 0xac, 0x4b, 0xef, 0x2b, 0x69, 0xe3,
+	0x2c, 0x95, 0xf4, 0xdc, 0xdd, 0x55, 0x20, 0x1f, 0xd0, 0x5b, 0x0f, 0xfd, 0x90, 0xd2, 0x4b, 0x7f,
+	0xb0, 0xbc, 0x27, 0xd9, 0x92, 0x13, 0x0a, 0xb9, 0xbd, 0x19, 0x2d, 0xd2, 0xcc, 0xbc, 0xd1, 0xb2,
+	0x48, 0x37, 0xa5, 0xbe, 0x6d, 0xf3, 0x6c, 0x67, 0xc0, 0x41, 0xb2, 0x66, 0x53, 0xa1, 0xbe, 0xb7,
+	0xca, 0x3a, 0xce, 0xd9, 0xa4, 0x94, 0x4e, 0xc6, 0xde, 0xc2, 0x4b, 0xe7, 0x82, 0x66, 0xe4, 0x0a,
+	0x68, 0x9a, 0xd8, 0x5f, 0x78, 0x69, 0x24, 0x68, 0xe6, 0x2f, 0xd9, 0x79, 0x51, 0x81, 0x55, 0x65,
+	0x7c, 0xba, 0xf0, 0xd2, 0x40, 0xf4, 0x28, 0xf9, 0xe9, 0xb1, 0x40, 0x28, 0xbb, 0x83, 0xc6, 0xaa,
+	0x27, 0xbf, 0xec, 0x15, 0x0b, 0xad, 0xb2, 0x56, 0x43, 0xb3, 0x5e, 0xd1, 0xfb, 0x26, 0x62, 0x20,
+	0x78, 0xc2, 0xe6, 0x3d, 0xf8, 0x02, 0xdf, 0x54, 0x13, 0x4f, 0x16, 0x5e, 0x1a, 0x8a, 0x23, 0x6e,
+	0x24, 0xe7, 0xec, 0x48, 0xce, 0x0f, 0x8f, 0xcd, 0xd6, 0x57, 0xab, 0xf5, 0xb5, 0x81, 0x1b, 0x5d,
+	0x29, 0xfe, 0x8c, 0xf9, 0xba, 0x24, 0x3d, 0x91, 0xf0, 0x75, 0x89, 0x6a, 0x1a, 0x59, 0x2b, 0x52,
+	0x13, 0x0a, 0x9a, 0x91, 0xdb, 0x81, 0x71, 0x24, 0x24, 0x12, 0x34, 0xa3, 0x42, 0xd9, 0x3a, 0xb0,
+	0x4e, 0x1a, 0x47, 0x02, 0x22, 0x31, 0x10, 0x7c, 0xc1, 0x66, 0x08, 0xd0, 0x8b, 0x2a, 0x1c, 0x49,
+	0x88, 0xc4, 0x98, 0x4a, 0x7e, 0x7b, 0x8c, 0xa1, 0x8e, 0x95, 0xd1, 0x77, 0xca, 0xa0, 0xdc, 0x5c,
+	0x37, 0xd2, 0xdc, 0x93, 0x94, 0x50, 0xf4, 0x08, 0xf9, 0x1b, 0x59, 0xeb, 0xea, 0xbe, 0x17, 0xd4,
+	0x23, 0xfe, 0x82, 0x9d, 0x55, 0x32, 0x57, 0x15, 0x69, 0x0a, 0x45, 0x07, 0x78, 0xcc, 0xa6, 0x77,
+	0xca, 0x60, 0x08, 0x7d, 0x26, 0x7b, 0x88, 0x16, 0x0c, 0x54, 0x8a, 0x94, 0x84, 0x82, 0x66, 0x8a,
+	0xa8, 0xb5, 0x0e, 0xea, 0xf8, 0xbc, 0x8f, 0x88, 0xd0, 0x21, 0x82, 0xe9, 0x10, 0x41, 0xf2, 0xc7,
+	0xef, 0x62, 0xbb, 0x6c, 0xf3, 0x4b, 0xb0, 0x0e, 0xbf, 0xef, 0x28, 0xfb, 0x4e, 0x6e, 0x07, 0xf8,
+	0x1b, 0x36, 0xdd, 0x75, 0xb9, 0x92, 0xdc, 0xd9, 0x72, 0x9e, 0x8d, 0xb2, 0x16, 0xfb, 0x87, 0xfc,
+	0x35, 0x9b, 0x96, 0xe4, 0xdb, 0xc6, 0xa7, 0x8b, 0xd3, 0x74, 0xb6, 0x9c, 0x65, 0x43, 0x16, 0x62,
+	0xff, 0x8c, 0x5f, 0xb0, 0xc0, 0x42, 0x05, 0x9f, 0xa1, 0x54, 0xe4, 0x27, 0x10, 0x07, 0x8c, 0xe2,
+	0xb5, 0xbd, 0xbe, 0x5c, 0x2d, 0xf7, 0xfb, 0xed, 0x10, 0xee, 0x45, 0x5b, 0x01, 0x39, 0x38, 0x5d,
+	0xf4, 0xbe, 0x06, 0x02, 0x9b, 0x23, 0xb7, 0xaa, 0x71, 0x5f, 0xfb, 0x94, 0x3a, 0x8b, 0x47, 0x1c,
+	0x36, 0x02, 0x6c, 0x1c, 0xd0, 0x13, 0x1f, 0x2c, 0xc6, 0x21, 0x4d, 0x71, 0x1b, 0x87, 0x5d, 0x1c,
+	0x38, 0xe3, 0x7e, 0xb5, 0xfd, 0x64, 0x40, 0x96, 0x85, 0xb4, 0x2e, 0x66, 0xf4, 0x9d, 0x31, 0x95,
+	0xfc, 0xf2, 0xd8, 0x5c, 0xa8, 0xad, 0xb6, 0x4e, 0x99, 0x75, 0x73, 0x03, 0xff, 0x49, 0xec, 0xa8,
+	0xe8, 0xfe, 0xc3, 0xa2, 0xa7, 0xec, 0xf9, 0x01, 0x5c, 0xb7, 0x79, 0xa5, 0x8b, 0x7e, 0xdf, 0x0f,
+	0xe9, 0x47, 0xc6, 0x26, 0x8f, 0x8d, 0x25, 0x1f, 0xd9, 0x6c, 0x03, 0x15, 0x6c, 0xda, 0xba, 0xc6,
+	0x6a, 0x61, 0x52, 0xb5, 0xdc, 0x2a, 0x7b, 0xd5, 0xd6, 0x24, 0x6a, 0x22, 0x06, 0xe2, 0xf0, 0xa7,
+	0xfa, 0xc3, 0x9f, 0xba, 0xfc, 0xeb, 0xb1, 0x69, 0x5f, 0x02, 0xfe, 0x6e, 0xb0, 0x47, 0x85, 0x98,
+	0x67, 0xa3, 0x7a, 0x5c, 0x44, 0xd9, 0xd8, 0x7b, 0x72, 0xc2, 0xdf, 0x76, 0x6d, 0xdf, 0x28, 0x83,
+	0x6d, 0x0f, 0xb3, 0xfd, 0x8d, 0x70, 0x11, 0x64, 0xfd, 0x45, 0x93, 0x9c, 0xa4, 0xde, 0x7b, 0x0f,
+	0x0f, 0xe2, 0x1e, 0x9f, 0x72, 0x30, 0xd8, 0xec, 0xcb, 0x30, 0x3a, 0x36, 0xcf, 0x46, 0x1e, 0xf1,
+	0x68, 0x7e, 0x4e, 0x57, 0xda, 0x87, 0x7f, 0x03, 0x00, 0xc6, 0x25, 0x47, 0xd6, 0xe3, 0x04, 0x00,
+	0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/indihub-space/agent/audit"
+	"github.com/indihub-space/agent/lib"
+)
+
+// SetAudit enables audit log of guest commands, mode is written to every entry
+func (p *TcpProxy) SetAudit(log *audit.Log, mode string) {
+	p.audit = log
+	p.mode = mode
+}
+
+// filterCommands drops guest commands denied by INDI filter and applies host BLOB policy,
+// every command is recorded to audit log with the decision
+func (p *TcpProxy) filterCommands(cNum uint32, sessionID uint64, cmds [][]byte) [][]byte {
+	allowed := cmds[:0]
+	for _, cmd := range cmds {
+		entry := audit.Entry{
+			Source:    audit.SourceTunnel,
+			Client:    fmt.Sprint(cNum),
+			Mode:      p.mode,
+			SessionID: sessionID,
+			Decision:  audit.Allowed,
+		}
+
+		if p.filter != nil {
+			if ok, reason := p.filter.Check(cmd); !ok {
+				p.log.With("conn", cNum).Infof("Command to %s.%s blocked: %s",
+					lib.ElementAttr(cmd, "device"), lib.ElementAttr(cmd, "name"), reason)
+				entry.Decision = audit.Denied
+				entry.Reason = reason
+				p.audit.Record(entry, cmd)
+				continue
+			}
+		}
+
+		if rewritten := p.rewriteEnableBLOB(cmd); !bytes.Equal(rewritten, cmd) {
+			entry.Decision = audit.Rewritten
+			entry.Reason = fmt.Sprintf("BLOB policy '%s' downgraded to '%s'", BLOBPolicyAlso, p.shaping.BLOBPolicy)
+			cmd = rewritten
+		}
+		p.audit.Record(entry, cmd)
+
+		allowed = append(allowed, cmd)
+	}
+	return allowed
+}
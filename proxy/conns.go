@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/indihub-space/agent/lib"
+	"github.com/indihub-space/agent/proto/indihub"
+)
+
+// max number of commands buffered for paused connection, older ones are dropped
+const maxPausedCommands = 1024
+
+var ErrUnknownConn = errors.New("unknown connection")
+
+// ConnInfo describes guest connection going via tunnel
+type ConnInfo struct {
+	Conn            uint32    `json:"conn"`
+	Started         time.Time `json:"started"`
+	BytesIn         uint64    `json:"bytesIn"`  // from guest to local server
+	BytesOut        uint64    `json:"bytesOut"` // from local server to guest
+	LastCommand     string    `json:"lastCommand"`
+	LastCommandTime time.Time `json:"lastCommandTime,omitempty"`
+	Devices         []string  `json:"devices"`
+	Paused          bool      `json:"paused"`
+	DropPaused      bool      `json:"dropPaused,omitempty"`
+	Buffered        int       `json:"buffered,omitempty"`
+}
+
+type connState struct {
+	info      ConnInfo
+	devices   map[string]bool
+	buffered  [][]byte
+	handshake handshake
+	kicked    bool
+}
+
+func (p *TcpProxy) getConnState(cNum uint32) *connState {
+	state, ok := p.connStates[cNum]
+	if !ok {
+		state = &connState{
+			info: ConnInfo{
+				Conn:    cNum,
+				Started: time.Now(),
+			},
+			devices: map[string]bool{},
+		}
+		p.connStates[cNum] = state
+		p.session.AddGuestConnection()
+		if p.guestListener != nil {
+			p.guestListener(state.info, true)
+		}
+	}
+	return state
+}
+
+// trackIncoming counts guest traffic and returns false if connection was closed by host
+func (p *TcpProxy) trackIncoming(cNum uint32, n int) bool {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+
+	state := p.getConnState(cNum)
+	state.info.BytesIn += uint64(n)
+	p.session.AddBytes(n, 0)
+	return !state.kicked
+}
+
+func (p *TcpProxy) trackOutgoing(cNum uint32, n int) {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+
+	if state, ok := p.connStates[cNum]; ok {
+		state.info.BytesOut += uint64(n)
+	}
+	p.session.AddBytes(0, n)
+}
+
+func (p *TcpProxy) forgetConn(cNum uint32) {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+
+	state, ok := p.connStates[cNum]
+	if !ok {
+		return
+	}
+	delete(p.connStates, cNum)
+	if p.guestListener != nil {
+		p.guestListener(state.info, false)
+	}
+}
+
+// holdCommands records guest commands and keeps them from local server if connection is paused
+func (p *TcpProxy) holdCommands(cNum uint32, commands [][]byte) [][]byte {
+	if len(commands) == 0 {
+		return commands
+	}
+
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+
+	state := p.getConnState(cNum)
+	for _, cmd := range commands {
+		tag := lib.ElementTag(cmd)
+		device := lib.ElementAttr(cmd, "device")
+		state.info.LastCommand = tag
+		if device != "" {
+			state.info.LastCommand += " " + device
+			if name := lib.ElementAttr(cmd, "name"); name != "" {
+				state.info.LastCommand += "." + name
+			}
+			state.devices[device] = true
+		}
+		state.info.LastCommandTime = time.Now()
+	}
+
+	if !state.info.Paused {
+		return commands
+	}
+
+	if !state.info.DropPaused {
+		for _, cmd := range commands {
+			// commands are re-used by XML flattener so keep copies
+			state.buffered = append(state.buffered, append([]byte{}, cmd...))
+		}
+		if len(state.buffered) > maxPausedCommands {
+			state.buffered = state.buffered[len(state.buffered)-maxPausedCommands:]
+		}
+	}
+
+	return nil
+}
+
+// Connections returns info about all guest connections
+func (p *TcpProxy) Connections() []ConnInfo {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+
+	conns := make([]ConnInfo, 0, len(p.connStates))
+	for _, state := range p.connStates {
+		if state.kicked {
+			continue
+		}
+		info := state.info
+		info.Devices = make([]string, 0, len(state.devices))
+		for device := range state.devices {
+			info.Devices = append(info.Devices, device)
+		}
+		sort.Strings(info.Devices)
+		info.Buffered = len(state.buffered)
+		conns = append(conns, info)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Conn < conns[j].Conn
+	})
+
+	return conns
+}
+
+// PauseConn stops passing guest commands to local server, commands are buffered or dropped
+func (p *TcpProxy) PauseConn(cNum uint32, drop bool) error {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+
+	state, ok := p.connStates[cNum]
+	if !ok || state.kicked {
+		return ErrUnknownConn
+	}
+	state.info.Paused = true
+	state.info.DropPaused = drop
+	if drop {
+		state.buffered = nil
+	}
+	p.log.With("conn", cNum).Infof("connection paused")
+
+	return nil
+}
+
+// ResumeConn sends buffered commands of paused connection to local server and resumes it,
+// connection stays paused while buffered commands are sent, so new guest commands don't overtake them
+func (p *TcpProxy) ResumeConn(cNum uint32) error {
+	log := p.log.With("conn", cNum)
+	for {
+		p.connMu.Lock()
+		state, ok := p.connStates[cNum]
+		if !ok || state.kicked {
+			p.connMu.Unlock()
+			return ErrUnknownConn
+		}
+		buffered := state.buffered
+		state.buffered = nil
+		if len(buffered) == 0 {
+			state.info.Paused = false
+			state.info.DropPaused = false
+			p.connMu.Unlock()
+			break
+		}
+		m := p.mux
+		c := p.connMap[cNum]
+		p.connMu.Unlock()
+
+		// commands are sent without lock, so slow local server doesn't block other connections
+		if m != nil {
+			// mux sends elements to guest which needs connMu
+			m.commands(cNum, buffered)
+			continue
+		}
+		if c == nil {
+			continue
+		}
+		for _, cmd := range buffered {
+			if _, err := c.Write(cmd); err != nil {
+				log.Errorf("could not send buffered command: %s", err)
+				break
+			}
+			p.recordHandshake(cNum, cmd)
+		}
+	}
+	log.Infof("connection resumed")
+
+	return nil
+}
+
+// CloseConn sends message to guest, closes guest connection in the tunnel and connection to local server,
+// all further guest traffic is dropped
+func (p *TcpProxy) CloseConn(cNum uint32, message string) error {
+	p.connMu.Lock()
+	state, ok := p.connStates[cNum]
+	if !ok || state.kicked {
+		p.connMu.Unlock()
+		return ErrUnknownConn
+	}
+	p.connMu.Unlock()
+
+	if message != "" {
+		p.sendMessageTo(message, cNum)
+	}
+
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+
+	state.kicked = true
+	state.buffered = nil
+	if c, ok := p.connMap[cNum]; ok {
+		c.Close()
+		delete(p.connMap, cNum)
+	}
+	if p.mux != nil {
+		p.mux.removeGuest(cNum)
+	}
+	// the cloud closes guest connection and answers with closed request, so state is forgotten then
+	if p.respCh != nil {
+		resp := p.respPool.Get().(*indihub.Response)
+		resp.Conn = cNum
+		resp.SessionID = p.sessionID
+		resp.SessionToken = p.sessionToken
+		resp.Data = resp.Data[:0]
+		resp.Closed = true
+		p.respCh <- resp
+	}
+	p.log.With("conn", cNum).Infof("connection closed by host")
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testNew = `<newNumberVector device="Telescope" name="EQUATORIAL_EOD_COORD"><oneNumber name="RA">%s</oneNumber></newNumberVector>`
+
+func newNumber(ra string) string {
+	return strings.Replace(testNew, "%s", ra, 1)
+}
+
+// waitConn waits until info of guest connection satisfies cond
+func waitConn(t *testing.T, p *TcpProxy, cNum uint32, cond func(info ConnInfo) bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		for _, info := range p.Connections() {
+			if info.Conn == cNum && cond(info) {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected connections: %+v", p.Connections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPauseAndResumeConn(t *testing.T) {
+	server := newFakeINDIServer(t, testDefs)
+	defer server.close()
+	tunnel := newFakeTunnel()
+	p := New("INDI-Server", server.addr(), tunnel, nil)
+	cancel, _ := startProxy(t, p, tunnel)
+	defer cancel()
+
+	tunnel.send(1, "<getProperties version=\"1.7\"/>\n")
+	tunnel.waitReceived(t, 1, "defNumberVector")
+
+	if err := p.PauseConn(1, false); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.send(1, newNumber("1")+"\n"+newNumber("2")+"\n")
+	waitConn(t, p, 1, func(info ConnInfo) bool {
+		return info.Paused && info.Buffered == 2 && info.LastCommand == "newNumberVector Telescope.EQUATORIAL_EOD_COORD"
+	})
+	for _, line := range server.received() {
+		if strings.HasPrefix(line, "<newNumberVector") {
+			t.Fatalf("command of paused connection is sent: %s", line)
+		}
+	}
+
+	if err := p.ResumeConn(1); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.send(1, newNumber("3")+"\n")
+	server.waitLine(t, newNumber("3"))
+	// buffered commands are sent before new ones
+	commands := []string{}
+	for _, line := range server.received() {
+		if strings.HasPrefix(line, "<newNumberVector") {
+			commands = append(commands, line)
+		}
+	}
+	if strings.Join(commands, "\n") != strings.Join([]string{newNumber("1"), newNumber("2"), newNumber("3")}, "\n") {
+		t.Errorf("unexpected commands: %q", commands)
+	}
+	waitConn(t, p, 1, func(info ConnInfo) bool {
+		return !info.Paused && info.Buffered == 0
+	})
+
+	// dropped commands are not sent after resume
+	if err := p.PauseConn(1, true); err != nil {
+		t.Fatal(err)
+	}
+	// last command is recorded together with dropping it
+	last := p.Connections()[0].LastCommandTime
+	tunnel.send(1, newNumber("4")+"\n")
+	waitConn(t, p, 1, func(info ConnInfo) bool {
+		return info.DropPaused && info.LastCommandTime.After(last) && info.Buffered == 0
+	})
+	if err := p.ResumeConn(1); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.send(1, newNumber("5")+"\n")
+	server.waitLine(t, newNumber("5"))
+	for _, line := range server.received() {
+		if line == newNumber("4") {
+			t.Error("dropped command is sent")
+		}
+	}
+
+	if err := p.ResumeConn(2); err != ErrUnknownConn {
+		t.Errorf("expected unknown connection, got %v", err)
+	}
+}
+
+func TestCloseConn(t *testing.T) {
+	server := newFakeINDIServer(t, testDefs)
+	defer server.close()
+	tunnel := newFakeTunnel()
+	p := New("INDI-Server", server.addr(), tunnel, nil)
+	cancel, _ := startProxy(t, p, tunnel)
+	defer cancel()
+
+	tunnel.send(1, "<getProperties version=\"1.7\"/>\n")
+	tunnel.waitReceived(t, 1, "defNumberVector")
+
+	if err := p.CloseConn(1, "Session is over"); err != nil {
+		t.Fatal(err)
+	}
+	// guest gets message and then its tunnel connection is closed
+	tunnel.waitReceived(t, 1, "Session is over")
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		tunnel.mu.Lock()
+		before, closed := tunnel.closed[1]
+		tunnel.mu.Unlock()
+		if closed {
+			if !strings.Contains(before, "Session is over") {
+				t.Errorf("connection is closed before message is sent: %s", before)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel connection is not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// further guest traffic is dropped, other guests work
+	tunnel.send(1, newNumber("1")+"\n")
+	tunnel.send(2, "<getProperties version=\"1.7\"/>\n")
+	tunnel.waitReceived(t, 2, "defNumberVector")
+	for _, line := range server.received() {
+		if line == newNumber("1") {
+			t.Error("command of closed connection is sent")
+		}
+	}
+	for _, info := range p.Connections() {
+		if info.Conn == 1 {
+			t.Errorf("closed connection is listed: %+v", info)
+		}
+	}
+	tunnel.mu.Lock()
+	_, closed := tunnel.closed[2]
+	tunnel.mu.Unlock()
+	if closed {
+		t.Error("re-used response closed another connection")
+	}
+
+	if err := p.CloseConn(1, ""); err != ErrUnknownConn {
+		t.Errorf("expected unknown connection, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/indihub-space/agent/lib"
+)
+
+var elementGetProperties = []byte("<getProperties")
+
+// handshake is guest's getProperties and enableBLOB commands sent to local server,
+// they are replayed after re-connect so the new connection has the same properties and BLOB policies
+type handshake struct {
+	keys     []string
+	commands [][]byte
+}
+
+// record keeps the latest command for every getProperties scope and every BLOB policy of device or property
+func (h *handshake) record(cmd []byte) {
+	var kind string
+	switch {
+	case bytes.HasPrefix(cmd, elementGetProperties):
+		kind = "getProperties"
+	case bytes.HasPrefix(cmd, elementEnableBLOB):
+		kind = "enableBLOB"
+	default:
+		return
+	}
+	key := kind + "\x00" + lib.ElementAttr(cmd, "device") + "\x00" + lib.ElementAttr(cmd, "name")
+
+	// command with the same scope moves to the end, so replay keeps order of policy changes
+	for i := range h.keys {
+		if h.keys[i] == key {
+			h.keys = append(h.keys[:i], h.keys[i+1:]...)
+			h.commands = append(h.commands[:i], h.commands[i+1:]...)
+			break
+		}
+	}
+	h.keys = append(h.keys, key)
+	// commands are re-used by XML flattener so keep copies
+	h.commands = append(h.commands, append([]byte{}, cmd...))
+}
+
+// recordHandshake records command sent to local server by guest connection
+func (p *TcpProxy) recordHandshake(cNum uint32, cmd []byte) {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+
+	if state, ok := p.connStates[cNum]; ok {
+		state.handshake.record(cmd)
+	}
+}
+
+// replayHandshake sends recorded handshake of guest connection to the new connection to local server,
+// local server answers getProperties with def*-vectors so guest gets current properties,
+// it should be called with connMu held
+func (p *TcpProxy) replayHandshake(cNum uint32, c net.Conn) error {
+	state, ok := p.connStates[cNum]
+	if !ok || len(state.handshake.commands) == 0 {
+		return nil
+	}
+	for _, cmd := range state.handshake.commands {
+		if _, err := c.Write(cmd); err != nil {
+			return err
+		}
+	}
+	p.log.With("conn", cNum).Infof("Replayed %d handshake commands to %s", len(state.handshake.commands), p.Name)
+	return nil
+}
@@ -0,0 +1,531 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/indihub-space/agent/indiclient"
+	"github.com/indihub-space/agent/lib"
+	"github.com/indihub-space/agent/logutil"
+)
+
+const muxReconnectDelay = time.Second
+
+// upstream is connection to local server shared by all guest connections,
+// control elements come from upstream with BLOBs disabled and BLOBs from upstream with "enableBLOB Only"
+type upstream struct {
+	policy  string
+	log     *logutil.Logger
+	writeMu sync.Mutex
+
+	// guarded by mux.mu
+	conn    net.Conn
+	started bool
+	devices []string // devices BLOBs are enabled for on BLOB upstream
+}
+
+func (u *upstream) write(c net.Conn, data []byte) error {
+	u.writeMu.Lock()
+	defer u.writeMu.Unlock()
+	_, err := c.Write(data)
+	return err
+}
+
+type muxScope struct {
+	device string
+	name   string
+}
+
+// muxGuest is getProperties and enableBLOB state of guest connection
+type muxGuest struct {
+	scopes   []muxScope
+	policies map[string]string // BLOB policy by device and optional property name
+
+	// elements are queued under mux.mu in order they are decided to be sent and written by flush,
+	// so updates can't overtake definitions sent to guest from kept ones
+	queue [][]byte
+	outMu sync.Mutex
+}
+
+// inScope checks if guest requested properties of device, messages without device go to all guests which requested anything
+func (g *muxGuest) inScope(device string, name string) bool {
+	for _, s := range g.scopes {
+		if device == "" || s.device == "" {
+			return true
+		}
+		if s.device == device && (s.name == "" || name == "" || s.name == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// blobPolicy returns BLOB policy for property, policy of property overrides policy of device
+func (g *muxGuest) blobPolicy(device string, name string) string {
+	if policy, ok := g.policies[device+"\x00"+name]; ok {
+		return policy
+	}
+	if policy, ok := g.policies[device+"\x00"]; ok {
+		return policy
+	}
+	return BLOBPolicyNever
+}
+
+// wantsBLOBs checks if guest enabled BLOBs of device or any its property
+func (g *muxGuest) wantsBLOBs(device string) bool {
+	for key, policy := range g.policies {
+		if strings.HasPrefix(key, device+"\x00") && policy != BLOBPolicyNever {
+			return true
+		}
+	}
+	return false
+}
+
+// wants checks if element of property from upstream with BLOB policy should be sent to guest
+func (g *muxGuest) wants(upstreamPolicy string, device string, name string) bool {
+	if !g.inScope(device, name) {
+		return false
+	}
+	if device == "" {
+		return true
+	}
+	policy := g.blobPolicy(device, name)
+	if upstreamPolicy == BLOBPolicyOnly {
+		return policy == BLOBPolicyAlso || policy == BLOBPolicyOnly
+	}
+	return policy != BLOBPolicyOnly
+}
+
+// mux shares connections to local server between guest connections, so local server sends every element once:
+// elements are sent to guests according to their getProperties and enableBLOB commands,
+// definitions of properties are kept to answer getProperties of guests
+type mux struct {
+	p   *TcpProxy
+	out func(cNum uint32, el []byte)
+	wg  sync.WaitGroup
+
+	mu      sync.Mutex
+	closed  bool
+	done    chan struct{}
+	control *upstream
+	blobs   *upstream
+	guests  map[uint32]*muxGuest
+	props   map[string]*indiclient.Vector // by device and name
+	order   []string                      // keys of props in order of definition
+}
+
+func newMux(p *TcpProxy, out func(cNum uint32, el []byte)) *mux {
+	return &mux{
+		p:       p,
+		out:     out,
+		done:    make(chan struct{}),
+		control: &upstream{policy: BLOBPolicyNever, log: p.log.With("upstream", "control")},
+		blobs:   &upstream{policy: BLOBPolicyOnly, log: p.log.With("upstream", "blobs")},
+		guests:  map[uint32]*muxGuest{},
+		props:   map[string]*indiclient.Vector{},
+	}
+}
+
+// SetMultiplexing enables sharing of connections to local server between guest connections
+func (p *TcpProxy) SetMultiplexing(enabled bool) {
+	p.multiplex = enabled
+}
+
+func (p *TcpProxy) setMux(m *mux) {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	p.mux = m
+}
+
+// commands handles commands from guest connection: getProperties are answered from definitions kept,
+// enableBLOB changes what is sent to guest and other commands are sent to control upstream
+func (m *mux) commands(cNum uint32, cmds [][]byte) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	// commands in progress are waited for on close, so nothing is sent to guests after that
+	m.wg.Add(1)
+	defer m.wg.Done()
+	m.guest(cNum)
+	m.start(m.control)
+	m.mu.Unlock()
+
+	for _, cmd := range cmds {
+		switch lib.ElementTag(cmd) {
+		case "getProperties":
+			m.getProperties(cNum, cmd)
+		case "enableBLOB":
+			m.enableBLOB(cNum, cmd)
+		default:
+			m.send(cNum, cmd)
+		}
+	}
+}
+
+// guest returns state of guest connection, it should be called with mu held
+func (m *mux) guest(cNum uint32) *muxGuest {
+	g, ok := m.guests[cNum]
+	if !ok {
+		g = &muxGuest{policies: map[string]string{}}
+		m.guests[cNum] = g
+	}
+	return g
+}
+
+func (m *mux) getProperties(cNum uint32, cmd []byte) {
+	scope := muxScope{
+		device: lib.ElementAttr(cmd, "device"),
+		name:   lib.ElementAttr(cmd, "name"),
+	}
+
+	m.mu.Lock()
+	g := m.guest(cNum)
+	known := false
+	for _, s := range g.scopes {
+		known = known || s == scope
+	}
+	if !known {
+		g.scopes = append(g.scopes, scope)
+	}
+	for _, key := range m.order {
+		v := m.props[key]
+		if (scope.device == "" || scope.device == v.Device) && (scope.name == "" || scope.name == v.Name) &&
+			g.blobPolicy(v.Device, v.Name) != BLOBPolicyOnly {
+			g.queue = append(g.queue, v.DefXML(false))
+		}
+	}
+	m.mu.Unlock()
+
+	m.flush(cNum, g)
+}
+
+func (m *mux) enableBLOB(cNum uint32, cmd []byte) {
+	device := lib.ElementAttr(cmd, "device")
+	name := lib.ElementAttr(cmd, "name")
+	policy := enableBLOBPolicy(cmd)
+	if device == "" || (policy != BLOBPolicyNever && policy != BLOBPolicyAlso && policy != BLOBPolicyOnly) {
+		return
+	}
+
+	m.mu.Lock()
+	m.guest(cNum).policies[device+"\x00"+name] = policy
+	if policy == BLOBPolicyNever {
+		conn, devices := m.releaseBLOBs()
+		m.mu.Unlock()
+		m.disableBLOBs(conn, devices)
+		return
+	}
+	for _, d := range m.blobs.devices {
+		if d == device {
+			m.mu.Unlock()
+			return
+		}
+	}
+	m.blobs.devices = append(m.blobs.devices, device)
+	m.start(m.blobs)
+	conn := m.blobs.conn
+	m.mu.Unlock()
+
+	// otherwise the device is enabled when BLOB upstream connects
+	if conn != nil {
+		if err := m.blobs.write(conn, blobsHandshake(device)); err != nil {
+			m.blobs.log.Errorf("Could not enable BLOBs of %s: %s", device, err)
+		}
+	}
+}
+
+// send sends guest command to control upstream
+func (m *mux) send(cNum uint32, cmd []byte) {
+	m.mu.Lock()
+	conn := m.control.conn
+	m.mu.Unlock()
+
+	if conn == nil {
+		m.control.log.With("conn", cNum).Warnf("Command is dropped, not connected to local %s", m.p.Name)
+		return
+	}
+	if err := m.control.write(conn, cmd); err != nil {
+		m.control.log.With("conn", cNum).Errorf("Failed to send a request to %s: %v", m.p.Name, err)
+	}
+}
+
+// removeGuest stops sending elements to guest connection
+func (m *mux) removeGuest(cNum uint32) {
+	m.mu.Lock()
+	delete(m.guests, cNum)
+	conn, devices := m.releaseBLOBs()
+	m.mu.Unlock()
+
+	m.disableBLOBs(conn, devices)
+}
+
+// releaseBLOBs removes devices no guest wants BLOBs of from BLOB upstream and returns them
+// with connection to disable them on, it should be called with mu held
+func (m *mux) releaseBLOBs() (net.Conn, []string) {
+	devices := m.blobs.devices[:0]
+	released := []string{}
+	for _, device := range m.blobs.devices {
+		wanted := false
+		for _, g := range m.guests {
+			wanted = wanted || g.wantsBLOBs(device)
+		}
+		if wanted {
+			devices = append(devices, device)
+		} else {
+			released = append(released, device)
+		}
+	}
+	m.blobs.devices = devices
+	return m.blobs.conn, released
+}
+
+// disableBLOBs stops BLOBs of devices on BLOB upstream connection
+func (m *mux) disableBLOBs(conn net.Conn, devices []string) {
+	if conn == nil {
+		return
+	}
+	for _, device := range devices {
+		if err := m.blobs.write(conn, blobsNever(device)); err != nil {
+			m.blobs.log.Errorf("Could not disable BLOBs of %s: %s", device, err)
+		}
+	}
+}
+
+// flush writes elements queued for guest
+func (m *mux) flush(cNum uint32, g *muxGuest) {
+	g.outMu.Lock()
+	defer g.outMu.Unlock()
+
+	for {
+		m.mu.Lock()
+		queue := g.queue
+		g.queue = nil
+		if m.guests[cNum] != g {
+			queue = nil
+		}
+		m.mu.Unlock()
+
+		if len(queue) == 0 {
+			return
+		}
+		for _, el := range queue {
+			m.out(cNum, el)
+		}
+	}
+}
+
+// guestConns returns numbers of all guest connections
+func (m *mux) guestConns() []uint32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cNums := make([]uint32, 0, len(m.guests))
+	for cNum := range m.guests {
+		cNums = append(cNums, cNum)
+	}
+	return cNums
+}
+
+// close closes upstreams, they are not re-opened after that
+func (m *mux) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return
+	}
+	m.closed = true
+	close(m.done)
+	for _, u := range []*upstream{m.control, m.blobs} {
+		if u.conn != nil {
+			u.conn.Close()
+		}
+	}
+}
+
+// wait waits for upstreams and guest commands in progress to finish after close
+func (m *mux) wait() {
+	m.wg.Wait()
+}
+
+// start starts upstream if it is not started yet, it should be called with mu held
+func (m *mux) start(u *upstream) {
+	if u.started || m.closed {
+		return
+	}
+	u.started = true
+	m.wg.Add(1)
+	go m.run(u)
+}
+
+// run keeps upstream connected until mux is closed
+func (m *mux) run(u *upstream) {
+	defer m.wg.Done()
+
+	buf := make([]byte, lib.INDIServerMaxRecvMsgSize)
+	for first := true; ; first = false {
+		if !first {
+			select {
+			case <-m.done:
+				return
+			case <-time.After(muxReconnectDelay):
+			}
+			m.p.session.AddReconnect()
+		}
+
+		u.log.Infof("Connecting to local %s... on %s", m.p.Name, m.p.Addr)
+		conn, err := net.Dial("tcp", m.p.Addr)
+		if err != nil {
+			u.log.Errorf("Could not connect to %s: %s", m.p.Name, err)
+			m.p.session.AddError(fmt.Sprintf("could not connect to %s: %s", m.p.Name, err))
+			continue
+		}
+		u.log.Infof("...OK")
+
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			conn.Close()
+			return
+		}
+		u.conn = conn
+		handshake := []byte("<getProperties version=\"1.7\"/>\n")
+		if u.policy == BLOBPolicyOnly {
+			handshake = nil
+			for _, device := range u.devices {
+				handshake = append(handshake, blobsHandshake(device)...)
+			}
+		}
+		m.mu.Unlock()
+
+		if err := u.write(conn, handshake); err != nil {
+			u.log.Errorf("Failed to send a request to %s: %v", m.p.Name, err)
+		}
+
+		xmlFlattener := lib.NewXmlFlattener()
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			for _, el := range xmlFlattener.FeedChunk(buf[:n]) {
+				m.dispatch(u, el)
+			}
+		}
+
+		m.mu.Lock()
+		u.conn = nil
+		if u.policy == BLOBPolicyNever {
+			// local server is re-started, guests will get new definitions from the new connection
+			m.props = map[string]*indiclient.Vector{}
+			m.order = nil
+		}
+		closed := m.closed
+		m.mu.Unlock()
+		conn.Close()
+
+		if closed {
+			return
+		}
+		u.log.Warnf("Lost connection to local %s", m.p.Name)
+	}
+}
+
+// dispatch sends element from upstream to guests which want it
+func (m *mux) dispatch(u *upstream, el []byte) {
+	tag := lib.ElementTag(el)
+	if u.policy == BLOBPolicyOnly && tag != "setBLOBVector" {
+		// definitions of devices BLOBs were enabled for
+		return
+	}
+	device := lib.ElementAttr(el, "device")
+	name := lib.ElementAttr(el, "name")
+
+	m.mu.Lock()
+	if u.policy == BLOBPolicyNever {
+		m.update(tag, device, name, el)
+	}
+	guests := map[uint32]*muxGuest{}
+	for cNum, g := range m.guests {
+		if g.wants(u.policy, device, name) {
+			g.queue = append(g.queue, el)
+			guests[cNum] = g
+		}
+	}
+	m.mu.Unlock()
+
+	// BLOB is read once from local server and sent to every guest which enabled it,
+	// element is written by the time flush returns, so it can stay in flattener buffer
+	for cNum, g := range guests {
+		m.flush(cNum, g)
+	}
+}
+
+// update updates definitions of properties, it should be called with mu held
+func (m *mux) update(tag string, device string, name string, el []byte) {
+	key := device + "\x00" + name
+	switch {
+	case tag == "delProperty":
+		order := m.order[:0]
+		for _, k := range m.order {
+			v := m.props[k]
+			if v.Device == device && (name == "" || v.Name == name) {
+				delete(m.props, k)
+				continue
+			}
+			order = append(order, k)
+		}
+		m.order = order
+
+	case strings.HasPrefix(tag, "def"):
+		msg, err := indiclient.Parse(el)
+		if err != nil || msg.Vector == nil {
+			return
+		}
+		if _, ok := m.props[key]; !ok {
+			m.order = append(m.order, key)
+		}
+		m.props[key] = msg.Vector
+
+	case strings.HasPrefix(tag, "set"):
+		v, ok := m.props[key]
+		if !ok {
+			return
+		}
+		if msg, err := indiclient.Parse(el); err == nil && msg.Vector != nil {
+			v.Update(msg.Vector)
+		}
+	}
+}
+
+// blobsHandshake requests properties of device and only BLOBs of it
+func blobsHandshake(device string) []byte {
+	buf := bytes.Buffer{}
+	xml.EscapeText(&buf, []byte(device))
+	return []byte(fmt.Sprintf("<getProperties version=\"1.7\" device=\"%s\"/>\n<enableBLOB device=\"%s\">%s</enableBLOB>\n",
+		buf.String(), buf.String(), BLOBPolicyOnly))
+}
+
+// blobsNever disables BLOBs of device
+func blobsNever(device string) []byte {
+	buf := bytes.Buffer{}
+	xml.EscapeText(&buf, []byte(device))
+	return []byte(fmt.Sprintf("<enableBLOB device=\"%s\">%s</enableBLOB>\n", buf.String(), BLOBPolicyNever))
+}
+
+// enableBLOBPolicy returns policy of enableBLOB command
+func enableBLOBPolicy(cmd []byte) string {
+	start := bytes.IndexByte(cmd, '>')
+	end := bytes.Index(cmd, elementEnableBLOBEnd)
+	if start == -1 || end < start {
+		return ""
+	}
+	return string(bytes.TrimSpace(cmd[start+1 : end]))
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/indihub-space/agent/proto/indihub"
+)
+
+const testSet = `<setNumberVector device="Telescope" name="EQUATORIAL_EOD_COORD" state="Ok">
+<oneNumber name="RA">7.25</oneNumber>
+</setNumberVector>
+`
+
+// waitLine waits until fake INDI-server receives line
+func (s *fakeINDIServer) waitLine(tb testing.TB, line string) {
+	tb.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		for _, l := range s.received() {
+			if l == line {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("INDI-server didn't receive %s, got: %q", line, s.received())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func startMuxProxy(t *testing.T, server *fakeINDIServer) (*fakeTunnel, func()) {
+	tunnel := newFakeTunnel()
+	p := New("INDI-Server", server.addr(), tunnel, nil)
+	p.SetMultiplexing(true)
+	cancel, done := startProxy(t, p, tunnel)
+	return tunnel, func() {
+		// Recv of gRPC stream fails when its context is cancelled
+		cancel()
+		close(tunnel.in)
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			t.Error("Start didn't return after proxy was stopped")
+		}
+	}
+}
+
+func TestMuxFanOut(t *testing.T) {
+	server := newFakeINDIServer(t, testDefs)
+	defer server.close()
+	server.handler = func(c net.Conn, line string) {
+		if strings.HasPrefix(line, "<newNumberVector") {
+			c.Write([]byte(testSet))
+		}
+	}
+	tunnel, stop := startMuxProxy(t, server)
+	defer stop()
+
+	tunnel.send(1, "<getProperties version=\"1.7\"/>\n")
+	tunnel.waitReceived(t, 1, "defNumberVector")
+	// the second guest gets definitions kept by mux
+	tunnel.send(2, "<getProperties version=\"1.7\"/>\n")
+	tunnel.waitReceived(t, 2, "defNumberVector")
+
+	// update caused by command of one guest goes to both
+	tunnel.send(1, `<newNumberVector device="Telescope" name="EQUATORIAL_EOD_COORD"><oneNumber name="RA">7.25</oneNumber></newNumberVector>`+"\n")
+	for _, cNum := range []uint32{1, 2} {
+		data := tunnel.waitReceived(t, cNum, "setNumberVector", ">7.25<")
+		if strings.Index(data, "defNumberVector") > strings.Index(data, "setNumberVector") {
+			t.Errorf("conn %d got update before definition: %s", cNum, data)
+		}
+	}
+
+	if n := server.connCount(); n != 1 {
+		t.Errorf("expected one connection to INDI-server, got %d", n)
+	}
+	commands := 0
+	for _, line := range server.received() {
+		if strings.HasPrefix(line, "<newNumberVector") {
+			commands++
+		}
+	}
+	if commands != 1 {
+		t.Errorf("expected command to be sent once, got %d", commands)
+	}
+}
+
+func TestMuxDisablesBLOBsOfRemovedGuest(t *testing.T) {
+	server := newFakeINDIServer(t, testDefs)
+	defer server.close()
+	tunnel, stop := startMuxProxy(t, server)
+	defer stop()
+
+	tunnel.send(1, "<getProperties version=\"1.7\"/>\n<enableBLOB device=\"CCD Simulator\">Also</enableBLOB>\n")
+	tunnel.send(2, "<getProperties version=\"1.7\"/>\n<enableBLOB device=\"CCD Simulator\">Also</enableBLOB>\n")
+	server.waitLine(t, `<enableBLOB device="CCD Simulator">Only</enableBLOB>`)
+
+	// BLOBs are still wanted by the second guest
+	tunnel.in <- &indihub.Request{Conn: 1, Closed: true}
+	tunnel.send(2, "<enableBLOB device=\"Telescope\">Never</enableBLOB>\n")
+	tunnel.waitReceived(t, 2, "defNumberVector")
+	time.Sleep(100 * time.Millisecond)
+	for _, line := range server.received() {
+		if strings.HasSuffix(line, ">Never</enableBLOB>") {
+			t.Fatalf("BLOBs are disabled while guest wants them: %s", line)
+		}
+	}
+
+	tunnel.in <- &indihub.Request{Conn: 2, Closed: true}
+	server.waitLine(t, `<enableBLOB device="CCD Simulator">Never</enableBLOB>`)
+}
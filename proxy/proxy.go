@@ -1,19 +1,29 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/indihub-space/agent/audit"
 	"github.com/indihub-space/agent/hostutils"
+	"github.com/indihub-space/agent/journal"
 	"github.com/indihub-space/agent/lib"
+	"github.com/indihub-space/agent/logutil"
 	"github.com/indihub-space/agent/proto/indihub"
+	"github.com/indihub-space/agent/recorder"
 )
 
 const queueSize = 4096
 
+var ErrClosed = errors.New("proxy is closed")
+
 type INDIHubTunnel interface {
 	Send(*indihub.Response) error
 	Recv() (*indihub.Request, error)
@@ -25,10 +35,27 @@ type TcpProxy struct {
 	Addr   string
 	Tunnel INDIHubTunnel
 
-	connMu  sync.Mutex
-	connMap map[uint32]net.Conn
+	connMu     sync.Mutex
+	closed     bool
+	connMap    map[uint32]net.Conn
+	connStates map[uint32]*connState
+	respCh     chan *indihub.Response
+
+	sessionID    uint64
+	sessionToken string
+
+	multiplex bool
+	mux       *mux
+
+	filter   *hostutils.INDIFilter
+	recorder *recorder.Recorder
+	audit    *audit.Log
+	mode     string
+	shaping  *ShapingConfig
+	session  *journal.Session
+	log      *logutil.Logger
 
-	filter *hostutils.INDIFilter
+	guestListener func(info ConnInfo, connected bool)
 
 	respPool *sync.Pool
 }
@@ -40,11 +67,13 @@ type PublicServerAddr struct {
 
 func New(name string, addr string, tunnel INDIHubTunnel, filter *hostutils.INDIFilter) *TcpProxy {
 	return &TcpProxy{
-		Name:    name,
-		Addr:    addr,
-		Tunnel:  tunnel,
-		connMap: map[uint32]net.Conn{},
-		filter:  filter,
+		Name:       name,
+		Addr:       addr,
+		Tunnel:     tunnel,
+		connMap:    map[uint32]net.Conn{},
+		connStates: map[uint32]*connState{},
+		filter:     filter,
+		log:        logutil.New("proxy", name),
 		respPool: &sync.Pool{
 			New: func() interface{} {
 				return &indihub.Response{
@@ -55,48 +84,88 @@ func New(name string, addr string, tunnel INDIHubTunnel, filter *hostutils.INDIF
 	}
 }
 
+// SetRecorder enables recording of all proxied traffic
+func (p *TcpProxy) SetRecorder(rec *recorder.Recorder) {
+	p.recorder = rec
+}
+
+// SetSession sets journal session to count guest connections, traffic and errors
+func (p *TcpProxy) SetSession(session *journal.Session) {
+	p.session = session
+}
+
+// SetGuestListener sets function called when guest connection appears or is closed,
+// it is called with connections lock held, so it should not block
+func (p *TcpProxy) SetGuestListener(fn func(info ConnInfo, connected bool)) {
+	p.guestListener = fn
+}
+
+// Close closes connections to local server, connections are not re-opened after that
 func (p *TcpProxy) Close() {
 	p.connMu.Lock()
 	defer p.connMu.Unlock()
 
+	p.closed = true
 	for num, c := range p.connMap {
 		c.Close()
 		delete(p.connMap, num)
 	}
+	if p.mux != nil {
+		p.mux.close()
+	}
 }
 
 func (p *TcpProxy) connect(cNum uint32) (net.Conn, bool, error) {
 	p.connMu.Lock()
 	defer p.connMu.Unlock()
 
+	if p.closed {
+		return nil, false, ErrClosed
+	}
 	if c, ok := p.connMap[cNum]; ok {
 		return c, false, nil
 	}
 
-	log.Printf("Connecting to local %s... on %s\n", p.Name, p.Addr)
+	log := p.log.With("conn", cNum)
+	log.Infof("Connecting to local %s... on %s", p.Name, p.Addr)
 	c, err := net.Dial("tcp", p.Addr)
 	if err != nil {
-		log.Printf("Could not connect to %s: %s\n", p.Name, err)
+		log.Errorf("Could not connect to %s: %s", p.Name, err)
+		p.session.AddError(fmt.Sprintf("could not connect to %s: %s", p.Name, err))
 		return nil, false, err
 	}
-	log.Println("...OK")
+	log.Infof("...OK")
 	p.connMap[cNum] = c
 	return c, true, err
 }
 
-func (p *TcpProxy) reConnect(cNum uint32) (net.Conn, error) {
+// reConnect replaces broken connection old to local server and replays guest's handshake on the new one,
+// if connection was already replaced by reader or writer of the guest connection the new one is returned
+func (p *TcpProxy) reConnect(cNum uint32, old net.Conn) (net.Conn, error) {
 	p.connMu.Lock()
 	defer p.connMu.Unlock()
 
-	log.Println("Re-connecting to local %s... on %s\n", p.Name, p.Addr)
+	if p.closed {
+		return nil, ErrClosed
+	}
+	if c, ok := p.connMap[cNum]; ok && c != old {
+		return c, nil
+	}
+	log := p.log.With("conn", cNum)
+	log.Infof("Re-connecting to local %s... on %s", p.Name, p.Addr)
+	p.session.AddReconnect()
 	c, err := net.Dial("tcp", p.Addr)
 	if err != nil {
-		log.Printf("Could not connect to %s: %s\n", p.Name, err)
+		log.Errorf("Could not connect to %s: %s", p.Name, err)
+		p.session.AddError(fmt.Sprintf("could not re-connect to %s: %s", p.Name, err))
 		return nil, err
 	}
-	log.Println("...OK")
+	log.Infof("...OK")
 	p.connMap[cNum] = c
-	return c, err
+	if err := p.replayHandshake(cNum, c); err != nil {
+		log.Errorf("Could not replay handshake to %s: %s", p.Name, err)
+	}
+	return c, nil
 }
 
 func (p *TcpProxy) close(cNum uint32) {
@@ -109,39 +178,107 @@ func (p *TcpProxy) close(cNum uint32) {
 	}
 }
 
-func (p *TcpProxy) Start(pubAddrChan chan PublicServerAddr, sessionID uint64, sessionToken string) {
+// Start proxies traffic between tunnel and local server until ctx is cancelled or tunnel is closed by the cloud,
+// tunnel should be opened with the same ctx. Nil is returned when ctx is cancelled.
+func (p *TcpProxy) Start(ctx context.Context, pubAddrChan chan PublicServerAddr, sessionID uint64, sessionToken string) error {
 	wg := sync.WaitGroup{}
 
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.Tunnel.CloseSend()
+			p.Close()
+		case <-stopped:
+		}
+	}()
+
 	// run response sending queue
 	respCh := make(chan *indihub.Response, queueSize)
-	defer close(respCh)
-	go p.sendResponses(respCh)
+	p.setRespCh(respCh, sessionID, sessionToken)
+	defer func() {
+		p.setRespCh(nil, 0, "")
+		close(respCh)
+	}()
+	var blobCh chan *blobChunk
+	if p.shaping != nil {
+		blobCh = make(chan *blobChunk, queueSize)
+		defer close(blobCh)
+		go p.sendShapedResponses(respCh, blobCh)
+	} else {
+		go p.sendResponses(respCh)
+	}
 
+	// guest connections share connections to local server
+	var m *mux
+	if p.multiplex {
+		m = newMux(p, func(cNum uint32, el []byte) {
+			p.recorder.Record(cNum, recorder.ToClient, el)
+			p.trackOutgoing(cNum, len(el))
+			if p.shaping != nil {
+				p.queueElement(el, cNum, sessionID, sessionToken, respCh, blobCh)
+				return
+			}
+			resp := p.respPool.Get().(*indihub.Response)
+			resp.Conn = cNum
+			resp.SessionToken = sessionToken
+			resp.SessionID = sessionID
+			resp.Data = append(resp.Data[:0], el...)
+			respCh <- resp
+		})
+		p.setMux(m)
+		defer func() {
+			p.setMux(nil)
+			m.close()
+		}()
+	}
+
+	var exitErr error
 	addrReceived := false
 	xmlFlattener := map[uint32]*lib.XmlFlattener{}
 	for {
 		// receive request from tunnel
 		in, err := p.Tunnel.Recv()
+		if ctx.Err() != nil {
+			p.log.Infof("Exiting. %s tunnel is closed.", p.Name)
+			break
+		}
 		if err == io.EOF {
 			// read done, server closed connection
-			log.Printf("Exiting. Got EOF from %s tunnel.\n", p.Name)
+			p.log.Warnf("Exiting. Got EOF from %s tunnel.", p.Name)
+			exitErr = fmt.Errorf("%s tunnel was closed by the cloud", p.Name)
 			break
 		}
 		if err != nil {
-			log.Printf("Exiting. Failed to receive a request from %s tunnel: %v\n", p.Name, err)
+			p.log.Warnf("Exiting. Failed to receive a request from %s tunnel: %v", p.Name, err)
+			p.session.AddError(fmt.Sprintf("failed to receive a request from %s tunnel: %v", p.Name, err))
+			exitErr = fmt.Errorf("failed to receive a request from %s tunnel: %w", p.Name, err)
 			break
 		}
 
 		// 1st message always with server address
 		if !addrReceived && in.Conn == 0 {
-			pubAddrChan <- PublicServerAddr{
+			select {
+			case pubAddrChan <- PublicServerAddr{
 				Name: p.Name,
 				Addr: string(in.Data),
+			}:
+			case <-ctx.Done():
 			}
 			addrReceived = true
 			continue
 		}
 
+		if !in.Closed {
+			p.recorder.Record(in.Conn, recorder.ToServer, in.Data)
+
+			// drop traffic of connections closed by host
+			if !p.trackIncoming(in.Conn, len(in.Data)) {
+				continue
+			}
+		}
+
 		// Flatten XML data stream into elements
 		if xmlFlattener[in.Conn] == nil {
 			xmlFlattener[in.Conn] = lib.NewXmlFlattener()
@@ -150,23 +287,39 @@ func (p *TcpProxy) Start(pubAddrChan chan PublicServerAddr, sessionID uint64, se
 		xmlCommands := xmlFlattener[in.Conn].FeedChunk(in.Data)
 
 		// check if we need to filter traffic
-		if p.filter != nil {
-			xmlCommands = p.filter.FilterIncoming(xmlCommands)
+		xmlCommands = p.filterCommands(in.Conn, sessionID, xmlCommands)
+		xmlCommands = p.holdCommands(in.Conn, xmlCommands)
+
+		if m != nil {
+			if in.Closed {
+				p.log.With("conn", in.Conn).Infof("Client closed connection to the cloud")
+				m.removeGuest(in.Conn)
+				p.forgetConn(in.Conn)
+				p.recorder.CloseConn(in.Conn)
+				delete(xmlFlattener, in.Conn)
+				continue
+			}
+			m.commands(in.Conn, xmlCommands)
+			continue
 		}
 
 		c, isNewConn, err := p.connect(in.Conn)
+		if err == ErrClosed {
+			continue
+		}
 		if err != nil {
-			if c, err = p.reConnect(in.Conn); err != nil {
-				log.Printf("Failed to send a request to %s: %v\n", p.Name, err)
+			if c, err = p.reConnect(in.Conn, nil); err != nil {
+				p.log.Errorf("Failed to send a request to %s: %v", p.Name, err)
 				time.Sleep(1 * time.Second)
 				continue
 			}
 		}
 
 		if in.Closed {
-			log.Printf("Client closed connection %d to the cloud, so closing it to local %s too\n",
-				in.Conn, p.Name)
+			p.log.With("conn", in.Conn).Infof("Client closed connection to the cloud, so closing it to local %s too", p.Name)
 			p.close(in.Conn)
+			p.forgetConn(in.Conn)
+			p.recorder.CloseConn(in.Conn)
 			continue
 		}
 
@@ -176,23 +329,43 @@ func (p *TcpProxy) Start(pubAddrChan chan PublicServerAddr, sessionID uint64, se
 			go func(conn net.Conn, cNum uint32, sessID uint64, sessToken string, ch chan *indihub.Response) {
 				defer wg.Done()
 				readBuf := make([]byte, lib.INDIServerMaxRecvMsgSize)
+				respFlattener := lib.NewXmlFlattener()
 				for {
 					// receive response from server
 					n, err := conn.Read(readBuf)
 					if err == io.EOF {
-						if conn, err = p.reConnect(cNum); err != nil {
-							log.Printf("Failed to send a request to %s: %v", p.Name, err)
+						var newConn net.Conn
+						newConn, err = p.reConnect(cNum, conn)
+						if err == ErrClosed {
+							return
+						}
+						if err != nil {
+							// old connection returns EOF again, so re-connecting is retried
+							p.log.Errorf("Failed to send a request to %s: %v", p.Name, err)
 							time.Sleep(1 * time.Second)
 							continue
-						} else {
-							n, err = conn.Read(readBuf)
 						}
+						// writer takes connection from connMap, so the old one can be closed
+						conn.Close()
+						conn = newConn
+						n, err = conn.Read(readBuf)
 					}
 					if err != nil {
-						log.Printf("Failed to receive a response from %s: %v", p.Name, err)
+						p.log.With("conn", cNum).Errorf("Failed to receive a response from %s: %v", p.Name, err)
 						return
 					}
 
+					p.recorder.Record(cNum, recorder.ToClient, readBuf[:n])
+					p.trackOutgoing(cNum, n)
+
+					// separate control elements from BLOBs
+					if p.shaping != nil {
+						for _, el := range respFlattener.FeedChunk(readBuf[:n]) {
+							p.queueElement(el, cNum, sessID, sessToken, ch, blobCh)
+						}
+						continue
+					}
+
 					// send response to tunnel
 					resp := p.respPool.Get().(*indihub.Response)
 					resp.Conn = cNum
@@ -211,8 +384,8 @@ func (p *TcpProxy) Start(pubAddrChan chan PublicServerAddr, sessionID uint64, se
 
 		for _, command := range xmlCommands {
 			if _, err = c.Write(command); err == io.EOF {
-				if c, err = p.reConnect(in.Conn); err != nil {
-					log.Printf("Failed to send a request to %s: %v", p.Name, err)
+				if c, err = p.reConnect(in.Conn, c); err != nil {
+					p.log.Errorf("Failed to send a request to %s: %v", p.Name, err)
 					time.Sleep(1 * time.Second)
 					continue
 				} else {
@@ -222,21 +395,75 @@ func (p *TcpProxy) Start(pubAddrChan chan PublicServerAddr, sessionID uint64, se
 			if err != nil {
 				break
 			}
+			p.recordHandshake(in.Conn, command)
 		}
 		if err != nil {
-			log.Printf("Failed to send a request to %s: %v", p.Name, err)
+			p.log.Errorf("Failed to send a request to %s: %v", p.Name, err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
 	}
+
+	// readers of local connections and mux upstreams are blocked in Read until connections are closed
+	p.Close()
 	wg.Wait()
+	if m != nil {
+		m.wait()
+	}
+	return exitErr
+}
+
+func (p *TcpProxy) setRespCh(ch chan *indihub.Response, sessionID uint64, sessionToken string) {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	p.respCh = ch
+	p.sessionID = sessionID
+	p.sessionToken = sessionToken
+}
+
+// SendMessage sends INDI message element to all connected guests
+func (p *TcpProxy) SendMessage(message string) {
+	p.sendMessageTo(message)
+}
+
+// sendMessageTo sends INDI message element to guest connections cNums or to all guests if none specified
+func (p *TcpProxy) sendMessageTo(message string, cNums ...uint32) {
+	msgBuf := bytes.Buffer{}
+	xml.EscapeText(&msgBuf, []byte(message))
+	data := []byte(fmt.Sprintf("<message timestamp=\"%s\" message=\"%s\"/>\n",
+		time.Now().UTC().Format("2006-01-02T15:04:05"), msgBuf.String()))
+
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+
+	if p.respCh == nil {
+		return
+	}
+	if len(cNums) == 0 && p.mux != nil {
+		cNums = p.mux.guestConns()
+	}
+	if len(cNums) == 0 {
+		for cNum := range p.connMap {
+			cNums = append(cNums, cNum)
+		}
+	}
+	for _, cNum := range cNums {
+		resp := p.respPool.Get().(*indihub.Response)
+		resp.Conn = cNum
+		resp.SessionID = p.sessionID
+		resp.SessionToken = p.sessionToken
+		resp.Data = append(resp.Data[:0], data...)
+		p.respCh <- resp
+	}
 }
 
 func (p *TcpProxy) sendResponses(respCh chan *indihub.Response) {
 	for resp := range respCh {
 		if err := p.Tunnel.Send(resp); err != nil {
-			log.Printf("Failed to send a response to %s tunnel: %v", p.Name, err)
+			p.log.Errorf("Failed to send a response to %s tunnel: %v", p.Name, err)
 		}
+		// responses are re-used, so closing one must not close the next connection
+		resp.Closed = false
 		p.respPool.Put(resp)
 	}
 }
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/indihub-space/agent/proto/indihub"
+)
+
+// fakeTunnel is INDIHUB tunnel fed by test, closing in makes Recv return io.EOF
+type fakeTunnel struct {
+	in chan *indihub.Request
+
+	mu     sync.Mutex
+	out    map[uint32][]byte
+	closed map[uint32]string // data sent to guest before its connection was closed by agent
+}
+
+func newFakeTunnel() *fakeTunnel {
+	return &fakeTunnel{
+		in:     make(chan *indihub.Request, 16),
+		out:    map[uint32][]byte{},
+		closed: map[uint32]string{},
+	}
+}
+
+func (t *fakeTunnel) Send(resp *indihub.Response) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.out[resp.Conn] = append(t.out[resp.Conn], resp.Data...)
+	if resp.Closed {
+		t.closed[resp.Conn] = string(t.out[resp.Conn])
+	}
+	return nil
+}
+
+func (t *fakeTunnel) Recv() (*indihub.Request, error) {
+	req, ok := <-t.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return req, nil
+}
+
+func (t *fakeTunnel) CloseSend() error {
+	return nil
+}
+
+func (t *fakeTunnel) send(cNum uint32, data string) {
+	t.in <- &indihub.Request{Conn: cNum, Data: []byte(data)}
+}
+
+// received returns everything sent to guest connection
+func (t *fakeTunnel) received(cNum uint32) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.out[cNum])
+}
+
+// waitReceived waits until guest connection receives data containing all substrings
+func (t *fakeTunnel) waitReceived(tb testing.TB, cNum uint32, substrings ...string) string {
+	tb.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		data := t.received(cNum)
+		ok := true
+		for _, s := range substrings {
+			ok = ok && strings.Contains(data, s)
+		}
+		if ok {
+			return data
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("conn %d didn't receive %q, got: %s", cNum, substrings, data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// fakeINDIServer answers getProperties with defs and passes every line it receives to handler
+type fakeINDIServer struct {
+	l    net.Listener
+	defs string
+
+	mu      sync.Mutex
+	conns   []net.Conn
+	lines   []string
+	handler func(c net.Conn, line string)
+}
+
+func newFakeINDIServer(tb testing.TB, defs string) *fakeINDIServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s := &fakeINDIServer{l: l, defs: defs}
+	go s.accept()
+	return s
+}
+
+func (s *fakeINDIServer) addr() string {
+	return s.l.Addr().String()
+}
+
+func (s *fakeINDIServer) accept() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, c)
+		s.mu.Unlock()
+		go s.serve(c)
+	}
+}
+
+func (s *fakeINDIServer) serve(c net.Conn) {
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		s.mu.Lock()
+		s.lines = append(s.lines, line)
+		handler := s.handler
+		s.mu.Unlock()
+
+		if strings.HasPrefix(line, "<getProperties") {
+			c.Write([]byte(s.defs))
+		}
+		if handler != nil {
+			handler(c, line)
+		}
+	}
+}
+
+func (s *fakeINDIServer) connCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *fakeINDIServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.lines...)
+}
+
+func (s *fakeINDIServer) close() {
+	s.l.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+const testDefs = `<defNumberVector device="Telescope" name="EQUATORIAL_EOD_COORD" state="Ok" perm="rw">
+<defNumber name="RA" format="%m" min="0" max="24" step="0">1</defNumber>
+</defNumberVector>
+`
+
+// startProxy starts proxy and waits for public address, Start result is sent to returned channel
+func startProxy(t *testing.T, p *TcpProxy, tunnel *fakeTunnel) (context.CancelFunc, chan error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	addrCh := make(chan PublicServerAddr, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Start(ctx, addrCh, 1, "token")
+	}()
+	tunnel.send(0, "indi.example.com:7624")
+	select {
+	case <-addrCh:
+	case <-time.After(3 * time.Second):
+		t.Fatal("public address is not received")
+	}
+	return cancel, done
+}
+
+func TestStartReturnsWhenTunnelIsLost(t *testing.T) {
+	server := newFakeINDIServer(t, testDefs)
+	defer server.close()
+	tunnel := newFakeTunnel()
+	p := New("INDI-Server", server.addr(), tunnel, nil)
+	cancel, done := startProxy(t, p, tunnel)
+	defer cancel()
+
+	tunnel.send(1, "<getProperties version=\"1.7\"/>\n")
+	tunnel.waitReceived(t, 1, "defNumberVector")
+
+	// the cloud closes tunnel while guest is connected
+	close(tunnel.in)
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected error when tunnel is closed by the cloud")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Start didn't return after tunnel was lost")
+	}
+}
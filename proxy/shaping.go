@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/indihub-space/agent/lib"
+	"github.com/indihub-space/agent/proto/indihub"
+)
+
+const (
+	// max size of BLOB data waiting to be sent to tunnel, reading from INDI-server is paused when exceeded
+	maxQueuedBLOBBytes = 8 * 1024 * 1024
+
+	BLOBPolicyNever = "Never"
+	BLOBPolicyOnly  = "Only"
+	BLOBPolicyAlso  = "Also"
+)
+
+var (
+	elementSetBLOBVector = []byte("<setBLOBVector")
+	elementEnableBLOB    = []byte("<enableBLOB")
+	elementEnableBLOBEnd = []byte("</enableBLOB>")
+)
+
+// ShapingConfig contains rules for BLOB traffic going from INDI-server to tunnel
+type ShapingConfig struct {
+	BLOBRate        int64  // bytes per second per connection, 0 - unlimited
+	SessionBLOBRate int64  // bytes per second for all connections, 0 - unlimited
+	BLOBPolicy      string // policy to use instead of guest's "enableBLOB Also", empty - keep guest's one
+}
+
+// blobChunk is a part of setBLOBVector element, elements are sent to tunnel in chunks
+type blobChunk struct {
+	resp *indihub.Response
+	last bool
+}
+
+// SetShaping enables separation of control and BLOB elements coming from INDI-server
+func (p *TcpProxy) SetShaping(conf *ShapingConfig) {
+	p.shaping = conf
+}
+
+// rewriteEnableBLOB downgrades "enableBLOB Also" from guest to host BLOB policy
+func (p *TcpProxy) rewriteEnableBLOB(cmd []byte) []byte {
+	if p.shaping == nil || p.shaping.BLOBPolicy == "" || p.shaping.BLOBPolicy == BLOBPolicyAlso ||
+		!bytes.HasPrefix(cmd, elementEnableBLOB) {
+		return cmd
+	}
+
+	start := bytes.IndexByte(cmd, '>')
+	end := bytes.Index(cmd, elementEnableBLOBEnd)
+	if start == -1 || end == -1 || end < start {
+		return cmd
+	}
+	if string(bytes.TrimSpace(cmd[start+1:end])) != BLOBPolicyAlso {
+		return cmd
+	}
+
+	res := make([]byte, 0, len(cmd))
+	res = append(res, cmd[:start+1]...)
+	res = append(res, p.shaping.BLOBPolicy...)
+	res = append(res, cmd[end:]...)
+	p.log.Infof("guest BLOB policy '%s' downgraded to '%s'", BLOBPolicyAlso, p.shaping.BLOBPolicy)
+
+	return res
+}
+
+// queueElement puts element from INDI-server to control or BLOB queue
+func (p *TcpProxy) queueElement(el []byte, cNum uint32, sessionID uint64, sessionToken string,
+	controlCh chan *indihub.Response, blobCh chan *blobChunk) {
+
+	newResp := func(data []byte) *indihub.Response {
+		resp := p.respPool.Get().(*indihub.Response)
+		resp.Conn = cNum
+		resp.SessionToken = sessionToken
+		resp.SessionID = sessionID
+		resp.Data = append(resp.Data[:0], data...)
+		return resp
+	}
+
+	if !bytes.HasPrefix(el, elementSetBLOBVector) {
+		controlCh <- newResp(el)
+		return
+	}
+
+	for len(el) > 0 {
+		n := lib.INDIServerMaxRecvMsgSize
+		if n > len(el) {
+			n = len(el)
+		}
+		blobCh <- &blobChunk{
+			resp: newResp(el[:n]),
+			last: n == len(el),
+		}
+		el = el[n:]
+	}
+}
+
+// sendShapedResponses sends control elements ahead of queued BLOB chunks and limits rate of BLOB bytes.
+// Control elements of connection which is in the middle of BLOB are held until the BLOB is sent.
+func (p *TcpProxy) sendShapedResponses(controlCh chan *indihub.Response, blobCh chan *blobChunk) {
+	sessionBucket := lib.NewTokenBucket(p.shaping.SessionBLOBRate, lib.INDIServerMaxRecvMsgSize)
+	connBuckets := map[uint32]*lib.TokenBucket{}
+
+	queues := map[uint32][]*blobChunk{}
+	queuedBytes := 0
+	inBLOB := map[uint32]bool{}
+	heldControl := map[uint32][]*indihub.Response{}
+	var lastConn uint32
+
+	send := func(resp *indihub.Response) {
+		if err := p.Tunnel.Send(resp); err != nil {
+			p.log.Errorf("Failed to send a response to %s tunnel: %v", p.Name, err)
+		}
+		// responses are re-used, so closing one must not close the next connection
+		resp.Closed = false
+		p.respPool.Put(resp)
+	}
+
+	sendControl := func(resp *indihub.Response) {
+		if inBLOB[resp.Conn] {
+			heldControl[resp.Conn] = append(heldControl[resp.Conn], resp)
+			return
+		}
+		send(resp)
+	}
+
+	queueBLOB := func(chunk *blobChunk) {
+		queues[chunk.resp.Conn] = append(queues[chunk.resp.Conn], chunk)
+		queuedBytes += len(chunk.resp.Data)
+	}
+
+	// sendBLOB sends one BLOB chunk if rate limits allow, returns delay till the next chunk otherwise
+	sendBLOB := func() (bool, time.Duration) {
+		conns := make([]uint32, 0, len(queues))
+		for cNum := range queues {
+			conns = append(conns, cNum)
+		}
+		if len(conns) == 0 {
+			return false, 0
+		}
+		sort.Slice(conns, func(i, j int) bool { return conns[i] < conns[j] })
+
+		// round-robin between connections starting after the last served one
+		first := sort.Search(len(conns), func(i int) bool { return conns[i] > lastConn })
+		minDelay := time.Duration(-1)
+		for i := 0; i < len(conns); i++ {
+			cNum := conns[(first+i)%len(conns)]
+			chunk := queues[cNum][0]
+			n := len(chunk.resp.Data)
+
+			connBucket, ok := connBuckets[cNum]
+			if !ok {
+				connBucket = lib.NewTokenBucket(p.shaping.BLOBRate, lib.INDIServerMaxRecvMsgSize)
+				connBuckets[cNum] = connBucket
+			}
+
+			if delay := lib.TakeTokens(n, connBucket, sessionBucket); delay > 0 {
+				if minDelay < 0 || delay < minDelay {
+					minDelay = delay
+				}
+				continue
+			}
+
+			if len(queues[cNum]) == 1 {
+				delete(queues, cNum)
+			} else {
+				queues[cNum] = queues[cNum][1:]
+			}
+			queuedBytes -= n
+			lastConn = cNum
+
+			send(chunk.resp)
+			inBLOB[cNum] = !chunk.last
+			if chunk.last {
+				for _, resp := range heldControl[cNum] {
+					send(resp)
+				}
+				delete(heldControl, cNum)
+			}
+			return true, 0
+		}
+
+		return false, minDelay
+	}
+
+	for {
+		// control elements always go first
+		select {
+		case resp, ok := <-controlCh:
+			if !ok {
+				return
+			}
+			sendControl(resp)
+			continue
+		default:
+		}
+
+		// collect BLOB chunks from INDI-server connections
+		if queuedBytes < maxQueuedBLOBBytes {
+			select {
+			case chunk, ok := <-blobCh:
+				if !ok {
+					return
+				}
+				queueBLOB(chunk)
+				continue
+			default:
+			}
+		}
+
+		sent, delay := sendBLOB()
+		if sent {
+			continue
+		}
+
+		// nothing to do right now - wait for new elements or rate limits
+		var timer <-chan time.Time
+		if delay > 0 {
+			timer = time.After(delay)
+		}
+		var inBLOBCh chan *blobChunk
+		if queuedBytes < maxQueuedBLOBBytes {
+			inBLOBCh = blobCh
+		}
+
+		select {
+		case resp, ok := <-controlCh:
+			if !ok {
+				return
+			}
+			sendControl(resp)
+		case chunk, ok := <-inBLOBCh:
+			if !ok {
+				return
+			}
+			queueBLOB(chunk)
+		case <-timer:
+		}
+	}
+}
+
+func (c *ShapingConfig) String() string {
+	rate := func(r int64) string {
+		if r <= 0 {
+			return "unlimited"
+		}
+		return fmt.Sprintf("%d KiB/s", r/1024)
+	}
+	policy := c.BLOBPolicy
+	if policy == "" {
+		policy = "guest's"
+	}
+	return fmt.Sprintf("BLOB rate per connection: %s, per session: %s, BLOB policy: %s",
+		rate(c.BLOBRate), rate(c.SessionBLOBRate), policy)
+}
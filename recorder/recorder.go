@@ -0,0 +1,252 @@
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/indihub-space/agent/lib"
+)
+
+// Direction of recorded INDI traffic
+type Direction byte
+
+const (
+	// ToServer marks elements sent by INDI-client (guest or WS-client) to INDI-server
+	ToServer Direction = 'S'
+	// ToClient marks elements sent by INDI-server to INDI-client
+	ToClient Direction = 'C'
+
+	// WSConnBase is added to connection numbers of WS API connections so they don't clash with tunnel ones
+	WSConnBase uint32 = 1 << 31
+
+	recordHeaderSize = 8 + 4 + 1 + 4
+)
+
+var (
+	fileMagic = []byte("INDIREC1")
+
+	elementSetBLOBVector = []byte("<setBLOBVector")
+	elementOneBLOB       = []byte("<oneBLOB")
+	elementOneBLOBEnd    = []byte("</oneBLOB>")
+
+	ErrBadFormat = errors.New("not an INDI recording file")
+)
+
+type streamKey struct {
+	conn uint32
+	dir  Direction
+}
+
+// Recorder writes every INDI element going in both directions into compact binary log file
+type Recorder struct {
+	mu         sync.Mutex
+	file       *os.File
+	w          *bufio.Writer
+	skipBLOBs  bool
+	flatteners map[streamKey]*lib.XmlFlattener
+}
+
+// Entry is one recorded INDI element
+type Entry struct {
+	Time time.Time
+	Conn uint32
+	Dir  Direction
+	Data []byte
+}
+
+// New creates recording file, the file is truncated if exists
+func New(fileName string, skipBLOBs bool) (*Recorder, error) {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(f)
+	if _, err := w.Write(fileMagic); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Recorder{
+		file:       f,
+		w:          w,
+		skipBLOBs:  skipBLOBs,
+		flatteners: map[streamKey]*lib.XmlFlattener{},
+	}, nil
+}
+
+// Record flattens chunk of INDI traffic for connection cNum and writes all complete elements
+func (r *Recorder) Record(cNum uint32, dir Direction, chunk []byte) {
+	if r == nil || len(chunk) == 0 {
+		return
+	}
+
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.w == nil {
+		return
+	}
+
+	key := streamKey{conn: cNum, dir: dir}
+	flattener, ok := r.flatteners[key]
+	if !ok {
+		flattener = lib.NewXmlFlattener()
+		r.flatteners[key] = flattener
+	}
+
+	for _, el := range flattener.FeedChunk(chunk) {
+		if r.skipBLOBs && bytes.HasPrefix(el, elementSetBLOBVector) {
+			el = stripBLOBs(el)
+		}
+		r.write(now, cNum, dir, el)
+	}
+}
+
+// CloseConn forgets partial data of connection which was closed
+func (r *Recorder) CloseConn(cNum uint32) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.flatteners, streamKey{conn: cNum, dir: ToServer})
+	delete(r.flatteners, streamKey{conn: cNum, dir: ToClient})
+}
+
+// Close flushes and closes recording file
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.w == nil {
+		return nil
+	}
+
+	err := r.w.Flush()
+	if cErr := r.file.Close(); err == nil {
+		err = cErr
+	}
+	r.w = nil
+
+	return err
+}
+
+func (r *Recorder) write(t time.Time, cNum uint32, dir Direction, el []byte) {
+	header := make([]byte, recordHeaderSize)
+	binary.BigEndian.PutUint64(header[0:8], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint32(header[8:12], cNum)
+	header[12] = byte(dir)
+	binary.BigEndian.PutUint32(header[13:17], uint32(len(el)))
+
+	r.w.Write(header)
+	r.w.Write(el)
+}
+
+// stripBLOBs removes payloads from all oneBLOB elements keeping their attributes
+func stripBLOBs(el []byte) []byte {
+	res := make([]byte, 0, 512)
+	for {
+		start := bytes.Index(el, elementOneBLOB)
+		if start == -1 {
+			break
+		}
+		tagEnd := bytes.IndexByte(el[start:], '>')
+		if tagEnd == -1 {
+			break
+		}
+		tagEnd += start + 1
+		end := bytes.Index(el[tagEnd:], elementOneBLOBEnd)
+		if end == -1 {
+			break
+		}
+		res = append(res, el[:tagEnd]...)
+		el = el[tagEnd+end:]
+	}
+
+	return append(res, el...)
+}
+
+// Reader reads recording file created by Recorder
+type Reader struct {
+	file *os.File
+	r    *bufio.Reader
+}
+
+// Open opens recording file for reading
+func Open(fileName string) (*Reader, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(fileMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, fileMagic) {
+		f.Close()
+		return nil, ErrBadFormat
+	}
+
+	return &Reader{
+		file: f,
+		r:    r,
+	}, nil
+}
+
+// Next returns next recorded element or io.EOF
+func (r *Reader) Next() (*Entry, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			// recording was not closed properly, ignore broken tail
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	entry := &Entry{
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(header[0:8]))),
+		Conn: binary.BigEndian.Uint32(header[8:12]),
+		Dir:  Direction(header[12]),
+		Data: make([]byte, binary.BigEndian.Uint32(header[13:17])),
+	}
+	if _, err := io.ReadFull(r.r, entry.Data); err != nil {
+		return nil, io.EOF
+	}
+
+	return entry, nil
+}
+
+// ReadAll reads all the remaining recorded elements
+func (r *Reader) ReadAll() ([]*Entry, error) {
+	entries := []*Entry{}
+	for {
+		entry, err := r.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// Close closes recording file
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
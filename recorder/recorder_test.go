@@ -0,0 +1,230 @@
+package recorder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/indihub-space/agent/lib"
+)
+
+// fixture is recorded from Telescope and CCD simulators with two guest connections and one WS API connection
+const fixture = "testdata/session.rec"
+
+func tempFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "session.rec"), func() { os.RemoveAll(dir) }
+}
+
+func readAll(t *testing.T, fileName string) []*Entry {
+	t.Helper()
+	r, err := Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	entries, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestRecordAndRead(t *testing.T) {
+	fileName, cleanup := tempFile(t)
+	defer cleanup()
+
+	rec, err := New(fileName, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// elements are split between chunks and chunks of connections are interleaved
+	rec.Record(1, ToServer, []byte(`<getProperties version="1.7"/><newSwitchVector device="Tel`))
+	rec.Record(2, ToClient, []byte(`<setBLOBVector device="CCD" name="CCD1"><oneBLOB name="CCD1" size="3" format=".fits">QUJD</oneBLOB>`))
+	rec.Record(1, ToServer, []byte(`escope" name="CONNECTION"><oneSwitch name="CONNECT">On</oneSwitch></newSwitchVector>`))
+	rec.Record(2, ToClient, []byte(`</setBLOBVector><defTextVector device="CCD"`))
+	// partial element of closed connection is dropped
+	rec.CloseConn(2)
+	rec.Record(2, ToClient, []byte(`<message device="CCD" message="closed"/>`))
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// recorder is nil-safe and ignores data after close
+	rec.Record(1, ToServer, []byte(`<getProperties version="1.7"/>`))
+	var noRec *Recorder
+	noRec.Record(1, ToServer, []byte(`<getProperties version="1.7"/>`))
+
+	expected := []struct {
+		conn uint32
+		dir  Direction
+		data string
+	}{
+		{1, ToServer, `<getProperties version="1.7"/>`},
+		{1, ToServer, `<newSwitchVector device="Telescope" name="CONNECTION"><oneSwitch name="CONNECT">On</oneSwitch></newSwitchVector>`},
+		{2, ToClient, `<setBLOBVector device="CCD" name="CCD1"><oneBLOB name="CCD1" size="3" format=".fits"></oneBLOB></setBLOBVector>`},
+		{2, ToClient, `<message device="CCD" message="closed"/>`},
+	}
+	entries := readAll(t, fileName)
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %d", len(expected), len(entries))
+	}
+	for i, e := range expected {
+		if entries[i].Conn != e.conn || entries[i].Dir != e.dir || string(entries[i].Data) != e.data {
+			t.Errorf("entry %d: got %d %c %s", i, entries[i].Conn, entries[i].Dir, entries[i].Data)
+		}
+		if i > 0 && entries[i].Time.Before(entries[i-1].Time) {
+			t.Errorf("entry %d is recorded before the previous one", i)
+		}
+	}
+}
+
+func TestReadBrokenRecording(t *testing.T) {
+	fileName, cleanup := tempFile(t)
+	defer cleanup()
+
+	data, err := ioutil.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := readAll(t, fixture)
+
+	// recording which was not closed properly is read up to the broken tail
+	for _, cut := range []int{1, recordHeaderSize / 2, recordHeaderSize + 10} {
+		if err := ioutil.WriteFile(fileName, data[:len(data)-len(all[len(all)-1].Data)-recordHeaderSize+cut], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if entries := readAll(t, fileName); len(entries) != len(all)-1 {
+			t.Errorf("cut %d: expected %d entries, got %d", cut, len(all)-1, len(entries))
+		}
+	}
+
+	if err := ioutil.WriteFile(fileName, []byte("<getProperties version=\"1.7\"/>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(fileName); err != ErrBadFormat {
+		t.Errorf("expected bad format, got %v", err)
+	}
+}
+
+// TestFlattenerOnRecording feeds recorded INDI streams to flattener in chunks of different sizes
+func TestFlattenerOnRecording(t *testing.T) {
+	entries := readAll(t, fixture)
+	if len(entries) != 16 {
+		t.Fatalf("expected 16 entries in fixture, got %d", len(entries))
+	}
+
+	streams := map[streamKey][][]byte{}
+	for _, e := range entries {
+		key := streamKey{conn: e.Conn, dir: e.Dir}
+		streams[key] = append(streams[key], e.Data)
+	}
+	if len(streams) != 4 {
+		t.Fatalf("expected 4 streams in fixture, got %d", len(streams))
+	}
+
+	for key, elements := range streams {
+		stream := bytes.Join(elements, nil)
+		for _, size := range []int{1, 7, 64, 1000, len(stream)} {
+			f := lib.NewXmlFlattener()
+			got := [][]byte{}
+			for start := 0; start < len(stream); start += size {
+				end := start + size
+				if end > len(stream) {
+					end = len(stream)
+				}
+				// elements returned by flattener are only valid until the next chunk
+				for _, el := range f.FeedChunk(stream[start:end]) {
+					got = append(got, append([]byte{}, el...))
+				}
+			}
+			if len(got) != len(elements) {
+				t.Errorf("stream %d %c, chunk %d: expected %d elements, got %d", key.conn, key.dir, size, len(elements), len(got))
+				continue
+			}
+			for i := range got {
+				// new line after element is kept only if it came in the same chunk
+				if !bytes.Equal(bytes.TrimSpace(got[i]), bytes.TrimSpace(elements[i])) {
+					t.Errorf("stream %d %c, chunk %d: element %d is %q, expected %q", key.conn, key.dir, size, i, got[i], elements[i])
+				}
+			}
+		}
+	}
+}
+
+func TestPlayer(t *testing.T) {
+	entries := readAll(t, fixture)
+	expected := func(dir Direction, conn uint32, allConn bool) []byte {
+		buf := &bytes.Buffer{}
+		for _, e := range entries {
+			if e.Dir == dir && (allConn || e.Conn == conn) {
+				buf.Write(e.Data)
+			}
+		}
+		return buf.Bytes()
+	}
+
+	for _, c := range []struct {
+		dir     Direction
+		conn    uint32
+		allConn bool
+	}{
+		{ToClient, 1, false},
+		{ToServer, 2, false},
+		{ToClient, WSConnBase + 1, false},
+		{ToServer, 0, true},
+		{ToClient, 0, true},
+	} {
+		buf := &bytes.Buffer{}
+		if err := NewPlayer(fixture, 0, c.conn, c.allConn).play(buf, c.dir); err != nil {
+			t.Fatal(err)
+		}
+		if exp := expected(c.dir, c.conn, c.allConn); buf.Len() == 0 || !bytes.Equal(buf.Bytes(), exp) {
+			t.Errorf("%c %d %v: played %d bytes, expected %d", c.dir, c.conn, c.allConn, buf.Len(), len(exp))
+		}
+	}
+
+	if err := NewPlayer("testdata/missing.rec", 0, 1, false).play(ioutil.Discard, ToClient); err == nil {
+		t.Error("missing recording is played")
+	}
+}
+
+func TestFakeClient(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan []byte)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(received)
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(`<defTextVector device="Telescope Simulator" name="DRIVER_INFO"></defTextVector>`))
+		data, _ := ioutil.ReadAll(conn)
+		received <- data
+	}()
+
+	if err := NewPlayer(fixture, 1000, 1, false).RunFakeClient(l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	data := <-received
+	buf := &bytes.Buffer{}
+	for _, e := range readAll(t, fixture) {
+		if e.Conn == 1 && e.Dir == ToServer {
+			buf.Write(e.Data)
+		}
+	}
+	if !bytes.Equal(data, buf.Bytes()) {
+		t.Errorf("server received %q", data)
+	}
+}
@@ -0,0 +1,113 @@
+package recorder
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/indihub-space/agent/logutil"
+)
+
+var logger = logutil.New("subsystem", "replay")
+
+// Player feeds elements of recording file back to INDI-client or INDI-server, elements are read one by one
+// while playing, so recordings of any size can be played
+type Player struct {
+	fileName string
+	speed    float64
+	conn     uint32
+	allConn  bool
+}
+
+// NewPlayer creates player of recording file, speed 1 is real-time, 0 means no delays at all.
+// If allConn is false only elements of connection conn are played.
+func NewPlayer(fileName string, speed float64, conn uint32, allConn bool) *Player {
+	return &Player{
+		fileName: fileName,
+		speed:    speed,
+		conn:     conn,
+		allConn:  allConn,
+	}
+}
+
+// ServeFakeServer listens on addr and acts as INDI-server sending recorded server elements to every client
+func (p *Player) ServeFakeServer(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	logger.Infof("Fake INDI-server is listening on %s", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		logger.Infof("Client %s connected, replaying recording", conn.RemoteAddr())
+		go func(c net.Conn) {
+			defer c.Close()
+			// client commands are read and dropped
+			go io.Copy(ioutil.Discard, c)
+			if err := p.play(c, ToClient); err != nil {
+				logger.Warnf("Replay to %s stopped: %s", c.RemoteAddr(), err)
+				return
+			}
+			logger.Infof("Replay to %s finished", c.RemoteAddr())
+		}(conn)
+	}
+}
+
+// RunFakeClient connects to INDI-server on addr and sends recorded client elements
+func (p *Player) RunFakeClient(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// server responses are read and dropped
+	go io.Copy(ioutil.Discard, conn)
+
+	logger.Infof("Fake INDI-client connected to %s, replaying recording", addr)
+	if err := p.play(conn, ToServer); err != nil {
+		return err
+	}
+	logger.Infof("Replay finished")
+
+	return nil
+}
+
+func (p *Player) play(w io.Writer, dir Direction) error {
+	reader, err := Open(p.fileName)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	var prev time.Time
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entry.Dir != dir || (!p.allConn && entry.Conn != p.conn) {
+			continue
+		}
+
+		if !prev.IsZero() && p.speed > 0 {
+			if delay := entry.Time.Sub(prev); delay > 0 {
+				time.Sleep(time.Duration(float64(delay) / p.speed))
+			}
+		}
+		prev = entry.Time
+
+		if _, err := w.Write(entry.Data); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+
+	"github.com/indihub-space/agent/recorder"
+)
+
+// runReplay implements 'replay' command: feeds recording back as fake INDI-server or fake INDI-client
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	recFile := fs.String("file", "", "path to recording file made with -record-file parameter")
+	as := fs.String("as", "server", `what to act as: "server" - fake INDI-server, "client" - fake INDI-client`)
+	addr := fs.String("addr", "localhost:7624", "address to listen on (server) or to connect to (client)")
+	speed := fs.Float64("speed", 1, "replay speed: 1 - real-time, 10 - ten times faster, 0 - without delays")
+	conn := fs.Int64("conn", -1, "replay only this connection number (the first recorded connection by default)")
+	all := fs.Bool("all", false, "replay all connections interleaved")
+	fs.Parse(args)
+
+	if *recFile == "" {
+		logger.Fatalf("'file' parameter is required")
+	}
+
+	// recording is played from file, the first element is only read to check it and to find the first connection
+	reader, err := recorder.Open(*recFile)
+	if err != nil {
+		logger.Fatalf("could not open recording '%s': %s", *recFile, err)
+	}
+	first, err := reader.Next()
+	reader.Close()
+	if err == io.EOF {
+		logger.Fatalf("recording '%s' is empty", *recFile)
+	}
+	if err != nil {
+		logger.Fatalf("could not read recording '%s': %s", *recFile, err)
+	}
+	if *conn < 0 && !*all {
+		*conn = int64(first.Conn)
+		logger.Infof("Replaying connection %d, use -conn or -all parameters to replay other connections", *conn)
+	}
+
+	player := recorder.NewPlayer(*recFile, *speed, uint32(*conn), *all)
+	switch *as {
+	case "server":
+		err = player.ServeFakeServer(*addr)
+	case "client":
+		err = player.RunFakeClient(*addr)
+	default:
+		logger.Fatalf("unknown replay role '%s'", *as)
+	}
+	if err != nil {
+		logger.Errorf("replay error: %s", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,108 @@
+package safety
+
+import (
+	"sync"
+	"time"
+
+	"github.com/indihub-space/agent/indiclient"
+)
+
+// max time to wait for abort commands, parking and closing use full timeout
+const abortTimeout = 15 * time.Second
+
+// ActionReport is result of one emergency command sent to device
+type ActionReport struct {
+	Property string `json:"property"`
+	Element  string `json:"element"`
+	State    string `json:"state"`
+	Error    string `json:"error,omitempty"`
+}
+
+// DeviceReport is result of emergency stop for device
+type DeviceReport struct {
+	Device  string         `json:"device"`
+	OK      bool           `json:"ok"`
+	Actions []ActionReport `json:"actions"`
+}
+
+type action struct {
+	property string
+	element  string
+	isAbort  bool
+}
+
+// stopSequence is applied to every device in this order, properties device doesn't have are skipped
+var stopSequence = []action{
+	{property: "TELESCOPE_ABORT_MOTION", element: "ABORT", isAbort: true},
+	{property: "CCD_ABORT_EXPOSURE", element: "ABORT", isAbort: true},
+	{property: "FOCUS_ABORT_MOTION", element: "ABORT", isAbort: true},
+	{property: "DOME_ABORT_MOTION", element: "ABORT", isAbort: true},
+	{property: "TELESCOPE_PARK", element: "PARK"},
+	{property: "DOME_SHUTTER", element: "SHUTTER_CLOSE"},
+	{property: "DOME_PARK", element: "PARK"},
+}
+
+// EmergencyStop aborts motion and exposures, parks mounts and closes domes of all devices in parallel
+func EmergencyStop(client *indiclient.Client, timeout time.Duration) []DeviceReport {
+	devices := []string{}
+	for _, device := range client.Devices() {
+		for _, a := range stopSequence {
+			if client.HasProperty(device, a.property) {
+				devices = append(devices, device)
+				break
+			}
+		}
+	}
+
+	reports := make([]DeviceReport, len(devices))
+	wg := sync.WaitGroup{}
+	for i, device := range devices {
+		wg.Add(1)
+		go func(i int, device string) {
+			defer wg.Done()
+			reports[i] = stopDevice(client, device, timeout)
+		}(i, device)
+	}
+	wg.Wait()
+
+	return reports
+}
+
+func stopDevice(client *indiclient.Client, device string, timeout time.Duration) DeviceReport {
+	report := DeviceReport{
+		Device:  device,
+		OK:      true,
+		Actions: []ActionReport{},
+	}
+
+	for _, a := range stopSequence {
+		if !client.HasProperty(device, a.property) {
+			continue
+		}
+
+		actTimeout := timeout
+		if a.isAbort && actTimeout > abortTimeout {
+			actTimeout = abortTimeout
+		}
+
+		logger.Infof("Emergency stop: %s %s.%s", device, a.property, a.element)
+		state, err := client.SetSwitchAndWait(device, a.property, a.element, actTimeout)
+		actReport := ActionReport{
+			Property: a.property,
+			Element:  a.element,
+			State:    state,
+		}
+		if err != nil {
+			actReport.Error = err.Error()
+		} else if state == indiclient.StateAlert {
+			actReport.Error = "device reported Alert state"
+		}
+		if actReport.Error != "" {
+			logger.Errorf("Emergency stop: %s %s failed: %s", device, a.property, actReport.Error)
+			report.OK = false
+		}
+		report.Actions = append(report.Actions, actReport)
+	}
+
+	return report
+}
@@ -0,0 +1,239 @@
+package safety
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/indihub-space/agent/indiclient"
+	"github.com/indihub-space/agent/lib"
+)
+
+const rigDefs = `<defSwitchVector device="Mount" name="TELESCOPE_ABORT_MOTION" state="Idle" perm="rw" rule="AtMostOne">
+<defSwitch name="ABORT">Off</defSwitch>
+</defSwitchVector>
+<defSwitchVector device="Mount" name="TELESCOPE_PARK" state="Ok" perm="rw" rule="OneOfMany">
+<defSwitch name="PARK">Off</defSwitch>
+<defSwitch name="UNPARK">On</defSwitch>
+</defSwitchVector>
+<defSwitchVector device="CCD" name="CCD_ABORT_EXPOSURE" state="Idle" perm="rw" rule="AtMostOne">
+<defSwitch name="ABORT">Off</defSwitch>
+</defSwitchVector>
+<defSwitchVector device="Dome" name="DOME_ABORT_MOTION" state="Idle" perm="rw" rule="AtMostOne">
+<defSwitch name="ABORT">Off</defSwitch>
+</defSwitchVector>
+<defSwitchVector device="Dome" name="DOME_SHUTTER" state="Ok" perm="rw" rule="OneOfMany">
+<defSwitch name="SHUTTER_OPEN">On</defSwitch>
+<defSwitch name="SHUTTER_CLOSE">Off</defSwitch>
+</defSwitchVector>
+<defSwitchVector device="Dome" name="DOME_PARK" state="Ok" perm="rw" rule="OneOfMany">
+<defSwitch name="PARK">Off</defSwitch>
+<defSwitch name="UNPARK">On</defSwitch>
+</defSwitchVector>
+<defLightVector device="Weather" name="WEATHER_STATUS" state="Ok">
+<defLight name="WEATHER_RAIN_HOUR">Ok</defLight>
+</defLightVector>
+`
+
+// fakeINDIServer answers getProperties with defs, replies to switch commands with states and keeps everything it receives
+type fakeINDIServer struct {
+	l net.Listener
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	received strings.Builder
+	states   map[string]string // reply state by device.property, no reply if state is empty
+}
+
+func newFakeINDIServer(t *testing.T, states map[string]string) *fakeINDIServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeINDIServer{l: l, states: states}
+	go s.accept()
+	return s
+}
+
+func (s *fakeINDIServer) addr() string {
+	return s.l.Addr().String()
+}
+
+func (s *fakeINDIServer) accept() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, c)
+		s.mu.Unlock()
+		go s.serve(c)
+	}
+}
+
+func (s *fakeINDIServer) serve(c net.Conn) {
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.received.WriteString(line)
+		s.mu.Unlock()
+
+		switch {
+		case strings.HasPrefix(line, "<getProperties"):
+			c.Write([]byte(rigDefs))
+		case strings.HasPrefix(line, "<newSwitchVector"):
+			el := []byte(line)
+			device, name := lib.ElementAttr(el, "device"), lib.ElementAttr(el, "name")
+			s.mu.Lock()
+			state := s.states[device+"."+name]
+			s.mu.Unlock()
+			if state != "" {
+				fmt.Fprintf(c, "<setSwitchVector device=\"%s\" name=\"%s\" state=\"%s\">\n</setSwitchVector>\n", device, name, state)
+			}
+		}
+	}
+}
+
+// send sends data to all connected clients
+func (s *fakeINDIServer) send(data string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Write([]byte(data))
+	}
+}
+
+func (s *fakeINDIServer) data() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received.String()
+}
+
+// waitData waits until INDI-server receives all parts
+func (s *fakeINDIServer) waitData(t *testing.T, parts ...string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		data := s.data()
+		received := true
+		for _, part := range parts {
+			received = received && strings.Contains(data, part)
+		}
+		if received {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("INDI-server didn't receive %q, got: %s", parts, data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *fakeINDIServer) close() {
+	s.l.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+func dialRig(t *testing.T, server *fakeINDIServer) *indiclient.Client {
+	client, err := indiclient.Dial(server.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.WaitDefs(200*time.Millisecond, 3*time.Second)
+	return client
+}
+
+func okStates() map[string]string {
+	return map[string]string{
+		"Mount.TELESCOPE_ABORT_MOTION": indiclient.StateOk,
+		"Mount.TELESCOPE_PARK":         indiclient.StateOk,
+		"CCD.CCD_ABORT_EXPOSURE":       indiclient.StateOk,
+		"Dome.DOME_ABORT_MOTION":       indiclient.StateOk,
+		"Dome.DOME_SHUTTER":            indiclient.StateOk,
+		"Dome.DOME_PARK":               indiclient.StateOk,
+	}
+}
+
+func TestEmergencyStop(t *testing.T) {
+	server := newFakeINDIServer(t, okStates())
+	defer server.close()
+	client := dialRig(t, server)
+	defer client.Close()
+
+	reports := EmergencyStop(client, time.Second)
+
+	devices := map[string]DeviceReport{}
+	for _, r := range reports {
+		devices[r.Device] = r
+	}
+	if len(devices) != 3 {
+		t.Fatalf("expected reports for Mount, CCD and Dome, got %+v", reports)
+	}
+	for device, actions := range map[string][]string{
+		"Mount": {"TELESCOPE_ABORT_MOTION", "TELESCOPE_PARK"},
+		"CCD":   {"CCD_ABORT_EXPOSURE"},
+		"Dome":  {"DOME_ABORT_MOTION", "DOME_SHUTTER", "DOME_PARK"},
+	} {
+		r := devices[device]
+		if !r.OK || len(r.Actions) != len(actions) {
+			t.Errorf("unexpected %s report: %+v", device, r)
+			continue
+		}
+		// aborts go before parking and closing
+		for i, property := range actions {
+			if r.Actions[i].Property != property || r.Actions[i].State != indiclient.StateOk {
+				t.Errorf("unexpected %s action %d: %+v", device, i, r.Actions[i])
+			}
+		}
+	}
+
+	server.waitData(t,
+		`<oneSwitch name="PARK">On</oneSwitch>`,
+		`<oneSwitch name="UNPARK">Off</oneSwitch>`,
+		`<oneSwitch name="SHUTTER_CLOSE">On</oneSwitch>`,
+		`<oneSwitch name="SHUTTER_OPEN">Off</oneSwitch>`,
+	)
+}
+
+func TestEmergencyStopFailures(t *testing.T) {
+	states := okStates()
+	states["Dome.DOME_SHUTTER"] = indiclient.StateAlert
+	delete(states, "CCD.CCD_ABORT_EXPOSURE")
+	server := newFakeINDIServer(t, states)
+	defer server.close()
+	client := dialRig(t, server)
+	defer client.Close()
+
+	reports := EmergencyStop(client, 300*time.Millisecond)
+
+	for _, r := range reports {
+		switch r.Device {
+		case "Mount":
+			if !r.OK {
+				t.Errorf("mount failed: %+v", r)
+			}
+		case "CCD":
+			if r.OK || r.Actions[0].Error != indiclient.ErrTimeout.Error() {
+				t.Errorf("CCD abort didn't time out: %+v", r)
+			}
+		case "Dome":
+			// failed shutter doesn't stop parking of dome
+			if r.OK || len(r.Actions) != 3 || r.Actions[1].Error == "" || r.Actions[2].Error != "" {
+				t.Errorf("unexpected dome report: %+v", r)
+			}
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package safety
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/indihub-space/agent/hostutils"
+	"github.com/indihub-space/agent/indiclient"
+	"github.com/indihub-space/agent/lib"
+	"github.com/indihub-space/agent/logutil"
+)
+
+var logger = logutil.New("subsystem", "safety")
+
+const (
+	ConditionUnknown = "unknown"
+	ConditionOk      = "ok"
+	ConditionAlert   = "alert"
+
+	maxEvents      = 20
+	reconnectDelay = 10 * time.Second
+	parkTimeout    = 180 * time.Second
+)
+
+// evaluateInterval is how often conditions are evaluated besides property changes, it counts hold time
+var evaluateInterval = time.Second
+
+// monitoredProperties are light properties of weather and safety devices
+var monitoredProperties = map[string]bool{
+	"WEATHER_STATUS": true,
+	"SAFETY_STATUS":  true,
+}
+
+// ModeController switches agent modes
+type ModeController interface {
+	CurrentMode() string
+	SwitchMode(mode string) error
+	NotifyGuests(message string)
+}
+
+// Event is safety condition change
+type Event struct {
+	Time      time.Time `json:"time"`
+	Condition string    `json:"condition"`
+	Reason    string    `json:"reason,omitempty"`
+	Action    string    `json:"action,omitempty"`
+}
+
+// Supervisor watches weather and safety devices, parks equipment and gates modes on Alert.
+// After Alert sharing stays stopped until conditions are reported Ok for hold time: unknown conditions
+// (weather device is gone or INDI-server is restarted) are not safe and start hold time again.
+type Supervisor struct {
+	indiServerAddr string
+	holdTime       time.Duration
+	controller     ModeController
+	filter         *hostutils.INDIFilter
+
+	mu           sync.Mutex
+	condition    string
+	reason       string
+	since        time.Time
+	okSince      time.Time
+	resumeMode   string
+	events       []Event
+	parkReport   []DeviceReport
+	sources      []string
+	client       *indiclient.Client
+	stopCh       chan struct{}
+	stopOnce     sync.Once
+	alertHandled bool
+	alertReason  string
+}
+
+// NewSupervisor creates safety supervisor, resumes sharing after conditions are Ok for holdTime
+func NewSupervisor(indiServerAddr string, holdTime time.Duration, controller ModeController,
+	filter *hostutils.INDIFilter) *Supervisor {
+	return &Supervisor{
+		indiServerAddr: indiServerAddr,
+		holdTime:       holdTime,
+		controller:     controller,
+		filter:         filter,
+		condition:      ConditionUnknown,
+		since:          time.Now(),
+		events:         []Event{},
+		sources:        []string{},
+		stopCh:         make(chan struct{}),
+	}
+}
+
+// Run watches INDI-server until Stop is called, re-connecting when connection is lost
+func (s *Supervisor) Run() {
+	ticker := time.NewTicker(evaluateInterval)
+	defer ticker.Stop()
+
+	for {
+		client, err := indiclient.Dial(s.indiServerAddr)
+		if err != nil {
+			logger.Errorf("Safety supervisor could not connect to INDI-server: %s", err)
+		} else {
+			logger.Infof("Safety supervisor is watching weather and safety devices")
+			s.mu.Lock()
+			s.client = client
+			s.mu.Unlock()
+
+			// evaluate in watch loop, not in client reading goroutine: parking waits for client updates
+			changed := make(chan struct{}, 1)
+			unsubscribe := client.Subscribe(func(msg *indiclient.Message) {
+				if monitoredProperties[msg.Name] {
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				}
+			})
+			s.watch(client, changed, ticker.C)
+			unsubscribe()
+			client.Close()
+
+			s.mu.Lock()
+			s.client = nil
+			s.setCondition(ConditionUnknown, "", "connection to INDI-server is lost")
+			s.mu.Unlock()
+		}
+
+		select {
+		case <-s.stopCh:
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// watch evaluates conditions on changes and every tick (for hold time of Ok conditions)
+// until connection is lost or supervisor is stopped
+func (s *Supervisor) watch(client *indiclient.Client, changed <-chan struct{}, tick <-chan time.Time) {
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-client.Done():
+			logger.Warnf("Safety supervisor lost connection to INDI-server")
+			return
+		case <-changed:
+			s.evaluate()
+		case <-tick:
+			s.evaluate()
+		}
+	}
+}
+
+// Stop stops supervisor
+func (s *Supervisor) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+}
+
+// AllowMode is used as mode gate: sharing modes are not allowed while conditions are not safe
+func (s *Supervisor) AllowMode(mode string) error {
+	if mode != lib.ModeShare && mode != lib.ModeRobotic {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.condition == ConditionAlert || s.alertHandled {
+		return fmt.Errorf("mode '%s' is not allowed: %s", mode, s.blockReason())
+	}
+	return nil
+}
+
+// blockReason explains why sharing modes are not allowed, it should be called with mu held
+func (s *Supervisor) blockReason() string {
+	switch {
+	case s.condition == ConditionAlert:
+		return fmt.Sprintf("safety conditions are not OK (%s)", s.reason)
+	case s.condition == ConditionUnknown:
+		return fmt.Sprintf("safety conditions are unknown after alert (%s), they must be reported OK for %s",
+			s.alertReason, s.holdTime)
+	default:
+		return fmt.Sprintf("safety conditions must stay OK for %s after alert (%s)", s.holdTime, s.alertReason)
+	}
+}
+
+// GetStatus returns safety state to be shown in agent status
+func (s *Supervisor) GetStatus() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blocked, _ := s.filter.IsBlockedBy(hostutils.BlockSafety)
+	status := map[string]interface{}{
+		"condition": s.condition,
+		"since":     s.since,
+		"sources":   s.sources,
+		"blocking":  blocked,
+		"events":    append([]Event{}, s.events...),
+	}
+	if s.reason != "" {
+		status["reason"] = s.reason
+	}
+	if s.resumeMode != "" {
+		status["resumeMode"] = s.resumeMode
+	}
+	status["sharingAllowed"] = s.condition != ConditionAlert && !s.alertHandled
+	if s.condition == ConditionAlert || s.alertHandled {
+		status["blockReason"] = s.blockReason()
+	}
+	if s.alertHandled {
+		status["lastAlert"] = s.alertReason
+	}
+	if s.alertHandled && !s.okSince.IsZero() {
+		status["resumeAt"] = s.okSince.Add(s.holdTime)
+	}
+	if s.parkReport != nil {
+		status["parkReport"] = s.parkReport
+	}
+
+	return status
+}
+
+// readCondition returns current condition reported by all weather and safety devices
+func (s *Supervisor) readCondition(client *indiclient.Client) (string, string, []string) {
+	sources := []string{}
+	alerts := []string{}
+	for name := range monitoredProperties {
+		for _, device := range client.DevicesWithProperty(name) {
+			v, ok := client.Property(device, name)
+			if !ok {
+				continue
+			}
+			sources = append(sources, device+"."+name)
+			if v.State == indiclient.StateAlert {
+				alerts = append(alerts, device+"."+name)
+				continue
+			}
+			for _, e := range v.Elements {
+				if e.Value == indiclient.StateAlert {
+					alerts = append(alerts, device+"."+name+"."+e.Name)
+				}
+			}
+		}
+	}
+
+	sort.Strings(sources)
+	sort.Strings(alerts)
+
+	if len(sources) == 0 {
+		return ConditionUnknown, "", sources
+	}
+	if len(alerts) > 0 {
+		return ConditionAlert, "Alert in " + strings.Join(alerts, ", "), sources
+	}
+	return ConditionOk, "", sources
+}
+
+func (s *Supervisor) evaluate() {
+	s.mu.Lock()
+	client := s.client
+	s.mu.Unlock()
+	if client == nil {
+		return
+	}
+
+	condition, reason, sources := s.readCondition(client)
+
+	s.mu.Lock()
+	s.sources = sources
+	s.setCondition(condition, reason, "")
+
+	switch {
+	case condition == ConditionAlert && !s.alertHandled:
+		s.alertHandled = true
+		s.alertReason = reason
+		s.okSince = time.Time{}
+		s.mu.Unlock()
+		s.onAlert(client, reason)
+		return
+
+	case condition == ConditionOk && s.alertHandled:
+		if s.okSince.IsZero() {
+			s.okSince = time.Now()
+		}
+		if time.Since(s.okSince) >= s.holdTime {
+			s.alertHandled = false
+			resumeMode := s.resumeMode
+			s.resumeMode = ""
+			s.mu.Unlock()
+			s.onOk(resumeMode)
+			return
+		}
+	}
+	s.mu.Unlock()
+}
+
+// setCondition records condition change, it should be called with mu held
+func (s *Supervisor) setCondition(condition string, reason string, action string) {
+	if condition == s.condition && reason == s.reason {
+		return
+	}
+	s.condition = condition
+	s.reason = reason
+	s.since = time.Now()
+	// Ok conditions must be seen for the whole hold time
+	if condition != ConditionOk {
+		s.okSince = time.Time{}
+	}
+	s.addEvent(condition, reason, action)
+	logger.Infof("Safety condition changed to '%s' %s", condition, reason)
+}
+
+func (s *Supervisor) onAlert(client *indiclient.Client, reason string) {
+	s.filter.Block(hostutils.BlockSafety, "safety alert: "+reason)
+
+	// drop sharing modes to solo
+	currMode := s.controller.CurrentMode()
+	if currMode == lib.ModeShare || currMode == lib.ModeRobotic {
+		s.controller.NotifyGuests("INDIHUB: session is stopped because of unsafe weather conditions, sorry!")
+		if err := s.controller.SwitchMode(lib.ModeSolo); err != nil {
+			logger.Errorf("Safety supervisor could not switch to solo-mode: %s", err)
+		} else {
+			s.mu.Lock()
+			s.resumeMode = currMode
+			s.mu.Unlock()
+		}
+	}
+
+	// park and close the rig
+	logger.Infof("Safety supervisor: parking and closing equipment")
+	report := EmergencyStop(client, parkTimeout)
+
+	s.mu.Lock()
+	s.parkReport = report
+	s.addEvent(ConditionAlert, reason, "guest commands blocked, equipment parked")
+	s.mu.Unlock()
+}
+
+func (s *Supervisor) onOk(resumeMode string) {
+	s.filter.Unblock(hostutils.BlockSafety)
+
+	action := "guest commands unblocked"
+	if resumeMode != "" && s.controller.CurrentMode() == lib.ModeSolo {
+		logger.Infof("Safety supervisor: conditions are OK for %s, resuming %s-mode", s.holdTime, resumeMode)
+		if err := s.controller.SwitchMode(resumeMode); err != nil {
+			logger.Errorf("Safety supervisor could not resume %s-mode: %s", resumeMode, err)
+		} else {
+			action += ", " + resumeMode + "-mode resumed"
+		}
+	}
+
+	s.mu.Lock()
+	s.addEvent(ConditionOk, "", action)
+	s.mu.Unlock()
+}
+
+func (s *Supervisor) addEvent(condition string, reason string, action string) {
+	s.events = append(s.events, Event{
+		Time:      time.Now(),
+		Condition: condition,
+		Reason:    reason,
+		Action:    action,
+	})
+	if len(s.events) > maxEvents {
+		s.events = s.events[len(s.events)-maxEvents:]
+	}
+}
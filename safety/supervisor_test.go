@@ -0,0 +1,245 @@
+package safety
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/indihub-space/agent/hostutils"
+	"github.com/indihub-space/agent/lib"
+)
+
+const (
+	weatherAlert = `<setLightVector device="Weather" name="WEATHER_STATUS" state="Alert">
+<oneLight name="WEATHER_RAIN_HOUR">Alert</oneLight>
+</setLightVector>
+`
+	weatherOk = `<setLightVector device="Weather" name="WEATHER_STATUS" state="Ok">
+<oneLight name="WEATHER_RAIN_HOUR">Ok</oneLight>
+</setLightVector>
+`
+	weatherGone = `<delProperty device="Weather" name="WEATHER_STATUS"/>
+`
+	weatherBack = `<defLightVector device="Weather" name="WEATHER_STATUS" state="Ok">
+<defLight name="WEATHER_RAIN_HOUR">Ok</defLight>
+</defLightVector>
+`
+)
+
+type fakeController struct {
+	mu       sync.Mutex
+	mode     string
+	switches []string
+	notified []string
+}
+
+func (c *fakeController) CurrentMode() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mode
+}
+
+func (c *fakeController) SwitchMode(mode string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mode = mode
+	c.switches = append(c.switches, mode)
+	return nil
+}
+
+func (c *fakeController) NotifyGuests(message string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.notified = append(c.notified, message)
+}
+
+func (c *fakeController) getSwitches() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.switches...)
+}
+
+// waitFor waits until cond is true
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func startSupervisor(t *testing.T, holdTime time.Duration) (*Supervisor, *fakeINDIServer, *fakeController,
+	*hostutils.INDIFilter, func()) {
+	evaluateInterval = 10 * time.Millisecond
+	server := newFakeINDIServer(t, okStates())
+	controller := &fakeController{mode: lib.ModeShare}
+	filter := hostutils.NewINDIFilter(&hostutils.INDIFilterConfig{})
+	s := NewSupervisor(server.addr(), holdTime, controller, filter)
+	go s.Run()
+
+	waitFor(t, "Ok condition", func() bool {
+		return s.GetStatus()["condition"] == ConditionOk
+	})
+	return s, server, controller, filter, func() {
+		s.Stop()
+		server.close()
+		evaluateInterval = time.Second
+	}
+}
+
+func isBlocked(filter *hostutils.INDIFilter) bool {
+	blocked, _ := filter.IsBlockedBy(hostutils.BlockSafety)
+	return blocked
+}
+
+func TestSupervisorAlertAndResume(t *testing.T) {
+	s, server, controller, filter, stop := startSupervisor(t, 300*time.Millisecond)
+	defer stop()
+
+	if err := s.AllowMode(lib.ModeShare); err != nil {
+		t.Fatalf("share-mode is not allowed: %s", err)
+	}
+
+	// alert blocks guests, stops sharing and parks equipment
+	server.send(weatherAlert)
+	waitFor(t, "equipment parked", func() bool {
+		return s.GetStatus()["parkReport"] != nil
+	})
+	if !isBlocked(filter) {
+		t.Error("guest commands are not blocked")
+	}
+	if switches := controller.getSwitches(); len(switches) != 1 || switches[0] != lib.ModeSolo {
+		t.Errorf("unexpected mode switches %v", switches)
+	}
+	controller.mu.Lock()
+	if len(controller.notified) != 1 {
+		t.Errorf("guests are not notified: %v", controller.notified)
+	}
+	controller.mu.Unlock()
+	server.waitData(t, `<oneSwitch name="PARK">On</oneSwitch>`, `<oneSwitch name="SHUTTER_CLOSE">On</oneSwitch>`)
+
+	status := s.GetStatus()
+	if status["condition"] != ConditionAlert || status["resumeMode"] != lib.ModeShare ||
+		status["sharingAllowed"] != false || !strings.Contains(status["reason"].(string), "Weather.WEATHER_STATUS") {
+		t.Errorf("unexpected status %v", status)
+	}
+	if err := s.AllowMode(lib.ModeRobotic); err == nil {
+		t.Error("robotic-mode is allowed during alert")
+	}
+	if err := s.AllowMode(lib.ModeSolo); err != nil {
+		t.Errorf("solo-mode is not allowed: %s", err)
+	}
+
+	// Ok conditions resume sharing after hold time
+	server.send(weatherOk)
+	waitFor(t, "Ok condition", func() bool {
+		return s.GetStatus()["condition"] == ConditionOk
+	})
+	status = s.GetStatus()
+	if _, ok := status["resumeAt"]; !ok || status["sharingAllowed"] != false || !isBlocked(filter) {
+		t.Errorf("sharing is resumed before hold time: %v", status)
+	}
+	if err := s.AllowMode(lib.ModeShare); err == nil || !strings.Contains(err.Error(), "must stay OK") {
+		t.Errorf("unexpected mode gate error during hold time: %v", err)
+	}
+
+	waitFor(t, "sharing resumed", func() bool {
+		return !isBlocked(filter)
+	})
+	waitFor(t, "share-mode resumed", func() bool {
+		switches := controller.getSwitches()
+		return len(switches) == 2 && switches[1] == lib.ModeShare
+	})
+	status = s.GetStatus()
+	if status["sharingAllowed"] != true || status["resumeMode"] != nil || status["blockReason"] != nil {
+		t.Errorf("unexpected status after resume %v", status)
+	}
+	if err := s.AllowMode(lib.ModeShare); err != nil {
+		t.Errorf("share-mode is not allowed after resume: %s", err)
+	}
+	events := status["events"].([]Event)
+	if last := events[len(events)-1]; last.Condition != ConditionOk || !strings.Contains(last.Action, "share-mode resumed") {
+		t.Errorf("unexpected last event %+v", last)
+	}
+}
+
+func TestSupervisorHoldTimeRestarts(t *testing.T) {
+	s, server, controller, filter, stop := startSupervisor(t, 500*time.Millisecond)
+	defer stop()
+
+	server.send(weatherAlert)
+	waitFor(t, "equipment parked", func() bool {
+		return s.GetStatus()["parkReport"] != nil
+	})
+
+	// short Ok period doesn't resume sharing
+	server.send(weatherOk)
+	time.Sleep(300 * time.Millisecond)
+	server.send(weatherAlert)
+	waitFor(t, "Alert condition", func() bool {
+		return s.GetStatus()["condition"] == ConditionAlert
+	})
+	okAt := time.Now()
+	server.send(weatherOk)
+	time.Sleep(300 * time.Millisecond)
+	if !isBlocked(filter) {
+		t.Fatal("hold time is not restarted by alert")
+	}
+
+	waitFor(t, "sharing resumed", func() bool {
+		return !isBlocked(filter)
+	})
+	if held := time.Since(okAt); held < 500*time.Millisecond {
+		t.Errorf("sharing resumed after %s", held)
+	}
+	// equipment is parked once per alert
+	if switches := controller.getSwitches(); len(switches) != 2 {
+		t.Errorf("unexpected mode switches %v", switches)
+	}
+}
+
+func TestSupervisorUnknownAfterAlert(t *testing.T) {
+	s, server, controller, filter, stop := startSupervisor(t, 200*time.Millisecond)
+	defer stop()
+
+	server.send(weatherAlert)
+	waitFor(t, "equipment parked", func() bool {
+		return s.GetStatus()["parkReport"] != nil
+	})
+	server.send(weatherOk)
+	time.Sleep(100 * time.Millisecond)
+
+	// weather device is gone: conditions are not safe, sharing stays stopped
+	server.send(weatherGone)
+	waitFor(t, "unknown condition", func() bool {
+		return s.GetStatus()["condition"] == ConditionUnknown
+	})
+	time.Sleep(400 * time.Millisecond)
+	if !isBlocked(filter) {
+		t.Fatal("guests are unblocked while conditions are unknown")
+	}
+	status := s.GetStatus()
+	if status["sharingAllowed"] != false || !strings.Contains(status["blockReason"].(string), "unknown after alert") ||
+		!strings.Contains(status["lastAlert"].(string), "WEATHER_STATUS") {
+		t.Errorf("unexpected status %v", status)
+	}
+	if _, ok := status["resumeAt"]; ok {
+		t.Errorf("resume time is shown while conditions are unknown: %v", status)
+	}
+	if err := s.AllowMode(lib.ModeShare); err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Errorf("unexpected mode gate error: %v", err)
+	}
+
+	// device is back and reports Ok for hold time
+	server.send(weatherBack)
+	waitFor(t, "sharing resumed", func() bool {
+		return !isBlocked(filter)
+	})
+	if switches := controller.getSwitches(); len(switches) != 2 || switches[1] != lib.ModeShare {
+		t.Errorf("unexpected mode switches %v", switches)
+	}
+}
@@ -0,0 +1,207 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/indihub-space/agent/lib"
+)
+
+const defaultWarnBefore = 10 * time.Minute
+
+var weekDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Duration is time.Duration which is read and written in JSON as string, i.e. "1h30m"
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s == "" {
+		d.Duration = 0
+		return nil
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = dur
+	return nil
+}
+
+// Window is recurring sharing window, i.e. weekdays from 21:00 to 01:00
+type Window struct {
+	Days []string `json:"days"` // mon, tue, ..., sun, weekdays, weekends or daily (empty means daily)
+	From string   `json:"from"` // local time HH:MM when session starts
+	To   string   `json:"to"`   // local time HH:MM when session ends, next day if it is before From
+}
+
+// Schedule describes when agent switches from solo-mode to sharing
+type Schedule struct {
+	Mode        string     `json:"mode"`               // share or robotic
+	Start       *time.Time `json:"start,omitempty"`    // one-off session start time
+	MaxDuration Duration   `json:"maxDuration"`        // max duration of any session, 0 - till window end
+	WarnBefore  Duration   `json:"warnBefore"`         // when to warn guests before the session end
+	Windows     []Window   `json:"windows"`            // recurring sessions
+	Disabled    bool       `json:"disabled,omitempty"` // schedule is kept but not applied
+}
+
+// Session is a period of time when agent should run in sharing mode
+type Session struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Validate checks schedule values and sets defaults
+func (s *Schedule) Validate() error {
+	if s.Mode == "" {
+		s.Mode = lib.ModeShare
+	}
+	if s.Mode != lib.ModeShare && s.Mode != lib.ModeRobotic {
+		return fmt.Errorf("schedule mode should be '%s' or '%s'", lib.ModeShare, lib.ModeRobotic)
+	}
+	if s.MaxDuration.Duration < 0 || s.WarnBefore.Duration < 0 {
+		return fmt.Errorf("durations could not be negative")
+	}
+	if s.Start != nil && s.MaxDuration.Duration == 0 {
+		return fmt.Errorf("maxDuration is required for session with start time")
+	}
+	if s.WarnBefore.Duration == 0 {
+		s.WarnBefore.Duration = defaultWarnBefore
+	}
+	for i, w := range s.Windows {
+		if _, err := w.days(); err != nil {
+			return fmt.Errorf("window %d: %s", i+1, err)
+		}
+		if _, _, err := parseClock(w.From); err != nil {
+			return fmt.Errorf("window %d: bad 'from' value: %s", i+1, err)
+		}
+		if _, _, err := parseClock(w.To); err != nil {
+			return fmt.Errorf("window %d: bad 'to' value: %s", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// Sessions returns sessions overlapping with period [from, to) sorted by start time
+func (s *Schedule) Sessions(from time.Time, to time.Time) []Session {
+	sessions := []Session{}
+	if s.Disabled {
+		return sessions
+	}
+
+	if s.Start != nil {
+		sess := Session{Start: *s.Start, End: s.Start.Add(s.MaxDuration.Duration)}
+		if sess.End.After(from) && sess.Start.Before(to) {
+			sessions = append(sessions, sess)
+		}
+	}
+
+	// windows could start on the previous day and end today
+	day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location()).AddDate(0, 0, -1)
+	for ; day.Before(to); day = day.AddDate(0, 0, 1) {
+		for _, w := range s.Windows {
+			days, _ := w.days()
+			if !days[day.Weekday()] {
+				continue
+			}
+			fromH, fromM, _ := parseClock(w.From)
+			toH, toM, _ := parseClock(w.To)
+			sess := Session{
+				Start: time.Date(day.Year(), day.Month(), day.Day(), fromH, fromM, 0, 0, day.Location()),
+				End:   time.Date(day.Year(), day.Month(), day.Day(), toH, toM, 0, 0, day.Location()),
+			}
+			if !sess.End.After(sess.Start) {
+				sess.End = sess.End.AddDate(0, 0, 1)
+			}
+			if s.MaxDuration.Duration > 0 && sess.End.Sub(sess.Start) > s.MaxDuration.Duration {
+				sess.End = sess.Start.Add(s.MaxDuration.Duration)
+			}
+			if sess.End.After(from) && sess.Start.Before(to) {
+				sessions = append(sessions, sess)
+			}
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Start.Before(sessions[j].Start)
+	})
+
+	return sessions
+}
+
+// ActiveSession returns session running at time t
+func (s *Schedule) ActiveSession(t time.Time) (Session, bool) {
+	for _, sess := range s.Sessions(t, t.Add(time.Second)) {
+		if !sess.Start.After(t) && sess.End.After(t) {
+			return sess, true
+		}
+	}
+	return Session{}, false
+}
+
+func (w *Window) days() (map[time.Weekday]bool, error) {
+	days := map[time.Weekday]bool{}
+	if len(w.Days) == 0 {
+		for _, d := range weekDays {
+			days[d] = true
+		}
+		return days, nil
+	}
+
+	for _, name := range w.Days {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "daily":
+			for _, d := range weekDays {
+				days[d] = true
+			}
+		case "weekdays":
+			for d := time.Monday; d <= time.Friday; d++ {
+				days[d] = true
+			}
+		case "weekends":
+			days[time.Saturday] = true
+			days[time.Sunday] = true
+		default:
+			if len(name) > 3 {
+				name = name[:3]
+			}
+			d, ok := weekDays[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown day '%s'", name)
+			}
+			days[d] = true
+		}
+	}
+
+	return days, nil
+}
+
+func parseClock(val string) (int, int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(val))
+	if err != nil {
+		return 0, 0, err
+	}
+	return t.Hour(), t.Minute(), nil
+}
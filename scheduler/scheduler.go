@@ -0,0 +1,250 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/indihub-space/agent/lib"
+	"github.com/indihub-space/agent/logutil"
+)
+
+const checkInterval = 10 * time.Second
+
+var logger = logutil.New("subsystem", "scheduler")
+
+// ModeController switches agent modes and talks to guests of current mode
+type ModeController interface {
+	CurrentMode() string
+	SwitchMode(mode string) error
+	NotifyGuests(message string)
+}
+
+// Scheduler switches agent from solo-mode to sharing and back according to schedule
+type Scheduler struct {
+	fileName   string
+	controller ModeController
+
+	// checks are done one by one, modes are switched without mu locked
+	checkMu sync.Mutex
+
+	mu       sync.Mutex
+	schedule *Schedule
+
+	// session started by scheduler
+	current    *Session
+	warned     bool
+	lastWarned bool
+	lastError  string
+	stopCh     chan struct{}
+	stopOnce   sync.Once
+
+	// end of session interrupted by host, scheduler doesn't switch modes until then
+	interruptedUntil time.Time
+}
+
+// New creates scheduler reading schedule from fileName if it exists
+func New(fileName string, controller ModeController) (*Scheduler, error) {
+	s := &Scheduler{
+		fileName:   fileName,
+		controller: controller,
+		schedule:   &Schedule{},
+		stopCh:     make(chan struct{}),
+	}
+
+	jsonData, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	schedule := &Schedule{}
+	if err := json.Unmarshal(jsonData, schedule); err != nil {
+		return nil, err
+	}
+	if err := schedule.Validate(); err != nil {
+		return nil, err
+	}
+	s.schedule = schedule
+
+	return s, nil
+}
+
+// Get returns current schedule
+func (s *Scheduler) Get() Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.schedule
+}
+
+// Set validates, saves and applies new schedule
+func (s *Scheduler) Set(schedule *Schedule) error {
+	if err := schedule.Validate(); err != nil {
+		return err
+	}
+
+	jsonData, err := json.MarshalIndent(schedule, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.fileName, jsonData, 0600); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.schedule = schedule
+	s.mu.Unlock()
+
+	// apply it right away
+	s.check(time.Now())
+
+	return nil
+}
+
+// Upcoming returns sessions starting within the next days
+func (s *Scheduler) Upcoming(days int) []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	return s.schedule.Sessions(now, now.AddDate(0, 0, days))
+}
+
+// GetStatus returns scheduler state to be shown in agent status
+func (s *Scheduler) GetStatus() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := map[string]interface{}{}
+	if s.current != nil {
+		status["sessionEnd"] = s.current.End
+	}
+	if !s.interruptedUntil.IsZero() {
+		status["interruptedUntil"] = s.interruptedUntil
+	}
+	now := time.Now()
+	for _, sess := range s.schedule.Sessions(now, now.AddDate(0, 0, 7)) {
+		if sess.Start.After(now) {
+			status["nextSession"] = sess
+			break
+		}
+	}
+	if s.lastError != "" {
+		status["error"] = s.lastError
+	}
+
+	return status
+}
+
+// Run checks schedule periodically until Stop is called, the first check is done after checkInterval
+// so agent has time to start in its initial mode
+func (s *Scheduler) Run() {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case now := <-ticker.C:
+			s.check(now)
+		}
+	}
+}
+
+// Stop stops checking schedule
+func (s *Scheduler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+}
+
+func (s *Scheduler) check(now time.Time) {
+	s.checkMu.Lock()
+	defer s.checkMu.Unlock()
+
+	currMode := s.controller.CurrentMode()
+
+	// decide what to do and switch mode after unlocking, so status is available while mode is switching
+	s.mu.Lock()
+	sess, active := s.schedule.ActiveSession(now)
+
+	// host switched mode manually while scheduled session was running - don't fight with it
+	if s.current != nil && currMode != s.schedule.Mode {
+		logger.Infof("Scheduled session was interrupted by mode change, scheduler won't switch modes until %s",
+			s.current.End.Format(time.RFC1123))
+		s.interruptedUntil = s.current.End
+		s.current = nil
+	}
+	if !s.interruptedUntil.IsZero() && !now.Before(s.interruptedUntil) {
+		s.interruptedUntil = time.Time{}
+	}
+
+	switchTo := ""
+	messages := []string{}
+	switch {
+	case active && s.current == nil && s.interruptedUntil.IsZero() && currMode == lib.ModeSolo:
+		logger.Infof("Starting scheduled %s-session, it will finish at %s",
+			s.schedule.Mode, sess.End.Format(time.RFC1123))
+		switchTo = s.schedule.Mode
+
+	case s.current != nil && !now.Before(s.current.End):
+		// extend if the next window starts right away
+		if active && sess.End.After(s.current.End) {
+			s.current = &sess
+			s.warned = false
+			s.lastWarned = false
+			break
+		}
+		logger.Infof("Scheduled session finished, switching back to solo-mode")
+		messages = append(messages, "INDIHUB: scheduled session is over, thank you!")
+		switchTo = lib.ModeSolo
+
+	case s.current != nil:
+		left := s.current.End.Sub(now)
+		if !s.warned && left <= s.schedule.WarnBefore.Duration {
+			s.warned = true
+			messages = append(messages, fmt.Sprintf("INDIHUB: session will finish in %s, at %s",
+				left.Round(time.Minute), s.current.End.Format("15:04 MST")))
+		}
+		if !s.lastWarned && left <= time.Minute {
+			s.lastWarned = true
+			messages = append(messages, "INDIHUB: session will finish in less than a minute!")
+		}
+	}
+	s.mu.Unlock()
+
+	for _, message := range messages {
+		s.controller.NotifyGuests(message)
+	}
+	if switchTo == "" {
+		return
+	}
+
+	err := s.controller.SwitchMode(switchTo)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		if switchTo == lib.ModeSolo {
+			s.lastError = fmt.Sprintf("could not finish scheduled session: %s", err)
+		} else {
+			s.lastError = fmt.Sprintf("could not start scheduled session: %s", err)
+		}
+		logger.Errorf("%s", s.lastError)
+		return
+	}
+	s.lastError = ""
+	if switchTo == lib.ModeSolo {
+		s.current = nil
+		return
+	}
+	s.current = &sess
+	s.warned = false
+	s.lastWarned = false
+}
@@ -0,0 +1,96 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/indihub-space/agent/lib"
+)
+
+type fakeController struct {
+	s        *Scheduler
+	mode     string
+	switches []string
+	messages []string
+}
+
+func (c *fakeController) CurrentMode() string {
+	return c.mode
+}
+
+func (c *fakeController) SwitchMode(mode string) error {
+	// status is requested by API while mode is switching
+	c.s.GetStatus()
+	c.mode = mode
+	c.switches = append(c.switches, mode)
+	return nil
+}
+
+func (c *fakeController) NotifyGuests(message string) {
+	c.messages = append(c.messages, message)
+}
+
+func newTestScheduler(t *testing.T, start time.Time, duration time.Duration) (*Scheduler, *fakeController) {
+	schedule := &Schedule{
+		Mode:        lib.ModeShare,
+		Start:       &start,
+		MaxDuration: Duration{duration},
+	}
+	if err := schedule.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c := &fakeController{mode: lib.ModeSolo}
+	s := &Scheduler{
+		controller: c,
+		schedule:   schedule,
+		stopCh:     make(chan struct{}),
+	}
+	c.s = s
+	return s, c
+}
+
+func TestSessionStartsAndFinishes(t *testing.T) {
+	start := time.Now().Add(time.Hour).Truncate(time.Minute)
+	s, c := newTestScheduler(t, start, time.Hour)
+
+	s.check(start.Add(-time.Minute))
+	s.check(start.Add(time.Minute))
+	s.check(start.Add(55 * time.Minute))
+	s.check(start.Add(time.Hour))
+
+	if len(c.switches) != 2 || c.switches[0] != lib.ModeShare || c.switches[1] != lib.ModeSolo {
+		t.Fatalf("expected switch to share and back to solo, got %q", c.switches)
+	}
+	if len(c.messages) != 2 {
+		t.Errorf("expected warning and goodbye messages, got %q", c.messages)
+	}
+}
+
+func TestInterruptedSessionIsNotRestarted(t *testing.T) {
+	start := time.Now().Add(time.Hour).Truncate(time.Minute)
+	s, c := newTestScheduler(t, start, time.Hour)
+
+	s.check(start.Add(time.Minute))
+	if c.mode != lib.ModeShare {
+		t.Fatalf("scheduled session is not started, mode is %s", c.mode)
+	}
+
+	// host switches to solo-mode manually
+	c.mode = lib.ModeSolo
+	s.check(start.Add(2 * time.Minute))
+	s.check(start.Add(3 * time.Minute))
+	if len(c.switches) != 1 {
+		t.Fatalf("interrupted session is restarted: %q", c.switches)
+	}
+	if _, ok := s.GetStatus()["interruptedUntil"]; !ok {
+		t.Error("interrupted session is not shown in status")
+	}
+
+	s.check(start.Add(time.Hour))
+	if len(c.switches) != 1 {
+		t.Fatalf("scheduler switched mode after interrupted session: %q", c.switches)
+	}
+	if _, ok := s.GetStatus()["interruptedUntil"]; ok {
+		t.Error("interrupted session is shown in status after its end")
+	}
+}
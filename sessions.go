@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/indihub-space/agent/journal"
+)
+
+// runSessions implements 'sessions' command: lists sessions from local journal file
+func runSessions(args []string) {
+	fs := flag.NewFlagSet("sessions", flag.ExitOnError)
+	fileName := fs.String("file", "", "session journal file set via -journal-file parameter of agent")
+	id := fs.String("id", "", "show all details of session with this ID")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s sessions [parameters]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *fileName == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	records, err := journal.ReadFile(*fileName)
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+
+	if *id == "" {
+		printSessions(records)
+		return
+	}
+
+	for _, rec := range records {
+		if rec.ID != *id {
+			continue
+		}
+		data, err := json.MarshalIndent(rec, "", "    ")
+		if err != nil {
+			logger.Fatalf("%s", err)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	logger.Fatalf("session '%s' not found in %s", *id, *fileName)
+}
+
+func printSessions(records []journal.Record) {
+	if len(records) == 0 {
+		fmt.Println("No sessions")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tMODE\tSTATUS\tSTARTED\tDURATION\tGUESTS\tIMAGES\tBYTES IN\tBYTES OUT\tRECONNECTS\tERRORS")
+	for _, r := range records {
+		duration := "-"
+		if r.Ended != nil {
+			duration = r.Ended.Sub(r.Started).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\n",
+			r.ID,
+			r.Mode,
+			r.Status,
+			r.Started.Format(time.RFC3339),
+			duration,
+			r.GuestConnections,
+			r.ImagesCaptured,
+			r.BytesIn,
+			r.BytesOut,
+			r.Reconnects,
+			len(r.Errors),
+		)
+	}
+	w.Flush()
+}
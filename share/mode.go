@@ -2,14 +2,19 @@ package share
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"sync"
 
 	"github.com/fatih/color"
 
+	"github.com/indihub-space/agent/audit"
 	"github.com/indihub-space/agent/hostutils"
+	"github.com/indihub-space/agent/journal"
 	"github.com/indihub-space/agent/lib"
+	"github.com/indihub-space/agent/logutil"
 	"github.com/indihub-space/agent/proto/indihub"
 	"github.com/indihub-space/agent/proxy"
+	"github.com/indihub-space/agent/recorder"
 )
 
 type Mode struct {
@@ -19,11 +24,28 @@ type Mode struct {
 	indiServerAddr string
 	phd2ServerAddr string
 
-	addrData []proxy.PublicServerAddr
+	recorder  *recorder.Recorder
+	shaping   *proxy.ShapingConfig
+	multiplex bool
+	filter    *hostutils.INDIFilter
+	journal   *journal.Journal
+	audit     *audit.Log
 
-	stopCh chan struct{}
-	status string
-	mode   string
+	guestListener      func(mode string, info proxy.ConnInfo, connected bool)
+	tunnelLostListener func(mode string, err error)
+	failureListener    func(err error)
+
+	mu              sync.Mutex
+	addrData        []proxy.PublicServerAddr
+	indiServerProxy *proxy.TcpProxy
+	session         *journal.Session
+	cancel          context.CancelFunc
+	done            chan struct{}
+	status          string
+	lastErr         string
+
+	mode string
+	log  *logutil.Logger
 }
 
 func NewMode(indiHubClient indihub.INDIHubClient, regInfo *indihub.RegisterInfo, indiServerAddr string, phd2ServerAddr string, mode string) *Mode {
@@ -33,80 +55,97 @@ func NewMode(indiHubClient indihub.INDIHubClient, regInfo *indihub.RegisterInfo,
 		indiServerAddr: indiServerAddr,
 		phd2ServerAddr: phd2ServerAddr,
 		mode:           mode,
+		log:            logutil.New("mode", mode),
 		addrData:       []proxy.PublicServerAddr{},
-		stopCh:         make(chan struct{}, 1),
+		status:         "stopped",
 	}
 }
 
-func (m *Mode) Start() {
-	// main equipment sharing mode
-	if m.mode == lib.ModeRobotic {
-		log.Println("'robotic' parameter was provided. Your session is in robotic-mode: equipment sharing is not available")
-	}
-	// open INDI server tunnel
-	log.Println("Starting INDI-Server in the cloud...")
-	indiServTunnel, err := m.indiHubClient.INDIServer(
-		context.Background(),
-	)
-	if err != nil {
-		log.Fatal(err)
-	}
-	log.Println("...OK")
+// SetRecorder sets recorder for INDI-server traffic of guests
+func (m *Mode) SetRecorder(rec *recorder.Recorder) {
+	m.recorder = rec
+}
 
-	indiFilterConf := &hostutils.INDIFilterConfig{} // TODO: add reading config
-	indiFilter := hostutils.NewINDIFilter(indiFilterConf)
-	indiServerProxy := proxy.New("INDI-Server", m.indiServerAddr, indiServTunnel, indiFilter)
+// SetAudit sets audit log for guest commands
+func (m *Mode) SetAudit(log *audit.Log) {
+	m.audit = log
+}
 
-	// start PHD2 server proxy if specified
-	var phd2ServerProxy *proxy.TcpProxy
-	if m.phd2ServerAddr != "" {
-		// open PHD2 server tunnel
-		log.Println("Starting PHD2-Server in the cloud...")
-		phd2ServTunnel, err := m.indiHubClient.PHD2Server(
-			context.Background(),
-		)
-		if err != nil {
-			log.Fatal(err)
-		}
-		log.Println("...OK")
-		phd2ServerProxy = proxy.New("PHD2-Server", m.phd2ServerAddr, phd2ServTunnel, nil)
-	}
+// SetGuestListener sets function called when guest connects to INDI-server or disconnects
+func (m *Mode) SetGuestListener(fn func(mode string, info proxy.ConnInfo, connected bool)) {
+	m.guestListener = fn
+}
 
-	go func() {
-		<-m.stopCh
+// SetTunnelLostListener sets function called when running session fails because tunnel is closed by the cloud
+func (m *Mode) SetTunnelLostListener(fn func(mode string, err error)) {
+	m.tunnelLostListener = fn
+}
 
-		log.Printf("Closing %s-session\n", m.mode)
+// SetFailureListener sets function called when running session fails on its own
+func (m *Mode) SetFailureListener(fn func(err error)) {
+	m.failureListener = fn
+}
 
-		// close connections to tunnels
-		indiServTunnel.CloseSend()
-		if phd2ServerProxy != nil {
-			phd2ServerProxy.Tunnel.CloseSend()
-		}
+// SetFilter sets INDI filter for guest commands, the filter can be shared with other modes
+func (m *Mode) SetFilter(filter *hostutils.INDIFilter) {
+	m.filter = filter
+}
 
-		// close connections to local INDI-server and PHD2-Server
-		indiServerProxy.Close()
-		if phd2ServerProxy != nil {
-			phd2ServerProxy.Close()
-		}
-	}()
+// SetJournal sets journal to record sessions in
+func (m *Mode) SetJournal(j *journal.Journal) {
+	m.journal = j
+}
 
-	serverAddrChan := make(chan proxy.PublicServerAddr, 3)
+// SetShaping sets BLOB traffic shaping rules for INDI-server tunnel
+func (m *Mode) SetShaping(conf *proxy.ShapingConfig) {
+	m.shaping = conf
+}
 
-	// INDI Server Proxy start
-	go indiServerProxy.Start(serverAddrChan, m.regInfo.SessionID, m.regInfo.SessionIDPublic)
-	sAddr := <-serverAddrChan
-	if m.mode != lib.ModeRobotic {
-		m.addrData = append(m.addrData, sAddr)
+// SetMultiplexing enables sharing of connections to INDI-server between guest connections
+func (m *Mode) SetMultiplexing(enabled bool) {
+	m.multiplex = enabled
+}
+
+// Start opens tunnels and waits for public addresses, the session lasts until Stop is called or ctx is cancelled
+func (m *Mode) Start(ctx context.Context) error {
+	m.mu.Lock()
+	if m.cancel != nil {
+		m.mu.Unlock()
+		return fmt.Errorf("%s-mode is already started", m.mode)
 	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	m.cancel = cancel
+	m.done = done
+	m.lastErr = ""
+	m.mu.Unlock()
 
-	// PHD2 Server proxy start
-	if m.phd2ServerAddr != "" {
-		go phd2ServerProxy.Start(serverAddrChan, m.regInfo.SessionID, m.regInfo.SessionIDPublic)
-		sAddr := <-serverAddrChan
-		if m.mode != lib.ModeRobotic {
-			m.addrData = append(m.addrData, sAddr)
-		}
+	wg := &sync.WaitGroup{}
+	addrData, err := m.start(ctx, wg)
+	if err != nil {
+		cancel()
+		wg.Wait()
+		close(done)
+		m.mu.Lock()
+		m.cancel = nil
+		m.indiServerProxy = nil
+		m.session = nil
+		m.status = "failed"
+		m.lastErr = err.Error()
+		m.mu.Unlock()
+		return err
 	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	m.mu.Lock()
+	m.status = "running"
+	if m.mode != lib.ModeRobotic {
+		m.addrData = addrData
+	}
+	m.mu.Unlock()
 
 	c := color.New(color.FgCyan)
 	gc := color.New(color.FgGreen)
@@ -117,7 +156,7 @@ func (m *Mode) Start() {
 		c.Println("                                *               INDIHUB public address list!!              *")
 		c.Println("                                ************************************************************")
 		c.Println("                                                                                            ")
-		for _, sAddr := range m.addrData {
+		for _, sAddr := range addrData {
 			gc.Printf("                                   %s: %s\n", sAddr.Name, sAddr.Addr)
 		}
 		c.Println("                                                                                            ")
@@ -142,12 +181,144 @@ func (m *Mode) Start() {
 		c.Println("                                                                                            ")
 	}
 
-	m.status = "running"
+	return nil
 }
 
-func (m *Mode) Stop() {
+// start opens tunnels and runs proxies in wg until ctx is cancelled
+func (m *Mode) start(ctx context.Context, wg *sync.WaitGroup) ([]proxy.PublicServerAddr, error) {
+	// main equipment sharing mode
+	if m.mode == lib.ModeRobotic {
+		m.log.Infof("'robotic' parameter was provided. Your session is in robotic-mode: equipment sharing is not available")
+	}
+
+	// open INDI server tunnel
+	m.log.Infof("Starting INDI-Server in the cloud...")
+	indiServTunnel, err := m.indiHubClient.INDIServer(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not start INDI-Server in the cloud: %w", err)
+	}
+	m.log.Infof("...OK")
+
+	session := m.journal.Begin(m.mode, m.regInfo.SessionID)
+
+	indiFilter := m.filter
+	if indiFilter == nil {
+		indiFilterConf := &hostutils.INDIFilterConfig{} // TODO: add reading config
+		indiFilter = hostutils.NewINDIFilter(indiFilterConf)
+	}
+	indiServerProxy := proxy.New("INDI-Server", m.indiServerAddr, indiServTunnel, indiFilter)
+	indiServerProxy.SetRecorder(m.recorder)
+	indiServerProxy.SetShaping(m.shaping)
+	indiServerProxy.SetMultiplexing(m.multiplex)
+	indiServerProxy.SetSession(session)
+	indiServerProxy.SetAudit(m.audit, m.mode)
+	if m.guestListener != nil {
+		indiServerProxy.SetGuestListener(func(info proxy.ConnInfo, connected bool) {
+			m.guestListener(m.mode, info, connected)
+		})
+	}
+
+	m.mu.Lock()
+	m.indiServerProxy = indiServerProxy
+	m.session = session
+	m.mu.Unlock()
+
+	proxies := []*proxy.TcpProxy{indiServerProxy}
+
+	// start PHD2 server proxy if specified
+	if m.phd2ServerAddr != "" {
+		// open PHD2 server tunnel
+		m.log.Infof("Starting PHD2-Server in the cloud...")
+		phd2ServTunnel, err := m.indiHubClient.PHD2Server(ctx)
+		if err != nil {
+			err = fmt.Errorf("could not start PHD2-Server in the cloud: %w", err)
+			session.AddError(err.Error())
+			session.End()
+			return nil, err
+		}
+		m.log.Infof("...OK")
+		phd2ServerProxy := proxy.New("PHD2-Server", m.phd2ServerAddr, phd2ServTunnel, nil)
+		phd2ServerProxy.SetSession(session)
+		proxies = append(proxies, phd2ServerProxy)
+	}
+
+	addrData := []proxy.PublicServerAddr{}
+	for _, p := range proxies {
+		serverAddrChan := make(chan proxy.PublicServerAddr, 1)
+		exitCh := make(chan error, 1)
+		wg.Add(1)
+		go func(p *proxy.TcpProxy) {
+			defer wg.Done()
+			err := p.Start(ctx, serverAddrChan, m.regInfo.SessionID, m.regInfo.SessionIDPublic)
+			exitCh <- err
+			if err != nil {
+				m.failed(err)
+			}
+		}(p)
+
+		select {
+		case sAddr := <-serverAddrChan:
+			session.AddEndpoint(sAddr.Name, sAddr.Addr)
+			addrData = append(addrData, sAddr)
+		case err := <-exitCh:
+			if err == nil {
+				err = fmt.Errorf("%s tunnel was closed", p.Name)
+			}
+			session.End()
+			return nil, err
+		case <-ctx.Done():
+			session.End()
+			return nil, ctx.Err()
+		}
+	}
+
+	return addrData, nil
+}
+
+// failed marks running session as failed when proxy exits on its own
+func (m *Mode) failed(err error) {
+	m.mu.Lock()
+	running := m.status == "running"
+	if running {
+		m.log.Errorf("%s-session failed: %s", m.mode, err)
+		m.status = "failed"
+		m.lastErr = err.Error()
+	}
+	m.mu.Unlock()
+
+	if running && m.tunnelLostListener != nil {
+		m.tunnelLostListener(m.mode, err)
+	}
+	if running && m.failureListener != nil {
+		m.failureListener(err)
+	}
+}
+
+// Stop closes tunnels and connections to local servers and waits for proxies to exit, it is safe to call it twice
+func (m *Mode) Stop() error {
+	m.mu.Lock()
+	cancel, done := m.cancel, m.done
+	if cancel == nil {
+		m.mu.Unlock()
+		return nil
+	}
+	m.cancel = nil
+	m.status = "stopping"
+	session := m.session
+	addrData := m.addrData
+	m.mu.Unlock()
+
+	m.log.Infof("Closing %s-session", m.mode)
+	cancel()
+	<-done
+	session.End()
+
+	m.mu.Lock()
 	m.status = "stopped"
-	m.stopCh <- struct{}{}
+	m.indiServerProxy = nil
+	m.session = nil
+	m.addrData = []proxy.PublicServerAddr{}
+	m.mu.Unlock()
 
 	c := color.New(color.FgCyan)
 	rc := color.New(color.FgMagenta)
@@ -157,7 +328,7 @@ func (m *Mode) Stop() {
 	c.Println("                                ************************************************************")
 	c.Println("                                                                                            ")
 	if m.mode != lib.ModeRobotic {
-		for _, sAddr := range m.addrData {
+		for _, sAddr := range addrData {
 			rc.Printf("                                   %s: %s - CLOSED!!\n", sAddr.Name, sAddr.Addr)
 		}
 	} else {
@@ -167,12 +338,72 @@ func (m *Mode) Stop() {
 	c.Println("                                                                                            ")
 	c.Println("                                ************************************************************")
 
-	m.addrData = []proxy.PublicServerAddr{}
+	return nil
+}
+
+// runningProxy returns INDI-server proxy if session is running
+func (m *Mode) runningProxy() *proxy.TcpProxy {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.status != "running" {
+		return nil
+	}
+	return m.indiServerProxy
+}
+
+// NotifyGuests sends INDI message to all guests connected to INDI-server
+func (m *Mode) NotifyGuests(message string) {
+	if p := m.runningProxy(); p != nil {
+		p.SendMessage(message)
+	}
+}
+
+// Connections returns info about guest connections to INDI-server
+func (m *Mode) Connections() []proxy.ConnInfo {
+	p := m.runningProxy()
+	if p == nil {
+		return []proxy.ConnInfo{}
+	}
+	return p.Connections()
+}
+
+// PauseConnection pauses guest connection to INDI-server, guest commands are buffered or dropped
+func (m *Mode) PauseConnection(cNum uint32, drop bool) error {
+	p := m.runningProxy()
+	if p == nil {
+		return proxy.ErrUnknownConn
+	}
+	return p.PauseConn(cNum, drop)
+}
+
+// ResumeConnection resumes paused guest connection to INDI-server
+func (m *Mode) ResumeConnection(cNum uint32) error {
+	p := m.runningProxy()
+	if p == nil {
+		return proxy.ErrUnknownConn
+	}
+	return p.ResumeConn(cNum)
+}
+
+// CloseConnection closes guest connection to INDI-server sending message to guest first
+func (m *Mode) CloseConnection(cNum uint32, message string) error {
+	p := m.runningProxy()
+	if p == nil {
+		return proxy.ErrUnknownConn
+	}
+	return p.CloseConn(cNum, message)
 }
 
 func (m *Mode) GetStatus() map[string]interface{} {
-	return map[string]interface{}{
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := map[string]interface{}{
 		"status":          m.status,
 		"publicEndpoints": m.addrData,
 	}
+	if m.lastErr != "" {
+		status["error"] = m.lastErr
+	}
+	return status
 }
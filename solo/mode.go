@@ -2,19 +2,42 @@ package solo
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 
+	"github.com/indihub-space/agent/images"
+	"github.com/indihub-space/agent/journal"
+	"github.com/indihub-space/agent/lib"
+	"github.com/indihub-space/agent/logutil"
 	"github.com/indihub-space/agent/proto/indihub"
 )
 
+var logger = logutil.New("mode", lib.ModeSolo)
+
+// time to get and display solo-session summary after connections to INDI-server are closed
+const summaryTimeout = 10 * time.Second
+
 type Mode struct {
 	indiServerAddr string
 	indiHubClient  indihub.INDIHubClient
 	regInfo        *indihub.RegisterInfo
 
-	stopCh chan struct{}
-	status string
+	mu      sync.Mutex
+	agent   *Agent
+	cancel  context.CancelFunc
+	done    chan struct{}
+	status  string
+	session *journal.Session
+
+	images          *images.Store
+	catalogueMu     sync.Mutex
+	catalogue       *images.Catalogue
+	imageListener   func(e *images.Entry)
+	failureListener func(err error)
+
+	journal *journal.Journal
 }
 
 func NewMode(indiHubClient indihub.INDIHubClient, regInfo *indihub.RegisterInfo, indiServerAddr string) *Mode {
@@ -22,47 +45,171 @@ func NewMode(indiHubClient indihub.INDIHubClient, regInfo *indihub.RegisterInfo,
 		indiServerAddr: indiServerAddr,
 		indiHubClient:  indiHubClient,
 		regInfo:        regInfo,
-		stopCh:         make(chan struct{}, 1),
+		status:         "stopped",
 	}
 }
 
-func (s *Mode) Start() {
+// SetImageStore sets store to keep the latest frames captured from CCDs
+func (s *Mode) SetImageStore(store *images.Store) {
+	s.images = store
+}
+
+// SetImageListener sets function called with catalogue entry of every captured frame
+func (s *Mode) SetImageListener(fn func(e *images.Entry)) {
+	s.imageListener = fn
+}
+
+// SetFailureListener sets function called when running solo-session fails on its own
+func (s *Mode) SetFailureListener(fn func(err error)) {
+	s.failureListener = fn
+}
+
+// SetJournal sets journal to record sessions in
+func (s *Mode) SetJournal(j *journal.Journal) {
+	s.journal = j
+}
+
+// Catalogue returns catalogue of frames captured in the current or the last solo session
+func (s *Mode) Catalogue() *images.Catalogue {
+	s.catalogueMu.Lock()
+	defer s.catalogueMu.Unlock()
+	return s.catalogue
+}
+
+// Start opens solo tunnel and connection to INDI-server, the session lasts until Stop is called or ctx is cancelled
+func (s *Mode) Start(ctx context.Context) error {
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.mu.Unlock()
+		return errors.New("solo-mode is already started")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+	s.status = "starting"
+	s.mu.Unlock()
+
 	// solo mode - equipment sharing is not available but host still sends all images to INDIHUB
-	log.Println("'solo' parameter was provided. Your session is in solo-mode: equipment sharing is not available")
-	log.Println("Starting INDIHUB agent in solo mode!")
+	logger.Infof("'solo' parameter was provided. Your session is in solo-mode: equipment sharing is not available")
+	logger.Infof("Starting INDIHUB agent in solo mode!")
 
-	soloClient, err := s.indiHubClient.SoloMode(context.Background())
+	soloAgent, err := s.start(ctx)
 	if err != nil {
-		log.Fatalf("Could not start agent in solo mode: %v", err)
+		cancel()
+		s.mu.Lock()
+		s.cancel = nil
+		s.status = "failed"
+		s.mu.Unlock()
+		return err
 	}
 
-	soloAgent := New(
-		s.indiServerAddr,
-		soloClient,
-	)
+	done := make(chan struct{})
+	s.mu.Lock()
+	s.agent = soloAgent
+	s.done = done
+	s.status = "running"
+	s.mu.Unlock()
 
+	// start agent in solo-mode
 	go func() {
-		<-s.stopCh
-		log.Println("Closing INDIHUB solo-session")
-		// close connections to local INDI-server
-		soloAgent.Close()
+		defer close(done)
+		soloAgent.Run()
+
+		s.mu.Lock()
+		failed := s.status == "running"
+		if failed {
+			logger.Errorf("solo-session failed: connection to INDI-server is lost")
+			s.status = "failed"
+		}
+		s.mu.Unlock()
+
+		if failed && s.failureListener != nil {
+			s.failureListener(errors.New("connection to INDI-server is lost"))
+		}
 	}()
 
-	// start agent in solo-mode
+	// close connections to local INDI-server if session is cancelled from outside
 	go func() {
-		soloAgent.Start(s.regInfo.SessionID, s.regInfo.SessionIDPublic)
+		select {
+		case <-ctx.Done():
+			soloAgent.Close()
+		case <-done:
+		}
 	}()
 
-	s.status = "running"
+	return nil
 }
 
-func (s *Mode) Stop() {
+func (s *Mode) start(ctx context.Context) (*Agent, error) {
+	soloClient, err := s.indiHubClient.SoloMode(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not start agent in solo mode: %w", err)
+	}
+
+	soloAgent := New(
+		s.indiServerAddr,
+		soloClient,
+	)
+	catalogue := images.NewCatalogue(s.regInfo.SessionID)
+	if s.imageListener != nil {
+		catalogue.SetListener(s.imageListener)
+	}
+	s.catalogueMu.Lock()
+	s.catalogue = catalogue
+	s.catalogueMu.Unlock()
+	soloAgent.SetImageStore(s.images, catalogue)
+	session := s.journal.Begin(lib.ModeSolo, s.regInfo.SessionID)
+	soloAgent.SetSession(session)
+
+	if err := soloAgent.Connect(s.regInfo.SessionID, s.regInfo.SessionIDPublic); err != nil {
+		session.AddError(fmt.Sprintf("could not connect to INDI-server: %s", err))
+		session.End()
+		return nil, fmt.Errorf("could not connect to INDI-server in solo mode: %w", err)
+	}
+
+	s.mu.Lock()
+	s.session = session
+	s.mu.Unlock()
+
+	return soloAgent, nil
+}
+
+// Stop closes connections to INDI-server and waits for solo-session summary, it is safe to call it twice
+func (s *Mode) Stop() error {
+	s.mu.Lock()
+	cancel, done, soloAgent, session := s.cancel, s.done, s.agent, s.session
+	if cancel == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.cancel = nil
+	s.status = "stopping"
+	s.mu.Unlock()
+
+	logger.Infof("Closing INDIHUB solo-session")
+	// tunnel is kept open until summary is received
+	soloAgent.Close()
+	var err error
+	select {
+	case <-done:
+	case <-time.After(summaryTimeout):
+		err = errors.New("solo-session summary was not received in time")
+	}
+	cancel()
+	session.End()
+
+	s.mu.Lock()
 	s.status = "stopped"
-	s.stopCh <- struct{}{}
-	time.Sleep(3 * time.Second) // give some time to get and display solo-session summary
+	s.agent = nil
+	s.session = nil
+	s.mu.Unlock()
+
+	return err
 }
 
 func (s *Mode) GetStatus() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	return map[string]interface{}{
 		"status": s.status,
 	}
@@ -2,20 +2,30 @@ package solo
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 
 	"github.com/clbanning/mxj"
 	"github.com/fatih/color"
 
+	"github.com/indihub-space/agent/images"
+	"github.com/indihub-space/agent/journal"
 	"github.com/indihub-space/agent/lib"
+	"github.com/indihub-space/agent/logutil"
 	"github.com/indihub-space/agent/proto/indihub"
 )
 
-const queueSize = 4096
+const (
+	queueSize       = 4096
+	frameQueueSize  = 16
+	frameQueueBytes = 512 << 20 // BLOB elements waiting to be decoded
+)
+
+var ErrClosed = errors.New("solo agent is closed")
 
 var (
 	getProperties    = []byte("<getProperties version='1.7'/>")
@@ -34,16 +44,21 @@ type INDIHubSoloTunnel interface {
 
 type Agent struct {
 	indiServerAddr string
-	indiConn       net.Conn
 	tunnel         INDIHubSoloTunnel
-	shouldExit     bool
 
-	ccdConnMap   map[string]net.Conn
-	ccdConnMapMu sync.Mutex
+	connMu     sync.Mutex
+	indiConn   net.Conn
+	ccdConnMap map[string]net.Conn
+	closed     chan struct{}
+	closeOnce  sync.Once
 
 	sessionID    uint64
 	sessionToken string
 
+	images    *images.Store
+	catalogue *images.Catalogue
+	session   *journal.Session
+
 	respPool *sync.Pool
 }
 
@@ -52,6 +67,7 @@ func New(indiServerAddr string, tunnel INDIHubSoloTunnel) *Agent {
 		indiServerAddr: indiServerAddr,
 		tunnel:         tunnel,
 		ccdConnMap:     make(map[string]net.Conn),
+		closed:         make(chan struct{}),
 		respPool: &sync.Pool{
 			New: func() interface{} {
 				return &indihub.Response{
@@ -62,18 +78,36 @@ func New(indiServerAddr string, tunnel INDIHubSoloTunnel) *Agent {
 	}
 }
 
-func (p *Agent) Start(sessionID uint64, sessionToken string) error {
+// SetImageStore sets store to keep the latest frames captured from CCDs and catalogue to add them to
+func (p *Agent) SetImageStore(store *images.Store, catalogue *images.Catalogue) {
+	p.images = store
+	p.catalogue = catalogue
+}
+
+// SetSession sets journal session to count images, traffic and errors
+func (p *Agent) SetSession(session *journal.Session) {
+	p.session = session
+}
+
+// Connect opens connection to INDI-server for the session, it should be called before Run
+func (p *Agent) Connect(sessionID uint64, sessionToken string) error {
 	p.sessionID = sessionID
 	p.sessionToken = sessionToken
 
 	// open connection to real INDI-server
-	var err error
-	p.indiConn, err = p.connectToINDI()
+	conn, err := p.connectToINDI()
 	if err != nil {
-		log.Printf("could not connect to INDI-server in solo-mode: %s\n", err)
 		return err
 	}
-	defer p.indiConn.Close()
+	return p.setINDIConn(conn)
+}
+
+// Run sends frames to INDIHUB until agent is closed or INDI-server can't be reached, then shows session summary
+func (p *Agent) Run() {
+	indiConn := p.getINDIConn()
+	defer func() {
+		p.getINDIConn().Close()
+	}()
 
 	// run response sending queue
 	respCh := make(chan *indihub.Response, queueSize)
@@ -86,22 +120,28 @@ func (p *Agent) Start(sessionID uint64, sessionToken string) error {
 	wg := sync.WaitGroup{}
 	var connNum uint32
 	for {
-		if p.shouldExit {
+		if p.isClosed() {
 			break
 		}
 
-		n, err := p.indiConn.Read(buf)
+		n, err := indiConn.Read(buf)
 		if err == io.EOF {
 			// reconnect
-			if p.indiConn, err = p.connectToINDI(); err != nil {
-				log.Printf("Failed to re-connect to INDI-server is solo mode: %s", err)
+			p.session.AddReconnect()
+			if indiConn, err = p.connectToINDI(); err != nil {
+				logger.Errorf("Failed to re-connect to INDI-server is solo mode: %s", err)
 				break
-			} else {
-				n, err = p.indiConn.Read(buf)
+			}
+			if err = p.setINDIConn(indiConn); err == nil {
+				n, err = indiConn.Read(buf)
 			}
 		}
+		if p.isClosed() {
+			break
+		}
 		if err != nil {
-			log.Println("could not read from INDI-server in solo-mode:", err)
+			logger.Errorf("could not read from INDI-server in solo-mode: %v", err)
+			p.session.AddError(fmt.Sprintf("could not read from INDI-server: %s", err))
 			break
 		}
 
@@ -116,7 +156,7 @@ func (p *Agent) Start(sessionID uint64, sessionToken string) error {
 
 			mapVal, err := mxj.NewMapXml(xmlCmd, true)
 			if err != nil {
-				log.Println("could not parse XML chunk in solo-mode:", err)
+				logger.Errorf("could not parse XML chunk in solo-mode: %v", err)
 				continue
 			}
 			defNumberVectorMap, _ := mapVal.ValueForKey("defNumberVector")
@@ -128,8 +168,8 @@ func (p *Agent) Start(sessionID uint64, sessionToken string) error {
 			if nameStr, ok := defNumberVectorVal["attr_name"].(string); ok && nameStr == "CCD_EXPOSURE" {
 				if deviceStr, ok := defNumberVectorVal["attr_device"].(string); ok && p.getConnCCD(deviceStr) == nil {
 					// disable receiving BLOBs on main connection
-					if _, err := p.indiConn.Write([]byte(fmt.Sprintf(enableBLOBNever, deviceStr))); err != nil {
-						log.Printf("could not write to INDI-server in solo-mode: %s\n", err)
+					if _, err := indiConn.Write([]byte(fmt.Sprintf(enableBLOBNever, deviceStr))); err != nil {
+						logger.Errorf("could not write to INDI-server in solo-mode: %s", err)
 					}
 
 					// launch Go-routine with connection per CCD and only BLOB enabled
@@ -145,6 +185,9 @@ func (p *Agent) Start(sessionID uint64, sessionToken string) error {
 	}
 
 	wg.Wait()
+	if p.catalogue != nil {
+		p.catalogue.Close()
+	}
 
 	// close connections to tunnel
 	if summary, err := p.tunnel.CloseAndRecv(); err == nil {
@@ -159,25 +202,26 @@ func (p *Agent) Start(sessionID uint64, sessionToken string) error {
 			"Processed %d images. Thank you for your contribution!\n",
 			summary.ImagesNum,
 		)
+		if p.catalogue != nil {
+			gc.Printf("                                   Local catalogue - %s\n", p.catalogue.Summary())
+		}
 		gc.Println("                                ************************************************************")
 	} else {
-		log.Printf("Error getting solo-session summary: %v", err)
+		logger.Errorf("Error getting solo-session summary: %v", err)
 	}
-
-	return nil
 }
 
 func (p *Agent) connectToINDI() (net.Conn, error) {
-	log.Println("Connecting to INDI-server in solo mode...")
+	logger.Infof("Connecting to INDI-server in solo mode...")
 	conn, err := net.Dial("tcp", p.indiServerAddr)
 	if err != nil {
-		log.Printf("could not connect to INDI-server in solo-mode: %s\n", err)
+		logger.Errorf("could not connect to INDI-server in solo-mode: %s", err)
 		return nil, err
 	}
 
 	// set connection to receive data
 	if _, err := conn.Write(getProperties); err != nil {
-		log.Printf("could not write to INDI-server in solo-mode: %s\n", err)
+		logger.Errorf("could not write to INDI-server in solo-mode: %s", err)
 		conn.Close()
 		return nil, err
 	}
@@ -186,18 +230,18 @@ func (p *Agent) connectToINDI() (net.Conn, error) {
 	names := p.getCurrCCD()
 	for _, ccdName := range names {
 		if _, err := conn.Write([]byte(fmt.Sprintf(enableBLOBNever, ccdName))); err != nil {
-			log.Printf("could not write to INDI-server in solo-mode: %s\n", err)
+			logger.Errorf("could not write to INDI-server in solo-mode: %s", err)
 		}
 	}
 
-	log.Println("...OK")
+	logger.Infof("...OK")
 
 	return conn, nil
 }
 
 func (p *Agent) getCurrCCD() []string {
-	p.ccdConnMapMu.Lock()
-	defer p.ccdConnMapMu.Unlock()
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
 	names := []string{}
 	for ccdName := range p.ccdConnMap {
 		names = append(names, ccdName)
@@ -207,18 +251,53 @@ func (p *Agent) getCurrCCD() []string {
 }
 
 func (p *Agent) getConnCCD(ccdName string) net.Conn {
-	p.ccdConnMapMu.Lock()
-	defer p.ccdConnMapMu.Unlock()
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
 	return p.ccdConnMap[ccdName]
 }
 
-func (p *Agent) setConnCCD(ccdName string, conn net.Conn) {
-	p.ccdConnMapMu.Lock()
-	defer p.ccdConnMapMu.Unlock()
+// setConnCCD keeps connection to CCD to close it with agent, the connection is closed if agent is already closed
+func (p *Agent) setConnCCD(ccdName string, conn net.Conn) error {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	if p.isClosed() {
+		conn.Close()
+		return ErrClosed
+	}
 	p.ccdConnMap[ccdName] = conn
+	return nil
+}
+
+func (p *Agent) getINDIConn() net.Conn {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	return p.indiConn
+}
+
+// setINDIConn sets main connection to INDI-server, the connection is closed if agent is already closed
+func (p *Agent) setINDIConn(conn net.Conn) error {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	if p.isClosed() {
+		conn.Close()
+		return ErrClosed
+	}
+	p.indiConn = conn
+	return nil
+}
+
+func (p *Agent) isClosed() bool {
+	select {
+	case <-p.closed:
+		return true
+	default:
+		return false
+	}
 }
 
 func (p *Agent) readFromCCD(ccdName string, cNum uint32, ch chan *indihub.Response) {
+	log := logger.With("device", ccdName, "conn", cNum)
+
 	// open connection
 	conn, err := p.connectToCCD(ccdName)
 	if err != nil {
@@ -226,28 +305,67 @@ func (p *Agent) readFromCCD(ccdName string, cNum uint32, ch chan *indihub.Respon
 	}
 	defer conn.Close()
 
+	// frames are decoded by worker, so reading of big BLOBs is not slowed down by FITS decoding
+	var frames chan []byte
+	var queued int64 // bytes of queued frames
+	if p.images != nil {
+		frames = make(chan []byte, frameQueueSize)
+		defer close(frames)
+		go p.putFrames(log, frames, &queued)
+	}
+
 	// read data from INDI-server and send to tunnel
-	buf := make([]byte, lib.INDIServerMaxSendMsgSize)
+	buf := make([]byte, lib.INDIServerMaxRecvMsgSize)
+	xmlFlattener := lib.NewXmlFlattener()
 	for {
-		if p.shouldExit {
+		if p.isClosed() {
 			break
 		}
 
 		n, err := conn.Read(buf)
 		if err == io.EOF {
 			// reconnect
+			p.session.AddReconnect()
 			if conn, err = p.connectToCCD(ccdName); err != nil {
-				log.Printf("Failed to re-connect to INDI-server for %s is solo mode: %s\n", ccdName, err)
+				log.Errorf("Failed to re-connect to INDI-server is solo mode: %s", err)
 				break
-			} else {
-				n, err = conn.Read(buf)
 			}
+			n, err = conn.Read(buf)
+		}
+		if p.isClosed() {
+			break
 		}
 		if err != nil {
-			log.Printf("could not read from INDI-server for %s in solo-mode: %s\n", ccdName, err)
+			log.Errorf("could not read from INDI-server in solo-mode: %s", err)
+			p.session.AddError(fmt.Sprintf("could not read from INDI-server for %s: %s", ccdName, err))
 			break
 		}
 
+		// count and keep the latest frames
+		for _, xmlCmd := range xmlFlattener.FeedChunk(buf[:n]) {
+			if !bytes.HasPrefix(xmlCmd, setBLOBVector) {
+				continue
+			}
+			p.session.AddImages(1)
+			if frames == nil {
+				continue
+			}
+			// the first frame is queued even if it is larger than the limit
+			size := int64(len(xmlCmd))
+			if q := atomic.LoadInt64(&queued); q > 0 && q+size > frameQueueBytes {
+				log.Warnf("Frame is skipped in solo-mode: previous frames are still being decoded")
+				continue
+			}
+			// element is in flattener buffer which is re-used by the next chunk
+			select {
+			case frames <- append([]byte(nil), xmlCmd...):
+				atomic.AddInt64(&queued, size)
+			default:
+				log.Warnf("Frame is skipped in solo-mode: previous frames are still being decoded")
+			}
+		}
+		p.session.AddBytes(0, n)
+
 		// send data to tunnel
 		resp := p.respPool.Get().(*indihub.Response)
 		resp.Conn = cNum
@@ -259,10 +377,26 @@ func (p *Agent) readFromCCD(ccdName string, cNum uint32, ch chan *indihub.Respon
 	}
 }
 
+// putFrames keeps frames in image store and adds them to catalogue until frames channel is closed
+func (p *Agent) putFrames(log *logutil.Logger, frames chan []byte, queued *int64) {
+	for xmlCmd := range frames {
+		_, captured, err := p.images.PutBLOBVector(xmlCmd)
+		atomic.AddInt64(queued, -int64(len(xmlCmd)))
+		if err != nil {
+			log.Errorf("could not read frame in solo-mode: %s", err)
+			continue
+		}
+		for _, frame := range captured {
+			p.catalogue.Add(frame)
+		}
+	}
+}
+
 func (p *Agent) sendResponses(respCh chan *indihub.Response) {
 	for resp := range respCh {
 		if err := p.tunnel.Send(resp); err != nil {
-			log.Printf("Failed to send a response to tunnel in solo-mode: %s", err)
+			logger.Errorf("Failed to send a response to tunnel in solo-mode: %s", err)
+			p.session.AddError(fmt.Sprintf("failed to send a response to tunnel: %s", err))
 		}
 		p.respPool.Put(resp)
 	}
@@ -270,44 +404,52 @@ func (p *Agent) sendResponses(respCh chan *indihub.Response) {
 
 func (p *Agent) connectToCCD(ccdName string) (net.Conn, error) {
 	// open connection
-	log.Println("Connecting to INDI-device:", ccdName)
+	log := logger.With("device", ccdName)
+	log.Infof("Connecting to INDI-device")
 	conn, err := net.Dial("tcp", p.indiServerAddr)
 	if err != nil {
-		log.Printf("could not connect to INDI-server for CCD '%s' in solo-mode: %s\n",
-			ccdName, err)
+		log.Errorf("could not connect to INDI-server for CCD in solo-mode: %s", err)
 		return nil, err
 	}
-	log.Println("...OK")
+	log.Infof("...OK")
 
 	// set connection to receive data
 	if _, err := conn.Write([]byte(fmt.Sprintf(getCCDProperties, ccdName))); err != nil {
-		log.Printf("getProperties: could not write to INDI-server for %s in solo-mode: %s\n", ccdName, err)
+		log.Errorf("getProperties: could not write to INDI-server in solo-mode: %s", err)
 		conn.Close()
 		return nil, err
 	}
 
 	// enable BLOBS only
 	if _, err := conn.Write([]byte(fmt.Sprintf(enableBLOBOnly, ccdName))); err != nil {
-		log.Printf("getProperties: could not write to INDI-server for %s in solo-mode: %s\n", ccdName, err)
+		log.Errorf("getProperties: could not write to INDI-server in solo-mode: %s", err)
 		conn.Close()
 		return nil, err
 	}
 
-	p.setConnCCD(ccdName, conn)
+	if err := p.setConnCCD(ccdName, conn); err != nil {
+		return nil, err
+	}
 
 	return conn, nil
 }
 
+// Close closes connections to INDI-server, so Run shows session summary and exits, it is safe to call it twice
 func (p *Agent) Close() {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+
 	// close connections to CCDs
-	p.ccdConnMapMu.Lock()
-	defer p.ccdConnMapMu.Unlock()
 	for ccdName, conn := range p.ccdConnMap {
-		log.Println("Closing connection to:", ccdName)
+		logger.With("device", ccdName).Infof("Closing connection to CCD")
 		conn.Close()
 	}
 
 	// close main connection
-	p.indiConn.Close()
-	p.shouldExit = true
+	if p.indiConn != nil {
+		p.indiConn.Close()
+	}
 }
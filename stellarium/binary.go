@@ -0,0 +1,98 @@
+package stellarium
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stellarium telescope server protocol, all values are little-endian:
+// goto from client is length(2) type(2) time(8) ra(4) dec(4),
+// position to client is length(2) type(2) time(8) ra(4) dec(4) status(4)
+const (
+	msgGoto         = 0
+	gotoLength      = 20
+	positionLength  = 24
+	positionPeriod  = 500 * time.Millisecond
+	stellariumRA24  = 0x100000000 // RA of 24h
+	stellariumDec90 = 0x40000000  // DEC of 90°
+)
+
+func (s *Server) serveStellarium(conn net.Conn) {
+	var writeMu sync.Mutex
+	done := make(chan struct{})
+	defer close(done)
+
+	// position is reported periodically while client is connected
+	go func() {
+		ticker := time.NewTicker(positionPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			ra, dec, err := s.Position()
+			if err != nil {
+				continue
+			}
+			writeMu.Lock()
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			_, err = conn.Write(encodePosition(ra, dec, time.Now()))
+			writeMu.Unlock()
+			if err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		length := int(binary.LittleEndian.Uint16(header[0:2]))
+		typ := binary.LittleEndian.Uint16(header[2:4])
+		if length < 4 {
+			logger.Warnf("bad Stellarium message length %d from %s", length, conn.RemoteAddr())
+			return
+		}
+		body := make([]byte, length-4)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		if typ != msgGoto || length != gotoLength {
+			logger.Warnf("unsupported Stellarium message type %d from %s", typ, conn.RemoteAddr())
+			continue
+		}
+
+		ra, dec := decodeGoto(body)
+		if err := s.Goto(ra, dec); err != nil {
+			logger.Warnf("Stellarium goto from %s failed: %s", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// decodeGoto returns coordinates from goto message body after type field
+func decodeGoto(body []byte) (float64, float64) {
+	ra := float64(binary.LittleEndian.Uint32(body[8:12])) * 24 / stellariumRA24
+	dec := float64(int32(binary.LittleEndian.Uint32(body[12:16]))) * 90 / stellariumDec90
+	return ra, dec
+}
+
+func encodePosition(ra float64, dec float64, t time.Time) []byte {
+	msg := make([]byte, positionLength)
+	binary.LittleEndian.PutUint16(msg[0:2], positionLength)
+	binary.LittleEndian.PutUint16(msg[2:4], msgGoto)
+	binary.LittleEndian.PutUint64(msg[4:12], uint64(t.UnixNano()/1000))
+	binary.LittleEndian.PutUint32(msg[12:16], uint32(math.Mod(ra/24*stellariumRA24, stellariumRA24)))
+	binary.LittleEndian.PutUint32(msg[16:20], uint32(int32(math.Round(dec/90*stellariumDec90))))
+	return msg
+}
@@ -0,0 +1,105 @@
+package stellarium
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/indihub-space/agent/astro"
+	"github.com/indihub-space/agent/indiclient"
+)
+
+var (
+	ErrBelowLimit  = errors.New("target is below altitude limit")
+	ErrUnknownSite = errors.New("telescope site is unknown, altitude limits can't be checked")
+)
+
+// HorizonPoint is minimal altitude at azimuth in degrees
+type HorizonPoint struct {
+	Az  float64 `json:"az"`
+	Alt float64 `json:"alt"`
+}
+
+// Limits are mount interlocks checked before goto, targets below minimal altitude or local horizon are refused
+type Limits struct {
+	MinAltitude float64        `json:"minAltitude"`
+	Horizon     []HorizonPoint `json:"horizon,omitempty"` // sorted by azimuth, altitude is interpolated between points
+}
+
+// ParseHorizon parses horizon like "0:10,90:25,180:15" of azimuth:altitude pairs in degrees
+func ParseHorizon(val string) ([]HorizonPoint, error) {
+	horizon := []HorizonPoint{}
+	for _, pair := range strings.Split(val, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad horizon point '%s', expected azimuth:altitude", pair)
+		}
+		az, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil || az < 0 || az >= 360 {
+			return nil, fmt.Errorf("bad horizon azimuth '%s', expected 0..360", parts[0])
+		}
+		alt, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || alt < -90 || alt > 90 {
+			return nil, fmt.Errorf("bad horizon altitude '%s', expected -90..90", parts[1])
+		}
+		horizon = append(horizon, HorizonPoint{Az: az, Alt: alt})
+	}
+	sort.Slice(horizon, func(i, j int) bool {
+		return horizon[i].Az < horizon[j].Az
+	})
+	return horizon, nil
+}
+
+// minAltitude returns minimal altitude at azimuth
+func (l *Limits) minAltitude(az float64) float64 {
+	return math.Max(l.MinAltitude, horizonAltitude(l.Horizon, az))
+}
+
+// horizonAltitude interpolates horizon altitude at azimuth, horizon wraps around North
+func horizonAltitude(horizon []HorizonPoint, az float64) float64 {
+	n := len(horizon)
+	if n == 0 {
+		return -90
+	}
+
+	i := sort.Search(n, func(k int) bool {
+		return horizon[k].Az > az
+	})
+	prev, next := horizon[(i+n-1)%n], horizon[i%n]
+	if i == 0 {
+		prev.Az -= 360
+	}
+	if i == n {
+		next.Az += 360
+	}
+	if next.Az == prev.Az {
+		return prev.Alt
+	}
+	return prev.Alt + (next.Alt-prev.Alt)*(az-prev.Az)/(next.Az-prev.Az)
+}
+
+// check refuses target in hours and degrees of equinox of date below limits for telescope site
+func (l *Limits) check(client *indiclient.Client, device string, ra float64, dec float64, t time.Time) error {
+	v, ok := client.Property(device, "GEOGRAPHIC_COORD")
+	if !ok {
+		return ErrUnknownSite
+	}
+	lat, err := elementNumber(v, "LAT")
+	if err != nil {
+		return ErrUnknownSite
+	}
+	long, err := elementNumber(v, "LONG")
+	if err != nil {
+		return ErrUnknownSite
+	}
+
+	alt, az := astro.Horizontal(ra, dec, lat, astro.SiderealTime(t, long))
+	if limit := l.minAltitude(az); alt < limit {
+		return fmt.Errorf("%w: altitude %.1f° at azimuth %.1f° is below %.1f°", ErrBelowLimit, alt, az, limit)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package stellarium
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const lx200ACK = 0x06
+
+// lx200Session keeps target coordinates set by client before goto or sync
+type lx200Session struct {
+	targetRA  *float64
+	targetDec *float64
+}
+
+// serveLX200 handles subset of Meade LX200 commands used by Stellarium and other planetariums
+func (s *Server) serveLX200(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	session := &lx200Session{}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+
+		var reply string
+		switch b {
+		case lx200ACK:
+			// alignment query, report polar mount
+			reply = "P"
+		case ':':
+			cmd, err := r.ReadString('#')
+			if err != nil {
+				return
+			}
+			reply = s.lx200Command(session, strings.TrimSuffix(cmd, "#"))
+		default:
+			continue
+		}
+
+		if reply == "" {
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) lx200Command(session *lx200Session, cmd string) string {
+	switch {
+	case cmd == "GR":
+		ra, _, err := s.Position()
+		if err != nil {
+			logger.Warnf("LX200 position: %s", err)
+		}
+		h, m, sec := sexagesimal(ra)
+		return fmt.Sprintf("%02d:%02d:%02d#", h, m, sec)
+
+	case cmd == "GD":
+		_, dec, err := s.Position()
+		if err != nil {
+			logger.Warnf("LX200 position: %s", err)
+		}
+		sign := "+"
+		if dec < 0 {
+			sign = "-"
+		}
+		d, m, sec := sexagesimal(math.Abs(dec))
+		return fmt.Sprintf("%s%02d*%02d'%02d#", sign, d, m, sec)
+
+	case strings.HasPrefix(cmd, "Sr"):
+		ra, err := parseSexagesimal(cmd[2:])
+		if err != nil || ra < 0 || ra >= 24 {
+			return "0"
+		}
+		session.targetRA = &ra
+		return "1"
+
+	case strings.HasPrefix(cmd, "Sd"):
+		dec, err := parseSexagesimal(cmd[2:])
+		if err != nil || dec < -90 || dec > 90 {
+			return "0"
+		}
+		session.targetDec = &dec
+		return "1"
+
+	case cmd == "MS":
+		if session.targetRA == nil || session.targetDec == nil {
+			return "2Target is not set#"
+		}
+		if err := s.Goto(*session.targetRA, *session.targetDec); err != nil {
+			logger.Warnf("LX200 goto failed: %s", err)
+			return "2" + err.Error() + "#"
+		}
+		return "0"
+
+	case cmd == "CM":
+		if session.targetRA == nil || session.targetDec == nil {
+			return "Target is not set#"
+		}
+		if err := s.Sync(*session.targetRA, *session.targetDec); err != nil {
+			logger.Warnf("LX200 sync failed: %s", err)
+			return err.Error() + "#"
+		}
+		return "Coordinates matched#"
+
+	case strings.HasPrefix(cmd, "Q"):
+		if err := s.Abort(); err != nil {
+			logger.Warnf("LX200 abort failed: %s", err)
+		}
+		return ""
+
+	case cmd == "GVP":
+		return "INDIHUB Agent#"
+
+	case cmd == "U" || strings.HasPrefix(cmd, "P"):
+		// precision toggles, long format is always used
+		return ""
+	}
+
+	logger.Debugf("unsupported LX200 command :%s#", cmd)
+	return ""
+}
+
+// sexagesimal splits value to whole units, minutes and seconds
+func sexagesimal(v float64) (int, int, int) {
+	total := int(math.Round(v * 3600))
+	return total / 3600, total / 60 % 60, total % 60
+}
+
+// parseSexagesimal parses LX200 values like HH:MM:SS, HH:MM.T, sDD*MM:SS or sDD*MM
+func parseSexagesimal(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	sign := 1.0
+	if strings.HasPrefix(s, "-") {
+		sign = -1
+		s = s[1:]
+	} else if strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+
+	// separators differ between clients: ':', '*', '\'', degree sign
+	parts := strings.FieldsFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if len(parts) == 0 || len(parts) > 3 {
+		return 0, fmt.Errorf("bad sexagesimal value '%s'", s)
+	}
+
+	value := 0.0
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("bad sexagesimal value '%s'", s)
+		}
+		value += n / math.Pow(60, float64(i))
+	}
+	return sign * value, nil
+}
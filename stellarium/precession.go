@@ -0,0 +1,45 @@
+package stellarium
+
+import (
+	"math"
+	"time"
+)
+
+const arcsec = math.Pi / 180 / 3600
+
+// precessionAngles returns IAU 1976 precession angles ζ, z and θ from J2000 to time t in radians
+func precessionAngles(t time.Time) (zeta float64, z float64, theta float64) {
+	jd := float64(t.UTC().UnixNano())/86400e9 + 2440587.5
+	T := (jd - 2451545.0) / 36525
+
+	zeta = (2306.2181*T + 0.30188*T*T + 0.017998*T*T*T) * arcsec
+	z = (2306.2181*T + 1.09468*T*T + 0.018203*T*T*T) * arcsec
+	theta = (2004.3109*T - 0.42665*T*T - 0.041833*T*T*T) * arcsec
+	return
+}
+
+// precess rotates coordinates in hours and degrees by precession angles
+func precess(ra float64, dec float64, zeta float64, z float64, theta float64) (float64, float64) {
+	a := ra * 15 * math.Pi / 180
+	d := dec * math.Pi / 180
+
+	A := math.Cos(d) * math.Sin(a+zeta)
+	B := math.Cos(theta)*math.Cos(d)*math.Cos(a+zeta) - math.Sin(theta)*math.Sin(d)
+	C := math.Sin(theta)*math.Cos(d)*math.Cos(a+zeta) + math.Cos(theta)*math.Sin(d)
+
+	ra = math.Mod((math.Atan2(A, B)+z)*180/math.Pi/15+24, 24)
+	dec = math.Asin(math.Max(-1, math.Min(1, C))) * 180 / math.Pi
+	return ra, dec
+}
+
+// toJNow converts J2000 coordinates to equinox of date
+func toJNow(ra float64, dec float64, t time.Time) (float64, float64) {
+	zeta, z, theta := precessionAngles(t)
+	return precess(ra, dec, zeta, z, theta)
+}
+
+// toJ2000 converts coordinates of equinox of date to J2000
+func toJ2000(ra float64, dec float64, t time.Time) (float64, float64) {
+	zeta, z, theta := precessionAngles(t)
+	return precess(ra, dec, -z, -zeta, -theta)
+}
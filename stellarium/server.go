@@ -0,0 +1,343 @@
+package stellarium
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/indihub-space/agent/hostutils"
+	"github.com/indihub-space/agent/indiclient"
+	"github.com/indihub-space/agent/logutil"
+)
+
+const reconnectDelay = 10 * time.Second
+
+var (
+	ErrNoTelescope  = errors.New("no telescope on INDI-server")
+	ErrNotConnected = errors.New("telescope is not connected")
+	ErrParked       = errors.New("telescope is parked")
+	ErrNoSync       = errors.New("telescope doesn't support sync")
+)
+
+var logger = logutil.New("subsystem", "stellarium")
+
+// DefaultBind is address telescope control listeners are bound to, clients don't support authorization
+const DefaultBind = "127.0.0.1"
+
+// Config is configuration of telescope control listeners, zero port disables listener
+type Config struct {
+	Bind           string  // listeners address, all interfaces if empty
+	StellariumPort uint64  // Stellarium binary protocol
+	LX200Port      uint64  // Meade LX200 protocol
+	Telescope      string  // INDI device name, the first device with EQUATORIAL_EOD_COORD is used if empty
+	J2000          bool    // clients send and expect J2000 coordinates instead of equinox of date
+	Limits         *Limits // goto interlocks, nil disables them
+}
+
+// Server translates Stellarium telescope control and LX200 commands to INDI goto and sync commands
+type Server struct {
+	config         Config
+	indiServerAddr string
+	filter         *hostutils.INDIFilter
+	sentHook       func(cmd []byte)
+
+	mu        sync.Mutex
+	client    *indiclient.Client
+	listeners []net.Listener
+	conns     map[net.Conn]string
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// NewServer creates telescope control server, commands are checked with filter like guest commands
+func NewServer(config Config, indiServerAddr string, filter *hostutils.INDIFilter) *Server {
+	return &Server{
+		config:         config,
+		indiServerAddr: indiServerAddr,
+		filter:         filter,
+		conns:          map[net.Conn]string{},
+		stopCh:         make(chan struct{}),
+	}
+}
+
+// Listen starts listeners of enabled protocols
+func (s *Server) Listen() error {
+	if s.config.StellariumPort != 0 {
+		if err := s.listen("Stellarium", s.config.StellariumPort, s.serveStellarium); err != nil {
+			return err
+		}
+	}
+	if s.config.LX200Port != 0 {
+		if err := s.listen("LX200", s.config.LX200Port, s.serveLX200); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetSentHook sets function called with every command sent to INDI-server, i.e. to write audit log
+func (s *Server) SetSentHook(fn func(cmd []byte)) {
+	s.sentHook = fn
+}
+
+// Run keeps connection to INDI-server until Stop is called
+func (s *Server) Run() {
+	for {
+		client, err := indiclient.Dial(s.indiServerAddr)
+		if err != nil {
+			logger.Errorf("could not connect to INDI-server: %s", err)
+		} else {
+			if s.filter != nil {
+				client.SetCommandFilter(s.filter.IsAllowed)
+			}
+			client.SetSentHook(s.sentHook)
+			s.mu.Lock()
+			s.client = client
+			s.mu.Unlock()
+
+			select {
+			case <-s.stopCh:
+			case <-client.Done():
+				logger.Warnf("telescope control lost connection to INDI-server")
+			}
+
+			s.mu.Lock()
+			s.client = nil
+			s.mu.Unlock()
+			client.Close()
+		}
+
+		select {
+		case <-s.stopCh:
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// Stop closes listeners and client connections
+func (s *Server) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, l := range s.listeners {
+			l.Close()
+		}
+		for conn := range s.conns {
+			conn.Close()
+		}
+	})
+}
+
+// GetStatus returns listeners and connected clients to be shown in agent status
+func (s *Server) GetStatus() map[string]interface{} {
+	s.mu.Lock()
+	connected := s.client != nil
+	clients := make([]string, 0, len(s.conns))
+	for conn, protocol := range s.conns {
+		clients = append(clients, protocol+" "+conn.RemoteAddr().String())
+	}
+	s.mu.Unlock()
+
+	status := map[string]interface{}{
+		"indiConnected": connected,
+		"clients":       clients,
+		"bind":          s.config.Bind,
+	}
+	if s.config.Limits != nil {
+		status["limits"] = s.config.Limits
+	}
+	if s.config.StellariumPort != 0 {
+		status["stellariumPort"] = s.config.StellariumPort
+	}
+	if s.config.LX200Port != 0 {
+		status["lx200Port"] = s.config.LX200Port
+	}
+	return status
+}
+
+func (s *Server) listen(protocol string, port uint64, serve func(conn net.Conn)) error {
+	l, err := net.Listen("tcp", net.JoinHostPort(s.config.Bind, strconv.FormatUint(port, 10)))
+	if err != nil {
+		return fmt.Errorf("could not start %s listener: %s", protocol, err)
+	}
+	logger.Infof("%s telescope control is listening on %s", protocol, l.Addr())
+
+	s.mu.Lock()
+	s.listeners = append(s.listeners, l)
+	s.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				select {
+				case <-s.stopCh:
+				default:
+					logger.Errorf("%s listener error: %s", protocol, err)
+				}
+				return
+			}
+
+			s.mu.Lock()
+			s.conns[conn] = protocol
+			s.mu.Unlock()
+			logger.Infof("%s client connected from %s", protocol, conn.RemoteAddr())
+
+			go func() {
+				defer func() {
+					conn.Close()
+					s.mu.Lock()
+					delete(s.conns, conn)
+					s.mu.Unlock()
+					logger.Infof("%s client from %s disconnected", protocol, conn.RemoteAddr())
+				}()
+				serve(conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+// telescope returns client and name of controlled telescope
+func (s *Server) telescope() (*indiclient.Client, string, error) {
+	s.mu.Lock()
+	client := s.client
+	s.mu.Unlock()
+	if client == nil {
+		return nil, "", indiclient.ErrClosed
+	}
+
+	device := s.config.Telescope
+	if device == "" {
+		devices := client.DevicesWithProperty("EQUATORIAL_EOD_COORD")
+		if len(devices) == 0 {
+			return nil, "", ErrNoTelescope
+		}
+		device = devices[0]
+	}
+	if !client.HasProperty(device, "EQUATORIAL_EOD_COORD") {
+		return nil, "", ErrNoTelescope
+	}
+	if !isOn(client, device, "CONNECTION", "CONNECT") {
+		return nil, "", ErrNotConnected
+	}
+	return client, device, nil
+}
+
+// Position returns current telescope coordinates in hours and degrees
+func (s *Server) Position() (float64, float64, error) {
+	client, device, err := s.telescope()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	v, _ := client.Property(device, "EQUATORIAL_EOD_COORD")
+	ra, err := elementNumber(v, "RA")
+	if err != nil {
+		return 0, 0, err
+	}
+	dec, err := elementNumber(v, "DEC")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if s.config.J2000 {
+		ra, dec = toJ2000(ra, dec, time.Now())
+	}
+	return ra, dec, nil
+}
+
+// Goto slews telescope to coordinates in hours and degrees
+func (s *Server) Goto(ra float64, dec float64) error {
+	return s.setCoords(ra, dec, "TRACK", "SLEW")
+}
+
+// Sync syncs telescope to coordinates in hours and degrees
+func (s *Server) Sync(ra float64, dec float64) error {
+	return s.setCoords(ra, dec, "SYNC")
+}
+
+// Abort stops telescope motion
+func (s *Server) Abort() error {
+	client, device, err := s.telescope()
+	if err != nil {
+		return err
+	}
+	return client.SetSwitch(device, "TELESCOPE_ABORT_MOTION", "ABORT")
+}
+
+// setCoords sets EQUATORIAL_EOD_COORD after switching ON_COORD_SET to the first available action
+func (s *Server) setCoords(ra float64, dec float64, actions ...string) error {
+	client, device, err := s.telescope()
+	if err != nil {
+		return err
+	}
+
+	if ra < 0 || ra >= 24 || dec < -90 || dec > 90 {
+		return fmt.Errorf("bad coordinates RA=%g DEC=%g", ra, dec)
+	}
+	if isOn(client, device, "TELESCOPE_PARK", "PARK") {
+		return ErrParked
+	}
+	if s.filter != nil {
+		if blocked, reason := s.filter.IsBlocked(); blocked {
+			return fmt.Errorf("%w: %s", indiclient.ErrBlocked, reason)
+		}
+	}
+
+	now := time.Now()
+	if s.config.J2000 {
+		ra, dec = toJNow(ra, dec, now)
+	}
+	// sync doesn't move telescope
+	if s.config.Limits != nil && actions[0] != "SYNC" {
+		if err := s.config.Limits.check(client, device, ra, dec, now); err != nil {
+			return err
+		}
+	}
+
+	if v, ok := client.Property(device, "ON_COORD_SET"); ok {
+		action := ""
+		for _, a := range actions {
+			if _, ok := v.Element(a); ok {
+				action = a
+				break
+			}
+		}
+		if action == "" {
+			return fmt.Errorf("%s doesn't support %s", device, actions[0])
+		}
+		if err := client.SetSwitch(device, "ON_COORD_SET", action); err != nil {
+			return err
+		}
+	} else if actions[0] == "SYNC" {
+		return ErrNoSync
+	}
+
+	logger.Infof("%s %s to RA=%.5f DEC=%.5f", actions[0], device, ra, dec)
+	return client.SetNumbers(device, "EQUATORIAL_EOD_COORD", map[string]float64{"RA": ra, "DEC": dec})
+}
+
+func isOn(client *indiclient.Client, device string, name string, element string) bool {
+	v, ok := client.Property(device, name)
+	if !ok {
+		return false
+	}
+	e, ok := v.Element(element)
+	return ok && e.Value == indiclient.SwitchOn
+}
+
+func elementNumber(v *indiclient.Vector, name string) (float64, error) {
+	e, ok := v.Element(name)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s.%s.%s", indiclient.ErrUnknownElement, v.Device, v.Name, name)
+	}
+	return strconv.ParseFloat(e.Value, 64)
+}
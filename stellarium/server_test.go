@@ -0,0 +1,371 @@
+package stellarium
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testDefs = `<defSwitchVector device="Mount" name="CONNECTION" state="Ok" perm="rw" rule="OneOfMany">
+<defSwitch name="CONNECT">On</defSwitch>
+<defSwitch name="DISCONNECT">Off</defSwitch>
+</defSwitchVector>
+<defNumberVector device="Mount" name="EQUATORIAL_EOD_COORD" state="Ok" perm="rw">
+<defNumber name="RA" format="%m" min="0" max="24" step="0">5.5</defNumber>
+<defNumber name="DEC" format="%m" min="-90" max="90" step="0">-10.25</defNumber>
+</defNumberVector>
+<defSwitchVector device="Mount" name="ON_COORD_SET" state="Ok" perm="rw" rule="OneOfMany">
+<defSwitch name="TRACK">On</defSwitch>
+<defSwitch name="SLEW">Off</defSwitch>
+<defSwitch name="SYNC">Off</defSwitch>
+</defSwitchVector>
+<defNumberVector device="Mount" name="GEOGRAPHIC_COORD" state="Ok" perm="rw">
+<defNumber name="LAT" format="%m" min="-90" max="90" step="0">50</defNumber>
+<defNumber name="LONG" format="%m" min="0" max="360" step="0">10</defNumber>
+</defNumberVector>
+`
+
+// fakeINDIServer answers getProperties with defs and keeps everything it receives
+type fakeINDIServer struct {
+	l net.Listener
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	received strings.Builder
+}
+
+func newFakeINDIServer(t *testing.T) *fakeINDIServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeINDIServer{l: l}
+	go s.accept()
+	return s
+}
+
+func (s *fakeINDIServer) accept() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, c)
+		s.mu.Unlock()
+		go s.serve(c)
+	}
+}
+
+func (s *fakeINDIServer) serve(c net.Conn) {
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.received.WriteString(line)
+		s.mu.Unlock()
+
+		if strings.HasPrefix(line, "<getProperties") {
+			c.Write([]byte(testDefs))
+		}
+	}
+}
+
+func (s *fakeINDIServer) data() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received.String()
+}
+
+// waitData waits until INDI-server receives all parts
+func (s *fakeINDIServer) waitData(t *testing.T, parts ...string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		data := s.data()
+		received := true
+		for _, part := range parts {
+			received = received && strings.Contains(data, part)
+		}
+		if received {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("INDI-server didn't receive %q, got: %s", parts, data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *fakeINDIServer) close() {
+	s.l.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+// startServer runs telescope control server and waits until telescope is known
+func startServer(t *testing.T, config Config) (*Server, *fakeINDIServer, func()) {
+	server := newFakeINDIServer(t)
+	s := NewServer(config, server.l.Addr().String(), nil)
+	done := make(chan struct{})
+	go func() {
+		s.Run()
+		close(done)
+	}()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, _, err := s.Position(); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("telescope is not available")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return s, server, func() {
+		s.Stop()
+		<-done
+		server.close()
+	}
+}
+
+// lx200 sends command to LX200 session and reads reply of n bytes or up to '#'
+func lx200(t *testing.T, conn net.Conn, r *bufio.Reader, cmd string, n int) string {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := conn.Write([]byte(cmd)); err != nil {
+		t.Fatal(err)
+	}
+	if n > 0 {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatalf("no reply to %s: %s", cmd, err)
+		}
+		return string(buf)
+	}
+	reply, err := r.ReadString('#')
+	if err != nil {
+		t.Fatalf("no reply to %s: %s", cmd, err)
+	}
+	return reply
+}
+
+func TestLX200(t *testing.T) {
+	s, server, stop := startServer(t, Config{Limits: &Limits{}})
+	defer stop()
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go s.serveLX200(conn)
+	r := bufio.NewReader(client)
+
+	if reply := lx200(t, client, r, ":GR#", 0); reply != "05:30:00#" {
+		t.Errorf("unexpected RA %s", reply)
+	}
+	if reply := lx200(t, client, r, ":GD#", 0); reply != "-10*15'00#" {
+		t.Errorf("unexpected DEC %s", reply)
+	}
+	if reply := lx200(t, client, r, ":Sr25:00:00#", 1); reply != "0" {
+		t.Errorf("bad RA is accepted: %s", reply)
+	}
+	if reply := lx200(t, client, r, ":Sr07:15:00#", 1); reply != "1" {
+		t.Errorf("RA is not accepted: %s", reply)
+	}
+
+	// the target is always below horizon at latitude 50
+	if reply := lx200(t, client, r, ":Sd-89*00:00#", 1); reply != "1" {
+		t.Errorf("DEC is not accepted: %s", reply)
+	}
+	if reply := lx200(t, client, r, ":MS#", 0); !strings.HasPrefix(reply, "2") || !strings.Contains(reply, "below") {
+		t.Errorf("goto below horizon is not refused: %s", reply)
+	}
+	if strings.Contains(server.data(), "<newNumberVector") {
+		t.Fatalf("goto below horizon is sent to INDI-server: %s", server.data())
+	}
+
+	// the target is always above horizon at latitude 50
+	if reply := lx200(t, client, r, ":Sd+89*30:00#", 1); reply != "1" {
+		t.Errorf("DEC is not accepted: %s", reply)
+	}
+	if reply := lx200(t, client, r, ":MS#", 1); reply != "0" {
+		t.Errorf("goto failed: %s", reply)
+	}
+	server.waitData(t, `<oneSwitch name="TRACK">On</oneSwitch>`, `<oneNumber name="RA">7.25</oneNumber>`, `<oneNumber name="DEC">89.5</oneNumber>`)
+
+	// sync isn't checked against limits
+	if reply := lx200(t, client, r, ":Sd-89*00:00#", 1); reply != "1" {
+		t.Errorf("DEC is not accepted: %s", reply)
+	}
+	if reply := lx200(t, client, r, ":CM#", 0); reply != "Coordinates matched#" {
+		t.Errorf("sync failed: %s", reply)
+	}
+	server.waitData(t, `<oneSwitch name="SYNC">On</oneSwitch>`, `<oneNumber name="DEC">-89</oneNumber>`)
+}
+
+func TestStellariumProtocol(t *testing.T) {
+	s, server, stop := startServer(t, Config{})
+	defer stop()
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go s.serveStellarium(conn)
+
+	// 12h, -45°
+	msg := make([]byte, gotoLength)
+	binary.LittleEndian.PutUint16(msg[0:2], gotoLength)
+	binary.LittleEndian.PutUint16(msg[2:4], msgGoto)
+	binary.LittleEndian.PutUint32(msg[12:16], 0x80000000)
+	binary.LittleEndian.PutUint32(msg[16:20], uint32(0xE0000000))
+	client.SetDeadline(time.Now().Add(3 * time.Second))
+
+	// position is reported periodically
+	pos := make([]byte, positionLength)
+	if _, err := io.ReadFull(client, pos); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	server.waitData(t, `<oneNumber name="RA">12</oneNumber>`, `<oneNumber name="DEC">-45</oneNumber>`)
+
+	ra := float64(binary.LittleEndian.Uint32(pos[12:16])) * 24 / stellariumRA24
+	dec := float64(int32(binary.LittleEndian.Uint32(pos[16:20]))) * 90 / stellariumDec90
+	if math.Abs(ra-5.5) > 1e-6 || math.Abs(dec+10.25) > 1e-6 {
+		t.Errorf("unexpected position RA=%g DEC=%g", ra, dec)
+	}
+}
+
+func TestStellariumCodec(t *testing.T) {
+	body := make([]byte, gotoLength-4)
+	binary.LittleEndian.PutUint32(body[8:12], 0x40000000)
+	binary.LittleEndian.PutUint32(body[12:16], uint32(0xC0000000))
+	if ra, dec := decodeGoto(body); ra != 6 || dec != -90 {
+		t.Errorf("unexpected goto RA=%g DEC=%g", ra, dec)
+	}
+
+	now := time.Unix(1600000000, 123456000)
+	msg := encodePosition(18, 45, now)
+	if len(msg) != positionLength || binary.LittleEndian.Uint16(msg[0:2]) != positionLength {
+		t.Fatalf("bad position message length: %v", msg)
+	}
+	if tm := binary.LittleEndian.Uint64(msg[4:12]); tm != 1600000000123456 {
+		t.Errorf("unexpected time %d", tm)
+	}
+	if ra := binary.LittleEndian.Uint32(msg[12:16]); ra != 0xC0000000 {
+		t.Errorf("unexpected RA %#x", ra)
+	}
+	if dec := binary.LittleEndian.Uint32(msg[16:20]); dec != 0x20000000 {
+		t.Errorf("unexpected DEC %#x", dec)
+	}
+	// 24h wraps to 0
+	if ra := binary.LittleEndian.Uint32(encodePosition(24, 0, now)[12:16]); ra != 0 {
+		t.Errorf("unexpected RA of 24h %#x", ra)
+	}
+}
+
+func TestParseSexagesimal(t *testing.T) {
+	for _, c := range []struct {
+		val      string
+		expected float64
+	}{
+		{"07:15:00", 7.25},
+		{"07:15.5", 7 + 15.5/60},
+		{"+45*30:00", 45.5},
+		{"-00*30:00", -0.5},
+		{"-10*15'36", -(10 + 15.0/60 + 36.0/3600)},
+		{" 12:00", 12},
+	} {
+		got, err := parseSexagesimal(c.val)
+		if err != nil || math.Abs(got-c.expected) > 1e-9 {
+			t.Errorf("%s: expected %g, got %g (%v)", c.val, c.expected, got, err)
+		}
+	}
+	for _, val := range []string{"", "1:2:3:4", "ab", "-"} {
+		if _, err := parseSexagesimal(val); err == nil {
+			t.Errorf("bad value '%s' is parsed", val)
+		}
+	}
+
+	if h, m, s := sexagesimal(7.999999); h != 8 || m != 0 || s != 0 {
+		t.Errorf("unexpected rounding %d:%d:%d", h, m, s)
+	}
+}
+
+func TestPrecession(t *testing.T) {
+	// Meeus, Astronomical Algorithms, example 21.b: θ Persei with proper motion applied, JD 2462088.69
+	t0 := time.Unix(int64((2462088.69-2440587.5)*86400), 0)
+	ra, dec := toJNow(41.054063/15, 49.227750, t0)
+	if math.Abs(ra*15-41.547214) > 1e-4 || math.Abs(dec-49.348483) > 1e-4 {
+		t.Errorf("unexpected JNow coordinates RA=%.6f° DEC=%.6f°", ra*15, dec)
+	}
+
+	ra, dec = toJ2000(ra, dec, t0)
+	if math.Abs(ra*15-41.054063) > 1e-6 || math.Abs(dec-49.227750) > 1e-6 {
+		t.Errorf("J2000 coordinates are not restored: RA=%.6f° DEC=%.6f°", ra*15, dec)
+	}
+
+	// no precession at J2000.0
+	ra, dec = toJNow(10, 20, time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC))
+	if math.Abs(ra-10) > 1e-9 || math.Abs(dec-20) > 1e-9 {
+		t.Errorf("coordinates are changed at J2000.0: RA=%g DEC=%g", ra, dec)
+	}
+}
+
+func TestHorizon(t *testing.T) {
+	horizon, err := ParseHorizon("270:20, 0:10,90:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := &Limits{MinAltitude: 12, Horizon: horizon}
+	for _, c := range []struct {
+		az       float64
+		expected float64
+	}{
+		{0, 12},
+		{45, 20},
+		{90, 30},
+		{180, 25},
+		{270, 20},
+		{315, 15},
+		{359, 12},
+	} {
+		if got := limits.minAltitude(c.az); math.Abs(got-c.expected) > 1e-9 {
+			t.Errorf("azimuth %g: expected %g, got %g", c.az, c.expected, got)
+		}
+	}
+
+	for _, val := range []string{"", "10", "360:10", "10:91", "a:b"} {
+		if _, err := ParseHorizon(val); err == nil {
+			t.Errorf("bad horizon '%s' is parsed", val)
+		}
+	}
+}
+
+func TestGotoNeedsSite(t *testing.T) {
+	s, _, stop := startServer(t, Config{Limits: &Limits{}})
+	defer stop()
+
+	client, device, err := s.telescope()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// other device without GEOGRAPHIC_COORD
+	if err := s.config.Limits.check(client, device+" 2", 0, 0, time.Now()); !errors.Is(err, ErrUnknownSite) {
+		t.Errorf("expected unknown site error, got %v", err)
+	}
+}
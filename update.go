@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/indihub-space/agent/update"
+	"github.com/indihub-space/agent/version"
+)
+
+// runUpdate implements 'update' command: replaces agent binary with verified new one
+func runUpdate(args []string) {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	from := fs.String("from", "", "file or URL of new agent binary, directory or URL ending with '/' to pick binary for this platform")
+	sig := fs.String("sig", "", "file or URL of ed25519 signature of new binary (<from>.sig by default)")
+	force := fs.Bool("force", false, "allow to install older version")
+	healthTimeout := fs.Duration("health-timeout", update.DefaultHealthTimeout, "timeout of new binary health check")
+	rollback := fs.Bool("rollback", false, "restore binary replaced by the last update")
+	keygen := fs.Bool("keygen", false, "generate key pair to sign releases with")
+	sign := fs.String("sign", "", "sign binary with private key from -key file, signature is written to <binary>.sig")
+	keyFile := fs.String("key", "", "file with base64-encoded private key to sign binary with")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s update -from=<file-or-url> [parameters]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	switch {
+	case *keygen:
+		pub, priv, err := update.GenerateKey()
+		if err != nil {
+			logger.Fatalf("%s", err)
+		}
+		fmt.Printf("Public key (embed with -ldflags \"-X github.com/indihub-space/agent/update.PublicKey=%s\"):\n%s\n", pub, pub)
+		fmt.Printf("Private key (keep it secret):\n%s\n", priv)
+
+	case *sign != "":
+		key, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			logger.Fatalf("could not read private key: %s", err)
+		}
+		data, err := ioutil.ReadFile(*sign)
+		if err != nil {
+			logger.Fatalf("%s", err)
+		}
+		signature, err := update.Sign(data, string(key))
+		if err != nil {
+			logger.Fatalf("%s", err)
+		}
+		if err := ioutil.WriteFile(*sign+".sig", signature, 0644); err != nil {
+			logger.Fatalf("%s", err)
+		}
+		fmt.Printf("Signature written to %s.sig\n", *sign)
+
+	case *rollback:
+		if err := update.Rollback(); err != nil {
+			logger.Fatalf("could not roll back: %s", err)
+		}
+		fmt.Println("Previous agent binary is restored")
+
+	default:
+		if *from == "" {
+			fs.Usage()
+			os.Exit(2)
+		}
+		res, err := update.Run(update.Options{
+			From:          *from,
+			Sig:           *sig,
+			Force:         *force,
+			HealthTimeout: *healthTimeout,
+		})
+		if err != nil {
+			logger.Fatalf("update failed: %s", err)
+		}
+		fmt.Printf("Agent %s is updated from version %s to %s, restart it to run the new version\n",
+			res.Binary, res.OldVersion, res.NewVersion)
+	}
+}
+
+// runVersion implements 'version' command, it is used as health check of updated binary
+func runVersion() {
+	fmt.Println(version.AgentVersion)
+}
@@ -0,0 +1,93 @@
+package update
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"fmt"
+	"runtime"
+)
+
+var (
+	elfMachines = map[string]elf.Machine{
+		"386":   elf.EM_386,
+		"amd64": elf.EM_X86_64,
+		"arm":   elf.EM_ARM,
+		"arm64": elf.EM_AARCH64,
+	}
+	machoCpus = map[string]macho.Cpu{
+		"amd64": macho.CpuAmd64,
+		"arm64": macho.CpuArm64,
+	}
+	peMachines = map[string]uint16{
+		"386":   pe.IMAGE_FILE_MACHINE_I386,
+		"amd64": pe.IMAGE_FILE_MACHINE_AMD64,
+		"arm":   pe.IMAGE_FILE_MACHINE_ARMNT,
+		"arm64": pe.IMAGE_FILE_MACHINE_ARM64,
+	}
+)
+
+// PlatformFileName returns name of agent binary built for current GOOS/GOARCH in update directory
+func PlatformFileName() string {
+	name := fmt.Sprintf("indihub-agent-%s-%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// CheckPlatform checks that data is executable for current GOOS/GOARCH
+func CheckPlatform(data []byte) error {
+	return checkPlatform(data, runtime.GOOS, runtime.GOARCH)
+}
+
+func checkPlatform(data []byte, goos string, goarch string) error {
+	r := bytes.NewReader(data)
+	switch goos {
+	case "windows":
+		machine, ok := peMachines[goarch]
+		if !ok {
+			return fmt.Errorf("update is not supported for %s/%s", goos, goarch)
+		}
+		f, err := pe.NewFile(r)
+		if err != nil {
+			return fmt.Errorf("binary is not Windows executable: %s", err)
+		}
+		if f.Machine != machine {
+			return fmt.Errorf("binary is built for another architecture (machine 0x%x), %s/%s is expected",
+				f.Machine, goos, goarch)
+		}
+
+	case "darwin":
+		cpu, ok := machoCpus[goarch]
+		if !ok {
+			return fmt.Errorf("update is not supported for %s/%s", goos, goarch)
+		}
+		f, err := macho.NewFile(r)
+		if err != nil {
+			return fmt.Errorf("binary is not macOS executable: %s", err)
+		}
+		if f.Cpu != cpu {
+			return fmt.Errorf("binary is built for %s, %s/%s is expected", f.Cpu, goos, goarch)
+		}
+
+	default:
+		machine, ok := elfMachines[goarch]
+		if !ok {
+			return fmt.Errorf("update is not supported for %s/%s", goos, goarch)
+		}
+		f, err := elf.NewFile(r)
+		if err != nil {
+			return fmt.Errorf("binary is not ELF executable: %s", err)
+		}
+		if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+			return fmt.Errorf("binary is not executable: %s", f.Type)
+		}
+		if f.Machine != machine {
+			return fmt.Errorf("binary is built for %s, %s/%s is expected", f.Machine, goos, goarch)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package update
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// PublicKey is base64-encoded ed25519 key to verify update signatures with,
+// it is embedded at release build: -ldflags "-X github.com/indihub-space/agent/update.PublicKey=..."
+var PublicKey = ""
+
+var ErrBadSignature = errors.New("bad signature of update")
+
+// Verify checks detached signature of data, signature can be raw or base64-encoded
+func Verify(data []byte, sig []byte) error {
+	if PublicKey == "" {
+		return errors.New("public key to verify updates is not embedded in this build")
+	}
+	key, err := decodeKey(PublicKey, ed25519.PublicKeySize)
+	if err != nil {
+		return fmt.Errorf("bad embedded public key: %s", err)
+	}
+
+	if len(sig) != ed25519.SignatureSize {
+		if sig, err = decodeKey(string(sig), ed25519.SignatureSize); err != nil {
+			return ErrBadSignature
+		}
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), data, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Sign returns base64-encoded detached signature of data
+func Sign(data []byte, privateKey string) ([]byte, error) {
+	key, err := decodeKey(privateKey, ed25519.PrivateKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("bad private key: %s", err)
+	}
+	sig := ed25519.Sign(ed25519.PrivateKey(key), data)
+	return []byte(base64.StdEncoding.EncodeToString(sig) + "\n"), nil
+}
+
+// GenerateKey returns new base64-encoded ed25519 key pair for signing releases
+func GenerateKey() (public string, private string, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(pub), base64.StdEncoding.EncodeToString(priv), nil
+}
+
+func decodeKey(s string, size int) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != size {
+		return nil, fmt.Errorf("%d bytes are expected, got %d", size, len(key))
+	}
+	return key, nil
+}
@@ -0,0 +1,73 @@
+package update
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// setTestKey embeds new public key and returns private key and function restoring embedded key
+func setTestKey(t *testing.T) (string, func()) {
+	public, private, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	embedded := PublicKey
+	PublicKey = public
+	return private, func() {
+		PublicKey = embedded
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	private, restore := setTestKey(t)
+	defer restore()
+
+	data := []byte("indihub-agent binary")
+	sig, err := Sign(data, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Verify(data, sig); err != nil {
+		t.Errorf("base64 signature: %s", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(sig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(data, raw); err != nil {
+		t.Errorf("raw signature: %s", err)
+	}
+
+	if err := Verify([]byte("indihub-agent binary!"), sig); err != ErrBadSignature {
+		t.Errorf("changed data: expected %v, got %v", ErrBadSignature, err)
+	}
+	if err := Verify(data, []byte("not a signature")); err != ErrBadSignature {
+		t.Errorf("bad signature: expected %v, got %v", ErrBadSignature, err)
+	}
+
+	// signature made with other key
+	_, other, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSig, err := Sign(data, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(data, otherSig); err != ErrBadSignature {
+		t.Errorf("other key: expected %v, got %v", ErrBadSignature, err)
+	}
+}
+
+func TestVerifyWithoutKey(t *testing.T) {
+	embedded := PublicKey
+	defer func() {
+		PublicKey = embedded
+	}()
+	PublicKey = ""
+
+	if err := Verify([]byte("data"), []byte("sig")); err == nil {
+		t.Error("expected error when public key is not embedded")
+	}
+}
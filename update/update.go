@@ -0,0 +1,264 @@
+package update
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/indihub-space/agent/version"
+)
+
+const (
+	newSuffix    = ".new"
+	backupSuffix = ".old"
+
+	DefaultHealthTimeout = 10 * time.Second
+)
+
+// Options of update
+type Options struct {
+	From          string        // file or URL of new binary, directory or URL ending with "/" has binaries for all platforms
+	Sig           string        // file or URL of detached signature, From + ".sig" by default
+	Force         bool          // allow downgrade
+	HealthTimeout time.Duration // timeout of new binary health check
+}
+
+// Result of successful update
+type Result struct {
+	Binary     string
+	OldVersion string
+	NewVersion string
+}
+
+// Run verifies new binary and replaces currently running one with it,
+// the previous binary is kept with ".old" suffix and restored if the new one fails health check
+func Run(opts Options) (*Result, error) {
+	binary, err := executable()
+	if err != nil {
+		return nil, err
+	}
+	return run(binary, opts)
+}
+
+func run(binary string, opts Options) (*Result, error) {
+	if opts.HealthTimeout == 0 {
+		opts.HealthTimeout = DefaultHealthTimeout
+	}
+
+	src := resolveSource(opts.From)
+	sigSrc := opts.Sig
+	if sigSrc == "" {
+		sigSrc = src + ".sig"
+	}
+
+	data, err := read(src)
+	if err != nil {
+		return nil, fmt.Errorf("could not read update: %s", err)
+	}
+	sig, err := read(sigSrc)
+	if err != nil {
+		return nil, fmt.Errorf("could not read update signature: %s", err)
+	}
+	if err := Verify(data, sig); err != nil {
+		return nil, err
+	}
+	if err := CheckPlatform(data); err != nil {
+		return nil, err
+	}
+
+	// write new binary next to the current one so that rename is atomic
+	info, err := os.Stat(binary)
+	if err != nil {
+		return nil, err
+	}
+	newBinary := binary + newSuffix
+	if err := writeFile(newBinary, data, info.Mode()); err != nil {
+		return nil, err
+	}
+
+	newVer, err := healthCheck(newBinary, opts.HealthTimeout)
+	if err != nil {
+		os.Remove(newBinary)
+		return nil, fmt.Errorf("new binary failed health check: %s", err)
+	}
+	if c, err := version.Compare(newVer, version.AgentVersion); err == nil && c < 0 && !opts.Force {
+		os.Remove(newBinary)
+		return nil, fmt.Errorf("new version %s is older than current %s, use force to downgrade", newVer, version.AgentVersion)
+	}
+
+	if err := swap(binary, newBinary); err != nil {
+		os.Remove(newBinary)
+		return nil, err
+	}
+
+	if _, err := healthCheck(binary, opts.HealthTimeout); err != nil {
+		if rbErr := rollback(binary); rbErr != nil {
+			return nil, fmt.Errorf("new binary failed health check: %s, rollback failed: %s", err, rbErr)
+		}
+		return nil, fmt.Errorf("new binary failed health check, previous version is restored: %s", err)
+	}
+
+	return &Result{
+		Binary:     binary,
+		OldVersion: version.AgentVersion,
+		NewVersion: newVer,
+	}, nil
+}
+
+// Rollback restores binary which was replaced by the last update
+func Rollback() error {
+	binary, err := executable()
+	if err != nil {
+		return err
+	}
+	return rollback(binary)
+}
+
+func rollback(binary string) error {
+	backup := binary + backupSuffix
+	if _, err := os.Stat(backup); err != nil {
+		return fmt.Errorf("no previous binary to roll back to: %s", err)
+	}
+
+	if runtime.GOOS == "windows" {
+		// running binary can be renamed but not replaced on Windows
+		os.Remove(binary + newSuffix)
+		if err := os.Rename(binary, binary+newSuffix); err != nil {
+			return err
+		}
+	}
+	return os.Rename(backup, binary)
+}
+
+func executable() (string, error) {
+	binary, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(binary)
+}
+
+// resolveSource adds name of binary for current platform to directory or URL ending with "/"
+func resolveSource(from string) string {
+	if isURL(from) {
+		if strings.HasSuffix(from, "/") {
+			return from + PlatformFileName()
+		}
+		return from
+	}
+	if info, err := os.Stat(from); err == nil && info.IsDir() {
+		return filepath.Join(from, PlatformFileName())
+	}
+	return from
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+func read(src string) ([]byte, error) {
+	if !isURL(src) {
+		return ioutil.ReadFile(src)
+	}
+
+	client := http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Get(src)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", src, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func writeFile(fileName string, data []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(fileName)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(fileName)
+		return err
+	}
+	return f.Close()
+}
+
+// swap keeps current binary as backup and moves new one in its place
+func swap(binary string, newBinary string) error {
+	backup := binary + backupSuffix
+	os.Remove(backup)
+
+	if runtime.GOOS == "windows" {
+		// running binary can be renamed but not replaced on Windows
+		if err := os.Rename(binary, backup); err != nil {
+			return err
+		}
+		if err := os.Rename(newBinary, binary); err != nil {
+			os.Rename(backup, binary)
+			return err
+		}
+		return nil
+	}
+
+	// binary stays in place until rename of the new one, so there is no moment without it
+	if err := os.Link(binary, backup); err != nil {
+		if err := copyFile(binary, backup); err != nil {
+			return fmt.Errorf("could not keep previous binary: %s", err)
+		}
+	}
+	return os.Rename(newBinary, binary)
+}
+
+func copyFile(src string, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// healthCheck runs binary with 'version' command and returns version it reports
+func healthCheck(binary string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, binary, "version").Output()
+	if err != nil {
+		return "", err
+	}
+	ver := strings.TrimSpace(string(out))
+	if _, err := version.ParseSemver(ver); err != nil {
+		return "", err
+	}
+	return ver, nil
+}
@@ -0,0 +1,136 @@
+package update
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// test binary is used as agent binary: it reports version from envVersion in health check
+const envVersion = "INDIHUB_UPDATE_TEST_VERSION"
+
+func TestMain(m *testing.M) {
+	if ver := os.Getenv(envVersion); ver != "" && len(os.Args) == 2 && os.Args[1] == "version" {
+		fmt.Println(ver)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// prepareUpdate makes temp dir with agent binary and signed new binary, new binary differs by suffix
+func prepareUpdate(t *testing.T, private string) (dir string, binary string, newBinary string) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err = ioutil.TempDir("", "update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary = filepath.Join(dir, "indihub-agent")
+	if err := ioutil.WriteFile(binary, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	newData := append(data, []byte("new")...)
+	newBinary = filepath.Join(dir, "indihub-agent-update")
+	if err := ioutil.WriteFile(newBinary, newData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sig, err := Sign(newData, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(newBinary+".sig", sig, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, binary, newBinary
+}
+
+func isNew(t *testing.T, binary string) bool {
+	data, err := ioutil.ReadFile(binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.HasSuffix(data, []byte("new"))
+}
+
+func TestUpdateAndRollback(t *testing.T) {
+	private, restore := setTestKey(t)
+	defer restore()
+	dir, binary, newBinary := prepareUpdate(t, private)
+	defer os.RemoveAll(dir)
+
+	os.Setenv(envVersion, "99.0.0")
+	defer os.Unsetenv(envVersion)
+
+	res, err := run(binary, Options{From: newBinary})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.NewVersion != "99.0.0" || res.Binary != binary {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if !isNew(t, binary) {
+		t.Error("binary is not replaced")
+	}
+	if isNew(t, binary+backupSuffix) {
+		t.Error("previous binary is not kept")
+	}
+	if info, err := os.Stat(binary); err != nil || info.Mode()&0100 == 0 {
+		t.Errorf("new binary is not executable: %v", err)
+	}
+	if _, err := os.Stat(binary + newSuffix); !os.IsNotExist(err) {
+		t.Error("temporary binary is left")
+	}
+
+	if err := rollback(binary); err != nil {
+		t.Fatal(err)
+	}
+	if isNew(t, binary) {
+		t.Error("previous binary is not restored")
+	}
+	if err := rollback(binary); err == nil {
+		t.Error("expected error when there is nothing to roll back to")
+	}
+}
+
+func TestUpdateIsRejected(t *testing.T) {
+	private, restore := setTestKey(t)
+	defer restore()
+	dir, binary, newBinary := prepareUpdate(t, private)
+	defer os.RemoveAll(dir)
+
+	// downgrade without force
+	os.Setenv(envVersion, "0.0.1")
+	defer os.Unsetenv(envVersion)
+	if _, err := run(binary, Options{From: newBinary}); err == nil {
+		t.Error("expected downgrade to be rejected")
+	}
+	if isNew(t, binary) {
+		t.Error("binary is replaced by older version")
+	}
+
+	// signature of other data
+	os.Setenv(envVersion, "99.0.0")
+	if err := ioutil.WriteFile(newBinary+".sig", []byte("bad"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run(binary, Options{From: newBinary}); err != ErrBadSignature {
+		t.Errorf("expected %v, got %v", ErrBadSignature, err)
+	}
+	if isNew(t, binary) {
+		t.Error("binary is replaced by update with bad signature")
+	}
+	if _, err := os.Stat(binary + newSuffix); !os.IsNotExist(err) {
+		t.Error("temporary binary is left")
+	}
+}
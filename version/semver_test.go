@@ -0,0 +1,86 @@
+package version
+
+import (
+	"testing"
+)
+
+func TestParseSemver(t *testing.T) {
+	tests := []struct {
+		in    string
+		out   string
+		major int
+		pre   int
+		err   bool
+	}{
+		{in: "1.0.6", out: "1.0.6", major: 1},
+		{in: "v2.10.0", out: "2.10.0", major: 2},
+		{in: " 1.2.3\n", out: "1.2.3", major: 1},
+		{in: "1.2.3-rc.1", out: "1.2.3-rc.1", major: 1, pre: 2},
+		{in: "1.2.3-beta+exp.sha.5114f85", out: "1.2.3-beta+exp.sha.5114f85", major: 1, pre: 1},
+		{in: "1.2.3+20201018", out: "1.2.3+20201018", major: 1},
+		{in: "1.2", err: true},
+		{in: "1.2.3.4", err: true},
+		{in: "1.02.3", err: true},
+		{in: "1.-2.3", err: true},
+		{in: "a.b.c", err: true},
+		{in: "1.2.3-", err: true},
+		{in: "1.2.3-rc..1", err: true},
+		{in: "", err: true},
+	}
+	for _, test := range tests {
+		v, err := ParseSemver(test.in)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected error, got %s", test.in, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.in, err)
+			continue
+		}
+		if v.String() != test.out || v.Major != test.major || len(v.Prerelease) != test.pre {
+			t.Errorf("%q: unexpected %#v", test.in, v)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a string
+		b string
+		c int
+	}{
+		{"1.0.6", "1.0.6", 0},
+		{"1.0.6", "v1.0.6", 0},
+		{"1.0.6", "1.0.7", -1},
+		{"1.0.10", "1.0.9", 1},
+		{"1.10.0", "1.9.9", 1},
+		{"2.0.0", "1.99.99", 1},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0", "1.0.0-rc.1", 1},
+		// semver.org precedence example
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-alpha.beta", "1.0.0-beta", -1},
+		{"1.0.0-beta", "1.0.0-beta.2", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.0-beta.11", "1.0.0-rc.1", -1},
+		// build metadata is ignored
+		{"1.0.0+build.1", "1.0.0+build.2", 0},
+	}
+	for _, test := range tests {
+		c, err := Compare(test.a, test.b)
+		if err != nil {
+			t.Errorf("%s vs %s: %s", test.a, test.b, err)
+			continue
+		}
+		if c != test.c {
+			t.Errorf("%s vs %s: expected %d, got %d", test.a, test.b, test.c, c)
+		}
+	}
+
+	if _, err := Compare("1.0", "1.0.0"); err == nil {
+		t.Error("expected error for bad version")
+	}
+}
@@ -1,18 +1,26 @@
 package version
 
 import (
-	"log"
-
 	"github.com/fatih/color"
+
+	"github.com/indihub-space/agent/logutil"
 )
 
+var logger = logutil.New("subsystem", "version")
+
 var AgentVersion = "1.0.6"
 
-func CheckAgentVersion(latestVer string) {
-	log.Println("Current agent version:", AgentVersion)
+// CheckAgentVersion prints warning if agent version is older than the latest one and returns true in this case
+func CheckAgentVersion(latestVer string) bool {
+	logger.Infof("Current agent version: %s", AgentVersion)
 
-	if AgentVersion < latestVer {
-		log.Println("Latest agent version:", latestVer)
+	c, err := Compare(AgentVersion, latestVer)
+	if err != nil {
+		logger.Errorf("could not check agent version: %s", err)
+		return false
+	}
+	if c < 0 {
+		logger.Infof("Latest agent version: %s", latestVer)
 		yc := color.New(color.FgYellow)
 		yc.Println()
 		yc.Println("                                ************************************************************")
@@ -24,4 +32,5 @@ func CheckAgentVersion(latestVer string) {
 		yc.Println("                                ************************************************************")
 		yc.Println("                                                                                            ")
 	}
+	return c < 0
 }
@@ -0,0 +1,89 @@
+package webhook
+
+import (
+	"sync"
+	"time"
+
+	"github.com/indihub-space/agent/indiclient"
+)
+
+const reconnectDelay = 10 * time.Second
+
+// watchINDIServer keeps connection to INDI-server until Stop is called, properties going to Alert state
+// and unreachable INDI-server are notified once until they recover
+func (n *Notifier) watchINDIServer(addr string) {
+	defer n.wg.Done()
+
+	// states are kept across re-connects, so properties which are still in Alert are not notified again
+	var mu sync.Mutex
+	states := map[string]string{}
+	onMessage := func(msg *indiclient.Message) {
+		if msg.Vector == nil || msg.Vector.State == "" {
+			return
+		}
+		key := msg.Device + "\x00" + msg.Name
+
+		mu.Lock()
+		prev := states[key]
+		states[key] = msg.Vector.State
+		mu.Unlock()
+
+		if msg.Vector.State == indiclient.StateAlert && prev != indiclient.StateAlert {
+			n.Notify(EventPropertyAlert, map[string]interface{}{
+				"device":   msg.Device,
+				"property": msg.Name,
+				"label":    msg.Vector.Label,
+				"message":  msg.Vector.Message,
+				"values":   elementValues(msg.Vector),
+			})
+		}
+	}
+
+	reachable := true
+	for {
+		client, err := indiclient.Dial(addr)
+		if err == nil {
+			reachable = true
+			unsubscribe := client.Subscribe(onMessage)
+			select {
+			case <-client.Done():
+				err = indiclient.ErrClosed
+			case <-n.stopping:
+			}
+			unsubscribe()
+			client.Close()
+		}
+
+		select {
+		case <-n.stopping:
+			return
+		default:
+		}
+
+		if reachable {
+			reachable = false
+			logger.Warnf("INDI-server %s is unreachable: %s", addr, err)
+			n.Notify(EventINDIServerUnreachable, map[string]interface{}{
+				"addr":  addr,
+				"error": err.Error(),
+			})
+		}
+
+		select {
+		case <-n.stopping:
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+func elementValues(v *indiclient.Vector) map[string]string {
+	values := map[string]string{}
+	for _, e := range v.Elements {
+		if v.Kind == indiclient.KindBLOB {
+			continue
+		}
+		values[e.Name] = e.Value
+	}
+	return values
+}
@@ -0,0 +1,459 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/indihub-space/agent/lib"
+	"github.com/indihub-space/agent/logutil"
+)
+
+// events sent to webhooks
+const (
+	EventModeStarted           = "mode.started"
+	EventModeStopped           = "mode.stopped"
+	EventGuestConnected        = "guest.connected"
+	EventGuestDisconnected     = "guest.disconnected"
+	EventImageCaptured         = "image.captured"
+	EventPropertyAlert         = "property.alert"
+	EventINDIServerUnreachable = "indiserver.unreachable"
+	EventTunnelLost            = "tunnel.lost"
+	EventTunnelRestored        = "tunnel.restored"
+	EventVersionOutdated       = "version.outdated"
+)
+
+const (
+	defaultMaxRetries     = 5
+	defaultDeadLetterFile = "indihub-webhooks-dead.jsonl"
+
+	queueSize      = 256
+	requestTimeout = 10 * time.Second
+	retryDelay     = time.Second
+	maxRetryDelay  = time.Minute
+	stopTimeout    = 5 * time.Second
+
+	headerEvent     = "X-Indihub-Event"
+	headerDelivery  = "X-Indihub-Delivery"
+	headerSignature = "X-Indihub-Signature"
+)
+
+var logger = logutil.New("subsystem", "webhook")
+
+// Hook is webhook receiving events
+type Hook struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"` // key of HMAC-SHA256 signature of body, empty - body is not signed
+	Events []string `json:"events,omitempty"` // event names or patterns, i.e. "guest.*", empty - all events
+}
+
+// Config is webhooks configuration file
+type Config struct {
+	Hooks          []Hook `json:"hooks"`
+	MaxRetries     int    `json:"maxRetries,omitempty"`     // retries of failed delivery, 5 by default
+	DeadLetterFile string `json:"deadLetterFile,omitempty"` // events which were not delivered
+}
+
+// Event is JSON body posted to webhook
+type Event struct {
+	ID    string      `json:"id"`
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+// DeadLetter is record of dead-letter file
+type DeadLetter struct {
+	Time     time.Time       `json:"time"`
+	URL      string          `json:"url"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	Event    json.RawMessage `json:"event"`
+}
+
+type delivery struct {
+	event string
+	id    string
+	body  []byte
+}
+
+type hookQueue struct {
+	hook  Hook
+	queue chan *delivery
+}
+
+// Notifier posts agent events to webhooks, every webhook has its own queue so slow one doesn't delay others
+type Notifier struct {
+	conf   Config
+	hooks  []*hookQueue
+	client *http.Client
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stopping chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+
+	indiServerAddr string
+
+	mu             sync.Mutex
+	tunnelLostMode string // mode which lost tunnel, empty if tunnel is not lost
+	delivered      int
+	retries        int
+	deadLetters    int
+	lastErr        string
+}
+
+// ReadConfig reads webhooks configuration file
+func ReadConfig(fileName string) (*Config, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &Config{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, err
+	}
+	for i, h := range conf.Hooks {
+		if h.URL == "" {
+			return nil, fmt.Errorf("webhook %d: url is empty", i+1)
+		}
+		for _, pattern := range h.Events {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("webhook %d: bad event pattern '%s': %s", i+1, pattern, err)
+			}
+		}
+	}
+
+	return conf, nil
+}
+
+// NewNotifier creates notifier, events are queued until Run is called
+func NewNotifier(conf Config) *Notifier {
+	if conf.MaxRetries <= 0 {
+		conf.MaxRetries = defaultMaxRetries
+	}
+	if conf.DeadLetterFile == "" {
+		conf.DeadLetterFile = defaultDeadLetterFile
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Notifier{
+		conf:     conf,
+		client:   &http.Client{Timeout: requestTimeout},
+		ctx:      ctx,
+		cancel:   cancel,
+		stopping: make(chan struct{}),
+	}
+	for _, h := range conf.Hooks {
+		n.hooks = append(n.hooks, &hookQueue{
+			hook:  h,
+			queue: make(chan *delivery, queueSize),
+		})
+	}
+	return n
+}
+
+// WatchINDIServer makes notifier watch INDI-server for properties going to Alert state and lost connection
+func (n *Notifier) WatchINDIServer(addr string) {
+	n.indiServerAddr = addr
+}
+
+// Run delivers events to webhooks until Stop is called
+func (n *Notifier) Run() {
+	for _, h := range n.hooks {
+		n.wg.Add(1)
+		go n.runHook(h)
+	}
+	if n.indiServerAddr != "" && (n.wants(EventPropertyAlert) || n.wants(EventINDIServerUnreachable)) {
+		n.wg.Add(1)
+		go n.watchINDIServer(n.indiServerAddr)
+	}
+	n.wg.Wait()
+}
+
+// Stop stops notifier, queued events are still delivered for a few seconds without retries,
+// events which were not delivered are written to dead-letter file
+func (n *Notifier) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.stopping)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(stopTimeout):
+		n.cancel()
+		<-done
+	}
+	n.cancel()
+}
+
+// Notify queues event for webhooks subscribed to it, nil notifier ignores all events
+func (n *Notifier) Notify(event string, data interface{}) {
+	if n == nil {
+		return
+	}
+
+	// tunnel is restored when mode which lost it is running again, solo mode has no tunnel
+	// and start of other mode means the lost tunnel is not coming back
+	n.mu.Lock()
+	restored := false
+	switch event {
+	case EventTunnelLost:
+		if mode := eventMode(data); mode != lib.ModeSolo {
+			n.tunnelLostMode = mode
+		}
+	case EventModeStarted:
+		restored = n.tunnelLostMode != "" && n.tunnelLostMode == eventMode(data)
+		n.tunnelLostMode = ""
+	}
+	n.mu.Unlock()
+
+	n.queue(event, data)
+	if restored {
+		n.queue(EventTunnelRestored, data)
+	}
+}
+
+func (n *Notifier) queue(event string, data interface{}) {
+	ev := &Event{
+		ID:    newID(),
+		Event: event,
+		Time:  time.Now(),
+		Data:  data,
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		logger.Errorf("could not marshal %s event: %s", event, err)
+		return
+	}
+	d := &delivery{event: event, id: ev.ID, body: body}
+
+	select {
+	case <-n.stopping:
+		for _, h := range n.hooks {
+			if matchEvent(h.hook.Events, event) {
+				n.deadLetter(h.hook, d, 0, "agent is stopped")
+			}
+		}
+		return
+	default:
+	}
+
+	for _, h := range n.hooks {
+		if !matchEvent(h.hook.Events, event) {
+			continue
+		}
+		select {
+		case h.queue <- d:
+		default:
+			n.deadLetter(h.hook, d, 0, "queue is full")
+		}
+	}
+}
+
+// runHook delivers queued events to webhook, after Stop the queue is drained
+func (n *Notifier) runHook(h *hookQueue) {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case d := <-h.queue:
+			n.deliver(h.hook, d)
+		case <-n.stopping:
+			for {
+				select {
+				case d := <-h.queue:
+					n.deliver(h.hook, d)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver posts event to webhook with retries, delay between retries is doubled every time
+func (n *Notifier) deliver(h Hook, d *delivery) {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := n.post(h, d)
+		if err == nil {
+			n.mu.Lock()
+			n.delivered++
+			n.mu.Unlock()
+			return
+		}
+
+		n.mu.Lock()
+		n.lastErr = fmt.Sprintf("%s: %s", h.URL, err)
+		n.mu.Unlock()
+
+		if !retry || attempt > n.conf.MaxRetries {
+			n.deadLetter(h, d, attempt, err.Error())
+			return
+		}
+		logger.Debugf("Delivery of %s event to %s failed, retry in %s: %s", d.event, h.URL, delay, err)
+
+		select {
+		case <-n.stopping:
+			n.deadLetter(h, d, attempt, "agent is stopped: "+err.Error())
+			return
+		case <-time.After(delay):
+		}
+		n.mu.Lock()
+		n.retries++
+		n.mu.Unlock()
+
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// post posts event to webhook, retry is false if webhook rejected the event
+func (n *Notifier) post(h Hook, d *delivery) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(n.ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerEvent, d.event)
+	req.Header.Set(headerDelivery, d.id)
+	if h.Secret != "" {
+		req.Header.Set(headerSignature, Sign(h.Secret, d.body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return false, fmt.Errorf("webhook rejected event with %s", resp.Status)
+}
+
+// deadLetter writes event which was not delivered to dead-letter file
+func (n *Notifier) deadLetter(h Hook, d *delivery, attempts int, reason string) {
+	logger.Warnf("Could not deliver %s event to %s: %s", d.event, h.URL, reason)
+
+	data, err := json.Marshal(DeadLetter{
+		Time:     time.Now(),
+		URL:      h.URL,
+		Attempts: attempts,
+		Error:    reason,
+		Event:    d.body,
+	})
+	if err != nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.deadLetters++
+
+	f, err := os.OpenFile(n.conf.DeadLetterFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		logger.Errorf("could not open webhooks dead-letter file: %s", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		logger.Errorf("could not write webhooks dead-letter file: %s", err)
+	}
+}
+
+// wants checks if any webhook is subscribed to event
+func (n *Notifier) wants(event string) bool {
+	for _, h := range n.hooks {
+		if matchEvent(h.hook.Events, event) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetStatus returns delivery counters of webhooks
+func (n *Notifier) GetStatus() map[string]interface{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	queued := 0
+	for _, h := range n.hooks {
+		queued += len(h.queue)
+	}
+	status := map[string]interface{}{
+		"hooks":       len(n.hooks),
+		"queued":      queued,
+		"delivered":   n.delivered,
+		"retries":     n.retries,
+		"deadLetters": n.deadLetters,
+	}
+	if n.lastErr != "" {
+		status["lastError"] = n.lastErr
+	}
+	return status
+}
+
+// Sign returns signature header value of body: "sha256=" and hex HMAC-SHA256 with secret as key
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// eventMode returns "mode" field of event data
+func eventMode(data interface{}) string {
+	fields, ok := data.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	mode, _ := fields["mode"].(string)
+	return mode
+}
+
+func matchEvent(patterns []string, event string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, event); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
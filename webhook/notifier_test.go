@@ -0,0 +1,214 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type request struct {
+	header http.Header
+	body   []byte
+	event  Event
+}
+
+// receiver is webhook responding with statuses in order, 200 when they are over
+type receiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []request
+}
+
+func newReceiver(statuses ...int) *receiver {
+	r := &receiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		ev := Event{}
+		json.Unmarshal(body, &ev)
+
+		r.mu.Lock()
+		r.requests = append(r.requests, request{header: req.Header, body: body, event: ev})
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		r.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	return r
+}
+
+// waitEvent waits until event is received and returns all received requests
+func (r *receiver) waitEvent(t *testing.T, event string) []request {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		requests := append([]request{}, r.requests...)
+		r.mu.Unlock()
+		for _, req := range requests {
+			if req.event.Event == event {
+				return requests
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s event is not received", event)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestNotifier(t *testing.T, hooks ...Hook) (*Notifier, string, func()) {
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetterFile := filepath.Join(dir, "dead.jsonl")
+	n := NewNotifier(Config{Hooks: hooks, MaxRetries: 2, DeadLetterFile: deadLetterFile})
+	done := make(chan struct{})
+	go func() {
+		n.Run()
+		close(done)
+	}()
+	return n, deadLetterFile, func() {
+		n.Stop()
+		<-done
+		os.RemoveAll(dir)
+	}
+}
+
+func TestTunnelRestoredPairing(t *testing.T) {
+	r := newReceiver()
+	defer r.Close()
+	n, _, stop := newTestNotifier(t, Hook{URL: r.URL})
+	defer stop()
+
+	lost := func(mode string) {
+		n.Notify(EventTunnelLost, map[string]interface{}{"mode": mode, "error": "closed"})
+	}
+	started := func(mode string) {
+		n.Notify(EventModeStarted, map[string]interface{}{"mode": mode})
+	}
+
+	// the same mode is running again
+	lost("share")
+	started("share")
+	// other mode is started
+	lost("share")
+	started("robotic")
+	// solo mode doesn't restore tunnel
+	lost("broadcast")
+	started("solo")
+	// solo mode has no tunnel
+	lost("solo")
+	started("solo")
+	// mode is started without lost tunnel
+	started("robotic")
+	n.Notify(EventVersionOutdated, nil)
+
+	restored := []string{}
+	for _, req := range r.waitEvent(t, EventVersionOutdated) {
+		if req.event.Event == EventTunnelRestored {
+			restored = append(restored, eventMode(req.event.Data))
+		}
+	}
+	if len(restored) != 1 || restored[0] != "share" {
+		t.Fatalf("expected one tunnel.restored event for share mode, got: %q", restored)
+	}
+}
+
+func TestDeliveryIsSignedAndRetried(t *testing.T) {
+	r := newReceiver(http.StatusServiceUnavailable)
+	defer r.Close()
+	n, _, stop := newTestNotifier(t, Hook{URL: r.URL, Secret: "my-secret", Events: []string{"guest.*"}})
+	defer stop()
+
+	n.Notify(EventModeStarted, map[string]interface{}{"mode": "share"})
+	n.Notify(EventGuestConnected, map[string]interface{}{"mode": "share", "conn": 1})
+
+	// the first attempt fails with 503, the second one is delivered
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := n.GetStatus()
+		if status["delivered"] == 1 {
+			if status["retries"] != 1 || status["deadLetters"] != 0 {
+				t.Fatalf("unexpected status: %v", status)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("event is not delivered, status: %v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	requests := r.waitEvent(t, EventGuestConnected)
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 attempts, got %d", len(requests))
+	}
+	for _, req := range requests {
+		if req.event.Event != EventGuestConnected {
+			t.Errorf("unsubscribed event is posted: %s", req.event.Event)
+		}
+		if req.event.ID != requests[0].event.ID || req.header.Get(headerDelivery) != req.event.ID {
+			t.Errorf("retry has other delivery ID: %s", req.header.Get(headerDelivery))
+		}
+		if sig := req.header.Get(headerSignature); sig != Sign("my-secret", req.body) {
+			t.Errorf("bad signature %s", sig)
+		}
+		if req.header.Get(headerEvent) != EventGuestConnected {
+			t.Errorf("bad event header %s", req.header.Get(headerEvent))
+		}
+	}
+}
+
+func TestRejectedEventIsDeadLettered(t *testing.T) {
+	r := newReceiver(http.StatusBadRequest)
+	defer r.Close()
+	n, deadLetterFile, stop := newTestNotifier(t, Hook{URL: r.URL})
+	defer stop()
+
+	n.Notify(EventModeStopped, map[string]interface{}{"mode": "share"})
+	r.waitEvent(t, EventModeStopped)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for n.GetStatus()["deadLetters"] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("event is not dead-lettered, status: %v", n.GetStatus())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	data, err := ioutil.ReadFile(deadLetterFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl := DeadLetter{}
+	if err := json.Unmarshal(data, &dl); err != nil {
+		t.Fatal(err)
+	}
+	if dl.URL != r.URL || dl.Attempts != 1 || !strings.Contains(dl.Error, "400") {
+		t.Errorf("unexpected dead letter: %s", data)
+	}
+	if n.GetStatus()["retries"] != 0 {
+		t.Error("rejected event must not be retried")
+	}
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '{"event":"test"}' | openssl dgst -sha256 -hmac secret
+	expected := "sha256=8419ab361b37d61b696d008ef7549a18325132dae5da84c7424e8e1c590d0498"
+	if got := Sign("secret", []byte(`{"event":"test"}`)); got != expected {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+}